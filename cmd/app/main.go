@@ -5,7 +5,15 @@ import (
 	"mahi-go-explorer/internal/api/handlers"
 	"mahi-go-explorer/internal/config"
 	"mahi-go-explorer/internal/store"
+	apikeypkg "mahi-go-explorer/pkg/apikey"
+	ldappkg "mahi-go-explorer/pkg/ldap"
+	mailpkg "mahi-go-explorer/pkg/mail"
+	oauthpkg "mahi-go-explorer/pkg/oauth"
+	oidcpkg "mahi-go-explorer/pkg/oidc"
+	samlpkg "mahi-go-explorer/pkg/saml"
+	tokenpkg "mahi-go-explorer/pkg/token"
 	userpkg "mahi-go-explorer/pkg/user"
+	webauthnpkg "mahi-go-explorer/pkg/webauthn"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -36,12 +44,43 @@ func main() {
 	log.Println("Connected to database")
 
 	//create services
-	userService := userpkg.NewService(db, cc)
+	mailer := mailpkg.NewMailer()
+	keyService, err := tokenpkg.NewKeyService(db, cc)
+	if err != nil {
+		log.Fatalf("Error configuring signing keys: %v", err)
+	}
+	tokenService, err := tokenpkg.NewService(keyService, tokenpkg.LoadPolicy())
+	if err != nil {
+		log.Fatalf("Error configuring tokens: %v", err)
+	}
+	authenticators := []userpkg.Authenticator{}
+	if ldapAuthenticator := ldappkg.NewAuthenticator(); ldapAuthenticator != nil {
+		authenticators = append(authenticators, ldapAuthenticator)
+	}
+	userService := userpkg.NewService(db, cc, tokenService, mailer, authenticators...)
+	apiKeyService := apikeypkg.NewService(db, cc)
+	oauthService, err := oauthpkg.NewService(db, cc, keyService, tokenService, userService)
+	if err != nil {
+		log.Fatalf("Error configuring OAuth: %v", err)
+	}
+	oidcService := oidcpkg.NewService(db, cc, userService)
+	samlService := samlpkg.NewService(db, cc, userService)
+	webAuthnService, err := webauthnpkg.NewService(db, cc, userService)
+	if err != nil {
+		log.Fatalf("Error configuring WebAuthn: %v", err)
+	}
 
 	//register routes
 	handlers.RegisterRoutes(
 		app,
 		userService,
+		keyService,
+		tokenService,
+		apiKeyService,
+		oauthService,
+		oidcService,
+		samlService,
+		webAuthnService,
 	)
 
 	//Ensure admin user exists
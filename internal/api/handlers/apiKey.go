@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"errors"
+	"mahi-go-explorer/internal/api/middleware"
+	"mahi-go-explorer/internal/api/response"
+	apikeypkg "mahi-go-explorer/pkg/apikey"
+	userpkg "mahi-go-explorer/pkg/user"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// APIKeyRoutes defines api key routes, users manage their own keys ("me")
+// and admins manage the keys of anyone
+func APIKeyRoutes(r *gin.Engine, aks apikeypkg.Service, s userpkg.Service, authenticate gin.HandlerFunc) {
+	apiKeys := r.Group("/api/user/:id/api-keys")
+	apiKeys.Use(authenticate, middleware.RequireSelfOrPermission(userpkg.ScopeProfileWrite, userpkg.PermAPIKeysManage), requireTokenAuth(), requireManageableUser(s))
+	{
+		apiKeys.POST("", middleware.BlockImpersonation(), requireRecentAuth(), createAPIKeyHandler(aks, s))
+		apiKeys.GET("", getAPIKeysHandler(aks))
+		apiKeys.DELETE("/:keyId", middleware.BlockImpersonation(), requireRecentAuth(), revokeAPIKeyHandler(aks))
+	}
+}
+
+// requireTokenAuth keeps api keys from being used to manage api keys
+func requireTokenAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			c.Abort()
+			return
+		}
+
+		if cu.AuthMethod == userpkg.AuthMethodAPIKey {
+			response.LogAndErrorResponse(c, http.StatusForbidden, "Not allowed with an API key", errors.New("api key used on a login only route"))
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func createAPIKeyHandler(aks apikeypkg.Service, s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		uID, err := resolveUserID(c, cu)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid ID", err)
+			return
+		}
+
+		var req apikeypkg.CreateRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+			return
+		}
+
+		if req.Name == "" {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Name is required", nil)
+			return
+		}
+
+		//a key can never do more than its owner, in the organization it is made in
+		owner, err := scopedUsers(s, cu).GetUser(bson.M{"_id": uID}, nil)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusNotFound, "User Not Found", err)
+			return
+		}
+		allowed := userpkg.RolePermissions(owner.Role)
+		for _, scope := range req.Scopes {
+			if !containsString(allowed, scope) && !containsString(userpkg.SelfServiceScopes, scope) {
+				response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid scope: "+scope, nil)
+				return
+			}
+		}
+
+		req.OrgID = cu.OrgID
+
+		res, err := aks.CreateAPIKey(uID, cu.ID, &req)
+		if err != nil {
+			switch err.Error() {
+			case "expiry in the past":
+				response.LogAndErrorResponse(c, http.StatusBadRequest, "Expiry must be in the future", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to create API key", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusCreated, res)
+	}
+}
+
+func getAPIKeysHandler(aks apikeypkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		uID, err := resolveUserID(c, cu)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid ID", err)
+			return
+		}
+
+		keys, err := aks.GetAPIKeys(uID)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get API keys", err)
+			return
+		}
+
+		response.SuccessResponse(c, http.StatusOK, keys)
+	}
+}
+
+func revokeAPIKeyHandler(aks apikeypkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		uID, err := resolveUserID(c, cu)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid ID", err)
+			return
+		}
+
+		keyID, err := primitive.ObjectIDFromHex(c.Param("keyId"))
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid key ID", err)
+			return
+		}
+
+		if err := aks.RevokeAPIKey(uID, keyID); err != nil {
+			switch err.Error() {
+			case "api key not found":
+				response.LogAndErrorResponse(c, http.StatusNotFound, "API Key Not Found", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to revoke API key", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusOK, nil)
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -1,24 +1,58 @@
 package handlers
 
 import (
+	"errors"
+	"log"
+	"mahi-go-explorer/internal/api/middleware"
 	"mahi-go-explorer/internal/api/response"
 	userpkg "mahi-go-explorer/pkg/user"
+	"math"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 // AuthRoutes defines auth routes
-func AuthRoutes(r *gin.Engine, s userpkg.Service) {
+func AuthRoutes(r *gin.Engine, s userpkg.Service, authenticate gin.HandlerFunc) {
 	auth := r.Group("/api/auth")
 	{
 		auth.POST("/signup", signupHandler(s))
 		auth.POST("/login", loginHandler(s))
+		auth.POST("/refresh", refreshHandler(s))
+		auth.POST("/mfa/verify", verifyMFAHandler(s))
+		auth.POST("/forgot-password", forgotPasswordHandler(s))
+		auth.POST("/reset-password", resetPasswordHandler(s))
+		auth.GET("/verify-email", verifyEmailHandler(s))
+		auth.POST("/verify-email", verifyEmailHandler(s))
+		auth.POST("/verify-email/resend", resendVerificationHandler(s))
+		auth.POST("/magic-link", requestMagicLinkHandler(s))
+		auth.POST("/magic-link/callback", magicLinkLoginHandler(s))
+		auth.POST("/accept-invitation", acceptInvitationHandler(s))
+	}
+
+	//sessions & credentials are a login's business, no api key scope covers them
+	authenticated := r.Group("/api/auth")
+	authenticated.Use(authenticate, requireTokenAuth())
+	{
+		authenticated.POST("/logout", logoutHandler(s))
+		authenticated.POST("/logout-all", middleware.BlockImpersonation(), logoutAllHandler(s))
+		authenticated.POST("/change-password", middleware.BlockImpersonation(), changePasswordHandler(s))
+		authenticated.POST("/mfa/enroll", middleware.BlockImpersonation(), enrollMFAHandler(s))
+		authenticated.POST("/mfa/confirm", middleware.BlockImpersonation(), confirmMFAHandler(s))
+		authenticated.POST("/reauth", middleware.BlockImpersonation(), reauthHandler(s))
 	}
 }
 
 func signupHandler(s userpkg.Service) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		//with signup closed accounts come from admins & invitations
+		if !userpkg.SignupEnabled() {
+			response.LogAndErrorResponse(c, http.StatusForbidden, "Signup is disabled", nil)
+			return
+		}
+
 		//bind the request
 		var req userpkg.CreateRequest
 		if err := c.ShouldBindJSON(&req); err != nil {
@@ -32,8 +66,14 @@ func signupHandler(s userpkg.Service) gin.HandlerFunc {
 			return
 		}
 
+		//public signups never choose their own role
+		req.Role = userpkg.RoleUser
+
 		u, err := req.CreateUser()
 		if err != nil {
+			if passwordPolicyErrorResponse(c, err) {
+				return
+			}
 			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
 			return
 		}
@@ -44,6 +84,8 @@ func signupHandler(s userpkg.Service) gin.HandlerFunc {
 			return
 		}
 
+		sendVerificationEmail(s, resp)
+
 		response.SuccessResponse(c, http.StatusCreated, resp)
 	}
 }
@@ -63,23 +105,303 @@ func loginHandler(s userpkg.Service) gin.HandlerFunc {
 			return
 		}
 
-		token, err := s.LoginUser(&req)
+		req.ClientInfo = clientInfo(c)
+
+		tokens, err := s.LoginUser(&req)
 		if err != nil {
+			var locked *userpkg.LockedError
+			if errors.As(err, &locked) {
+				c.Header("Retry-After", strconv.Itoa(int(math.Ceil(locked.RetryAfter.Seconds()))))
+				response.LogAndErrorResponse(c, http.StatusTooManyRequests, "Too many failed attempts, try again later", err)
+				return
+			}
+
 			switch err.Error() {
-			case "user not found":
-				response.LogAndErrorResponse(c, http.StatusNotFound, "User Not Found", err)
+			case "invalid credentials":
+				response.LogAndErrorResponse(c, http.StatusUnauthorized, "Invalid email or password", err)
+				return
+			case "user is blocked":
+				response.LogAndErrorResponse(c, http.StatusForbidden, "User Is Blocked", err)
+				return
+			case "email not verified":
+				response.LogAndErrorResponse(c, http.StatusForbidden, "Email Not Verified", err)
+				return
+			case "signup disabled":
+				response.LogAndErrorResponse(c, http.StatusForbidden, "Signup is disabled", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Internal Server Error", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusOK, tokens)
+	}
+}
+
+func refreshHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		//bind the request
+		var req userpkg.RefreshRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+			return
+		}
+
+		//validate required fields
+		if req.RefreshToken == "" {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Refresh token is required", nil)
+			return
+		}
+
+		tokens, err := s.RefreshTokens(req.RefreshToken)
+		if err != nil {
+			switch err.Error() {
+			case "invalid refresh token", "refresh token expired", "refresh token reuse detected", "user not found", "user is blocked":
+				response.LogAndErrorResponse(c, http.StatusUnauthorized, "Invalid refresh token", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Internal Server Error", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusOK, tokens)
+	}
+}
+
+func forgotPasswordHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		//bind the request
+		var req userpkg.ForgotPasswordRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+			return
+		}
+
+		//validate required fields
+		if req.Email == "" {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Email is required", nil)
+			return
+		}
+
+		//same answer whether or not the email is registered, even when the email fails
+		s.RequestPasswordReset(req.Email)
+		response.SuccessResponse(c, http.StatusOK, gin.H{
+			"message": "If the email is registered, a reset link has been sent",
+		})
+	}
+}
+
+func resetPasswordHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		//bind the request
+		var req userpkg.ResetPasswordRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+			return
+		}
+
+		//validate required fields
+		if req.Token == "" || req.Password == "" {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Token and password are required", nil)
+			return
+		}
+
+		if err := s.ResetPassword(req.Token, req.Password); err != nil {
+			if passwordPolicyErrorResponse(c, err) {
+				return
+			}
+			switch err.Error() {
+			case "invalid reset token":
+				response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid or expired reset token", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Internal Server Error", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusOK, nil)
+	}
+}
+
+func changePasswordHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		var req userpkg.ChangePasswordRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+			return
+		}
+
+		if req.CurrentPassword == "" || req.NewPassword == "" {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Current and new password are required", nil)
+			return
+		}
+
+		req.ClientInfo = clientInfo(c)
+
+		tokens, err := s.ChangePassword(cu.ID, &req)
+		if err != nil {
+			var locked *userpkg.LockedError
+			if errors.As(err, &locked) {
+				c.Header("Retry-After", strconv.Itoa(int(math.Ceil(locked.RetryAfter.Seconds()))))
+				response.LogAndErrorResponse(c, http.StatusTooManyRequests, "Too many failed attempts, try again later", err)
+				return
+			}
+
+			if passwordPolicyErrorResponse(c, err) {
 				return
+			}
+			switch err.Error() {
 			case "invalid password":
 				response.LogAndErrorResponse(c, http.StatusUnauthorized, "Invalid Password", err)
 				return
+			case "user not found":
+				response.LogAndErrorResponse(c, http.StatusNotFound, "User Not Found", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to change password", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusOK, tokens)
+	}
+}
+
+func verifyEmailHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		//the token comes from the link query or a json body
+		var req userpkg.VerifyEmailRequest
+		if err := c.ShouldBind(&req); err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+			return
+		}
+
+		if req.Token == "" {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Token is required", nil)
+			return
+		}
+
+		if err := s.VerifyEmail(req.Token); err != nil {
+			switch err.Error() {
+			case "invalid verification token":
+				response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid or expired verification token", err)
+				return
 			default:
 				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Internal Server Error", err)
 				return
 			}
 		}
 
+		response.SuccessResponse(c, http.StatusOK, nil)
+	}
+}
+
+func resendVerificationHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req userpkg.ResendVerificationRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+			return
+		}
+
+		if req.Email == "" {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Email is required", nil)
+			return
+		}
+
+		if err := s.ResendVerificationEmail(req.Email); err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Internal Server Error", err)
+			return
+		}
+
+		//same answer for unknown, verified and throttled addresses
 		response.SuccessResponse(c, http.StatusOK, gin.H{
-			"accessToken": token,
+			"message": "If the email needs verification, a link has been sent",
 		})
 	}
 }
+
+// sendVerificationEmail sends the verification email for a newly created user,
+// a failure is only logged since the user can ask for a resend
+func sendVerificationEmail(s userpkg.Service, insertedID any) {
+	id, ok := insertedID.(primitive.ObjectID)
+	if !ok {
+		return
+	}
+	if err := s.SendVerificationEmail(id); err != nil {
+		log.Printf("Failed to send verification email to %s: %v", id.Hex(), err)
+	}
+}
+
+func logoutHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		//the refresh token is optional, when given its whole family is revoked
+		var req userpkg.LogoutRequest
+		if c.Request.ContentLength > 0 {
+			if err := c.ShouldBindJSON(&req); err != nil {
+				response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+				return
+			}
+		}
+
+		if err := s.RevokeAccessToken(cu.ID, cu.TokenID, cu.Exp); err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to logout", err)
+			return
+		}
+
+		if req.RefreshToken != "" {
+			if err := s.RevokeRefreshToken(cu.ID, req.RefreshToken); err != nil && err.Error() != "invalid refresh token" {
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to logout", err)
+				return
+			}
+		}
+
+		//the session of the token ends with its refresh family, the session of
+		//an impersonating admin is theirs to end
+		if cu.SessionID != "" && !cu.IsImpersonated() {
+			sessionID, err := primitive.ObjectIDFromHex(cu.SessionID)
+			if err == nil {
+				err = s.RevokeSession(cu.ID, sessionID)
+			}
+			if err != nil && err.Error() != "session not found" {
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to logout", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusOK, nil)
+	}
+}
+
+func logoutAllHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		//the token of the request goes too, with its session
+		if err := s.RevokeUserTokens(cu.ID); err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to logout", err)
+			return
+		}
+
+		response.SuccessResponse(c, http.StatusOK, nil)
+	}
+}
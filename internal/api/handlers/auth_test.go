@@ -0,0 +1,903 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	oidcpkg "mahi-go-explorer/pkg/oidc"
+	passwordpkg "mahi-go-explorer/pkg/password"
+	userpkg "mahi-go-explorer/pkg/user"
+	webauthnpkg "mahi-go-explorer/pkg/webauthn"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestLoginHandler(t *testing.T) {
+	type testCase struct {
+		Name               string
+		LoginErr           error
+		ExpectedStatusCode int
+		ExpectedMessage    string
+		ExpectedRetryAfter string
+	}
+
+	tests := []testCase{
+		{
+			Name:               "Login",
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "Login with wrong credentials",
+			LoginErr:           errors.New("invalid credentials"),
+			ExpectedStatusCode: http.StatusUnauthorized,
+			ExpectedMessage:    "Invalid email or password",
+		},
+		{
+			Name:               "Login while locked out",
+			LoginErr:           &userpkg.LockedError{RetryAfter: 1500 * time.Millisecond},
+			ExpectedStatusCode: http.StatusTooManyRequests,
+			ExpectedMessage:    "Too many failed attempts, try again later",
+			ExpectedRetryAfter: "2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			mockUserService := &mockUserService{
+				LoginUserMock: func(req *userpkg.LoginRequest) (*userpkg.LoginResponse, error) {
+					assert.NotEmpty(t, req.ClientIP)
+					if tt.LoginErr != nil {
+						return nil, tt.LoginErr
+					}
+					return &userpkg.LoginResponse{TokenPair: &userpkg.TokenPair{AccessToken: "access", RefreshToken: "refresh"}}, nil
+				},
+			}
+
+			gin.SetMode(gin.TestMode)
+
+			reqBody, _ := json.Marshal(userpkg.LoginRequest{Email: "user@example.com", Password: "password"})
+			req, err := http.NewRequest("POST", "/api/auth/login", bytes.NewBuffer(reqBody))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.RemoteAddr = "192.0.2.1:1234"
+
+			rr := httptest.NewRecorder()
+
+			router := gin.Default()
+			router.POST("/api/auth/login", loginHandler(mockUserService))
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.ExpectedStatusCode, rr.Code)
+			assert.Equal(t, tt.ExpectedRetryAfter, rr.Header().Get("Retry-After"))
+
+			var response map[string]interface{}
+			err = json.NewDecoder(rr.Body).Decode(&response)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.ExpectedMessage != "" {
+				assert.Equal(t, tt.ExpectedMessage, response["message"])
+			} else {
+				data := response["data"].(map[string]interface{})
+				assert.Equal(t, "access", data["accessToken"])
+			}
+		})
+	}
+}
+
+func TestRefreshHandler(t *testing.T) {
+	type testCase struct {
+		Name               string
+		RequestBody        userpkg.RefreshRequest
+		RefreshErr         error
+		ExpectedStatusCode int
+		ExpectedError      bool
+		ExpectedMessage    string
+	}
+
+	tests := []testCase{
+		{
+			Name:               "Refresh tokens",
+			RequestBody:        userpkg.RefreshRequest{RefreshToken: "valid"},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "Refresh with missing token",
+			RequestBody:        userpkg.RefreshRequest{},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedError:      true,
+			ExpectedMessage:    "Refresh token is required",
+		},
+		{
+			Name:               "Refresh with reused token",
+			RequestBody:        userpkg.RefreshRequest{RefreshToken: "reused"},
+			RefreshErr:         errors.New("refresh token reuse detected"),
+			ExpectedStatusCode: http.StatusUnauthorized,
+			ExpectedError:      true,
+			ExpectedMessage:    "Invalid refresh token",
+		},
+		{
+			Name:               "Refresh with store failure",
+			RequestBody:        userpkg.RefreshRequest{RefreshToken: "valid"},
+			RefreshErr:         assert.AnError,
+			ExpectedStatusCode: http.StatusInternalServerError,
+			ExpectedError:      true,
+			ExpectedMessage:    "Internal Server Error",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			mockUserService := &mockUserService{
+				RefreshTokensMock: func(refreshToken string) (*userpkg.TokenPair, error) {
+					if tt.RefreshErr != nil {
+						return nil, tt.RefreshErr
+					}
+					return &userpkg.TokenPair{AccessToken: "access", RefreshToken: "rotated"}, nil
+				},
+			}
+
+			gin.SetMode(gin.TestMode)
+
+			reqBody, _ := json.Marshal(tt.RequestBody)
+			req, err := http.NewRequest("POST", "/api/auth/refresh", bytes.NewBuffer(reqBody))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+
+			router := gin.Default()
+			router.POST("/api/auth/refresh", refreshHandler(mockUserService))
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.ExpectedStatusCode, rr.Code)
+
+			var response map[string]interface{}
+			err = json.NewDecoder(rr.Body).Decode(&response)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.ExpectedError {
+				assert.Contains(t, response["message"], tt.ExpectedMessage)
+			} else {
+				data := response["data"].(map[string]interface{})
+				assert.Equal(t, "access", data["accessToken"])
+				assert.Equal(t, "rotated", data["refreshToken"])
+			}
+		})
+	}
+}
+
+func TestLogoutHandler(t *testing.T) {
+	userID := primitive.NewObjectID()
+
+	sessionID := primitive.NewObjectID()
+
+	type testCase struct {
+		Name                   string
+		RequestBody            *userpkg.LogoutRequest
+		Actor                  *userpkg.Actor
+		ExpectedStatusCode     int
+		ExpectedRefreshRevoked bool
+		ExpectedSessionRevoked bool
+	}
+
+	tests := []testCase{
+		{
+			Name:                   "Logout without refresh token",
+			ExpectedStatusCode:     http.StatusOK,
+			ExpectedSessionRevoked: true,
+		},
+		{
+			Name:                   "Logout with refresh token",
+			RequestBody:            &userpkg.LogoutRequest{RefreshToken: "refresh"},
+			ExpectedStatusCode:     http.StatusOK,
+			ExpectedRefreshRevoked: true,
+			ExpectedSessionRevoked: true,
+		},
+		{
+			Name:               "Logout while impersonating",
+			Actor:              &userpkg.Actor{},
+			ExpectedStatusCode: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			var revokedJti string
+			refreshRevoked := false
+			sessionRevoked := false
+			mockUserService := &mockUserService{
+				RevokeSessionMock: func(id primitive.ObjectID, sid primitive.ObjectID) error {
+					assert.Equal(t, userID, id)
+					assert.Equal(t, sessionID, sid)
+					sessionRevoked = true
+					return nil
+				},
+				RevokeAccessTokenMock: func(id primitive.ObjectID, jti string, exp interface{}) error {
+					assert.Equal(t, userID, id)
+					revokedJti = jti
+					return nil
+				},
+				RevokeRefreshTokenMock: func(id primitive.ObjectID, refreshToken string) error {
+					refreshRevoked = true
+					return nil
+				},
+			}
+
+			gin.SetMode(gin.TestMode)
+
+			var body []byte
+			if tt.RequestBody != nil {
+				body, _ = json.Marshal(tt.RequestBody)
+			}
+			req, err := http.NewRequest("POST", "/api/auth/logout", bytes.NewBuffer(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+
+			router := gin.Default()
+			router.Use(func(c *gin.Context) {
+				c.Set("user", &userpkg.UserContext{ID: userID, TokenID: "token-id", SessionID: sessionID.Hex(), Actor: tt.Actor})
+			})
+			router.POST("/api/auth/logout", logoutHandler(mockUserService))
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.ExpectedStatusCode, rr.Code)
+			assert.Equal(t, "token-id", revokedJti)
+			assert.Equal(t, tt.ExpectedRefreshRevoked, refreshRevoked)
+			assert.Equal(t, tt.ExpectedSessionRevoked, sessionRevoked)
+		})
+	}
+}
+
+func TestMagicLinkHandlers(t *testing.T) {
+	type testCase struct {
+		Name               string
+		BindBrowser        bool
+		LoginErr           error
+		ExpectedStatusCode int
+		ExpectedMessage    string
+	}
+
+	tests := []testCase{
+		{
+			Name:               "Login with a link",
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "Login with a link bound to the browser",
+			BindBrowser:        true,
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "Login with a used link",
+			LoginErr:           errors.New("invalid magic link"),
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedMessage:    "Invalid or expired login link",
+		},
+		{
+			Name:               "Login with a link bound to another browser",
+			BindBrowser:        true,
+			LoginErr:           errors.New("magic link bound to another browser"),
+			ExpectedStatusCode: http.StatusForbidden,
+			ExpectedMessage:    "Open the login link in the browser it was requested from",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			mockUserService := &mockUserService{
+				RequestMagicLinkMock: func(req *userpkg.MagicLinkRequest) (string, error) {
+					assert.Equal(t, "user@example.com", req.Email)
+					assert.Equal(t, tt.BindBrowser, req.BindBrowser)
+					if req.BindBrowser {
+						return "browser-secret", nil
+					}
+					return "", nil
+				},
+				LoginWithMagicLinkMock: func(req *userpkg.MagicLinkLoginRequest) (*userpkg.LoginResponse, error) {
+					assert.Equal(t, "link-token", req.Token)
+					if tt.BindBrowser {
+						assert.Equal(t, "browser-secret", req.Binding)
+					} else {
+						assert.Empty(t, req.Binding)
+					}
+					if tt.LoginErr != nil {
+						return nil, tt.LoginErr
+					}
+					return &userpkg.LoginResponse{TokenPair: &userpkg.TokenPair{AccessToken: "access", RefreshToken: "refresh"}}, nil
+				},
+			}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.Default()
+			router.POST("/api/auth/magic-link", requestMagicLinkHandler(mockUserService))
+			router.POST("/api/auth/magic-link/callback", magicLinkLoginHandler(mockUserService))
+
+			reqBody, _ := json.Marshal(userpkg.MagicLinkRequest{Email: "user@example.com", BindBrowser: tt.BindBrowser})
+			req, err := http.NewRequest("POST", "/api/auth/magic-link", bytes.NewBuffer(reqBody))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusOK, rr.Code)
+
+			//the browser sends back the cookie it was given
+			cookies := rr.Result().Cookies()
+			if tt.BindBrowser {
+				assert.Len(t, cookies, 1)
+				assert.True(t, cookies[0].HttpOnly)
+				assert.Equal(t, "/api/auth/magic-link", cookies[0].Path)
+			} else {
+				assert.Empty(t, cookies)
+			}
+
+			//the page the link opens posts the token
+			loginBody, _ := json.Marshal(userpkg.MagicLinkLoginRequest{Token: "link-token"})
+			req, err = http.NewRequest("POST", "/api/auth/magic-link/callback", bytes.NewBuffer(loginBody))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range cookies {
+				req.AddCookie(c)
+			}
+			rr = httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.ExpectedStatusCode, rr.Code)
+
+			var response map[string]interface{}
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if tt.ExpectedMessage != "" {
+				assert.Equal(t, tt.ExpectedMessage, response["message"])
+			}
+		})
+	}
+}
+
+func TestChangePasswordHandler(t *testing.T) {
+	userID := primitive.NewObjectID()
+
+	type testCase struct {
+		Name               string
+		ChangeErr          error
+		ExpectedStatusCode int
+		ExpectedRetryAfter string
+	}
+
+	tests := []testCase{
+		{
+			Name:               "Change password",
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "Change password with a wrong current password",
+			ChangeErr:          errors.New("invalid password"),
+			ExpectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			Name:               "Change password while locked out",
+			ChangeErr:          &userpkg.LockedError{RetryAfter: 1500 * time.Millisecond},
+			ExpectedStatusCode: http.StatusTooManyRequests,
+			ExpectedRetryAfter: "2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			mockUserService := &mockUserService{
+				ChangePasswordMock: func(id primitive.ObjectID, req *userpkg.ChangePasswordRequest) (*userpkg.TokenPair, error) {
+					assert.Equal(t, userID, id)
+					if tt.ChangeErr != nil {
+						return nil, tt.ChangeErr
+					}
+					return &userpkg.TokenPair{AccessToken: "access", RefreshToken: "refresh"}, nil
+				},
+			}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.Default()
+			router.Use(func(c *gin.Context) {
+				c.Set("user", &userpkg.UserContext{ID: userID, Role: userpkg.RoleUser})
+			})
+			router.POST("/api/auth/change-password", changePasswordHandler(mockUserService))
+
+			body, _ := json.Marshal(userpkg.ChangePasswordRequest{CurrentPassword: "current", NewPassword: "new-password"})
+			req, err := http.NewRequest("POST", "/api/auth/change-password", bytes.NewBuffer(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.ExpectedStatusCode, rr.Code)
+			assert.Equal(t, tt.ExpectedRetryAfter, rr.Header().Get("Retry-After"))
+		})
+	}
+}
+
+func TestReauthHandler(t *testing.T) {
+	userID := primitive.NewObjectID()
+
+	type testCase struct {
+		Name               string
+		RequestBody        userpkg.ReauthRequest
+		ReauthErr          error
+		ExpectedStatusCode int
+		ExpectedError      bool
+		ExpectedMessage    string
+	}
+
+	tests := []testCase{
+		{
+			Name:               "Reauthenticate with password",
+			RequestBody:        userpkg.ReauthRequest{Password: "password"},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "Reauthenticate with MFA code",
+			RequestBody:        userpkg.ReauthRequest{Code: "123456"},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "Reauthenticate without proof",
+			RequestBody:        userpkg.ReauthRequest{},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedError:      true,
+			ExpectedMessage:    "Password or MFA code is required",
+		},
+		{
+			Name:               "Reauthenticate with wrong password",
+			RequestBody:        userpkg.ReauthRequest{Password: "wrong"},
+			ReauthErr:          errors.New("invalid credentials"),
+			ExpectedStatusCode: http.StatusUnauthorized,
+			ExpectedError:      true,
+			ExpectedMessage:    "Invalid credentials",
+		},
+		{
+			Name:               "Reauthenticate while locked out",
+			RequestBody:        userpkg.ReauthRequest{Password: "password"},
+			ReauthErr:          &userpkg.LockedError{RetryAfter: time.Minute},
+			ExpectedStatusCode: http.StatusTooManyRequests,
+			ExpectedError:      true,
+			ExpectedMessage:    "Too many failed attempts",
+		},
+		{
+			Name:               "Reauthenticate with code without MFA",
+			RequestBody:        userpkg.ReauthRequest{Code: "123456"},
+			ReauthErr:          errors.New("mfa not enabled"),
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedError:      true,
+			ExpectedMessage:    "MFA Not Enabled",
+		},
+		{
+			Name:               "Reauthenticate in revoked session",
+			RequestBody:        userpkg.ReauthRequest{Password: "password"},
+			ReauthErr:          errors.New("session revoked"),
+			ExpectedStatusCode: http.StatusUnauthorized,
+			ExpectedError:      true,
+			ExpectedMessage:    "Unauthorized",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			mockUserService := &mockUserService{
+				ReauthenticateMock: func(id primitive.ObjectID, sessionID string, req *userpkg.ReauthRequest) (*userpkg.ReauthResponse, error) {
+					assert.Equal(t, userID, id)
+					assert.Equal(t, "session-id", sessionID)
+					assert.Equal(t, tt.RequestBody.Password, req.Password)
+					assert.Equal(t, tt.RequestBody.Code, req.Code)
+					if tt.ReauthErr != nil {
+						return nil, tt.ReauthErr
+					}
+					return &userpkg.ReauthResponse{AccessToken: "access", ExpiresIn: 3600}, nil
+				},
+			}
+
+			gin.SetMode(gin.TestMode)
+
+			reqBody, _ := json.Marshal(tt.RequestBody)
+			req, err := http.NewRequest("POST", "/api/auth/reauth", bytes.NewBuffer(reqBody))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+
+			router := gin.Default()
+			router.Use(func(c *gin.Context) {
+				c.Set("user", &userpkg.UserContext{ID: userID, SessionID: "session-id"})
+			})
+			router.POST("/api/auth/reauth", reauthHandler(mockUserService))
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.ExpectedStatusCode, rr.Code)
+
+			var response map[string]interface{}
+			err = json.NewDecoder(rr.Body).Decode(&response)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.ExpectedError {
+				assert.Contains(t, response["message"], tt.ExpectedMessage)
+			} else {
+				data := response["data"].(map[string]interface{})
+				assert.Equal(t, "access", data["accessToken"])
+			}
+		})
+	}
+}
+
+func TestSignupHandlerDisabled(t *testing.T) {
+	t.Setenv("SIGNUP_ENABLED", "false")
+
+	mockUserService := &mockUserService{
+		CreateUserMock: func(user *userpkg.User) (any, error) {
+			t.Fatal("user created with signup disabled")
+			return nil, nil
+		},
+	}
+
+	gin.SetMode(gin.TestMode)
+
+	reqBody, _ := json.Marshal(userpkg.CreateRequest{Email: "user@example.com", Password: "Str0ng-Password!"})
+	req, err := http.NewRequest("POST", "/api/auth/signup", bytes.NewBuffer(reqBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	router := gin.Default()
+	router.POST("/api/auth/signup", signupHandler(mockUserService))
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func TestForgotPasswordHandler(t *testing.T) {
+	type testCase struct {
+		Name               string
+		Email              string
+		ExpectedStatusCode int
+	}
+
+	tests := []testCase{
+		{
+			Name:               "Registered email",
+			Email:              "user@example.com",
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "Unknown email gets the same answer",
+			Email:              "nobody@example.com",
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "Missing email",
+			ExpectedStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	var bodies []string
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			var requested string
+			mockUserService := &mockUserService{
+				RequestPasswordResetMock: func(email string) {
+					requested = email
+				},
+			}
+
+			gin.SetMode(gin.TestMode)
+
+			reqBody, _ := json.Marshal(userpkg.ForgotPasswordRequest{Email: tt.Email})
+			req, err := http.NewRequest("POST", "/api/auth/forgot-password", bytes.NewBuffer(reqBody))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+
+			router := gin.Default()
+			router.POST("/api/auth/forgot-password", forgotPasswordHandler(mockUserService))
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.ExpectedStatusCode, rr.Code)
+			assert.Equal(t, tt.Email, requested)
+			if rr.Code == http.StatusOK {
+				bodies = append(bodies, rr.Body.String())
+			}
+		})
+	}
+	assert.Len(t, bodies, 2)
+	assert.Equal(t, bodies[0], bodies[1])
+}
+
+func TestAcceptInvitationHandler(t *testing.T) {
+	type testCase struct {
+		Name               string
+		RequestBody        userpkg.AcceptInvitationRequest
+		AcceptErr          error
+		ExpectedStatusCode int
+		ExpectedMessage    string
+	}
+
+	tests := []testCase{
+		{
+			Name:               "Accept invitation",
+			RequestBody:        userpkg.AcceptInvitationRequest{Token: "token", Password: "Str0ng-Password!"},
+			ExpectedStatusCode: http.StatusCreated,
+		},
+		{
+			Name:               "Accept without password",
+			RequestBody:        userpkg.AcceptInvitationRequest{Token: "token"},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedMessage:    "Token and password are required",
+		},
+		{
+			Name:               "Accept with weak password",
+			RequestBody:        userpkg.AcceptInvitationRequest{Token: "token", Password: "weak"},
+			AcceptErr:          &passwordpkg.PolicyError{Errors: []passwordpkg.FieldError{{Field: "password", Message: "too short"}}},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedMessage:    "Password does not meet the password policy",
+		},
+		{
+			Name:               "Accept expired invitation",
+			RequestBody:        userpkg.AcceptInvitationRequest{Token: "expired", Password: "Str0ng-Password!"},
+			AcceptErr:          errors.New("invalid invitation"),
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedMessage:    "Invalid or expired invitation",
+		},
+		{
+			Name:               "Join with the wrong password of an existing account",
+			RequestBody:        userpkg.AcceptInvitationRequest{Token: "token", Password: "wrong"},
+			AcceptErr:          errors.New("invalid credentials"),
+			ExpectedStatusCode: http.StatusUnauthorized,
+			ExpectedMessage:    "Invalid password for the existing account",
+		},
+		{
+			Name:               "Join a locked account",
+			RequestBody:        userpkg.AcceptInvitationRequest{Token: "token", Password: "wrong"},
+			AcceptErr:          &userpkg.LockedError{RetryAfter: time.Minute},
+			ExpectedStatusCode: http.StatusTooManyRequests,
+			ExpectedMessage:    "Too many failed attempts, try again later",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			mockUserService := &mockUserService{
+				AcceptInvitationMock: func(req *userpkg.AcceptInvitationRequest) (*userpkg.LoginResponse, error) {
+					assert.Equal(t, tt.RequestBody.Token, req.Token)
+					if tt.AcceptErr != nil {
+						return nil, tt.AcceptErr
+					}
+					return &userpkg.LoginResponse{TokenPair: &userpkg.TokenPair{AccessToken: "access", RefreshToken: "refresh"}}, nil
+				},
+			}
+
+			gin.SetMode(gin.TestMode)
+
+			reqBody, _ := json.Marshal(tt.RequestBody)
+			req, err := http.NewRequest("POST", "/api/auth/accept-invitation", bytes.NewBuffer(reqBody))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+
+			router := gin.Default()
+			router.POST("/api/auth/accept-invitation", acceptInvitationHandler(mockUserService))
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.ExpectedStatusCode, rr.Code)
+
+			var response map[string]interface{}
+			err = json.NewDecoder(rr.Body).Decode(&response)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.ExpectedMessage != "" {
+				assert.Equal(t, tt.ExpectedMessage, response["message"])
+			} else {
+				data := response["data"].(map[string]interface{})
+				assert.Equal(t, "access", data["accessToken"])
+			}
+		})
+	}
+}
+
+type mockWebAuthnService struct {
+	webauthnpkg.Service
+	BeginRegistrationMock func(userID primitive.ObjectID) (*webauthnpkg.Ceremony, error)
+	DeleteCredentialMock  func(userID primitive.ObjectID, id primitive.ObjectID) error
+}
+
+func (m *mockWebAuthnService) BeginRegistration(userID primitive.ObjectID) (*webauthnpkg.Ceremony, error) {
+	return m.BeginRegistrationMock(userID)
+}
+
+func (m *mockWebAuthnService) DeleteCredential(userID primitive.ObjectID, id primitive.ObjectID) error {
+	return m.DeleteCredentialMock(userID, id)
+}
+
+func TestPasskeyRoutesRecentAuth(t *testing.T) {
+	userID := primitive.NewObjectID()
+
+	type testCase struct {
+		Name               string
+		Method             string
+		Path               string
+		AuthTime           time.Time
+		ExpectedStatusCode int
+	}
+
+	tests := []testCase{
+		{
+			Name:               "Register a passkey long after login",
+			Method:             "POST",
+			Path:               "/api/auth/webauthn/register/begin",
+			AuthTime:           time.Now().Add(-time.Hour),
+			ExpectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			Name:               "Register a passkey right after login",
+			Method:             "POST",
+			Path:               "/api/auth/webauthn/register/begin",
+			AuthTime:           time.Now(),
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "Finish a registration long after login",
+			Method:             "POST",
+			Path:               "/api/auth/webauthn/register/finish",
+			AuthTime:           time.Now().Add(-time.Hour),
+			ExpectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			Name:               "Delete a passkey long after login",
+			Method:             "DELETE",
+			Path:               "/api/auth/webauthn/credentials/" + primitive.NewObjectID().Hex(),
+			AuthTime:           time.Now().Add(-time.Hour),
+			ExpectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			Name:               "Delete a passkey right after login",
+			Method:             "DELETE",
+			Path:               "/api/auth/webauthn/credentials/" + primitive.NewObjectID().Hex(),
+			AuthTime:           time.Now(),
+			ExpectedStatusCode: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			was := &mockWebAuthnService{
+				BeginRegistrationMock: func(id primitive.ObjectID) (*webauthnpkg.Ceremony, error) {
+					return &webauthnpkg.Ceremony{SessionID: "session"}, nil
+				},
+				DeleteCredentialMock: func(id primitive.ObjectID, credentialID primitive.ObjectID) error {
+					return nil
+				},
+			}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.Default()
+			authenticate := func(c *gin.Context) {
+				c.Set("user", &userpkg.UserContext{ID: userID, Role: userpkg.RoleUser, AuthTime: tt.AuthTime.Unix()})
+			}
+			WebAuthnRoutes(router, was, authenticate)
+
+			req, err := http.NewRequest(tt.Method, tt.Path, bytes.NewBufferString("{}"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.ExpectedStatusCode, rr.Code)
+		})
+	}
+}
+
+type mockOIDCService struct {
+	oidcpkg.Service
+	StartLoginMock  func(provider string) (string, string, error)
+	FinishLoginMock func(provider string, req *oidcpkg.CallbackRequest) (*userpkg.LoginResponse, error)
+}
+
+func (m *mockOIDCService) StartLogin(provider string) (string, string, error) {
+	return m.StartLoginMock(provider)
+}
+
+func (m *mockOIDCService) FinishLogin(provider string, req *oidcpkg.CallbackRequest) (*userpkg.LoginResponse, error) {
+	return m.FinishLoginMock(provider, req)
+}
+
+func TestOIDCLoginBinding(t *testing.T) {
+	type testCase struct {
+		Name               string
+		SendCookie         bool
+		ExpectedStatusCode int
+	}
+
+	tests := []testCase{
+		{
+			Name:               "Finish the login in the browser that started it",
+			SendCookie:         true,
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "Finish the login in another browser",
+			SendCookie:         false,
+			ExpectedStatusCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			ols := &mockOIDCService{
+				StartLoginMock: func(provider string) (string, string, error) {
+					return "https://idp.example.com/authorize", "browser-secret", nil
+				},
+				FinishLoginMock: func(provider string, req *oidcpkg.CallbackRequest) (*userpkg.LoginResponse, error) {
+					if req.Binding != "browser-secret" {
+						return nil, errors.New("login started in another browser")
+					}
+					return &userpkg.LoginResponse{TokenPair: &userpkg.TokenPair{AccessToken: "access", RefreshToken: "refresh"}}, nil
+				},
+			}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.Default()
+			OIDCRoutes(router, ols)
+
+			req, err := http.NewRequest("GET", "/api/auth/oidc/corp/login", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusFound, rr.Code)
+
+			cookies := rr.Result().Cookies()
+			assert.Len(t, cookies, 1)
+			assert.True(t, cookies[0].HttpOnly)
+			assert.Equal(t, http.SameSiteLaxMode, cookies[0].SameSite)
+			assert.Equal(t, "/api/auth/oidc", cookies[0].Path)
+
+			body, _ := json.Marshal(oidcpkg.CallbackRequest{Code: "code", State: "state"})
+			req, err = http.NewRequest("POST", "/api/auth/oidc/corp/callback", bytes.NewBuffer(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.SendCookie {
+				req.AddCookie(cookies[0])
+			}
+			rr = httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.ExpectedStatusCode, rr.Code)
+		})
+	}
+}
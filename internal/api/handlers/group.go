@@ -0,0 +1,345 @@
+package handlers
+
+import (
+	"mahi-go-explorer/internal/api/middleware"
+	"mahi-go-explorer/internal/api/response"
+	userpkg "mahi-go-explorer/pkg/user"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// GroupRoutes defines group routes, organization admins manage the groups of
+// their organization
+func GroupRoutes(r *gin.Engine, s userpkg.Service, authenticate gin.HandlerFunc) {
+	groups := r.Group("/api/groups")
+	groups.Use(authenticate, middleware.RequirePermission(userpkg.PermGroupsManage))
+	{
+		groups.POST("", createGroupHandler(s))
+		groups.GET("", getGroupsHandler(s))
+		groups.GET("/:id", getGroupHandler(s))
+		groups.PUT("/:id", updateGroupHandler(s))
+		groups.DELETE("/:id", deleteGroupHandler(s))
+		groups.POST("/:id/members", addGroupMemberHandler(s))
+		groups.DELETE("/:id/members/:userId", removeGroupMemberHandler(s))
+		groups.POST("/:id/groups", addSubgroupHandler(s))
+		groups.DELETE("/:id/groups/:groupId", removeSubgroupHandler(s))
+	}
+}
+
+// canGrant checks the current user could give the role & permissions
+// themselves, writing the error response when not
+func canGrant(c *gin.Context, cu *userpkg.UserContext, role string, permissions []string) bool {
+	if role != "" && !userpkg.CanAssignRole(cu.Role, role) {
+		response.LogAndErrorResponse(c, http.StatusForbidden, "Cannot assign this role", nil)
+		return false
+	}
+	for _, p := range permissions {
+		if !cu.HasPermission(p) {
+			response.LogAndErrorResponse(c, http.StatusForbidden, "Cannot grant permission: "+p, nil)
+			return false
+		}
+	}
+	return true
+}
+
+// manageableGroup gets the :id group when the current user could grant what
+// it grants, writing the error response when not
+func manageableGroup(c *gin.Context, s userpkg.Service, cu *userpkg.UserContext) (*userpkg.Group, bool) {
+	objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid ID", err)
+		return nil, false
+	}
+
+	group, err := scopedUsers(s, cu).GetGroup(objID)
+	if err != nil {
+		groupErrorResponse(c, err, "Failed to get group")
+		return nil, false
+	}
+
+	if !canGrant(c, cu, group.Role, group.Permissions) {
+		return nil, false
+	}
+	return group, true
+}
+
+// groupErrorResponse writes the response for an error of the group service
+func groupErrorResponse(c *gin.Context, err error, msg string) {
+	switch err.Error() {
+	case "group not found":
+		response.LogAndErrorResponse(c, http.StatusNotFound, "Group Not Found", err)
+	case "group already exists":
+		response.LogAndErrorResponse(c, http.StatusConflict, "Group Already Exists", err)
+	case "user not found":
+		response.LogAndErrorResponse(c, http.StatusNotFound, "User Not Found", err)
+	case "member not found":
+		response.LogAndErrorResponse(c, http.StatusNotFound, "Member Not Found", err)
+	case "group cycle":
+		response.LogAndErrorResponse(c, http.StatusConflict, "Group would contain itself", err)
+	default:
+		response.LogAndErrorResponse(c, http.StatusInternalServerError, msg, err)
+	}
+}
+
+// bindGroupRequest binds a group request the current user may grant
+func bindGroupRequest(c *gin.Context, cu *userpkg.UserContext) (*userpkg.GroupRequest, bool) {
+	var req userpkg.GroupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+		return nil, false
+	}
+
+	if req.Name == "" {
+		response.LogAndErrorResponse(c, http.StatusBadRequest, "Name is required", nil)
+		return nil, false
+	}
+
+	if req.Role != "" {
+		req.Role = userpkg.NormalizeRole(req.Role)
+	}
+	if !canGrant(c, cu, req.Role, req.Permissions) {
+		return nil, false
+	}
+	return &req, true
+}
+
+func createGroupHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		req, ok := bindGroupRequest(c, cu)
+		if !ok {
+			return
+		}
+
+		group, err := scopedUsers(s, cu).CreateGroup(req)
+		if err != nil {
+			groupErrorResponse(c, err, "Failed to create group")
+			return
+		}
+
+		response.SuccessResponse(c, http.StatusCreated, group)
+	}
+}
+
+func getGroupsHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		groups, err := scopedUsers(s, cu).GetGroups()
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get groups", err)
+			return
+		}
+
+		response.SuccessResponse(c, http.StatusOK, groups)
+	}
+}
+
+func getGroupHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid ID", err)
+			return
+		}
+
+		group, err := scopedUsers(s, cu).GetGroup(objID)
+		if err != nil {
+			groupErrorResponse(c, err, "Failed to get group")
+			return
+		}
+
+		response.SuccessResponse(c, http.StatusOK, group)
+	}
+}
+
+func updateGroupHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		group, ok := manageableGroup(c, s, cu)
+		if !ok {
+			return
+		}
+
+		req, ok := bindGroupRequest(c, cu)
+		if !ok {
+			return
+		}
+
+		group, err = scopedUsers(s, cu).UpdateGroup(group.ID, req)
+		if err != nil {
+			groupErrorResponse(c, err, "Failed to update group")
+			return
+		}
+
+		response.SuccessResponse(c, http.StatusOK, group)
+	}
+}
+
+func deleteGroupHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		group, ok := manageableGroup(c, s, cu)
+		if !ok {
+			return
+		}
+
+		if err := scopedUsers(s, cu).DeleteGroup(group.ID); err != nil {
+			groupErrorResponse(c, err, "Failed to delete group")
+			return
+		}
+
+		response.SuccessResponse(c, http.StatusOK, nil)
+	}
+}
+
+func addGroupMemberHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		group, ok := manageableGroup(c, s, cu)
+		if !ok {
+			return
+		}
+
+		var req userpkg.GroupMemberRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+			return
+		}
+
+		userID, err := primitive.ObjectIDFromHex(req.UserID)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid user ID", err)
+			return
+		}
+
+		if err := scopedUsers(s, cu).AddGroupMember(group.ID, userID); err != nil {
+			groupErrorResponse(c, err, "Failed to add group member")
+			return
+		}
+
+		response.SuccessResponse(c, http.StatusCreated, nil)
+	}
+}
+
+func removeGroupMemberHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		group, ok := manageableGroup(c, s, cu)
+		if !ok {
+			return
+		}
+
+		userID, err := primitive.ObjectIDFromHex(c.Param("userId"))
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid user ID", err)
+			return
+		}
+
+		if err := scopedUsers(s, cu).RemoveGroupMember(group.ID, userID); err != nil {
+			groupErrorResponse(c, err, "Failed to remove group member")
+			return
+		}
+
+		response.SuccessResponse(c, http.StatusOK, nil)
+	}
+}
+
+func addSubgroupHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		group, ok := manageableGroup(c, s, cu)
+		if !ok {
+			return
+		}
+
+		var req userpkg.SubgroupRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+			return
+		}
+
+		subgroupID, err := primitive.ObjectIDFromHex(req.GroupID)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid group ID", err)
+			return
+		}
+
+		if err := scopedUsers(s, cu).AddSubgroup(group.ID, subgroupID); err != nil {
+			groupErrorResponse(c, err, "Failed to add nested group")
+			return
+		}
+
+		response.SuccessResponse(c, http.StatusCreated, nil)
+	}
+}
+
+func removeSubgroupHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		group, ok := manageableGroup(c, s, cu)
+		if !ok {
+			return
+		}
+
+		subgroupID, err := primitive.ObjectIDFromHex(c.Param("groupId"))
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid group ID", err)
+			return
+		}
+
+		if err := scopedUsers(s, cu).RemoveSubgroup(group.ID, subgroupID); err != nil {
+			groupErrorResponse(c, err, "Failed to remove nested group")
+			return
+		}
+
+		response.SuccessResponse(c, http.StatusOK, nil)
+	}
+}
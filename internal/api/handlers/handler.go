@@ -2,7 +2,18 @@ package handlers
 
 import (
 	"errors"
+	"mahi-go-explorer/internal/api/middleware"
+	"mahi-go-explorer/internal/api/response"
+	apikeypkg "mahi-go-explorer/pkg/apikey"
+	oauthpkg "mahi-go-explorer/pkg/oauth"
+	oidcpkg "mahi-go-explorer/pkg/oidc"
+	passwordpkg "mahi-go-explorer/pkg/password"
+	samlpkg "mahi-go-explorer/pkg/saml"
+	tokenpkg "mahi-go-explorer/pkg/token"
 	userpkg "mahi-go-explorer/pkg/user"
+	webauthnpkg "mahi-go-explorer/pkg/webauthn"
+
+	"net/http"
 
 	"github.com/gin-gonic/gin"
 )
@@ -11,9 +22,27 @@ import (
 func RegisterRoutes(
 	r *gin.Engine,
 	userService userpkg.Service,
+	keyService tokenpkg.KeyService,
+	tokenService tokenpkg.Service,
+	apiKeyService apikeypkg.Service,
+	oauthService oauthpkg.Service,
+	oidcService oidcpkg.Service,
+	samlService samlpkg.Service,
+	webAuthnService webauthnpkg.Service,
 ) {
-	AuthRoutes(r, userService)
-	UserRoutes(r, userService)
+	authenticate := middleware.Authenticate(userService, tokenService, apiKeyService)
+
+	AuthRoutes(r, userService, authenticate)
+	OIDCRoutes(r, oidcService)
+	SAMLRoutes(r, samlService)
+	WebAuthnRoutes(r, webAuthnService, authenticate)
+	UserRoutes(r, userService, authenticate)
+	InvitationRoutes(r, userService, authenticate)
+	OrganizationRoutes(r, userService, authenticate)
+	GroupRoutes(r, userService, authenticate)
+	APIKeyRoutes(r, apiKeyService, userService, authenticate)
+	OAuthRoutes(r, oauthService, authenticate)
+	WellKnownRoutes(r, keyService, oauthService)
 }
 
 func getUserContext(c *gin.Context) (*userpkg.UserContext, error) {
@@ -29,3 +58,23 @@ func getUserContext(c *gin.Context) (*userpkg.UserContext, error) {
 
 	return currentUser, nil
 }
+
+// clientInfo describes the device of the request for the session it starts
+func clientInfo(c *gin.Context) userpkg.ClientInfo {
+	return userpkg.ClientInfo{
+		ClientIP:  c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+	}
+}
+
+// passwordPolicyErrorResponse writes the field errors when err is a password
+// policy violation, reporting whether it did
+func passwordPolicyErrorResponse(c *gin.Context, err error) bool {
+	var policyErr *passwordpkg.PolicyError
+	if !errors.As(err, &policyErr) {
+		return false
+	}
+
+	response.ValidationErrorResponse(c, http.StatusBadRequest, "Password does not meet the password policy", policyErr.Errors)
+	return true
+}
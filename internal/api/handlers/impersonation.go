@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"mahi-go-explorer/internal/api/response"
+	userpkg "mahi-go-explorer/pkg/user"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func impersonateHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid ID", err)
+			return
+		}
+
+		token, err := s.Impersonate(cu, objID)
+		if err != nil {
+			switch err.Error() {
+			case "user not found":
+				response.LogAndErrorResponse(c, http.StatusNotFound, "User Not Found", err)
+				return
+			case "cannot impersonate this user", "already impersonating":
+				response.LogAndErrorResponse(c, http.StatusForbidden, "Cannot impersonate this user", err)
+				return
+			case "user is blocked":
+				response.LogAndErrorResponse(c, http.StatusForbidden, "User Is Blocked", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to impersonate user", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusOK, token)
+	}
+}
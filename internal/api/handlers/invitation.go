@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"errors"
+	"mahi-go-explorer/internal/api/middleware"
+	"mahi-go-explorer/internal/api/response"
+	userpkg "mahi-go-explorer/pkg/user"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// InvitationRoutes defines invitation routes, accepting one is an auth route
+func InvitationRoutes(r *gin.Engine, s userpkg.Service, authenticate gin.HandlerFunc) {
+	invitations := r.Group("/api/invitations")
+	invitations.Use(authenticate, middleware.RequirePermission(userpkg.PermUsersCreate))
+	{
+		invitations.POST("", createInvitationHandler(s))
+		invitations.GET("", getInvitationsHandler(s))
+		invitations.POST("/:id/resend", resendInvitationHandler(s))
+		invitations.DELETE("/:id", revokeInvitationHandler(s))
+	}
+}
+
+func createInvitationHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		var req userpkg.InvitationRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+			return
+		}
+
+		if req.Email == "" {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Email is required", nil)
+			return
+		}
+
+		req.Role = userpkg.NormalizeRole(req.Role)
+		if !userpkg.CanAssignRole(cu.Role, req.Role) {
+			response.LogAndErrorResponse(c, http.StatusForbidden, "Cannot assign this role", nil)
+			return
+		}
+
+		invitation, err := scopedUsers(s, cu).InviteUser(cu.ID, &req)
+		if err != nil {
+			switch err.Error() {
+			case "user already exists":
+				response.LogAndErrorResponse(c, http.StatusConflict, "User Already Exists", err)
+				return
+			case "already a member":
+				response.LogAndErrorResponse(c, http.StatusConflict, "Already A Member", err)
+				return
+			case "invitation already pending":
+				response.LogAndErrorResponse(c, http.StatusConflict, "Invitation Already Pending", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to invite user", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusCreated, invitation)
+	}
+}
+
+func getInvitationsHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		invitations, err := scopedUsers(s, cu).GetInvitations()
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get invitations", err)
+			return
+		}
+
+		response.SuccessResponse(c, http.StatusOK, invitations)
+	}
+}
+
+func resendInvitationHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid ID", err)
+			return
+		}
+
+		invitation, err := scopedUsers(s, cu).ResendInvitation(objID)
+		if err != nil {
+			switch err.Error() {
+			case "invitation not found":
+				response.LogAndErrorResponse(c, http.StatusNotFound, "Invitation Not Found", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to resend invitation", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusOK, invitation)
+	}
+}
+
+func revokeInvitationHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid ID", err)
+			return
+		}
+
+		if err := scopedUsers(s, cu).RevokeInvitation(objID); err != nil {
+			switch err.Error() {
+			case "invitation not found":
+				response.LogAndErrorResponse(c, http.StatusNotFound, "Invitation Not Found", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to revoke invitation", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusOK, nil)
+	}
+}
+
+func acceptInvitationHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req userpkg.AcceptInvitationRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+			return
+		}
+
+		if req.Token == "" || req.Password == "" {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Token and password are required", nil)
+			return
+		}
+
+		req.ClientInfo = clientInfo(c)
+
+		resp, err := s.AcceptInvitation(&req)
+		if err != nil {
+			var locked *userpkg.LockedError
+			if errors.As(err, &locked) {
+				c.Header("Retry-After", strconv.Itoa(int(math.Ceil(locked.RetryAfter.Seconds()))))
+				response.LogAndErrorResponse(c, http.StatusTooManyRequests, "Too many failed attempts, try again later", err)
+				return
+			}
+
+			if passwordPolicyErrorResponse(c, err) {
+				return
+			}
+			switch err.Error() {
+			case "invalid invitation":
+				response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid or expired invitation", err)
+				return
+			case "invalid credentials":
+				response.LogAndErrorResponse(c, http.StatusUnauthorized, "Invalid password for the existing account", err)
+				return
+			case "user is blocked":
+				response.LogAndErrorResponse(c, http.StatusForbidden, "User Is Blocked", err)
+				return
+			case "user already exists":
+				response.LogAndErrorResponse(c, http.StatusConflict, "User Already Exists", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to accept invitation", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusCreated, resp)
+	}
+}
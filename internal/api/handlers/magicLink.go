@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"mahi-go-explorer/internal/api/response"
+	"mahi-go-explorer/internal/config"
+	userpkg "mahi-go-explorer/pkg/user"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// magicLinkCookie holds the secret a bound link is only valid with
+	magicLinkCookie     = "magic_link_binding"
+	magicLinkCookiePath = "/api/auth/magic-link"
+)
+
+func requestMagicLinkHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		//bind the request
+		var req userpkg.MagicLinkRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+			return
+		}
+
+		//validate required fields
+		if req.Email == "" {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Email is required", nil)
+			return
+		}
+
+		binding, err := s.RequestMagicLink(&req)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Internal Server Error", err)
+			return
+		}
+
+		if binding != "" {
+			ttl := config.GetDurationFromEnv("MAGIC_LINK_TTL", 15*time.Minute)
+			setMagicLinkCookie(c, binding, int(ttl.Seconds()))
+		}
+
+		//same answer for unknown and throttled addresses
+		response.SuccessResponse(c, http.StatusOK, gin.H{
+			"message": "If the email belongs to an account, a login link has been sent",
+		})
+	}
+}
+
+func magicLinkLoginHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		//the token comes from the json body the app posts
+		var req userpkg.MagicLinkLoginRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+			return
+		}
+
+		if req.Token == "" {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Token is required", nil)
+			return
+		}
+
+		req.Binding, _ = c.Cookie(magicLinkCookie)
+		req.ClientInfo = clientInfo(c)
+
+		tokens, err := s.LoginWithMagicLink(&req)
+		if err != nil {
+			switch err.Error() {
+			case "invalid magic link":
+				response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid or expired login link", err)
+				return
+			case "magic link bound to another browser":
+				response.LogAndErrorResponse(c, http.StatusForbidden, "Open the login link in the browser it was requested from", err)
+				return
+			case "user is blocked":
+				response.LogAndErrorResponse(c, http.StatusForbidden, "User Is Blocked", err)
+				return
+			case "email not verified":
+				response.LogAndErrorResponse(c, http.StatusForbidden, "Email Not Verified", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Internal Server Error", err)
+				return
+			}
+		}
+
+		//the link is used up, so is its binding
+		if req.Binding != "" {
+			setMagicLinkCookie(c, "", -1)
+		}
+
+		response.SuccessResponse(c, http.StatusOK, tokens)
+	}
+}
+
+func setMagicLinkCookie(c *gin.Context, value string, maxAge int) {
+	secure := strings.HasPrefix(config.AppURL(), "https://")
+	//lax, the app opened from the email posts the token from its own site
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(magicLinkCookie, value, maxAge, magicLinkCookiePath, "", secure, true)
+}
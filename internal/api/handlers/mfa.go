@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"mahi-go-explorer/internal/api/response"
+	userpkg "mahi-go-explorer/pkg/user"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func enrollMFAHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		enrollment, err := s.EnrollMFA(cu.ID)
+		if err != nil {
+			switch err.Error() {
+			case "mfa already enabled":
+				response.LogAndErrorResponse(c, http.StatusConflict, "MFA already enabled", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to enroll MFA", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusOK, enrollment)
+	}
+}
+
+func confirmMFAHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		var req userpkg.MFACodeRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+			return
+		}
+
+		if req.Code == "" {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Code is required", nil)
+			return
+		}
+
+		codes, err := s.ConfirmMFA(cu.ID, req.Code)
+		if err != nil {
+			switch err.Error() {
+			case "mfa already enabled":
+				response.LogAndErrorResponse(c, http.StatusConflict, "MFA already enabled", err)
+				return
+			case "mfa enrollment not started":
+				response.LogAndErrorResponse(c, http.StatusBadRequest, "MFA enrollment not started", err)
+				return
+			case "invalid mfa code":
+				response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid code", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to confirm MFA", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusOK, gin.H{
+			"recoveryCodes": codes,
+		})
+	}
+}
+
+func verifyMFAHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req userpkg.MFAVerifyRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+			return
+		}
+
+		if req.MFAToken == "" || (req.Code == "" && req.RecoveryCode == "") {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "MFA token and code are required", nil)
+			return
+		}
+
+		req.ClientInfo = clientInfo(c)
+
+		tokens, err := s.VerifyMFA(&req)
+		if err != nil {
+			switch err.Error() {
+			case "invalid mfa token", "invalid mfa code", "user not found", "user is blocked":
+				response.LogAndErrorResponse(c, http.StatusUnauthorized, "Invalid MFA code", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Internal Server Error", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusOK, tokens)
+	}
+}
+
+func resetMFAHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		objID, err := resolveUserID(c, cu)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid ID", err)
+			return
+		}
+
+		if !canManageUser(c, s, cu, objID) || !canManageAccount(c, s, cu, objID) {
+			return
+		}
+
+		if err := s.ResetMFA(objID); err != nil {
+			switch err.Error() {
+			case "user not found":
+				response.LogAndErrorResponse(c, http.StatusNotFound, "User Not Found", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to reset MFA", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusOK, nil)
+	}
+}
@@ -0,0 +1,351 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"mahi-go-explorer/internal/api/middleware"
+	"mahi-go-explorer/internal/api/response"
+	oauthpkg "mahi-go-explorer/pkg/oauth"
+	userpkg "mahi-go-explorer/pkg/user"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// OAuthRoutes defines the oauth authorization server routes. The protocol
+// endpoints answer in plain oauth, the consent screen & client management
+// are part of the api.
+func OAuthRoutes(r *gin.Engine, oas oauthpkg.Service, authenticate gin.HandlerFunc) {
+	oauth := r.Group("/oauth")
+	{
+		oauth.GET("/authorize", authorizeHandler(oas))
+		oauth.POST("/token", tokenHandler(oas))
+		oauth.POST("/revoke", revokeOAuthTokenHandler(oas))
+		oauth.POST("/introspect", introspectHandler(oas))
+		oauth.GET("/userinfo", userInfoHandler(oas))
+		oauth.POST("/userinfo", userInfoHandler(oas))
+	}
+
+	consent := r.Group("/api/oauth/authorize")
+	consent.Use(authenticate, requireTokenAuth(), middleware.BlockImpersonation())
+	{
+		consent.GET("", getConsentHandler(oas))
+		consent.POST("", consentHandler(oas))
+	}
+
+	clients := r.Group("/api/oauth/clients")
+	clients.Use(authenticate, middleware.RequirePermission(userpkg.PermOAuthClientsManage))
+	{
+		clients.POST("", createOAuthClientHandler(oas))
+		clients.GET("", getOAuthClientsHandler(oas))
+		clients.DELETE("/:clientId", deleteOAuthClientHandler(oas))
+	}
+}
+
+// oauthErrorResponse writes err as a standard oauth error response
+func oauthErrorResponse(c *gin.Context, err error) {
+	c.Header("Cache-Control", "no-store")
+
+	var oauthErr *oauthpkg.Error
+	if !errors.As(err, &oauthErr) {
+		log.Printf("OAuth request failed: %v", err)
+		c.JSON(http.StatusInternalServerError, &oauthpkg.Error{Code: "server_error"})
+		return
+	}
+
+	switch oauthErr.Code {
+	case oauthpkg.ErrInvalidClient:
+		if _, _, ok := c.Request.BasicAuth(); ok {
+			c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+		}
+	case oauthpkg.ErrInvalidToken, oauthpkg.ErrInsufficientScope:
+		c.Header("WWW-Authenticate", `Bearer error="`+oauthErr.Code+`"`)
+	}
+	c.JSON(oauthErr.StatusCode(), oauthErr)
+}
+
+// authenticateClient authenticates the client by http basic auth or by
+// client_id & client_secret in the form
+func authenticateClient(c *gin.Context, oas oauthpkg.Service) (*oauthpkg.Client, error) {
+	clientID, secret, ok := c.Request.BasicAuth()
+	if ok {
+		if c.PostForm("client_secret") != "" {
+			return nil, &oauthpkg.Error{Code: oauthpkg.ErrInvalidRequest, Description: "only one client authentication method may be used"}
+		}
+
+		//both parts are form encoded before they are put in the header
+		var err error
+		if clientID, err = url.QueryUnescape(clientID); err != nil {
+			return nil, &oauthpkg.Error{Code: oauthpkg.ErrInvalidClient, Description: "client authentication failed"}
+		}
+		if secret, err = url.QueryUnescape(secret); err != nil {
+			return nil, &oauthpkg.Error{Code: oauthpkg.ErrInvalidClient, Description: "client authentication failed"}
+		}
+	} else {
+		clientID = c.PostForm("client_id")
+		secret = c.PostForm("client_secret")
+	}
+
+	return oas.AuthenticateClient(clientID, secret)
+}
+
+func authorizeHandler(oas oauthpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req oauthpkg.AuthorizeRequest
+		if err := c.ShouldBindQuery(&req); err != nil {
+			oauthErrorResponse(c, &oauthpkg.Error{Code: oauthpkg.ErrInvalidRequest, Description: err.Error()})
+			return
+		}
+
+		client, err := oas.ValidateAuthorizeRequest(&req)
+		if err != nil {
+			var oauthErr *oauthpkg.Error
+			if client == nil || !errors.As(err, &oauthErr) {
+				//the redirect uri cannot be trusted, show the error instead
+				oauthErrorResponse(c, err)
+				return
+			}
+			c.Redirect(http.StatusFound, oauthpkg.RedirectURL(req.RedirectURI, oauthpkg.ErrorParams(oauthErr, req.State)))
+			return
+		}
+
+		//the consent screen logs the user in & asks for their approval
+		c.Redirect(http.StatusFound, oas.ConsentURL(c.Request.URL.RawQuery))
+	}
+}
+
+func tokenHandler(oas oauthpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client, err := authenticateClient(c, oas)
+		if err != nil {
+			oauthErrorResponse(c, err)
+			return
+		}
+
+		var req oauthpkg.TokenRequest
+		if err := c.ShouldBindWith(&req, binding.Form); err != nil {
+			oauthErrorResponse(c, &oauthpkg.Error{Code: oauthpkg.ErrInvalidRequest, Description: err.Error()})
+			return
+		}
+
+		tokens, err := oas.Token(client, &req)
+		if err != nil {
+			oauthErrorResponse(c, err)
+			return
+		}
+
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, tokens)
+	}
+}
+
+func revokeOAuthTokenHandler(oas oauthpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client, err := authenticateClient(c, oas)
+		if err != nil {
+			oauthErrorResponse(c, err)
+			return
+		}
+
+		token := c.PostForm("token")
+		if token == "" {
+			oauthErrorResponse(c, &oauthpkg.Error{Code: oauthpkg.ErrInvalidRequest, Description: "token is required"})
+			return
+		}
+
+		if err := oas.Revoke(client, token, c.PostForm("token_type_hint")); err != nil {
+			oauthErrorResponse(c, err)
+			return
+		}
+
+		//unknown tokens are not an error, the client wanted them gone either way
+		c.Status(http.StatusOK)
+	}
+}
+
+func introspectHandler(oas oauthpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client, err := authenticateClient(c, oas)
+		if err != nil {
+			oauthErrorResponse(c, err)
+			return
+		}
+
+		//public clients could be anyone
+		if client.Public {
+			oauthErrorResponse(c, &oauthpkg.Error{Code: oauthpkg.ErrUnauthorizedClient, Description: "public clients cannot introspect tokens"})
+			return
+		}
+
+		token := c.PostForm("token")
+		if token == "" {
+			oauthErrorResponse(c, &oauthpkg.Error{Code: oauthpkg.ErrInvalidRequest, Description: "token is required"})
+			return
+		}
+
+		introspection, err := oas.Introspect(token)
+		if err != nil {
+			oauthErrorResponse(c, err)
+			return
+		}
+
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, introspection)
+	}
+}
+
+func userInfoHandler(oas oauthpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if token == "" || token == c.GetHeader("Authorization") {
+			oauthErrorResponse(c, &oauthpkg.Error{Code: oauthpkg.ErrInvalidToken, Description: "bearer token required"})
+			return
+		}
+
+		userInfo, err := oas.UserInfo(token)
+		if err != nil {
+			oauthErrorResponse(c, err)
+			return
+		}
+
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, userInfo)
+	}
+}
+
+// authorizeErrorResponse writes an invalid authorization request for the consent screen
+func authorizeErrorResponse(c *gin.Context, err error) {
+	var oauthErr *oauthpkg.Error
+	if errors.As(err, &oauthErr) {
+		response.ValidationErrorResponse(c, http.StatusBadRequest, "Invalid authorization request", oauthErr)
+		return
+	}
+	response.LogAndErrorResponse(c, http.StatusInternalServerError, "Internal Server Error", err)
+}
+
+func getConsentHandler(oas oauthpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		var req oauthpkg.AuthorizeRequest
+		if err := c.ShouldBindQuery(&req); err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+			return
+		}
+
+		info, err := oas.GetConsentInfo(cu.ID, &req)
+		if err != nil {
+			authorizeErrorResponse(c, err)
+			return
+		}
+
+		response.SuccessResponse(c, http.StatusOK, info)
+	}
+}
+
+func consentHandler(oas oauthpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		//bind the request
+		var req oauthpkg.ConsentRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+			return
+		}
+
+		resp, err := oas.Authorize(cu.ID, &req)
+		if err != nil {
+			authorizeErrorResponse(c, err)
+			return
+		}
+
+		response.SuccessResponse(c, http.StatusOK, resp)
+	}
+}
+
+func createOAuthClientHandler(oas oauthpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		//bind the request
+		var req oauthpkg.CreateClientRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+			return
+		}
+
+		//validate required fields
+		if req.Name == "" {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Name is required", nil)
+			return
+		}
+
+		client, err := oas.CreateClient(cu.ID, &req)
+		if err != nil {
+			switch err.Error() {
+			case "invalid grant type":
+				response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid grant type", err)
+				return
+			case "public clients cannot use client credentials":
+				response.LogAndErrorResponse(c, http.StatusBadRequest, "Public clients cannot use client credentials", err)
+				return
+			case "redirect uri required":
+				response.LogAndErrorResponse(c, http.StatusBadRequest, "Redirect URI is required", err)
+				return
+			case "invalid redirect uri":
+				response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid redirect URI", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to create client", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusCreated, client)
+	}
+}
+
+func getOAuthClientsHandler(oas oauthpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		clients, err := oas.GetClients()
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get clients", err)
+			return
+		}
+
+		response.SuccessResponse(c, http.StatusOK, clients)
+	}
+}
+
+func deleteOAuthClientHandler(oas oauthpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := oas.DeleteClient(c.Param("clientId")); err != nil {
+			switch err.Error() {
+			case "client not found":
+				response.LogAndErrorResponse(c, http.StatusNotFound, "Client Not Found", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to delete client", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusOK, nil)
+	}
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"encoding/json"
+	oauthpkg "mahi-go-explorer/pkg/oauth"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockOAuthService struct {
+	oauthpkg.Service
+	AuthenticateClientMock func(clientID string, secret string) (*oauthpkg.Client, error)
+	TokenMock              func(client *oauthpkg.Client, req *oauthpkg.TokenRequest) (*oauthpkg.TokenResponse, error)
+}
+
+func (m *mockOAuthService) AuthenticateClient(clientID string, secret string) (*oauthpkg.Client, error) {
+	return m.AuthenticateClientMock(clientID, secret)
+}
+
+func (m *mockOAuthService) Token(client *oauthpkg.Client, req *oauthpkg.TokenRequest) (*oauthpkg.TokenResponse, error) {
+	return m.TokenMock(client, req)
+}
+
+func TestTokenHandler(t *testing.T) {
+	type testCase struct {
+		Name                 string
+		BasicAuth            []string
+		Form                 url.Values
+		ExpectedStatusCode   int
+		ExpectedError        string
+		ExpectedAuthenticate string
+	}
+
+	tests := []testCase{
+		{
+			Name:               "Client credentials in form",
+			Form:               url.Values{"grant_type": {"client_credentials"}, "client_id": {"svc"}, "client_secret": {"s3cret"}},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "Client credentials in basic auth",
+			BasicAuth:          []string{"svc", "s3cret"},
+			Form:               url.Values{"grant_type": {"client_credentials"}},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:                 "Wrong secret in basic auth",
+			BasicAuth:            []string{"svc", "wrong"},
+			Form:                 url.Values{"grant_type": {"client_credentials"}},
+			ExpectedStatusCode:   http.StatusUnauthorized,
+			ExpectedError:        oauthpkg.ErrInvalidClient,
+			ExpectedAuthenticate: `Basic realm="oauth"`,
+		},
+		{
+			Name:               "Two authentication methods",
+			BasicAuth:          []string{"svc", "s3cret"},
+			Form:               url.Values{"grant_type": {"client_credentials"}, "client_secret": {"s3cret"}},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedError:      oauthpkg.ErrInvalidRequest,
+		},
+		{
+			Name:               "Unsupported grant type",
+			Form:               url.Values{"grant_type": {"password"}, "client_id": {"svc"}, "client_secret": {"s3cret"}},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedError:      oauthpkg.ErrUnsupportedGrantType,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			mockOAuthService := &mockOAuthService{
+				AuthenticateClientMock: func(clientID string, secret string) (*oauthpkg.Client, error) {
+					if clientID != "svc" || secret != "s3cret" {
+						return nil, &oauthpkg.Error{Code: oauthpkg.ErrInvalidClient}
+					}
+					return &oauthpkg.Client{ClientID: clientID}, nil
+				},
+				TokenMock: func(client *oauthpkg.Client, req *oauthpkg.TokenRequest) (*oauthpkg.TokenResponse, error) {
+					if req.GrantType != oauthpkg.GrantClientCredentials {
+						return nil, &oauthpkg.Error{Code: oauthpkg.ErrUnsupportedGrantType}
+					}
+					return &oauthpkg.TokenResponse{AccessToken: "access", TokenType: "Bearer", ExpiresIn: 3600}, nil
+				},
+			}
+
+			gin.SetMode(gin.TestMode)
+
+			req, err := http.NewRequest("POST", "/oauth/token", strings.NewReader(tt.Form.Encode()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.BasicAuth != nil {
+				req.SetBasicAuth(tt.BasicAuth[0], tt.BasicAuth[1])
+			}
+
+			rr := httptest.NewRecorder()
+
+			router := gin.Default()
+			router.POST("/oauth/token", tokenHandler(mockOAuthService))
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.ExpectedStatusCode, rr.Code)
+			assert.Equal(t, "no-store", rr.Header().Get("Cache-Control"))
+			assert.Equal(t, tt.ExpectedAuthenticate, rr.Header().Get("WWW-Authenticate"))
+
+			//oauth clients expect the standard response, not the api envelope
+			var response map[string]interface{}
+			err = json.NewDecoder(rr.Body).Decode(&response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.ExpectedError != "" {
+				assert.Equal(t, tt.ExpectedError, response["error"])
+			} else {
+				assert.Equal(t, "access", response["access_token"])
+				assert.Equal(t, "Bearer", response["token_type"])
+			}
+		})
+	}
+}
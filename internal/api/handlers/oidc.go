@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"mahi-go-explorer/internal/api/response"
+	"mahi-go-explorer/internal/config"
+	oidcpkg "mahi-go-explorer/pkg/oidc"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// oidcBindingCookie holds the secret the login state is only valid with
+	oidcBindingCookie     = "oidc_login_binding"
+	oidcBindingCookiePath = "/api/auth/oidc"
+)
+
+// OIDCRoutes defines the routes for logging in through upstream OpenID Connect
+// providers. The provider sends the user back to the app, which posts what it
+// got to the callback. The login has to finish in the browser that started
+// it, the callback needs the cookie set by the login route.
+func OIDCRoutes(r *gin.Engine, ols oidcpkg.Service) {
+	oidc := r.Group("/api/auth/oidc")
+	{
+		oidc.GET("/providers", oidcProvidersHandler(ols))
+		oidc.GET("/:provider/login", oidcLoginHandler(ols))
+		oidc.POST("/:provider/callback", oidcCallbackHandler(ols))
+	}
+}
+
+func oidcProvidersHandler(ols oidcpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		response.SuccessResponse(c, http.StatusOK, ols.Providers())
+	}
+}
+
+func oidcLoginHandler(ols oidcpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u, binding, err := ols.StartLogin(c.Param("provider"))
+		if err != nil {
+			switch err.Error() {
+			case "provider not found":
+				response.LogAndErrorResponse(c, http.StatusNotFound, "Provider Not Found", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusBadGateway, "Provider unavailable", err)
+				return
+			}
+		}
+
+		setOIDCBindingCookie(c, binding, int(oidcpkg.LoginStateTTL.Seconds()))
+		c.Redirect(http.StatusFound, u)
+	}
+}
+
+func oidcCallbackHandler(ols oidcpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		//bind the request
+		var req oidcpkg.CallbackRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+			return
+		}
+
+		//validate required fields
+		if req.State == "" || (req.Code == "" && req.Error == "") {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", nil)
+			return
+		}
+
+		req.Binding, _ = c.Cookie(oidcBindingCookie)
+		req.ClientInfo = clientInfo(c)
+
+		tokens, err := ols.FinishLogin(c.Param("provider"), &req)
+		//the state is used up either way, so is its binding
+		if req.Binding != "" {
+			setOIDCBindingCookie(c, "", -1)
+		}
+		if err != nil {
+			switch err.Error() {
+			case "provider not found":
+				response.LogAndErrorResponse(c, http.StatusNotFound, "Provider Not Found", err)
+				return
+			case "invalid state":
+				response.LogAndErrorResponse(c, http.StatusBadRequest, "Login expired, please try again", err)
+				return
+			case "login started in another browser":
+				response.LogAndErrorResponse(c, http.StatusForbidden, "Finish the login in the browser it was started from", err)
+				return
+			case "provider login failed":
+				response.LogAndErrorResponse(c, http.StatusUnauthorized, "Login with provider failed", err)
+				return
+			case "email missing":
+				response.LogAndErrorResponse(c, http.StatusUnauthorized, "Provider did not share an email", err)
+				return
+			case "email not verified by provider":
+				response.LogAndErrorResponse(c, http.StatusConflict, "An account with this email exists, verify the email at the provider to link it", err)
+				return
+			case "user is blocked":
+				response.LogAndErrorResponse(c, http.StatusForbidden, "User Is Blocked", err)
+				return
+			case "signup disabled":
+				response.LogAndErrorResponse(c, http.StatusForbidden, "Signup is disabled", err)
+				return
+			case "email not verified":
+				response.LogAndErrorResponse(c, http.StatusForbidden, "Email Not Verified", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Internal Server Error", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusOK, tokens)
+	}
+}
+
+func setOIDCBindingCookie(c *gin.Context, value string, maxAge int) {
+	secure := strings.HasPrefix(config.AppURL(), "https://")
+	//lax, the app posts the callback from its own site after the provider sent the user back
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcBindingCookie, value, maxAge, oidcBindingCookiePath, "", secure, true)
+}
@@ -0,0 +1,267 @@
+package handlers
+
+import (
+	"mahi-go-explorer/internal/api/middleware"
+	"mahi-go-explorer/internal/api/response"
+	userpkg "mahi-go-explorer/pkg/user"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// OrganizationRoutes defines organization routes, run by platform admins.
+// Organization admins manage their members through the user routes.
+func OrganizationRoutes(r *gin.Engine, s userpkg.Service, authenticate gin.HandlerFunc) {
+	orgs := r.Group("/api/orgs")
+	orgs.Use(authenticate, middleware.RequirePermission(userpkg.PermOrgsManage))
+	{
+		orgs.POST("", createOrganizationHandler(s))
+		orgs.GET("", getOrganizationsHandler(s))
+		orgs.GET("/:orgId/members", getMembersHandler(s))
+		orgs.POST("/:orgId/members", addMemberHandler(s))
+		orgs.PUT("/:orgId/members/:userId", updateMemberHandler(s))
+		orgs.DELETE("/:orgId/members/:userId", removeMemberHandler(s))
+	}
+
+	auth := r.Group("/api/auth")
+	auth.Use(authenticate)
+	{
+		auth.GET("/organizations", middleware.RequireScope(userpkg.ScopeProfileRead), getUserOrganizationsHandler(s))
+		auth.POST("/switch-organization", requireTokenAuth(), middleware.BlockImpersonation(), switchOrganizationHandler(s))
+	}
+}
+
+func createOrganizationHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req userpkg.OrganizationRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+			return
+		}
+
+		if req.Name == "" {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Name is required", nil)
+			return
+		}
+
+		org, err := s.CreateOrganization(&req)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to create organization", err)
+			return
+		}
+
+		response.SuccessResponse(c, http.StatusCreated, org)
+	}
+}
+
+func getOrganizationsHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		orgs, err := s.GetOrganizations()
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get organizations", err)
+			return
+		}
+
+		response.SuccessResponse(c, http.StatusOK, orgs)
+	}
+}
+
+func getMembersHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		orgID, err := primitive.ObjectIDFromHex(c.Param("orgId"))
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid organization ID", err)
+			return
+		}
+
+		users, err := s.InOrg(orgID).GetUsers(bson.M{}, nil)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get members", err)
+			return
+		}
+
+		response.SuccessResponse(c, http.StatusOK, users)
+	}
+}
+
+func addMemberHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		orgID, err := primitive.ObjectIDFromHex(c.Param("orgId"))
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid organization ID", err)
+			return
+		}
+
+		var req userpkg.MembershipRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+			return
+		}
+
+		if req.Email == "" {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Email is required", nil)
+			return
+		}
+		if !userpkg.IsValidRole(req.Role) {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid role", nil)
+			return
+		}
+
+		if err := s.AddMember(orgID, &req); err != nil {
+			switch err.Error() {
+			case "organization not found":
+				response.LogAndErrorResponse(c, http.StatusNotFound, "Organization Not Found", err)
+				return
+			case "user not found":
+				response.LogAndErrorResponse(c, http.StatusNotFound, "User Not Found", err)
+				return
+			case "already a member":
+				response.LogAndErrorResponse(c, http.StatusConflict, "Already A Member", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to add member", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusCreated, nil)
+	}
+}
+
+func updateMemberHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		orgID, err := primitive.ObjectIDFromHex(c.Param("orgId"))
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid organization ID", err)
+			return
+		}
+
+		userID, err := primitive.ObjectIDFromHex(c.Param("userId"))
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid ID", err)
+			return
+		}
+
+		var req userpkg.MembershipRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+			return
+		}
+
+		if req.Role == "" || !userpkg.IsValidRole(req.Role) {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid role", nil)
+			return
+		}
+
+		res, err := s.InOrg(orgID).UpdateUser(bson.M{"_id": userID}, bson.M{"$set": bson.M{"role": userpkg.NormalizeRole(req.Role)}}, nil)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to update member", err)
+			return
+		}
+		if res, ok := res.(*mongo.UpdateResult); ok && res.MatchedCount == 0 {
+			response.LogAndErrorResponse(c, http.StatusNotFound, "Member Not Found", nil)
+			return
+		}
+
+		response.SuccessResponse(c, http.StatusOK, res)
+	}
+}
+
+func removeMemberHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		orgID, err := primitive.ObjectIDFromHex(c.Param("orgId"))
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid organization ID", err)
+			return
+		}
+
+		userID, err := primitive.ObjectIDFromHex(c.Param("userId"))
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid ID", err)
+			return
+		}
+
+		if err := s.RemoveMember(orgID, userID); err != nil {
+			switch err.Error() {
+			case "membership not found":
+				response.LogAndErrorResponse(c, http.StatusNotFound, "Member Not Found", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to remove member", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusOK, nil)
+	}
+}
+
+func getUserOrganizationsHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		orgs, err := s.GetUserOrganizations(cu.ID)
+		if err != nil {
+			switch err.Error() {
+			case "user not found":
+				response.LogAndErrorResponse(c, http.StatusNotFound, "User Not Found", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get organizations", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusOK, orgs)
+	}
+}
+
+func switchOrganizationHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		var req userpkg.SwitchOrganizationRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+			return
+		}
+
+		//an empty org leaves the organization
+		orgID := primitive.NilObjectID
+		if req.OrgID != "" {
+			orgID, err = primitive.ObjectIDFromHex(req.OrgID)
+			if err != nil {
+				response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid organization ID", err)
+				return
+			}
+		}
+
+		token, err := s.SwitchOrganization(cu.ID, cu.SessionID, orgID)
+		if err != nil {
+			switch err.Error() {
+			case "not a member":
+				response.LogAndErrorResponse(c, http.StatusForbidden, "Not a member of this organization", err)
+				return
+			case "session revoked", "user not found":
+				response.LogAndErrorResponse(c, http.StatusUnauthorized, "Unauthorized", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to switch organization", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusOK, token)
+	}
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"errors"
+	"mahi-go-explorer/internal/api/middleware"
+	"mahi-go-explorer/internal/api/response"
+	"mahi-go-explorer/internal/config"
+	userpkg "mahi-go-explorer/pkg/user"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// reauthMaxAge is how recently the user must have proved who they are for
+// sensitive operations
+func reauthMaxAge() time.Duration {
+	return config.GetDurationFromEnv("REAUTH_MAX_AGE", 5*time.Minute)
+}
+
+// requireRecentAuth guards sensitive routes, the user must have proved who
+// they are in the last REAUTH_MAX_AGE
+func requireRecentAuth() gin.HandlerFunc {
+	return middleware.RequireRecentAuth(reauthMaxAge())
+}
+
+func reauthHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		var req userpkg.ReauthRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+			return
+		}
+
+		if req.Password == "" && req.Code == "" && req.RecoveryCode == "" {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Password or MFA code is required", nil)
+			return
+		}
+
+		req.ClientInfo = clientInfo(c)
+
+		token, err := s.Reauthenticate(cu.ID, cu.SessionID, &req)
+		if err != nil {
+			var locked *userpkg.LockedError
+			if errors.As(err, &locked) {
+				c.Header("Retry-After", strconv.Itoa(int(math.Ceil(locked.RetryAfter.Seconds()))))
+				response.LogAndErrorResponse(c, http.StatusTooManyRequests, "Too many failed attempts, try again later", err)
+				return
+			}
+
+			switch err.Error() {
+			case "invalid credentials":
+				response.LogAndErrorResponse(c, http.StatusUnauthorized, "Invalid credentials", err)
+				return
+			case "mfa not enabled":
+				response.LogAndErrorResponse(c, http.StatusBadRequest, "MFA Not Enabled", err)
+				return
+			case "session revoked", "user not found", "user is blocked":
+				response.LogAndErrorResponse(c, http.StatusUnauthorized, "Unauthorized", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to reauthenticate", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusOK, token)
+	}
+}
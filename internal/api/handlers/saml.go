@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"log"
+	"mahi-go-explorer/internal/api/response"
+	samlpkg "mahi-go-explorer/pkg/saml"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SAMLRoutes defines the routes for logging in through SAML 2.0 identity
+// providers. The provider posts its response to the acs, which sends the user
+// back to the app with a code the app exchanges for tokens.
+func SAMLRoutes(r *gin.Engine, sls samlpkg.Service) {
+	saml := r.Group("/api/auth/saml")
+	{
+		saml.GET("/providers", samlProvidersHandler(sls))
+		saml.POST("/token", samlTokenHandler(sls))
+		saml.GET("/:provider/metadata", samlMetadataHandler(sls))
+		saml.GET("/:provider/login", samlLoginHandler(sls))
+		saml.POST("/:provider/acs", samlACSHandler(sls))
+	}
+}
+
+func samlProvidersHandler(sls samlpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		response.SuccessResponse(c, http.StatusOK, sls.Providers())
+	}
+}
+
+func samlMetadataHandler(sls samlpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		md, err := sls.Metadata(c.Param("provider"))
+		if err != nil {
+			switch err.Error() {
+			case "provider not found":
+				response.LogAndErrorResponse(c, http.StatusNotFound, "Provider Not Found", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Internal Server Error", err)
+				return
+			}
+		}
+
+		c.Data(http.StatusOK, "application/samlmetadata+xml", md)
+	}
+}
+
+func samlLoginHandler(sls samlpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u, err := sls.StartLogin(c.Param("provider"))
+		if err != nil {
+			switch err.Error() {
+			case "provider not found":
+				response.LogAndErrorResponse(c, http.StatusNotFound, "Provider Not Found", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Internal Server Error", err)
+				return
+			}
+		}
+
+		c.Redirect(http.StatusFound, u)
+	}
+}
+
+func samlACSHandler(sls samlpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		samlResponse := c.PostForm("SAMLResponse")
+		if samlResponse == "" {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", nil)
+			return
+		}
+
+		code, err := sls.ConsumeResponse(c.Param("provider"), samlResponse)
+		if err != nil {
+			//the user is looking at this page, send them back to the app either way
+			var reason string
+			switch err.Error() {
+			case "provider not found":
+				response.LogAndErrorResponse(c, http.StatusNotFound, "Provider Not Found", err)
+				return
+			case "invalid response", "assertion replayed":
+				reason = "login_failed"
+			case "invalid request":
+				reason = "login_expired"
+			case "email missing":
+				reason = "email_missing"
+			case "email not verified by provider", "email not verified":
+				reason = "email_not_verified"
+			case "user is blocked":
+				reason = "user_blocked"
+			case "signup disabled":
+				reason = "signup_disabled"
+			default:
+				log.Printf("SAML login failed: %v", err)
+				reason = "server_error"
+			}
+			c.Redirect(http.StatusSeeOther, sls.CallbackURL(url.Values{"error": {reason}}))
+			return
+		}
+
+		c.Redirect(http.StatusSeeOther, sls.CallbackURL(url.Values{"code": {code}}))
+	}
+}
+
+func samlTokenHandler(sls samlpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		//bind the request
+		var req samlpkg.FinishLoginRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+			return
+		}
+
+		//validate required fields
+		if req.Code == "" {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Code is required", nil)
+			return
+		}
+
+		req.ClientInfo = clientInfo(c)
+
+		tokens, err := sls.FinishLogin(&req)
+		if err != nil {
+			switch err.Error() {
+			case "invalid code":
+				response.LogAndErrorResponse(c, http.StatusBadRequest, "Login expired, please try again", err)
+				return
+			case "user is blocked":
+				response.LogAndErrorResponse(c, http.StatusForbidden, "User Is Blocked", err)
+				return
+			case "email not verified":
+				response.LogAndErrorResponse(c, http.StatusForbidden, "Email Not Verified", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Internal Server Error", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusOK, tokens)
+	}
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"mahi-go-explorer/internal/api/response"
+	userpkg "mahi-go-explorer/pkg/user"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func getSessionsHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		objID, err := resolveUserID(c, cu)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid ID", err)
+			return
+		}
+
+		sessions, err := s.GetSessions(objID)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get sessions", err)
+			return
+		}
+
+		//point out the session the user is looking from
+		if objID == cu.ID {
+			for i := range sessions {
+				sessions[i].Current = sessions[i].ID.Hex() == cu.SessionID
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusOK, sessions)
+	}
+}
+
+func revokeSessionHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		objID, err := resolveUserID(c, cu)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid ID", err)
+			return
+		}
+
+		sessionID, err := primitive.ObjectIDFromHex(c.Param("sessionId"))
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid session ID", err)
+			return
+		}
+
+		if !canManageUser(c, s, cu, objID) {
+			return
+		}
+
+		if err := s.RevokeSession(objID, sessionID); err != nil {
+			switch err.Error() {
+			case "session not found":
+				response.LogAndErrorResponse(c, http.StatusNotFound, "Session Not Found", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to revoke session", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusOK, nil)
+	}
+}
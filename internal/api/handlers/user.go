@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"mahi-go-explorer/internal/api/middleware"
 	"mahi-go-explorer/internal/api/response"
 	userpkg "mahi-go-explorer/pkg/user"
@@ -9,23 +10,36 @@ import (
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // UserRoutes defnies user service routes
-func UserRoutes(r *gin.Engine, s userpkg.Service) {
+func UserRoutes(r *gin.Engine, s userpkg.Service, authenticate gin.HandlerFunc) {
 	user := r.Group("/api/user")
-	user.Use(middleware.Authenticate())
+	user.Use(authenticate)
 	{
-		user.POST("", createUserHandler(s))
-		user.GET("", getUsersHandler(s))
-		user.GET("/:id", getUserHandler(s))
-		user.PUT("/:id", updateUserHandler(s))
-		user.DELETE("/:id", deleteUserHandler(s))
+		user.POST("", middleware.RequirePermission(userpkg.PermUsersCreate), createUserHandler(s))
+		user.GET("", middleware.RequirePermission(userpkg.PermUsersRead), getUsersHandler(s))
+		user.GET("/:id", middleware.RequireSelfOrPermission(userpkg.ScopeProfileRead, userpkg.PermUsersRead), getUserHandler(s))
+		user.PUT("/:id", middleware.RequireSelfOrPermission(userpkg.ScopeProfileWrite, userpkg.PermUsersWrite), updateUserHandler(s))
+		user.DELETE("/:id", middleware.RequirePermission(userpkg.PermUsersDelete), middleware.BlockImpersonation(), requireRecentAuth(), deleteUserHandler(s))
+		user.DELETE("/:id/mfa", middleware.RequirePermission(userpkg.PermUsersWrite), middleware.BlockImpersonation(), resetMFAHandler(s))
+		user.POST("/:id/unlock", middleware.RequirePermission(userpkg.PermUsersWrite), requireManageableUser(s), unlockUserHandler(s))
+		user.GET("/:id/sessions", middleware.RequireSelfOrPermission(userpkg.ScopeProfileRead, userpkg.PermUsersRead), requireManageableUser(s), getSessionsHandler(s))
+		user.DELETE("/:id/sessions/:sessionId", middleware.RequireSelfOrPermission(userpkg.ScopeProfileWrite, userpkg.PermUsersWrite), middleware.BlockImpersonation(), revokeSessionHandler(s))
+		user.POST("/:id/impersonate", middleware.RequirePermission(userpkg.PermUsersImpersonate), requireTokenAuth(), middleware.BlockImpersonation(), impersonateHandler(s))
 	}
 }
 
 func createUserHandler(s userpkg.Service) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
 		var req userpkg.CreateRequest
 		if err := c.ShouldBindJSON(&req); err != nil {
 			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
@@ -37,23 +51,43 @@ func createUserHandler(s userpkg.Service) gin.HandlerFunc {
 			return
 		}
 
-		u, _ := req.CreateUser()
+		req.Role = userpkg.NormalizeRole(req.Role)
+		if !userpkg.CanAssignRole(cu.Role, req.Role) {
+			response.LogAndErrorResponse(c, http.StatusForbidden, "Cannot assign this role", nil)
+			return
+		}
 
-		res, err := s.CreateUser(u)
+		u, err := req.CreateUser()
+		if err != nil {
+			if passwordPolicyErrorResponse(c, err) {
+				return
+			}
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+			return
+		}
+
+		res, err := scopedUsers(s, cu).CreateUser(u)
 		if err != nil {
 			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to create user", err)
 			return
 		}
 
+		sendVerificationEmail(s, res)
+
 		response.SuccessResponse(c, http.StatusCreated, res)
 	}
 }
 
 func getUsersHandler(s userpkg.Service) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
 
 		conds := bson.M{}
-		users, err := s.GetUsers(conds, nil)
+		users, err := scopedUsers(s, cu).GetUsers(conds, nil)
 		if err != nil {
 			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get users", err)
 			return
@@ -72,20 +106,17 @@ func getUserHandler(s userpkg.Service) gin.HandlerFunc {
 			return
 		}
 
-		var uID primitive.ObjectID
-		idstr := c.Param("id")
-		if idstr == "me" {
-			uID = cu.ID
-		} else {
-			objID, err := primitive.ObjectIDFromHex(idstr)
-			if err != nil {
-				response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid ID", err)
-				return
-			}
-			uID = objID
+		uID, err := resolveUserID(c, cu)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid ID", err)
+			return
 		}
 
-		user, err := s.GetUser(bson.M{"_id": uID}, nil)
+		user, err := scopedUsers(s, cu).GetUser(bson.M{"_id": uID}, nil)
+		if err == mongo.ErrNoDocuments {
+			response.LogAndErrorResponse(c, http.StatusNotFound, "User Not Found", err)
+			return
+		}
 		if err != nil {
 			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user", err)
 			return
@@ -97,8 +128,13 @@ func getUserHandler(s userpkg.Service) gin.HandlerFunc {
 
 func updateUserHandler(s userpkg.Service) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		idstr := c.Param("id")
-		objID, err := primitive.ObjectIDFromHex(idstr)
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		objID, err := resolveUserID(c, cu)
 		if err != nil {
 			response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid ID", err)
 			return
@@ -110,6 +146,39 @@ func updateUserHandler(s userpkg.Service) gin.HandlerFunc {
 			return
 		}
 
+		//a new email or role needs a recent proof of identity, a new name does not
+		if req.Email != "" || req.Role != "" {
+			maxAge := reauthMaxAge()
+			if !cu.AuthenticatedWithin(maxAge) {
+				middleware.ReauthRequiredResponse(c, maxAge)
+				return
+			}
+		}
+
+		if !canManageUser(c, s, cu, objID) {
+			return
+		}
+		if req.Email != "" || req.IsBlocked != nil {
+			if !canManageAccount(c, s, cu, objID) {
+				return
+			}
+		}
+
+		//changing role or blocked state is never a self service action
+		if req.Role != "" || req.IsBlocked != nil {
+			if !cu.HasPermission(userpkg.PermUsersWrite) {
+				response.LogAndErrorResponse(c, http.StatusForbidden, "Forbidden", nil)
+				return
+			}
+		}
+		if req.Role != "" {
+			req.Role = userpkg.NormalizeRole(req.Role)
+			if !userpkg.CanAssignRole(cu.Role, req.Role) {
+				response.LogAndErrorResponse(c, http.StatusForbidden, "Cannot assign this role", nil)
+				return
+			}
+		}
+
 		update := bson.M{}
 		if req.FirstName != "" {
 			update["firstName"] = req.FirstName
@@ -118,37 +187,248 @@ func updateUserHandler(s userpkg.Service) gin.HandlerFunc {
 			update["lastName"] = req.LastName
 		}
 		if req.Email != "" {
+			//a new address has to be verified again
 			update["email"] = req.Email
+			update["emailVerified"] = false
 		}
 		if req.Role != "" {
 			update["role"] = req.Role
 		}
+		if req.IsBlocked != nil {
+			update["isBlocked"] = *req.IsBlocked
+		}
+		if len(update) == 0 {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Nothing to update", nil)
+			return
+		}
 
-		res, err := s.UpdateUser(bson.M{"_id": objID}, update, nil)
+		res, err := scopedUsers(s, cu).UpdateUser(bson.M{"_id": objID}, bson.M{"$set": update}, nil)
 		if err != nil {
 			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to update user", err)
 			return
 		}
 
+		if req.Email != "" {
+			sendVerificationEmail(s, objID)
+		}
+
+		//cut off a blocked user right away, tokens of a new platform role
+		//carry the old one, the organization ends its own sessions
+		if (req.IsBlocked != nil && *req.IsBlocked) || (req.Role != "" && !cu.InOrg()) {
+			if err := s.RevokeUserTokens(objID); err != nil {
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to revoke user tokens", err)
+				return
+			}
+		}
+
 		response.SuccessResponse(c, http.StatusOK, res)
 	}
 }
 
 func deleteUserHandler(s userpkg.Service) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		idstr := c.Param("id")
-		objID, err := primitive.ObjectIDFromHex(idstr)
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		objID, err := resolveUserID(c, cu)
 		if err != nil {
 			response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid ID", err)
 			return
 		}
 
-		res, err := s.DeleteUser(bson.M{"_id": objID})
+		if !canManageUser(c, s, cu, objID) || !canDeleteAccount(c, s, cu, objID) {
+			return
+		}
+
+		res, err := scopedUsers(s, cu).DeleteUser(bson.M{"_id": objID})
 		if err != nil {
 			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to delete user", err)
 			return
 		}
 
+		//an organization only ends the sessions working in it
+		if cu.InOrg() {
+			response.SuccessResponse(c, http.StatusOK, res)
+			return
+		}
+
+		if err := s.RevokeUserTokens(objID); err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to revoke user tokens", err)
+			return
+		}
+
 		response.SuccessResponse(c, http.StatusOK, res)
 	}
 }
+
+// resolveUserID gets the user id from the :id param, "me" being the current user
+func resolveUserID(c *gin.Context, cu *userpkg.UserContext) (primitive.ObjectID, error) {
+	idstr := c.Param("id")
+	if idstr == "me" {
+		return cu.ID, nil
+	}
+	return primitive.ObjectIDFromHex(idstr)
+}
+
+// scopedUsers returns the users the current user works with, the members of
+// their organization when they are in one
+func scopedUsers(s userpkg.Service, cu *userpkg.UserContext) userpkg.Service {
+	return s.InOrg(cu.OrgID)
+}
+
+// canManageUser checks the target user is in the organization of the current
+// user & does not outrank them, writing the error response when not
+func canManageUser(c *gin.Context, s userpkg.Service, cu *userpkg.UserContext, id primitive.ObjectID) bool {
+	if id == cu.ID {
+		return true
+	}
+
+	target, err := scopedUsers(s, cu).GetUser(bson.M{"_id": id}, nil)
+	if err == mongo.ErrNoDocuments {
+		response.LogAndErrorResponse(c, http.StatusNotFound, "User Not Found", err)
+		return false
+	}
+	if err != nil {
+		response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user", err)
+		return false
+	}
+
+	//a role granted through groups counts as well
+	grants, err := s.GroupGrants(id, cu.OrgID)
+	if err != nil {
+		response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user", err)
+		return false
+	}
+	role := target.Role
+	if userpkg.RoleRank(grants.Role) > userpkg.RoleRank(role) {
+		role = grants.Role
+	}
+
+	if userpkg.RoleRank(role) > userpkg.RoleRank(cu.Role) {
+		response.LogAndErrorResponse(c, http.StatusForbidden, "Forbidden", nil)
+		return false
+	}
+
+	return true
+}
+
+// canManageAccount checks an organization admin only changes the login of
+// users belonging to no other organization & holding no platform role,
+// writing the error response when they do. The account is shared by all
+// organizations of the user.
+func canManageAccount(c *gin.Context, s userpkg.Service, cu *userpkg.UserContext, id primitive.ObjectID) bool {
+	if !cu.InOrg() || id == cu.ID {
+		return true
+	}
+
+	target, ok := accountOf(c, s, id)
+	if !ok {
+		return false
+	}
+
+	if len(target.Memberships) > 1 {
+		response.LogAndErrorResponse(c, http.StatusForbidden, "User belongs to other organizations", nil)
+		return false
+	}
+	if hasPlatformRole(target, cu) {
+		response.LogAndErrorResponse(c, http.StatusForbidden, "Forbidden", errors.New("user has a platform role"))
+		return false
+	}
+
+	return true
+}
+
+// canDeleteAccount checks an organization admin only deletes the account of
+// users holding no platform role, writing the error response when they do.
+// Users belonging to other organizations are only removed from this one.
+func canDeleteAccount(c *gin.Context, s userpkg.Service, cu *userpkg.UserContext, id primitive.ObjectID) bool {
+	if !cu.InOrg() || id == cu.ID {
+		return true
+	}
+
+	target, ok := accountOf(c, s, id)
+	if !ok {
+		return false
+	}
+
+	if len(target.Memberships) <= 1 && hasPlatformRole(target, cu) {
+		response.LogAndErrorResponse(c, http.StatusForbidden, "Forbidden", errors.New("user has a platform role"))
+		return false
+	}
+
+	return true
+}
+
+// accountOf gets the platform role & memberships of the user, outside of any
+// organization, writing the error response when it fails
+func accountOf(c *gin.Context, s userpkg.Service, id primitive.ObjectID) (*userpkg.User, bool) {
+	target, err := s.GetUser(bson.M{"_id": id}, options.FindOne().SetProjection(bson.M{"role": 1, "memberships": 1}))
+	if err == mongo.ErrNoDocuments {
+		response.LogAndErrorResponse(c, http.StatusNotFound, "User Not Found", err)
+		return nil, false
+	}
+	if err != nil {
+		response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user", err)
+		return nil, false
+	}
+	return target, true
+}
+
+// hasPlatformRole checks the user ranks above a plain user, or above the
+// caller, on the platform, which no organization admin has a say over
+func hasPlatformRole(target *userpkg.User, cu *userpkg.UserContext) bool {
+	rank := userpkg.RoleRank(target.Role)
+	return rank > userpkg.RoleRank(userpkg.RoleUser) || rank > userpkg.RoleRank(cu.Role)
+}
+
+// requireManageableUser runs canManageUser for the :id user of the route
+func requireManageableUser(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			c.Abort()
+			return
+		}
+
+		objID, err := resolveUserID(c, cu)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid ID", err)
+			c.Abort()
+			return
+		}
+
+		if !canManageUser(c, s, cu, objID) {
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func unlockUserHandler(s userpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid ID", err)
+			return
+		}
+
+		if err := s.UnlockUser(objID); err != nil {
+			switch err.Error() {
+			case "user not found":
+				response.LogAndErrorResponse(c, http.StatusNotFound, "User Not Found", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to unlock user", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusOK, nil)
+	}
+}
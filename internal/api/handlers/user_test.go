@@ -3,14 +3,19 @@ package handlers
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"mahi-go-explorer/internal/api/middleware"
 	userpkg "mahi-go-explorer/pkg/user"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
@@ -21,12 +26,173 @@ type mockUserService struct {
 	GetUserMock    func(conds bson.M, opts *options.FindOneOptions) (*userpkg.User, error)
 	UpdateUserMock func(conds bson.M, update bson.M, opts *options.UpdateOptions) (any, error)
 	DeleteUserMock func(conds bson.M) (any, error)
+
+	LoginUserMock          func(req *userpkg.LoginRequest) (*userpkg.LoginResponse, error)
+	RefreshTokensMock      func(refreshToken string) (*userpkg.TokenPair, error)
+	RevokeAccessTokenMock  func(userID primitive.ObjectID, jti string, exp interface{}) error
+	RevokeRefreshTokenMock func(userID primitive.ObjectID, refreshToken string) error
+
+	RequestMagicLinkMock   func(req *userpkg.MagicLinkRequest) (string, error)
+	LoginWithMagicLinkMock func(req *userpkg.MagicLinkLoginRequest) (*userpkg.LoginResponse, error)
+
+	GetSessionsMock   func(userID primitive.ObjectID) ([]userpkg.Session, error)
+	RevokeSessionMock func(userID primitive.ObjectID, sessionID primitive.ObjectID) error
+
+	ImpersonateMock func(actor *userpkg.UserContext, userID primitive.ObjectID) (*userpkg.ImpersonationResponse, error)
+
+	ReauthenticateMock func(userID primitive.ObjectID, sessionID string, req *userpkg.ReauthRequest) (*userpkg.ReauthResponse, error)
+
+	InviteUserMock       func(invitedBy primitive.ObjectID, req *userpkg.InvitationRequest) (*userpkg.Invitation, error)
+	ResendInvitationMock func(id primitive.ObjectID) (*userpkg.Invitation, error)
+	RevokeInvitationMock func(id primitive.ObjectID) error
+	AcceptInvitationMock func(req *userpkg.AcceptInvitationRequest) (*userpkg.LoginResponse, error)
+
+	AddMemberMock          func(orgID primitive.ObjectID, req *userpkg.MembershipRequest) error
+	SwitchOrganizationMock func(userID primitive.ObjectID, sessionID string, orgID primitive.ObjectID) (*userpkg.AccessTokenResponse, error)
+	// ScopedOrgID is the organization the handler last scoped the service to
+	ScopedOrgID primitive.ObjectID
+
+	GroupGrantsMock    func(userID primitive.ObjectID, orgID primitive.ObjectID) (*userpkg.GroupGrants, error)
+	CreateGroupMock    func(req *userpkg.GroupRequest) (*userpkg.Group, error)
+	GetGroupMock       func(id primitive.ObjectID) (*userpkg.Group, error)
+	AddGroupMemberMock func(id primitive.ObjectID, userID primitive.ObjectID) error
+	AddSubgroupMock    func(id primitive.ObjectID, subgroupID primitive.ObjectID) error
+
+	SendVerificationEmailMock func(userID primitive.ObjectID) error
+	RequestPasswordResetMock  func(email string)
+	ChangePasswordMock        func(userID primitive.ObjectID, req *userpkg.ChangePasswordRequest) (*userpkg.TokenPair, error)
+	RevokeUserTokensMock      func(userID primitive.ObjectID) error
 }
 
 func (m *mockUserService) CreateUser(req *userpkg.User) (any, error) {
 	return m.CreateUserMock(req)
 }
 
+func (m *mockUserService) GetUsers(conds bson.M, opts *options.FindOptions) ([]userpkg.User, error) {
+	return m.GetUsersMock(conds, opts)
+}
+
+func (m *mockUserService) GetUser(conds bson.M, opts *options.FindOneOptions) (*userpkg.User, error) {
+	return m.GetUserMock(conds, opts)
+}
+
+func (m *mockUserService) UpdateUser(conds bson.M, update bson.M, opts *options.UpdateOptions) (any, error) {
+	return m.UpdateUserMock(conds, update, opts)
+}
+
+func (m *mockUserService) DeleteUser(conds bson.M) (any, error) {
+	return m.DeleteUserMock(conds)
+}
+
+func (m *mockUserService) LoginUser(req *userpkg.LoginRequest) (*userpkg.LoginResponse, error) {
+	return m.LoginUserMock(req)
+}
+
+func (m *mockUserService) RequestMagicLink(req *userpkg.MagicLinkRequest) (string, error) {
+	return m.RequestMagicLinkMock(req)
+}
+
+func (m *mockUserService) LoginWithMagicLink(req *userpkg.MagicLinkLoginRequest) (*userpkg.LoginResponse, error) {
+	return m.LoginWithMagicLinkMock(req)
+}
+
+func (m *mockUserService) GetSessions(userID primitive.ObjectID) ([]userpkg.Session, error) {
+	return m.GetSessionsMock(userID)
+}
+
+func (m *mockUserService) RevokeSession(userID primitive.ObjectID, sessionID primitive.ObjectID) error {
+	return m.RevokeSessionMock(userID, sessionID)
+}
+
+func (m *mockUserService) Impersonate(actor *userpkg.UserContext, userID primitive.ObjectID) (*userpkg.ImpersonationResponse, error) {
+	return m.ImpersonateMock(actor, userID)
+}
+
+func (m *mockUserService) Reauthenticate(userID primitive.ObjectID, sessionID string, req *userpkg.ReauthRequest) (*userpkg.ReauthResponse, error) {
+	return m.ReauthenticateMock(userID, sessionID, req)
+}
+
+func (m *mockUserService) InviteUser(invitedBy primitive.ObjectID, req *userpkg.InvitationRequest) (*userpkg.Invitation, error) {
+	return m.InviteUserMock(invitedBy, req)
+}
+
+func (m *mockUserService) ResendInvitation(id primitive.ObjectID) (*userpkg.Invitation, error) {
+	return m.ResendInvitationMock(id)
+}
+
+func (m *mockUserService) RevokeInvitation(id primitive.ObjectID) error {
+	return m.RevokeInvitationMock(id)
+}
+
+func (m *mockUserService) AcceptInvitation(req *userpkg.AcceptInvitationRequest) (*userpkg.LoginResponse, error) {
+	return m.AcceptInvitationMock(req)
+}
+
+func (m *mockUserService) AddMember(orgID primitive.ObjectID, req *userpkg.MembershipRequest) error {
+	return m.AddMemberMock(orgID, req)
+}
+
+func (m *mockUserService) SwitchOrganization(userID primitive.ObjectID, sessionID string, orgID primitive.ObjectID) (*userpkg.AccessTokenResponse, error) {
+	return m.SwitchOrganizationMock(userID, sessionID, orgID)
+}
+
+// GroupGrants grants nothing unless mocked, most users are in no group
+func (m *mockUserService) GroupGrants(userID primitive.ObjectID, orgID primitive.ObjectID) (*userpkg.GroupGrants, error) {
+	if m.GroupGrantsMock == nil {
+		return &userpkg.GroupGrants{}, nil
+	}
+	return m.GroupGrantsMock(userID, orgID)
+}
+
+func (m *mockUserService) CreateGroup(req *userpkg.GroupRequest) (*userpkg.Group, error) {
+	return m.CreateGroupMock(req)
+}
+
+func (m *mockUserService) GetGroup(id primitive.ObjectID) (*userpkg.Group, error) {
+	return m.GetGroupMock(id)
+}
+
+func (m *mockUserService) AddGroupMember(id primitive.ObjectID, userID primitive.ObjectID) error {
+	return m.AddGroupMemberMock(id, userID)
+}
+
+func (m *mockUserService) AddSubgroup(id primitive.ObjectID, subgroupID primitive.ObjectID) error {
+	return m.AddSubgroupMock(id, subgroupID)
+}
+
+func (m *mockUserService) SendVerificationEmail(userID primitive.ObjectID) error {
+	return m.SendVerificationEmailMock(userID)
+}
+
+func (m *mockUserService) RequestPasswordReset(email string) {
+	m.RequestPasswordResetMock(email)
+}
+
+func (m *mockUserService) ChangePassword(userID primitive.ObjectID, req *userpkg.ChangePasswordRequest) (*userpkg.TokenPair, error) {
+	return m.ChangePasswordMock(userID, req)
+}
+
+func (m *mockUserService) RevokeUserTokens(userID primitive.ObjectID) error {
+	return m.RevokeUserTokensMock(userID)
+}
+
+func (m *mockUserService) InOrg(orgID primitive.ObjectID) userpkg.Service {
+	m.ScopedOrgID = orgID
+	return m
+}
+
+func (m *mockUserService) RefreshTokens(refreshToken string) (*userpkg.TokenPair, error) {
+	return m.RefreshTokensMock(refreshToken)
+}
+
+func (m *mockUserService) RevokeAccessToken(userID primitive.ObjectID, jti string, exp interface{}) error {
+	return m.RevokeAccessTokenMock(userID, jti, exp)
+}
+
+func (m *mockUserService) RevokeRefreshToken(userID primitive.ObjectID, refreshToken string) error {
+	return m.RevokeRefreshTokenMock(userID, refreshToken)
+}
+
 func TestCreateUserHandler(t *testing.T) {
 	// Create a mock user service
 	mockUserService := &mockUserService{
@@ -37,6 +203,7 @@ func TestCreateUserHandler(t *testing.T) {
 
 	type testCase struct {
 		Name               string
+		CallerRole         string
 		RequestBody        userpkg.CreateRequest
 		ExpectedStatusCode int
 		ExpectedError      bool
@@ -71,6 +238,33 @@ func TestCreateUserHandler(t *testing.T) {
 			ExpectedError:      true,
 			ExpectedMessage:    "Email and password are required",
 		},
+		{
+			Name: "Create user with weak password",
+			RequestBody: userpkg.CreateRequest{
+				FirstName: "John",
+				LastName:  "Doe",
+				Email:     "john@example.com",
+				Role:      "admin",
+				Password:  "john",
+			},
+			ExpectedStatusCode: http.StatusBadRequest,
+			ExpectedError:      true,
+			ExpectedMessage:    "Password does not meet the password policy",
+		},
+		{
+			Name:       "Create user with a role above the caller",
+			CallerRole: userpkg.RoleSupport,
+			RequestBody: userpkg.CreateRequest{
+				FirstName: "John",
+				LastName:  "Doe",
+				Email:     "XXXXXXXXXXXXXXXXX",
+				Role:      "admin",
+				Password:  "strongpassword",
+			},
+			ExpectedStatusCode: http.StatusForbidden,
+			ExpectedError:      true,
+			ExpectedMessage:    "Cannot assign this role",
+		},
 	}
 
 	for _, tt := range tests {
@@ -98,6 +292,13 @@ func TestCreateUserHandler(t *testing.T) {
 
 			// Create a Gin router and set the route
 			router := gin.Default()
+			router.Use(func(c *gin.Context) {
+				callerRole := tt.CallerRole
+				if callerRole == "" {
+					callerRole = userpkg.RoleAdmin
+				}
+				c.Set("user", &userpkg.UserContext{ID: primitive.NewObjectID(), Role: callerRole})
+			})
 			router.POST("/api/user", createUserHandler(mockUserService))
 
 			// Serve the HTTP request and get the response
@@ -123,3 +324,989 @@ func TestCreateUserHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestSessionHandlers(t *testing.T) {
+	callerID := primitive.NewObjectID()
+	otherID := primitive.NewObjectID()
+	currentID := primitive.NewObjectID()
+	otherSessionID := primitive.NewObjectID()
+
+	type testCase struct {
+		Name               string
+		CallerRole         string
+		Method             string
+		Path               string
+		RevokeErr          error
+		ExpectedStatusCode int
+		// ExpectedUserID is the user whose sessions the service is asked about
+		ExpectedUserID primitive.ObjectID
+	}
+
+	tests := []testCase{
+		{
+			Name:               "List own sessions",
+			Method:             "GET",
+			Path:               "/api/user/me/sessions",
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedUserID:     callerID,
+		},
+		{
+			Name:               "List sessions of another user as admin",
+			CallerRole:         userpkg.RoleAdmin,
+			Method:             "GET",
+			Path:               "/api/user/" + otherID.Hex() + "/sessions",
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedUserID:     otherID,
+		},
+		{
+			Name:               "List sessions of another user",
+			Method:             "GET",
+			Path:               "/api/user/" + otherID.Hex() + "/sessions",
+			ExpectedStatusCode: http.StatusForbidden,
+		},
+		{
+			Name:               "Revoke own session",
+			Method:             "DELETE",
+			Path:               "/api/user/me/sessions/" + otherSessionID.Hex(),
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedUserID:     callerID,
+		},
+		{
+			Name:               "Revoke unknown session",
+			Method:             "DELETE",
+			Path:               "/api/user/me/sessions/" + otherSessionID.Hex(),
+			RevokeErr:          errors.New("session not found"),
+			ExpectedStatusCode: http.StatusNotFound,
+			ExpectedUserID:     callerID,
+		},
+		{
+			Name:               "Revoke session with invalid id",
+			Method:             "DELETE",
+			Path:               "/api/user/me/sessions/invalid",
+			ExpectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			Name:               "Revoke session of another user as admin",
+			CallerRole:         userpkg.RoleAdmin,
+			Method:             "DELETE",
+			Path:               "/api/user/" + otherID.Hex() + "/sessions/" + otherSessionID.Hex(),
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedUserID:     otherID,
+		},
+		{
+			Name:               "Revoke session of another user",
+			Method:             "DELETE",
+			Path:               "/api/user/" + otherID.Hex() + "/sessions/" + otherSessionID.Hex(),
+			ExpectedStatusCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			var calledFor primitive.ObjectID
+			mockUserService := &mockUserService{
+				GetUserMock: func(conds bson.M, opts *options.FindOneOptions) (*userpkg.User, error) {
+					return &userpkg.User{ID: otherID, Role: userpkg.RoleUser}, nil
+				},
+				GetSessionsMock: func(userID primitive.ObjectID) ([]userpkg.Session, error) {
+					calledFor = userID
+					return []userpkg.Session{{ID: currentID, UserID: userID}, {ID: otherSessionID, UserID: userID}}, nil
+				},
+				RevokeSessionMock: func(userID primitive.ObjectID, sessionID primitive.ObjectID) error {
+					calledFor = userID
+					assert.Equal(t, otherSessionID, sessionID)
+					return tt.RevokeErr
+				},
+			}
+
+			gin.SetMode(gin.TestMode)
+
+			req, err := http.NewRequest(tt.Method, tt.Path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+
+			router := gin.Default()
+			router.Use(func(c *gin.Context) {
+				callerRole := tt.CallerRole
+				if callerRole == "" {
+					callerRole = userpkg.RoleUser
+				}
+				c.Set("user", &userpkg.UserContext{ID: callerID, Role: callerRole, SessionID: currentID.Hex()})
+			})
+			router.GET("/api/user/:id/sessions", middleware.RequireSelfOrPermission(userpkg.ScopeProfileRead, userpkg.PermUsersRead), getSessionsHandler(mockUserService))
+			router.DELETE("/api/user/:id/sessions/:sessionId", middleware.RequireSelfOrPermission(userpkg.ScopeProfileWrite, userpkg.PermUsersWrite), revokeSessionHandler(mockUserService))
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.ExpectedStatusCode, rr.Code)
+			assert.Equal(t, tt.ExpectedUserID, calledFor)
+
+			if tt.Method == "GET" && rr.Code == http.StatusOK {
+				var response struct {
+					Data []userpkg.Session `json:"data"`
+				}
+				if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+					t.Fatal(err)
+				}
+				assert.Len(t, response.Data, 2)
+				//only the caller's own list points out the session they use
+				assert.Equal(t, tt.ExpectedUserID == callerID, response.Data[0].Current)
+				assert.False(t, response.Data[1].Current)
+			}
+		})
+	}
+}
+
+func TestImpersonateHandler(t *testing.T) {
+	adminID := primitive.NewObjectID()
+	userID := primitive.NewObjectID()
+
+	type testCase struct {
+		Name               string
+		Path               string
+		ImpersonateErr     error
+		ExpectedStatusCode int
+	}
+
+	tests := []testCase{
+		{
+			Name:               "Impersonate user",
+			Path:               "/api/user/" + userID.Hex() + "/impersonate",
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "Impersonate unknown user",
+			Path:               "/api/user/" + userID.Hex() + "/impersonate",
+			ImpersonateErr:     errors.New("user not found"),
+			ExpectedStatusCode: http.StatusNotFound,
+		},
+		{
+			Name:               "Impersonate user of the same role",
+			Path:               "/api/user/" + userID.Hex() + "/impersonate",
+			ImpersonateErr:     errors.New("cannot impersonate this user"),
+			ExpectedStatusCode: http.StatusForbidden,
+		},
+		{
+			Name:               "Impersonate with invalid id",
+			Path:               "/api/user/invalid/impersonate",
+			ExpectedStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			mockUserService := &mockUserService{
+				ImpersonateMock: func(actor *userpkg.UserContext, id primitive.ObjectID) (*userpkg.ImpersonationResponse, error) {
+					assert.Equal(t, adminID, actor.ID)
+					assert.Equal(t, userID, id)
+					if tt.ImpersonateErr != nil {
+						return nil, tt.ImpersonateErr
+					}
+					return &userpkg.ImpersonationResponse{AccessToken: "access", ExpiresIn: 900}, nil
+				},
+			}
+
+			gin.SetMode(gin.TestMode)
+
+			req, err := http.NewRequest("POST", tt.Path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+
+			router := gin.Default()
+			router.Use(func(c *gin.Context) {
+				c.Set("user", &userpkg.UserContext{ID: adminID, Role: userpkg.RoleAdmin})
+			})
+			router.POST("/api/user/:id/impersonate", impersonateHandler(mockUserService))
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.ExpectedStatusCode, rr.Code)
+		})
+	}
+}
+
+func TestInvitationHandlers(t *testing.T) {
+	adminID := primitive.NewObjectID()
+	invitationID := primitive.NewObjectID()
+
+	type testCase struct {
+		Name               string
+		Method             string
+		Path               string
+		RequestBody        *userpkg.InvitationRequest
+		ServiceErr         error
+		ExpectedStatusCode int
+		ExpectedRole       string
+	}
+
+	tests := []testCase{
+		{
+			Name:               "Invite user",
+			Method:             "POST",
+			Path:               "/api/invitations",
+			RequestBody:        &userpkg.InvitationRequest{Email: "new@example.com"},
+			ExpectedStatusCode: http.StatusCreated,
+			ExpectedRole:       userpkg.RoleUser,
+		},
+		{
+			Name:               "Invite support user",
+			Method:             "POST",
+			Path:               "/api/invitations",
+			RequestBody:        &userpkg.InvitationRequest{Email: "new@example.com", Role: "support"},
+			ExpectedStatusCode: http.StatusCreated,
+			ExpectedRole:       userpkg.RoleSupport,
+		},
+		{
+			Name:               "Invite with unknown role",
+			Method:             "POST",
+			Path:               "/api/invitations",
+			RequestBody:        &userpkg.InvitationRequest{Email: "new@example.com", Role: "owner"},
+			ExpectedStatusCode: http.StatusForbidden,
+		},
+		{
+			Name:               "Invite without email",
+			Method:             "POST",
+			Path:               "/api/invitations",
+			RequestBody:        &userpkg.InvitationRequest{},
+			ExpectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			Name:               "Invite existing user",
+			Method:             "POST",
+			Path:               "/api/invitations",
+			RequestBody:        &userpkg.InvitationRequest{Email: "admin@example.com"},
+			ServiceErr:         errors.New("user already exists"),
+			ExpectedStatusCode: http.StatusConflict,
+			ExpectedRole:       userpkg.RoleUser,
+		},
+		{
+			Name:               "Invite a member of the organization",
+			Method:             "POST",
+			Path:               "/api/invitations",
+			RequestBody:        &userpkg.InvitationRequest{Email: "member@example.com"},
+			ServiceErr:         errors.New("already a member"),
+			ExpectedStatusCode: http.StatusConflict,
+			ExpectedRole:       userpkg.RoleUser,
+		},
+		{
+			Name:               "Resend invitation",
+			Method:             "POST",
+			Path:               "/api/invitations/" + invitationID.Hex() + "/resend",
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "Resend accepted invitation",
+			Method:             "POST",
+			Path:               "/api/invitations/" + invitationID.Hex() + "/resend",
+			ServiceErr:         errors.New("invitation not found"),
+			ExpectedStatusCode: http.StatusNotFound,
+		},
+		{
+			Name:               "Revoke invitation",
+			Method:             "DELETE",
+			Path:               "/api/invitations/" + invitationID.Hex(),
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "Revoke invitation with invalid id",
+			Method:             "DELETE",
+			Path:               "/api/invitations/invalid",
+			ExpectedStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			mockUserService := &mockUserService{
+				InviteUserMock: func(invitedBy primitive.ObjectID, req *userpkg.InvitationRequest) (*userpkg.Invitation, error) {
+					assert.Equal(t, adminID, invitedBy)
+					assert.Equal(t, tt.ExpectedRole, req.Role)
+					if tt.ServiceErr != nil {
+						return nil, tt.ServiceErr
+					}
+					return &userpkg.Invitation{ID: invitationID, Email: req.Email, Role: req.Role}, nil
+				},
+				ResendInvitationMock: func(id primitive.ObjectID) (*userpkg.Invitation, error) {
+					assert.Equal(t, invitationID, id)
+					if tt.ServiceErr != nil {
+						return nil, tt.ServiceErr
+					}
+					return &userpkg.Invitation{ID: invitationID}, nil
+				},
+				RevokeInvitationMock: func(id primitive.ObjectID) error {
+					assert.Equal(t, invitationID, id)
+					return tt.ServiceErr
+				},
+			}
+
+			gin.SetMode(gin.TestMode)
+
+			var body []byte
+			if tt.RequestBody != nil {
+				body, _ = json.Marshal(tt.RequestBody)
+			}
+			req, err := http.NewRequest(tt.Method, tt.Path, bytes.NewBuffer(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+
+			router := gin.Default()
+			router.Use(func(c *gin.Context) {
+				c.Set("user", &userpkg.UserContext{ID: adminID, Role: userpkg.RoleAdmin})
+			})
+			router.POST("/api/invitations", createInvitationHandler(mockUserService))
+			router.POST("/api/invitations/:id/resend", resendInvitationHandler(mockUserService))
+			router.DELETE("/api/invitations/:id", revokeInvitationHandler(mockUserService))
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.ExpectedStatusCode, rr.Code)
+		})
+	}
+}
+
+func TestOrganizationHandlers(t *testing.T) {
+	callerID := primitive.NewObjectID()
+	memberID := primitive.NewObjectID()
+	orgID := primitive.NewObjectID()
+	otherOrgID := primitive.NewObjectID()
+	sessionID := primitive.NewObjectID().Hex()
+
+	type testCase struct {
+		Name               string
+		Method             string
+		Path               string
+		Body               any
+		ServiceErr         error
+		ExpectedStatusCode int
+		// ExpectedOrgID is the organization the service is scoped or switched to
+		ExpectedOrgID primitive.ObjectID
+	}
+
+	tests := []testCase{
+		{
+			Name:               "List users of the organization",
+			Method:             "GET",
+			Path:               "/api/user",
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedOrgID:      orgID,
+		},
+		{
+			Name:               "Get user outside of the organization",
+			Method:             "GET",
+			Path:               "/api/user/" + memberID.Hex(),
+			ServiceErr:         mongo.ErrNoDocuments,
+			ExpectedStatusCode: http.StatusNotFound,
+			ExpectedOrgID:      orgID,
+		},
+		{
+			Name:               "Change email of a user in other organizations",
+			Method:             "PUT",
+			Path:               "/api/user/" + memberID.Hex(),
+			Body:               &userpkg.UpdateRequest{Email: "new@example.com"},
+			ExpectedStatusCode: http.StatusForbidden,
+			ExpectedOrgID:      orgID,
+		},
+		{
+			Name:               "Change role of a member",
+			Method:             "PUT",
+			Path:               "/api/user/" + memberID.Hex(),
+			Body:               &userpkg.UpdateRequest{Role: userpkg.RoleSupport},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedOrgID:      orgID,
+		},
+		{
+			Name:               "Delete member",
+			Method:             "DELETE",
+			Path:               "/api/user/" + memberID.Hex(),
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedOrgID:      orgID,
+		},
+		{
+			Name:               "Add member",
+			Method:             "POST",
+			Path:               "/api/orgs/" + otherOrgID.Hex() + "/members",
+			Body:               &userpkg.MembershipRequest{Email: "member@example.com", Role: "admin"},
+			ExpectedStatusCode: http.StatusCreated,
+			ExpectedOrgID:      otherOrgID,
+		},
+		{
+			Name:               "Add member to unknown organization",
+			Method:             "POST",
+			Path:               "/api/orgs/" + otherOrgID.Hex() + "/members",
+			Body:               &userpkg.MembershipRequest{Email: "member@example.com"},
+			ServiceErr:         errors.New("organization not found"),
+			ExpectedStatusCode: http.StatusNotFound,
+			ExpectedOrgID:      otherOrgID,
+		},
+		{
+			Name:               "Add existing member",
+			Method:             "POST",
+			Path:               "/api/orgs/" + otherOrgID.Hex() + "/members",
+			Body:               &userpkg.MembershipRequest{Email: "member@example.com"},
+			ServiceErr:         errors.New("already a member"),
+			ExpectedStatusCode: http.StatusConflict,
+			ExpectedOrgID:      otherOrgID,
+		},
+		{
+			Name:               "Add member with unknown role",
+			Method:             "POST",
+			Path:               "/api/orgs/" + otherOrgID.Hex() + "/members",
+			Body:               &userpkg.MembershipRequest{Email: "member@example.com", Role: "owner"},
+			ExpectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			Name:               "Switch organization",
+			Method:             "POST",
+			Path:               "/api/auth/switch-organization",
+			Body:               &userpkg.SwitchOrganizationRequest{OrgID: otherOrgID.Hex()},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedOrgID:      otherOrgID,
+		},
+		{
+			Name:               "Switch to organization of others",
+			Method:             "POST",
+			Path:               "/api/auth/switch-organization",
+			Body:               &userpkg.SwitchOrganizationRequest{OrgID: otherOrgID.Hex()},
+			ServiceErr:         errors.New("not a member"),
+			ExpectedStatusCode: http.StatusForbidden,
+			ExpectedOrgID:      otherOrgID,
+		},
+		{
+			Name:               "Leave organization",
+			Method:             "POST",
+			Path:               "/api/auth/switch-organization",
+			Body:               &userpkg.SwitchOrganizationRequest{},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "Switch with invalid organization",
+			Method:             "POST",
+			Path:               "/api/auth/switch-organization",
+			Body:               &userpkg.SwitchOrganizationRequest{OrgID: "invalid"},
+			ExpectedStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			var calledFor primitive.ObjectID
+			mockUserService := &mockUserService{
+				GetUsersMock: func(conds bson.M, opts *options.FindOptions) ([]userpkg.User, error) {
+					return []userpkg.User{}, nil
+				},
+				GetUserMock: func(conds bson.M, opts *options.FindOneOptions) (*userpkg.User, error) {
+					if tt.ServiceErr != nil {
+						return nil, tt.ServiceErr
+					}
+					return &userpkg.User{ID: memberID, Role: userpkg.RoleUser, Memberships: []userpkg.Membership{{OrgID: orgID}, {OrgID: otherOrgID}}}, nil
+				},
+				UpdateUserMock: func(conds bson.M, update bson.M, opts *options.UpdateOptions) (any, error) {
+					return &mongo.UpdateResult{MatchedCount: 1}, nil
+				},
+				DeleteUserMock: func(conds bson.M) (any, error) {
+					return &mongo.DeleteResult{DeletedCount: 1}, nil
+				},
+				AddMemberMock: func(id primitive.ObjectID, req *userpkg.MembershipRequest) error {
+					calledFor = id
+					return tt.ServiceErr
+				},
+				SwitchOrganizationMock: func(userID primitive.ObjectID, sid string, id primitive.ObjectID) (*userpkg.AccessTokenResponse, error) {
+					assert.Equal(t, callerID, userID)
+					assert.Equal(t, sessionID, sid)
+					calledFor = id
+					if tt.ServiceErr != nil {
+						return nil, tt.ServiceErr
+					}
+					return &userpkg.AccessTokenResponse{AccessToken: "access", ExpiresIn: 3600}, nil
+				},
+			}
+
+			gin.SetMode(gin.TestMode)
+
+			var body []byte
+			if tt.Body != nil {
+				body, _ = json.Marshal(tt.Body)
+			}
+			req, err := http.NewRequest(tt.Method, tt.Path, bytes.NewBuffer(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+
+			router := gin.Default()
+			router.Use(func(c *gin.Context) {
+				c.Set("user", &userpkg.UserContext{ID: callerID, Role: userpkg.RoleAdmin, SessionID: sessionID, OrgID: orgID, AuthTime: time.Now().Unix()})
+			})
+			router.GET("/api/user", getUsersHandler(mockUserService))
+			router.GET("/api/user/:id", getUserHandler(mockUserService))
+			router.PUT("/api/user/:id", updateUserHandler(mockUserService))
+			router.DELETE("/api/user/:id", deleteUserHandler(mockUserService))
+			router.POST("/api/orgs/:orgId/members", addMemberHandler(mockUserService))
+			router.POST("/api/auth/switch-organization", switchOrganizationHandler(mockUserService))
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.ExpectedStatusCode, rr.Code)
+			if calledFor.IsZero() {
+				calledFor = mockUserService.ScopedOrgID
+			}
+			assert.Equal(t, tt.ExpectedOrgID, calledFor)
+		})
+	}
+}
+
+func TestOrgAdminOnPlatformUser(t *testing.T) {
+	callerID := primitive.NewObjectID()
+	adminID := primitive.NewObjectID()
+	orgID := primitive.NewObjectID()
+	otherOrgID := primitive.NewObjectID()
+
+	type testCase struct {
+		Name               string
+		Method             string
+		Path               string
+		Body               any
+		Memberships        []userpkg.Membership
+		ExpectedStatusCode int
+		ExpectedChange     bool
+	}
+
+	onlyHere := []userpkg.Membership{{OrgID: orgID, Role: userpkg.RoleUser}}
+	tests := []testCase{
+		{
+			Name:               "Change email of a platform admin",
+			Method:             "PUT",
+			Path:               "/api/user/" + adminID.Hex(),
+			Body:               &userpkg.UpdateRequest{Email: "attacker@example.com"},
+			Memberships:        onlyHere,
+			ExpectedStatusCode: http.StatusForbidden,
+		},
+		{
+			Name:               "Block a platform admin",
+			Method:             "PUT",
+			Path:               "/api/user/" + adminID.Hex(),
+			Body:               map[string]any{"isBlocked": true},
+			Memberships:        onlyHere,
+			ExpectedStatusCode: http.StatusForbidden,
+		},
+		{
+			Name:               "Reset MFA of a platform admin",
+			Method:             "DELETE",
+			Path:               "/api/user/" + adminID.Hex() + "/mfa",
+			Memberships:        onlyHere,
+			ExpectedStatusCode: http.StatusForbidden,
+		},
+		{
+			Name:               "Delete a platform admin",
+			Method:             "DELETE",
+			Path:               "/api/user/" + adminID.Hex(),
+			Memberships:        onlyHere,
+			ExpectedStatusCode: http.StatusForbidden,
+		},
+		{
+			Name:               "Rename a platform admin",
+			Method:             "PUT",
+			Path:               "/api/user/" + adminID.Hex(),
+			Body:               &userpkg.UpdateRequest{FirstName: "Jane"},
+			Memberships:        onlyHere,
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedChange:     true,
+		},
+		{
+			Name:               "Remove a platform admin belonging to other organizations",
+			Method:             "DELETE",
+			Path:               "/api/user/" + adminID.Hex(),
+			Memberships:        append(onlyHere, userpkg.Membership{OrgID: otherOrgID, Role: userpkg.RoleAdmin}),
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedChange:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			changed := false
+			mockUserService := &mockUserService{
+				GetUserMock: func(conds bson.M, opts *options.FindOneOptions) (*userpkg.User, error) {
+					return &userpkg.User{ID: adminID, Role: userpkg.RoleAdmin, Memberships: tt.Memberships}, nil
+				},
+				UpdateUserMock: func(conds bson.M, update bson.M, opts *options.UpdateOptions) (any, error) {
+					changed = true
+					return &mongo.UpdateResult{MatchedCount: 1, ModifiedCount: 1}, nil
+				},
+				DeleteUserMock: func(conds bson.M) (any, error) {
+					changed = true
+					return &mongo.DeleteResult{DeletedCount: 1}, nil
+				},
+			}
+
+			gin.SetMode(gin.TestMode)
+
+			var body []byte
+			if tt.Body != nil {
+				body, _ = json.Marshal(tt.Body)
+			}
+			req, err := http.NewRequest(tt.Method, tt.Path, bytes.NewBuffer(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+
+			router := gin.Default()
+			router.Use(func(c *gin.Context) {
+				c.Set("user", &userpkg.UserContext{ID: callerID, Role: userpkg.RoleAdmin, OrgID: orgID, AuthTime: time.Now().Unix()})
+			})
+			router.PUT("/api/user/:id", updateUserHandler(mockUserService))
+			router.DELETE("/api/user/:id", deleteUserHandler(mockUserService))
+			router.DELETE("/api/user/:id/mfa", resetMFAHandler(mockUserService))
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.ExpectedStatusCode, rr.Code)
+			assert.Equal(t, tt.ExpectedChange, changed)
+		})
+	}
+}
+
+func TestGroupHandlers(t *testing.T) {
+	callerID := primitive.NewObjectID()
+	groupID := primitive.NewObjectID()
+	adminGroupID := primitive.NewObjectID()
+	memberID := primitive.NewObjectID()
+
+	type testCase struct {
+		Name               string
+		CallerRole         string
+		Method             string
+		Path               string
+		Body               any
+		ServiceErr         error
+		ExpectedStatusCode int
+	}
+
+	tests := []testCase{
+		{
+			Name:               "Create group",
+			Method:             "POST",
+			Path:               "/api/groups",
+			Body:               &userpkg.GroupRequest{Name: "Support", Role: "support", Permissions: []string{userpkg.PermAPIKeysManage}},
+			ExpectedStatusCode: http.StatusCreated,
+		},
+		{
+			Name:               "Create group without name",
+			Method:             "POST",
+			Path:               "/api/groups",
+			Body:               &userpkg.GroupRequest{Role: userpkg.RoleSupport},
+			ExpectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			Name:               "Create existing group",
+			Method:             "POST",
+			Path:               "/api/groups",
+			Body:               &userpkg.GroupRequest{Name: "Support"},
+			ServiceErr:         errors.New("group already exists"),
+			ExpectedStatusCode: http.StatusConflict,
+		},
+		{
+			Name:               "Create group granting a role above the caller",
+			CallerRole:         userpkg.RoleSupport,
+			Method:             "POST",
+			Path:               "/api/groups",
+			Body:               &userpkg.GroupRequest{Name: "Admins", Role: userpkg.RoleAdmin},
+			ExpectedStatusCode: http.StatusForbidden,
+		},
+		{
+			Name:               "Create group granting a permission the caller lacks",
+			CallerRole:         userpkg.RoleSupport,
+			Method:             "POST",
+			Path:               "/api/groups",
+			Body:               &userpkg.GroupRequest{Name: "Deleters", Permissions: []string{userpkg.PermUsersDelete}},
+			ExpectedStatusCode: http.StatusForbidden,
+		},
+		{
+			Name:               "Add member",
+			Method:             "POST",
+			Path:               "/api/groups/" + groupID.Hex() + "/members",
+			Body:               &userpkg.GroupMemberRequest{UserID: memberID.Hex()},
+			ExpectedStatusCode: http.StatusCreated,
+		},
+		{
+			Name:               "Add unknown member",
+			Method:             "POST",
+			Path:               "/api/groups/" + groupID.Hex() + "/members",
+			Body:               &userpkg.GroupMemberRequest{UserID: memberID.Hex()},
+			ServiceErr:         errors.New("user not found"),
+			ExpectedStatusCode: http.StatusNotFound,
+		},
+		{
+			Name:               "Add member with invalid id",
+			Method:             "POST",
+			Path:               "/api/groups/" + groupID.Hex() + "/members",
+			Body:               &userpkg.GroupMemberRequest{UserID: "invalid"},
+			ExpectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			Name:               "Add member to a group granting a role above the caller",
+			CallerRole:         userpkg.RoleSupport,
+			Method:             "POST",
+			Path:               "/api/groups/" + adminGroupID.Hex() + "/members",
+			Body:               &userpkg.GroupMemberRequest{UserID: callerID.Hex()},
+			ExpectedStatusCode: http.StatusForbidden,
+		},
+		{
+			Name:               "Nest group",
+			Method:             "POST",
+			Path:               "/api/groups/" + adminGroupID.Hex() + "/groups",
+			Body:               &userpkg.SubgroupRequest{GroupID: groupID.Hex()},
+			ExpectedStatusCode: http.StatusCreated,
+		},
+		{
+			Name:               "Nest group in itself",
+			Method:             "POST",
+			Path:               "/api/groups/" + groupID.Hex() + "/groups",
+			Body:               &userpkg.SubgroupRequest{GroupID: adminGroupID.Hex()},
+			ServiceErr:         errors.New("group cycle"),
+			ExpectedStatusCode: http.StatusConflict,
+		},
+		{
+			Name:               "Nest group in unknown group",
+			Method:             "POST",
+			Path:               "/api/groups/" + primitive.NewObjectID().Hex() + "/groups",
+			Body:               &userpkg.SubgroupRequest{GroupID: groupID.Hex()},
+			ExpectedStatusCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			mockUserService := &mockUserService{
+				CreateGroupMock: func(req *userpkg.GroupRequest) (*userpkg.Group, error) {
+					if tt.ServiceErr != nil {
+						return nil, tt.ServiceErr
+					}
+					return &userpkg.Group{ID: groupID, Name: req.Name, Role: req.Role, Permissions: req.Permissions}, nil
+				},
+				GetGroupMock: func(id primitive.ObjectID) (*userpkg.Group, error) {
+					switch id {
+					case groupID:
+						return &userpkg.Group{ID: groupID, Role: userpkg.RoleSupport}, nil
+					case adminGroupID:
+						return &userpkg.Group{ID: adminGroupID, Role: userpkg.RoleAdmin}, nil
+					}
+					return nil, errors.New("group not found")
+				},
+				AddGroupMemberMock: func(id primitive.ObjectID, userID primitive.ObjectID) error {
+					assert.Equal(t, memberID, userID)
+					return tt.ServiceErr
+				},
+				AddSubgroupMock: func(id primitive.ObjectID, subgroupID primitive.ObjectID) error {
+					return tt.ServiceErr
+				},
+			}
+
+			gin.SetMode(gin.TestMode)
+
+			body, _ := json.Marshal(tt.Body)
+			req, err := http.NewRequest(tt.Method, tt.Path, bytes.NewBuffer(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+
+			router := gin.Default()
+			router.Use(func(c *gin.Context) {
+				callerRole := tt.CallerRole
+				if callerRole == "" {
+					callerRole = userpkg.RoleAdmin
+				}
+				c.Set("user", &userpkg.UserContext{ID: callerID, Role: callerRole})
+			})
+			router.POST("/api/groups", createGroupHandler(mockUserService))
+			router.POST("/api/groups/:id/members", addGroupMemberHandler(mockUserService))
+			router.POST("/api/groups/:id/groups", addSubgroupHandler(mockUserService))
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.ExpectedStatusCode, rr.Code)
+		})
+	}
+}
+
+func TestUpdateUserHandlerRecentAuth(t *testing.T) {
+	userID := primitive.NewObjectID()
+	staleAuth := time.Now().Add(-time.Hour).Unix()
+
+	type testCase struct {
+		Name               string
+		Caller             *userpkg.UserContext
+		Path               string
+		RequestBody        *userpkg.UpdateRequest
+		ExpectedStatusCode int
+	}
+
+	tests := []testCase{
+		{
+			Name:               "Rename self long after login",
+			Caller:             &userpkg.UserContext{ID: userID, Role: userpkg.RoleUser, AuthTime: staleAuth},
+			Path:               "/api/user/me",
+			RequestBody:        &userpkg.UpdateRequest{FirstName: "Jane"},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "Rename with an api key",
+			Caller:             &userpkg.UserContext{ID: primitive.NewObjectID(), Role: userpkg.RoleAdmin, AuthMethod: userpkg.AuthMethodAPIKey, Scopes: []string{userpkg.PermUsersWrite}},
+			Path:               "/api/user/" + userID.Hex(),
+			RequestBody:        &userpkg.UpdateRequest{FirstName: "Jane"},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "Change email long after login",
+			Caller:             &userpkg.UserContext{ID: userID, Role: userpkg.RoleUser, AuthTime: staleAuth},
+			Path:               "/api/user/me",
+			RequestBody:        &userpkg.UpdateRequest{Email: "new@example.com"},
+			ExpectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			Name:               "Change email right after login",
+			Caller:             &userpkg.UserContext{ID: userID, Role: userpkg.RoleUser, AuthTime: time.Now().Unix()},
+			Path:               "/api/user/me",
+			RequestBody:        &userpkg.UpdateRequest{Email: "new@example.com"},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "Change role with an api key",
+			Caller:             &userpkg.UserContext{ID: primitive.NewObjectID(), Role: userpkg.RoleAdmin, AuthMethod: userpkg.AuthMethodAPIKey, Scopes: []string{userpkg.PermUsersWrite}},
+			Path:               "/api/user/" + userID.Hex(),
+			RequestBody:        &userpkg.UpdateRequest{Role: userpkg.RoleSupport},
+			ExpectedStatusCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			mockUserService := &mockUserService{
+				GetUserMock: func(conds bson.M, opts *options.FindOneOptions) (*userpkg.User, error) {
+					return &userpkg.User{ID: userID, Role: userpkg.RoleUser}, nil
+				},
+				UpdateUserMock: func(conds bson.M, update bson.M, opts *options.UpdateOptions) (any, error) {
+					return &mongo.UpdateResult{MatchedCount: 1, ModifiedCount: 1}, nil
+				},
+				SendVerificationEmailMock: func(id primitive.ObjectID) error {
+					return nil
+				},
+			}
+
+			gin.SetMode(gin.TestMode)
+
+			body, _ := json.Marshal(tt.RequestBody)
+			req, err := http.NewRequest("PUT", tt.Path, bytes.NewBuffer(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+
+			router := gin.Default()
+			router.Use(func(c *gin.Context) {
+				c.Set("user", tt.Caller)
+			})
+			router.PUT("/api/user/:id", middleware.RequireSelfOrPermission(userpkg.ScopeProfileWrite, userpkg.PermUsersWrite), updateUserHandler(mockUserService))
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.ExpectedStatusCode, rr.Code)
+		})
+	}
+}
+
+func TestUpdateUserHandlerRevocation(t *testing.T) {
+	userID := primitive.NewObjectID()
+	blocked := true
+
+	type testCase struct {
+		Name               string
+		Caller             *userpkg.UserContext
+		RequestBody        *userpkg.UpdateRequest
+		ExpectedStatusCode int
+		ExpectedRevoked    bool
+	}
+
+	admin := &userpkg.UserContext{ID: primitive.NewObjectID(), Role: userpkg.RoleAdmin, AuthTime: time.Now().Unix()}
+	tests := []testCase{
+		{
+			Name:               "Rename",
+			Caller:             admin,
+			RequestBody:        &userpkg.UpdateRequest{FirstName: "Jane"},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "Change the platform role",
+			Caller:             admin,
+			RequestBody:        &userpkg.UpdateRequest{Role: userpkg.RoleSupport},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedRevoked:    true,
+		},
+		{
+			Name:               "Change the role in an organization",
+			Caller:             &userpkg.UserContext{ID: admin.ID, Role: userpkg.RoleAdmin, AuthTime: admin.AuthTime, OrgID: primitive.NewObjectID()},
+			RequestBody:        &userpkg.UpdateRequest{Role: userpkg.RoleSupport},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "Block",
+			Caller:             admin,
+			RequestBody:        &userpkg.UpdateRequest{IsBlocked: &blocked},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedRevoked:    true,
+		},
+		{
+			Name:               "Update nothing",
+			Caller:             admin,
+			RequestBody:        &userpkg.UpdateRequest{},
+			ExpectedStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			revoked := false
+			mockUserService := &mockUserService{
+				GetUserMock: func(conds bson.M, opts *options.FindOneOptions) (*userpkg.User, error) {
+					return &userpkg.User{ID: userID, Role: userpkg.RoleUser}, nil
+				},
+				UpdateUserMock: func(conds bson.M, update bson.M, opts *options.UpdateOptions) (any, error) {
+					return &mongo.UpdateResult{MatchedCount: 1, ModifiedCount: 1}, nil
+				},
+				RevokeUserTokensMock: func(id primitive.ObjectID) error {
+					assert.Equal(t, userID, id)
+					revoked = true
+					return nil
+				},
+			}
+
+			gin.SetMode(gin.TestMode)
+
+			body, _ := json.Marshal(tt.RequestBody)
+			req, err := http.NewRequest("PUT", "/api/user/"+userID.Hex(), bytes.NewBuffer(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+
+			router := gin.Default()
+			router.Use(func(c *gin.Context) {
+				c.Set("user", tt.Caller)
+			})
+			router.PUT("/api/user/:id", updateUserHandler(mockUserService))
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.ExpectedStatusCode, rr.Code)
+			assert.Equal(t, tt.ExpectedRevoked, revoked)
+		})
+	}
+}
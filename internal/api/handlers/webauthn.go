@@ -0,0 +1,289 @@
+package handlers
+
+import (
+	"mahi-go-explorer/internal/api/middleware"
+	"mahi-go-explorer/internal/api/response"
+	webauthnpkg "mahi-go-explorer/pkg/webauthn"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// WebAuthnRoutes defines the passkey routes. A passkey logs the user in on
+// its own, or answers the MFA challenge of a password login. Adding or
+// removing one needs a recent login, an access token alone is not enough.
+func WebAuthnRoutes(r *gin.Engine, was webauthnpkg.Service, authenticate gin.HandlerFunc) {
+	webauthn := r.Group("/api/auth/webauthn")
+	{
+		webauthn.POST("/login/begin", beginPasskeyLoginHandler(was))
+		webauthn.POST("/login/finish", finishPasskeyLoginHandler(was))
+		webauthn.POST("/mfa/begin", beginPasskeyMFAHandler(was))
+		webauthn.POST("/mfa/finish", finishPasskeyMFAHandler(was))
+	}
+
+	authenticated := r.Group("/api/auth/webauthn")
+	authenticated.Use(authenticate, requireTokenAuth())
+	{
+		authenticated.POST("/register/begin", middleware.BlockImpersonation(), requireRecentAuth(), beginPasskeyRegistrationHandler(was))
+		authenticated.POST("/register/finish", middleware.BlockImpersonation(), requireRecentAuth(), finishPasskeyRegistrationHandler(was))
+		authenticated.GET("/credentials", getPasskeysHandler(was))
+		authenticated.DELETE("/credentials/:id", middleware.BlockImpersonation(), requireRecentAuth(), deletePasskeyHandler(was))
+	}
+}
+
+func beginPasskeyRegistrationHandler(was webauthnpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		ceremony, err := was.BeginRegistration(cu.ID)
+		if err != nil {
+			switch err.Error() {
+			case "user not found":
+				response.LogAndErrorResponse(c, http.StatusNotFound, "User Not Found", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Internal Server Error", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusOK, ceremony)
+	}
+}
+
+func finishPasskeyRegistrationHandler(was webauthnpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		//bind the request
+		var req webauthnpkg.FinishRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+			return
+		}
+
+		//validate required fields
+		if req.SessionID == "" || len(req.Credential) == 0 {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Session id and credential are required", nil)
+			return
+		}
+
+		credential, err := was.FinishRegistration(cu.ID, &req)
+		if err != nil {
+			switch err.Error() {
+			case "invalid session":
+				response.LogAndErrorResponse(c, http.StatusBadRequest, "Registration expired, please try again", err)
+				return
+			case "invalid credential":
+				response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid passkey", err)
+				return
+			case "credential already registered":
+				response.LogAndErrorResponse(c, http.StatusConflict, "Passkey already registered", err)
+				return
+			case "user not found":
+				response.LogAndErrorResponse(c, http.StatusNotFound, "User Not Found", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Internal Server Error", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusCreated, credential)
+	}
+}
+
+func getPasskeysHandler(was webauthnpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		credentials, err := was.GetCredentials(cu.ID)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Internal Server Error", err)
+			return
+		}
+
+		response.SuccessResponse(c, http.StatusOK, credentials)
+	}
+}
+
+func deletePasskeyHandler(was webauthnpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, err := getUserContext(c)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get user context", err)
+			return
+		}
+
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Invalid ID", err)
+			return
+		}
+
+		if err := was.DeleteCredential(cu.ID, id); err != nil {
+			switch err.Error() {
+			case "credential not found":
+				response.LogAndErrorResponse(c, http.StatusNotFound, "Passkey Not Found", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Internal Server Error", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusOK, nil)
+	}
+}
+
+func beginPasskeyLoginHandler(was webauthnpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		//bind the request, the body is optional
+		var req webauthnpkg.BeginLoginRequest
+		if c.Request.ContentLength > 0 {
+			if err := c.ShouldBindJSON(&req); err != nil {
+				response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+				return
+			}
+		}
+
+		ceremony, err := was.BeginLogin(&req)
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Internal Server Error", err)
+			return
+		}
+
+		response.SuccessResponse(c, http.StatusOK, ceremony)
+	}
+}
+
+func finishPasskeyLoginHandler(was webauthnpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		//bind the request
+		var req webauthnpkg.FinishRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+			return
+		}
+
+		//validate required fields
+		if req.SessionID == "" || len(req.Credential) == 0 {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Session id and credential are required", nil)
+			return
+		}
+
+		req.ClientInfo = clientInfo(c)
+
+		tokens, err := was.FinishLogin(&req)
+		if err != nil {
+			switch err.Error() {
+			case "invalid session":
+				response.LogAndErrorResponse(c, http.StatusBadRequest, "Login expired, please try again", err)
+				return
+			case "invalid credential", "credential cloned":
+				response.LogAndErrorResponse(c, http.StatusUnauthorized, "Invalid passkey", err)
+				return
+			case "user is blocked":
+				response.LogAndErrorResponse(c, http.StatusForbidden, "User Is Blocked", err)
+				return
+			case "email not verified":
+				response.LogAndErrorResponse(c, http.StatusForbidden, "Email Not Verified", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Internal Server Error", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusOK, tokens)
+	}
+}
+
+func beginPasskeyMFAHandler(was webauthnpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		//bind the request
+		var req webauthnpkg.BeginMFARequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+			return
+		}
+
+		//validate required fields
+		if req.MFAToken == "" {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "MFA token is required", nil)
+			return
+		}
+
+		ceremony, err := was.BeginMFA(&req)
+		if err != nil {
+			switch err.Error() {
+			case "invalid mfa token", "user not found":
+				response.LogAndErrorResponse(c, http.StatusUnauthorized, "Invalid or expired MFA token", err)
+				return
+			case "no passkeys registered":
+				response.LogAndErrorResponse(c, http.StatusBadRequest, "No passkeys registered", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Internal Server Error", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusOK, ceremony)
+	}
+}
+
+func finishPasskeyMFAHandler(was webauthnpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		//bind the request
+		var req webauthnpkg.FinishRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Bad Request", err)
+			return
+		}
+
+		//validate required fields
+		if req.SessionID == "" || req.MFAToken == "" || len(req.Credential) == 0 {
+			response.LogAndErrorResponse(c, http.StatusBadRequest, "Session id, MFA token and credential are required", nil)
+			return
+		}
+
+		req.ClientInfo = clientInfo(c)
+
+		tokens, err := was.FinishMFA(&req)
+		if err != nil {
+			switch err.Error() {
+			case "invalid session":
+				response.LogAndErrorResponse(c, http.StatusBadRequest, "Login expired, please try again", err)
+				return
+			case "invalid mfa token", "user not found":
+				response.LogAndErrorResponse(c, http.StatusUnauthorized, "Invalid or expired MFA token", err)
+				return
+			case "invalid credential", "credential cloned":
+				response.LogAndErrorResponse(c, http.StatusUnauthorized, "Invalid passkey", err)
+				return
+			case "user is blocked":
+				response.LogAndErrorResponse(c, http.StatusForbidden, "User Is Blocked", err)
+				return
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Internal Server Error", err)
+				return
+			}
+		}
+
+		response.SuccessResponse(c, http.StatusOK, tokens)
+	}
+}
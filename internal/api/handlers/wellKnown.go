@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"mahi-go-explorer/internal/api/response"
+	oauthpkg "mahi-go-explorer/pkg/oauth"
+	tokenpkg "mahi-go-explorer/pkg/token"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// WellKnownRoutes defines the public discovery routes
+func WellKnownRoutes(r *gin.Engine, ks tokenpkg.KeyService, oas oauthpkg.Service) {
+	wellKnown := r.Group("/.well-known")
+	{
+		wellKnown.GET("/jwks.json", jwksHandler(ks))
+		wellKnown.GET("/openid-configuration", openIDConfigurationHandler(oas))
+	}
+}
+
+func jwksHandler(ks tokenpkg.KeyService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		jwks, err := ks.JWKS()
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Failed to get keys", err)
+			return
+		}
+
+		//verifiers expect a bare key set, not the api response envelope
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(http.StatusOK, jwks)
+	}
+}
+
+func openIDConfigurationHandler(oas oauthpkg.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "public, max-age=3600")
+		c.JSON(http.StatusOK, oas.Metadata())
+	}
+}
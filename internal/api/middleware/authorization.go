@@ -0,0 +1,168 @@
+package middleware
+
+import (
+	"errors"
+	"mahi-go-explorer/internal/api/response"
+	userpkg "mahi-go-explorer/pkg/user"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequireRole checks if the authenticated user ranks at least as high as role.
+// It panics on an unknown role, which would rank lowest and let everyone in.
+func RequireRole(role string) gin.HandlerFunc {
+	if !userpkg.IsValidRole(role) {
+		panic("middleware: RequireRole with unknown role " + strconv.Quote(role))
+	}
+
+	return func(c *gin.Context) {
+		cu, ok := currentUser(c)
+		if !ok {
+			return
+		}
+
+		if !cu.HasRole(role) {
+			response.LogAndErrorResponse(c, http.StatusForbidden, "Forbidden", errors.New("role "+role+" required"))
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// RequirePermission checks if the authenticated user has the permission
+func RequirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, ok := currentUser(c)
+		if !ok {
+			return
+		}
+
+		if !cu.HasPermission(permission) {
+			response.LogAndErrorResponse(c, http.StatusForbidden, "Forbidden", errors.New("permission "+permission+" required"))
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// RequireScope checks the scopes of the request allow the self-service scope
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, ok := currentUser(c)
+		if !ok {
+			return
+		}
+
+		if !cu.HasScope(scope) {
+			response.LogAndErrorResponse(c, http.StatusForbidden, "Forbidden", errors.New("scope "+scope+" required"))
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// RequireSelfOrPermission lets users act on their own :id (or "me") within
+// the self-service scope, anyone else needs the permission
+func RequireSelfOrPermission(scope string, permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, ok := currentUser(c)
+		if !ok {
+			return
+		}
+
+		id := c.Param("id")
+		if id == "me" || id == cu.ID.Hex() {
+			if !cu.HasScope(scope) {
+				response.LogAndErrorResponse(c, http.StatusForbidden, "Forbidden", errors.New("scope "+scope+" required"))
+				c.Abort()
+				return
+			}
+			c.Next()
+			return
+		}
+
+		if !cu.HasPermission(permission) {
+			response.LogAndErrorResponse(c, http.StatusForbidden, "Forbidden", errors.New("permission "+permission+" required"))
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// BlockImpersonation keeps admins acting as a user from taking actions
+// only the user should take
+func BlockImpersonation() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, ok := currentUser(c)
+		if !ok {
+			return
+		}
+
+		if cu.IsImpersonated() {
+			response.LogAndErrorResponse(c, http.StatusForbidden, "Not allowed while impersonating", errors.New("admin "+cu.Actor.ID.Hex()+" impersonating user "+cu.ID.Hex()))
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// ReauthRequired is the error body telling clients to reauthenticate at
+// /api/auth/reauth & retry
+type ReauthRequired struct {
+	Code   string `json:"code"`
+	MaxAge int64  `json:"maxAge"`
+}
+
+// RequireRecentAuth checks the user proved who they are in the last maxAge,
+// api keys never did. The challenge follows RFC 9470.
+func RequireRecentAuth(maxAge time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cu, ok := currentUser(c)
+		if !ok {
+			return
+		}
+
+		if !cu.AuthenticatedWithin(maxAge) {
+			ReauthRequiredResponse(c, maxAge)
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// ReauthRequiredResponse writes the reauthentication challenge, for handlers
+// that only need a recent authentication for some changes
+func ReauthRequiredResponse(c *gin.Context, maxAge time.Duration) {
+	secs := int64(maxAge.Seconds())
+	c.Header("WWW-Authenticate", `Bearer error="insufficient_user_authentication", error_description="A more recent authentication is required", max_age=`+strconv.FormatInt(secs, 10))
+	response.ValidationErrorResponse(c, http.StatusUnauthorized, "Reauthentication required", ReauthRequired{Code: "reauthentication_required", MaxAge: secs})
+}
+
+// currentUser gets the authenticated user, aborting the request when there is none
+func currentUser(c *gin.Context) (*userpkg.UserContext, bool) {
+	userContext, ok := c.Get("user")
+	if ok {
+		if cu, ok := userContext.(*userpkg.UserContext); ok {
+			return cu, true
+		}
+	}
+
+	response.LogAndErrorResponse(c, http.StatusUnauthorized, "Unauthorized", errors.New("user context missing"))
+	c.Abort()
+	return nil, false
+}
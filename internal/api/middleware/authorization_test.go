@@ -0,0 +1,239 @@
+package middleware
+
+import (
+	"encoding/json"
+	userpkg "mahi-go-explorer/pkg/user"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestAuthorization(t *testing.T) {
+	self := primitive.NewObjectID()
+	other := primitive.NewObjectID()
+
+	type testCase struct {
+		Name               string
+		Role               string
+		Actor              *userpkg.Actor
+		Scopes             []string
+		Middleware         gin.HandlerFunc
+		Path               string
+		ExpectedStatusCode int
+	}
+
+	tests := []testCase{
+		{
+			Name:               "Admin has permission",
+			Role:               userpkg.RoleAdmin,
+			Middleware:         RequirePermission(userpkg.PermUsersDelete),
+			Path:               "/users/" + other.Hex(),
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "User lacks permission",
+			Role:               userpkg.RoleUser,
+			Middleware:         RequirePermission(userpkg.PermUsersRead),
+			Path:               "/users/" + other.Hex(),
+			ExpectedStatusCode: http.StatusForbidden,
+		},
+		{
+			Name:               "Support meets support role",
+			Role:               userpkg.RoleSupport,
+			Middleware:         RequireRole(userpkg.RoleSupport),
+			Path:               "/users/" + other.Hex(),
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "Support below admin role",
+			Role:               userpkg.RoleSupport,
+			Middleware:         RequireRole(userpkg.RoleAdmin),
+			Path:               "/users/" + other.Hex(),
+			ExpectedStatusCode: http.StatusForbidden,
+		},
+		{
+			Name:               "User acts on self",
+			Role:               userpkg.RoleUser,
+			Middleware:         RequireSelfOrPermission(userpkg.ScopeProfileWrite, userpkg.PermUsersWrite),
+			Path:               "/users/" + self.Hex(),
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "User acts on me",
+			Role:               userpkg.RoleUser,
+			Middleware:         RequireSelfOrPermission(userpkg.ScopeProfileWrite, userpkg.PermUsersWrite),
+			Path:               "/users/me",
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "User acts on someone else",
+			Role:               userpkg.RoleUser,
+			Middleware:         RequireSelfOrPermission(userpkg.ScopeProfileWrite, userpkg.PermUsersWrite),
+			Path:               "/users/" + other.Hex(),
+			ExpectedStatusCode: http.StatusForbidden,
+		},
+		{
+			Name:               "Key without the profile scope acts on self",
+			Role:               userpkg.RoleUser,
+			Scopes:             []string{},
+			Middleware:         RequireSelfOrPermission(userpkg.ScopeProfileWrite, userpkg.PermUsersWrite),
+			Path:               "/users/me",
+			ExpectedStatusCode: http.StatusForbidden,
+		},
+		{
+			Name:               "Key with the profile scope acts on self",
+			Role:               userpkg.RoleUser,
+			Scopes:             []string{userpkg.ScopeProfileWrite},
+			Middleware:         RequireSelfOrPermission(userpkg.ScopeProfileWrite, userpkg.PermUsersWrite),
+			Path:               "/users/me",
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "Profile scope does not reach someone else",
+			Role:               userpkg.RoleAdmin,
+			Scopes:             []string{userpkg.ScopeProfileWrite},
+			Middleware:         RequireSelfOrPermission(userpkg.ScopeProfileWrite, userpkg.PermUsersWrite),
+			Path:               "/users/" + other.Hex(),
+			ExpectedStatusCode: http.StatusForbidden,
+		},
+		{
+			Name:               "Key with the read scope",
+			Role:               userpkg.RoleUser,
+			Scopes:             []string{userpkg.ScopeProfileRead},
+			Middleware:         RequireScope(userpkg.ScopeProfileRead),
+			Path:               "/users/me",
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "Key without the read scope",
+			Role:               userpkg.RoleUser,
+			Scopes:             []string{userpkg.PermUsersRead},
+			Middleware:         RequireScope(userpkg.ScopeProfileRead),
+			Path:               "/users/me",
+			ExpectedStatusCode: http.StatusForbidden,
+		},
+		{
+			Name:               "Login is not limited by scopes",
+			Role:               userpkg.RoleUser,
+			Middleware:         RequireScope(userpkg.ScopeProfileRead),
+			Path:               "/users/me",
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "User acts without impersonation",
+			Role:               userpkg.RoleUser,
+			Middleware:         BlockImpersonation(),
+			Path:               "/users/me",
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "Admin impersonates user",
+			Role:               userpkg.RoleUser,
+			Actor:              &userpkg.Actor{ID: other},
+			Middleware:         BlockImpersonation(),
+			Path:               "/users/me",
+			ExpectedStatusCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+
+			router := gin.New()
+			router.Use(func(c *gin.Context) {
+				c.Set("user", &userpkg.UserContext{ID: self, Role: tt.Role, Actor: tt.Actor, Scopes: tt.Scopes})
+			})
+			router.GET("/users/:id", tt.Middleware, func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			req, err := http.NewRequest("GET", tt.Path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.ExpectedStatusCode, rr.Code)
+		})
+	}
+}
+
+func TestRequireRoleRejectsUnknownRole(t *testing.T) {
+	assert.Panics(t, func() { RequireRole("superuser") })
+	assert.NotPanics(t, func() { RequireRole(userpkg.RoleAdmin) })
+}
+
+func TestRequireRecentAuth(t *testing.T) {
+	type testCase struct {
+		Name               string
+		AuthTime           time.Time
+		ExpectedStatusCode int
+	}
+
+	tests := []testCase{
+		{
+			Name:               "Recently authenticated",
+			AuthTime:           time.Now().Add(-time.Minute),
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "Authenticated too long ago",
+			AuthTime:           time.Now().Add(-10 * time.Minute),
+			ExpectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			Name:               "Never authenticated, like an api key",
+			ExpectedStatusCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+
+			user := &userpkg.UserContext{ID: primitive.NewObjectID(), Role: userpkg.RoleUser}
+			if !tt.AuthTime.IsZero() {
+				user.AuthTime = tt.AuthTime.Unix()
+			}
+
+			router := gin.New()
+			router.Use(func(c *gin.Context) {
+				c.Set("user", user)
+			})
+			router.DELETE("/users/:id", RequireRecentAuth(5*time.Minute), func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			req, err := http.NewRequest("DELETE", "/users/me", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.ExpectedStatusCode, rr.Code)
+			if tt.ExpectedStatusCode != http.StatusUnauthorized {
+				return
+			}
+
+			//clients learn what to do from the body or the challenge
+			assert.Contains(t, rr.Header().Get("WWW-Authenticate"), `error="insufficient_user_authentication"`)
+			assert.Contains(t, rr.Header().Get("WWW-Authenticate"), "max_age=300")
+
+			var response struct {
+				Errors ReauthRequired `json:"errors"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, ReauthRequired{Code: "reauthentication_required", MaxAge: 300}, response.Errors)
+		})
+	}
+}
@@ -2,21 +2,31 @@ package middleware
 
 import (
 	"errors"
+	"log"
 	"mahi-go-explorer/internal/api/response"
-	"mahi-go-explorer/internal/config"
+	apikeypkg "mahi-go-explorer/pkg/apikey"
+	tokenpkg "mahi-go-explorer/pkg/token"
 	userpkg "mahi-go-explorer/pkg/user"
 	"net/http"
 	"strings"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-// Authenticate checks if user is authenticated
-func Authenticate() gin.HandlerFunc {
+// Authenticate checks if user is authenticated, either by a token that
+// passes the token policy & is not revoked or by an api key in
+// "Authorization: ApiKey ..." or "X-API-Key"
+func Authenticate(s userpkg.Service, ts tokenpkg.Service, aks apikeypkg.Service) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		//get auth header
 		authHeader := c.GetHeader("Authorization")
+		if key := apiKeyFromRequest(c, authHeader); key != "" {
+			authenticateAPIKey(c, s, aks, key)
+			return
+		}
+
 		if authHeader == "" {
 			response.LogAndErrorResponse(c, http.StatusUnauthorized, "Authorization header reqired", errors.New("Auth header required"))
 			c.Abort()
@@ -31,52 +41,182 @@ func Authenticate() gin.HandlerFunc {
 			return
 		}
 
-		//verify by jwt secret
-		secret := config.GetFromEnv("JWT_SECRET")
-
-		token, err := jwt.ParseWithClaims(tokenParts[1], &userpkg.JwtClaims{}, func(t *jwt.Token) (interface{}, error) {
-			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, errors.New("Invalid signing method")
+		//verify the token & check issuer, audience & lifetime
+		claims := &userpkg.JwtClaims{}
+		if err := ts.Verify(tokenParts[1], claims); err != nil {
+			switch err.Error() {
+			case "token expired":
+				response.LogAndErrorResponse(c, http.StatusUnauthorized, "Token expired", err)
+			default:
+				response.LogAndErrorResponse(c, http.StatusUnauthorized, "Invalid token", err)
 			}
-			return []byte(secret), nil
-		})
-		if err != nil {
-			response.LogAndErrorResponse(c, http.StatusUnauthorized, "Invalid token", err)
 			c.Abort()
 			return
 		}
 
-		if !token.Valid {
-			response.LogAndErrorResponse(c, http.StatusUnauthorized, "Invalid token", errors.New("Invalid token"))
+		userID, err := claims.UserID()
+		if err != nil {
+			response.LogAndErrorResponse(c, http.StatusUnauthorized, "Invalid token", err)
 			c.Abort()
 			return
 		}
 
-		claims, ok := token.Claims.(*userpkg.JwtClaims)
-		if !ok {
-			response.LogAndErrorResponse(c, http.StatusUnauthorized, "Invalid token claims", errors.New("Invalid token claims"))
+		//check the token has not been revoked
+		if err := s.CheckTokenRevocation(userID, claims.ID, claims.UserSession(), claims.IssuedAt.Unix()); err != nil {
+			switch err.Error() {
+			case "token revoked", "user not found", "user is blocked":
+				response.LogAndErrorResponse(c, http.StatusUnauthorized, "Token revoked", err)
+			default:
+				response.LogAndErrorResponse(c, http.StatusInternalServerError, "Internal Server Error", err)
+			}
 			c.Abort()
 			return
 		}
 
-		//check token expiration
-		if claims.ExpiresAt > jwt.TimeFunc().Unix() {
-			response.LogAndErrorResponse(c, http.StatusUnauthorized, "Token expired", errors.New("Token expired"))
-			c.Abort()
-			return
+		//check the session the token was issued to is still logged in
+		if claims.SessionID != "" {
+			if err := s.CheckSession(claims.SessionID); err != nil {
+				switch err.Error() {
+				case "session revoked":
+					response.LogAndErrorResponse(c, http.StatusUnauthorized, "Token revoked", err)
+				default:
+					response.LogAndErrorResponse(c, http.StatusInternalServerError, "Internal Server Error", err)
+				}
+				c.Abort()
+				return
+			}
 		}
 
 		user := &userpkg.UserContext{
-			ID:        claims.ID,
+			ID:        userID,
 			FirstName: claims.FirstName,
 			LastName:  claims.LastName,
 			Email:     claims.Email,
 			Role:      claims.Role,
-			Exp:       claims.ExpiresAt,
+			Exp:       claims.ExpiresAt.Unix(),
+			TokenID:   claims.ID,
+			SessionID: claims.SessionID,
+			Actor:     claims.Act,
+			AMR:       claims.AMR,
+
+			EmailVerified: claims.EmailVerified,
+			AuthMethod:    userpkg.AuthMethodToken,
+		}
+		if claims.AuthTime != nil {
+			user.AuthTime = claims.AuthTime.Unix()
+		}
+		//in an organization the user has the role they have there
+		if claims.OrgID != "" {
+			orgID, err := primitive.ObjectIDFromHex(claims.OrgID)
+			if err != nil {
+				response.LogAndErrorResponse(c, http.StatusUnauthorized, "Invalid token", err)
+				c.Abort()
+				return
+			}
+			user.OrgID = orgID
+			user.Role = claims.OrgRole
+		}
+		if !applyGroupGrants(c, s, user) {
+			return
 		}
 
 		c.Set("user", user)
 
 		c.Next()
+
+		//every request made as someone else ends up in the audit trail
+		if user.IsImpersonated() {
+			err := s.RecordImpersonation(&userpkg.ImpersonationRecord{
+				ActorID: user.Actor.ID,
+				UserID:  user.ID,
+				TokenID: user.TokenID,
+				Action:  c.Request.Method + " " + c.Request.URL.Path,
+				Status:  c.Writer.Status(),
+				IP:      c.ClientIP(),
+			})
+			if err != nil {
+				log.Printf("Failed to record impersonated request of admin %s: %v", user.Actor.ID.Hex(), err)
+			}
+		}
+	}
+}
+
+// applyGroupGrants adds what the groups of the user grant in their
+// organization, writing the error response when they cannot be resolved
+func applyGroupGrants(c *gin.Context, s userpkg.Service, user *userpkg.UserContext) bool {
+	grants, err := s.GroupGrants(user.ID, user.OrgID)
+	if err != nil {
+		response.LogAndErrorResponse(c, http.StatusInternalServerError, "Internal Server Error", err)
+		c.Abort()
+		return false
+	}
+
+	if userpkg.RoleRank(grants.Role) > userpkg.RoleRank(user.Role) {
+		user.Role = grants.Role
+	}
+	user.Permissions = grants.Permissions
+	return true
+}
+
+func apiKeyFromRequest(c *gin.Context, authHeader string) string {
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		return key
 	}
+	if strings.HasPrefix(authHeader, "ApiKey ") {
+		return strings.TrimSpace(strings.TrimPrefix(authHeader, "ApiKey "))
+	}
+	return ""
+}
+
+// authenticateAPIKey sets the key owner as the user, limited to the key's scopes
+func authenticateAPIKey(c *gin.Context, s userpkg.Service, aks apikeypkg.Service, key string) {
+	apiKey, err := aks.Authenticate(key)
+	if err != nil {
+		switch err.Error() {
+		case "invalid api key":
+			response.LogAndErrorResponse(c, http.StatusUnauthorized, "Invalid API key", err)
+		default:
+			response.LogAndErrorResponse(c, http.StatusInternalServerError, "Internal Server Error", err)
+		}
+		c.Abort()
+		return
+	}
+
+	owner, err := s.GetUser(bson.M{"_id": apiKey.UserID}, nil)
+	if err != nil || owner.IsBlocked {
+		response.LogAndErrorResponse(c, http.StatusUnauthorized, "Invalid API key", errors.New("api key owner not found or blocked"))
+		c.Abort()
+		return
+	}
+
+	user := &userpkg.UserContext{
+		ID:        owner.ID,
+		FirstName: owner.FirstName,
+		LastName:  owner.LastName,
+		Email:     owner.Email,
+		Role:      owner.Role,
+
+		EmailVerified: owner.EmailVerified,
+		AuthMethod:    userpkg.AuthMethodAPIKey,
+		APIKeyID:      apiKey.ID.Hex(),
+		Scopes:        apiKey.Scopes,
+	}
+	//a key made in an organization stops working once the owner leaves it
+	if !apiKey.OrgID.IsZero() {
+		m := owner.Membership(apiKey.OrgID)
+		if m == nil {
+			response.LogAndErrorResponse(c, http.StatusUnauthorized, "Invalid API key", errors.New("api key owner left the organization"))
+			c.Abort()
+			return
+		}
+		user.OrgID = apiKey.OrgID
+		user.Role = m.Role
+	}
+	if !applyGroupGrants(c, s, user) {
+		return
+	}
+
+	c.Set("user", user)
+
+	c.Next()
 }
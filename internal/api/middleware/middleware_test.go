@@ -0,0 +1,561 @@
+package middleware
+
+import (
+	"errors"
+	apikeypkg "mahi-go-explorer/pkg/apikey"
+	tokenpkg "mahi-go-explorer/pkg/token"
+	userpkg "mahi-go-explorer/pkg/user"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type mockUserService struct {
+	userpkg.Service
+	GetUserMock              func(conds bson.M, opts *options.FindOneOptions) (*userpkg.User, error)
+	CheckTokenRevocationMock func(userID primitive.ObjectID, jti string, sessionID string, issuedAt int64) error
+	CheckSessionMock         func(sessionID string) error
+	RecordImpersonationMock  func(record *userpkg.ImpersonationRecord) error
+	GroupGrantsMock          func(userID primitive.ObjectID, orgID primitive.ObjectID) (*userpkg.GroupGrants, error)
+}
+
+func (m *mockUserService) GetUser(conds bson.M, opts *options.FindOneOptions) (*userpkg.User, error) {
+	return m.GetUserMock(conds, opts)
+}
+
+func (m *mockUserService) CheckTokenRevocation(userID primitive.ObjectID, jti string, sessionID string, issuedAt int64) error {
+	return m.CheckTokenRevocationMock(userID, jti, sessionID, issuedAt)
+}
+
+func (m *mockUserService) CheckSession(sessionID string) error {
+	return m.CheckSessionMock(sessionID)
+}
+
+func (m *mockUserService) RecordImpersonation(record *userpkg.ImpersonationRecord) error {
+	return m.RecordImpersonationMock(record)
+}
+
+// GroupGrants grants nothing unless mocked, most users are in no group
+func (m *mockUserService) GroupGrants(userID primitive.ObjectID, orgID primitive.ObjectID) (*userpkg.GroupGrants, error) {
+	if m.GroupGrantsMock == nil {
+		return &userpkg.GroupGrants{}, nil
+	}
+	return m.GroupGrantsMock(userID, orgID)
+}
+
+// mockKeyService verifies tokens signed with a fixed secret
+type mockKeyService struct {
+	tokenpkg.KeyService
+	secret []byte
+}
+
+func (m *mockKeyService) Keyfunc(t *jwt.Token) (interface{}, error) {
+	return m.secret, nil
+}
+
+var testPolicy = &tokenpkg.Policy{
+	Issuer:    "https://auth.example.com",
+	Audiences: []string{"api"},
+	Audience:  "api",
+	TTL:       time.Hour,
+	Leeway:    time.Minute,
+}
+
+// signTestToken signs the claims for the user as the policy issues them
+func signTestToken(t *testing.T, ks *mockKeyService, userID primitive.ObjectID, claims userpkg.JwtClaims) (string, userpkg.JwtClaims) {
+	claims.RegisteredClaims = testPolicy.RegisteredClaims(userID.Hex(), testPolicy.TTL)
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(ks.secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token, claims
+}
+
+type mockAPIKeyService struct {
+	apikeypkg.Service
+	AuthenticateMock func(key string) (*apikeypkg.APIKey, error)
+}
+
+func (m *mockAPIKeyService) Authenticate(key string) (*apikeypkg.APIKey, error) {
+	return m.AuthenticateMock(key)
+}
+
+func TestAuthenticateAPIKey(t *testing.T) {
+	owner := &userpkg.User{ID: primitive.NewObjectID(), Email: "svc@example.com", Role: userpkg.RoleAdmin}
+	keyID := primitive.NewObjectID()
+
+	userService := &mockUserService{
+		GetUserMock: func(conds bson.M, opts *options.FindOneOptions) (*userpkg.User, error) {
+			return owner, nil
+		},
+	}
+	apiKeyService := &mockAPIKeyService{
+		AuthenticateMock: func(key string) (*apikeypkg.APIKey, error) {
+			if key != "mge_valid_secret" {
+				return nil, errors.New("invalid api key")
+			}
+			return &apikeypkg.APIKey{ID: keyID, UserID: owner.ID, Scopes: []string{userpkg.PermUsersRead}}, nil
+		},
+	}
+
+	type testCase struct {
+		Name               string
+		Headers            map[string]string
+		ExpectedStatusCode int
+	}
+
+	tests := []testCase{
+		{
+			Name:               "Key in X-API-Key header",
+			Headers:            map[string]string{"X-API-Key": "mge_valid_secret"},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "Key in Authorization header",
+			Headers:            map[string]string{"Authorization": "ApiKey mge_valid_secret"},
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "Invalid key",
+			Headers:            map[string]string{"X-API-Key": "mge_wrong_secret"},
+			ExpectedStatusCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+
+			var cu *userpkg.UserContext
+			router := gin.New()
+			router.GET("/", Authenticate(userService, nil, apiKeyService), func(c *gin.Context) {
+				cu, _ = currentUser(c)
+				c.Status(http.StatusOK)
+			})
+
+			req, err := http.NewRequest("GET", "/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tt.Headers {
+				req.Header.Set(k, v)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.ExpectedStatusCode, rr.Code)
+			if tt.ExpectedStatusCode != http.StatusOK {
+				return
+			}
+
+			//the key acts as its owner, limited to its scopes
+			assert.Equal(t, owner.ID, cu.ID)
+			assert.Equal(t, userpkg.AuthMethodAPIKey, cu.AuthMethod)
+			assert.Equal(t, keyID.Hex(), cu.APIKeyID)
+			assert.True(t, cu.HasPermission(userpkg.PermUsersRead))
+			assert.False(t, cu.HasPermission(userpkg.PermUsersDelete))
+		})
+	}
+}
+
+func TestAuthenticateSession(t *testing.T) {
+	keyService := &mockKeyService{secret: []byte("test-secret")}
+	userID := primitive.NewObjectID()
+	liveSession := primitive.NewObjectID().Hex()
+
+	userService := &mockUserService{
+		CheckTokenRevocationMock: func(id primitive.ObjectID, jti string, sessionID string, issuedAt int64) error {
+			return nil
+		},
+		CheckSessionMock: func(sessionID string) error {
+			if sessionID != liveSession {
+				return errors.New("session revoked")
+			}
+			return nil
+		},
+	}
+
+	type testCase struct {
+		Name               string
+		SessionID          string
+		ExpectedStatusCode int
+	}
+
+	tests := []testCase{
+		{
+			Name:               "Token of a live session",
+			SessionID:          liveSession,
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "Token of a revoked session",
+			SessionID:          primitive.NewObjectID().Hex(),
+			ExpectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			Name:               "Token without a session",
+			ExpectedStatusCode: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+
+			token, _ := signTestToken(t, keyService, userID, userpkg.JwtClaims{Role: userpkg.RoleUser, SessionID: tt.SessionID})
+
+			var cu *userpkg.UserContext
+			router := gin.New()
+			router.GET("/", Authenticate(userService, tokenpkg.NewJWTService(keyService, testPolicy), nil), func(c *gin.Context) {
+				cu, _ = currentUser(c)
+				c.Status(http.StatusOK)
+			})
+
+			req, err := http.NewRequest("GET", "/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.ExpectedStatusCode, rr.Code)
+			if tt.ExpectedStatusCode == http.StatusOK {
+				assert.Equal(t, tt.SessionID, cu.SessionID)
+			}
+		})
+	}
+}
+
+func TestAuthenticateImpersonation(t *testing.T) {
+	keyService := &mockKeyService{secret: []byte("test-secret")}
+	userID := primitive.NewObjectID()
+	adminID := primitive.NewObjectID()
+
+	type testCase struct {
+		Name            string
+		Act             *userpkg.Actor
+		ExpectedRecords int
+	}
+
+	tests := []testCase{
+		{
+			Name:            "Impersonated request is recorded",
+			Act:             &userpkg.Actor{ID: adminID, Email: "admin@example.com"},
+			ExpectedRecords: 1,
+		},
+		{
+			Name: "Own request is not recorded",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+
+			var records []*userpkg.ImpersonationRecord
+			userService := &mockUserService{
+				CheckTokenRevocationMock: func(id primitive.ObjectID, jti string, sessionID string, issuedAt int64) error {
+					return nil
+				},
+				RecordImpersonationMock: func(record *userpkg.ImpersonationRecord) error {
+					records = append(records, record)
+					return nil
+				},
+			}
+
+			token, claims := signTestToken(t, keyService, userID, userpkg.JwtClaims{Role: userpkg.RoleUser, Act: tt.Act})
+
+			var cu *userpkg.UserContext
+			router := gin.New()
+			router.GET("/users/me", Authenticate(userService, tokenpkg.NewJWTService(keyService, testPolicy), nil), func(c *gin.Context) {
+				cu, _ = currentUser(c)
+				c.Status(http.StatusNoContent)
+			})
+
+			req, err := http.NewRequest("GET", "/users/me", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, http.StatusNoContent, rr.Code)
+			assert.Equal(t, userID, cu.ID)
+			assert.Equal(t, tt.Act, cu.Actor)
+			assert.Len(t, records, tt.ExpectedRecords)
+			if tt.ExpectedRecords > 0 {
+				assert.Equal(t, adminID, records[0].ActorID)
+				assert.Equal(t, userID, records[0].UserID)
+				assert.Equal(t, claims.ID, records[0].TokenID)
+				assert.Equal(t, "GET /users/me", records[0].Action)
+				assert.Equal(t, http.StatusNoContent, records[0].Status)
+			}
+		})
+	}
+}
+
+func TestAuthenticateTokenPolicy(t *testing.T) {
+	keyService := &mockKeyService{secret: []byte("test-secret")}
+	userService := &mockUserService{
+		CheckTokenRevocationMock: func(id primitive.ObjectID, jti string, sessionID string, issuedAt int64) error {
+			return nil
+		},
+	}
+
+	type testCase struct {
+		Name string
+		// Prepare changes the claims before the token is signed
+		Prepare            func(c *jwt.RegisteredClaims)
+		ExpectedStatusCode int
+	}
+
+	tests := []testCase{
+		{
+			Name:               "Valid token",
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Name:               "Expired token",
+			Prepare:            func(c *jwt.RegisteredClaims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Hour)) },
+			ExpectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			Name:               "Token for another service",
+			Prepare:            func(c *jwt.RegisteredClaims) { c.Audience = jwt.ClaimStrings{"billing"} },
+			ExpectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			Name:               "Token with a subject that is not a user",
+			Prepare:            func(c *jwt.RegisteredClaims) { c.Subject = "client" },
+			ExpectedStatusCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+
+			claims := userpkg.JwtClaims{Role: userpkg.RoleUser}
+			claims.RegisteredClaims = testPolicy.RegisteredClaims(primitive.NewObjectID().Hex(), testPolicy.TTL)
+			if tt.Prepare != nil {
+				tt.Prepare(&claims.RegisteredClaims)
+			}
+			token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(keyService.secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			router := gin.New()
+			router.GET("/", Authenticate(userService, tokenpkg.NewJWTService(keyService, testPolicy), nil), func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			req, err := http.NewRequest("GET", "/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.ExpectedStatusCode, rr.Code)
+		})
+	}
+}
+
+func TestAuthenticateOrganization(t *testing.T) {
+	keyService := &mockKeyService{secret: []byte("test-secret")}
+	orgID := primitive.NewObjectID()
+	otherOrgID := primitive.NewObjectID()
+	owner := &userpkg.User{
+		ID:          primitive.NewObjectID(),
+		Role:        userpkg.RoleUser,
+		Memberships: []userpkg.Membership{{OrgID: orgID, Role: userpkg.RoleAdmin}},
+	}
+
+	userService := &mockUserService{
+		GetUserMock: func(conds bson.M, opts *options.FindOneOptions) (*userpkg.User, error) {
+			return owner, nil
+		},
+		CheckTokenRevocationMock: func(id primitive.ObjectID, jti string, sessionID string, issuedAt int64) error {
+			return nil
+		},
+	}
+	apiKeyService := &mockAPIKeyService{
+		AuthenticateMock: func(key string) (*apikeypkg.APIKey, error) {
+			switch key {
+			case "mge_org_secret":
+				return &apikeypkg.APIKey{ID: primitive.NewObjectID(), UserID: owner.ID, OrgID: orgID}, nil
+			case "mge_left_secret":
+				return &apikeypkg.APIKey{ID: primitive.NewObjectID(), UserID: owner.ID, OrgID: otherOrgID}, nil
+			}
+			return nil, errors.New("invalid api key")
+		},
+	}
+
+	orgToken, _ := signTestToken(t, keyService, owner.ID, userpkg.JwtClaims{Role: userpkg.RoleUser, OrgID: orgID.Hex(), OrgRole: userpkg.RoleAdmin})
+	plainToken, _ := signTestToken(t, keyService, owner.ID, userpkg.JwtClaims{Role: userpkg.RoleUser})
+	badToken, _ := signTestToken(t, keyService, owner.ID, userpkg.JwtClaims{Role: userpkg.RoleUser, OrgID: "not-an-id", OrgRole: userpkg.RoleAdmin})
+
+	type testCase struct {
+		Name               string
+		Headers            map[string]string
+		ExpectedStatusCode int
+		ExpectedOrgID      primitive.ObjectID
+		ExpectedRole       string
+	}
+
+	tests := []testCase{
+		{
+			Name:               "Token in an organization",
+			Headers:            map[string]string{"Authorization": "Bearer " + orgToken},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedOrgID:      orgID,
+			ExpectedRole:       userpkg.RoleAdmin,
+		},
+		{
+			Name:               "Token outside of organizations",
+			Headers:            map[string]string{"Authorization": "Bearer " + plainToken},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedRole:       userpkg.RoleUser,
+		},
+		{
+			Name:               "Token with an invalid organization",
+			Headers:            map[string]string{"Authorization": "Bearer " + badToken},
+			ExpectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			Name:               "Key of an organization",
+			Headers:            map[string]string{"X-API-Key": "mge_org_secret"},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedOrgID:      orgID,
+			ExpectedRole:       userpkg.RoleAdmin,
+		},
+		{
+			Name:               "Key of an organization the owner left",
+			Headers:            map[string]string{"X-API-Key": "mge_left_secret"},
+			ExpectedStatusCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+
+			var cu *userpkg.UserContext
+			router := gin.New()
+			router.GET("/", Authenticate(userService, tokenpkg.NewJWTService(keyService, testPolicy), apiKeyService), func(c *gin.Context) {
+				cu, _ = currentUser(c)
+				c.Status(http.StatusOK)
+			})
+
+			req, err := http.NewRequest("GET", "/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tt.Headers {
+				req.Header.Set(k, v)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.ExpectedStatusCode, rr.Code)
+			if tt.ExpectedStatusCode != http.StatusOK {
+				return
+			}
+
+			//the role is the one the user has in the organization
+			assert.Equal(t, tt.ExpectedOrgID, cu.OrgID)
+			assert.Equal(t, tt.ExpectedRole, cu.Role)
+		})
+	}
+}
+
+func TestAuthenticateGroupGrants(t *testing.T) {
+	keyService := &mockKeyService{secret: []byte("test-secret")}
+	userID := primitive.NewObjectID()
+
+	type testCase struct {
+		Name               string
+		Role               string
+		Grants             *userpkg.GroupGrants
+		GrantsErr          error
+		ExpectedStatusCode int
+		ExpectedRole       string
+	}
+
+	tests := []testCase{
+		{
+			Name:               "Role from a group",
+			Role:               userpkg.RoleUser,
+			Grants:             &userpkg.GroupGrants{Role: userpkg.RoleSupport, Permissions: []string{userpkg.PermAPIKeysManage}},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedRole:       userpkg.RoleSupport,
+		},
+		{
+			Name:               "Group role below the own role",
+			Role:               userpkg.RoleAdmin,
+			Grants:             &userpkg.GroupGrants{Role: userpkg.RoleSupport, Permissions: []string{userpkg.PermAPIKeysManage}},
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedRole:       userpkg.RoleAdmin,
+		},
+		{
+			Name:               "Groups cannot be resolved",
+			Role:               userpkg.RoleUser,
+			GrantsErr:          errors.New("connection refused"),
+			ExpectedStatusCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+
+			userService := &mockUserService{
+				CheckTokenRevocationMock: func(id primitive.ObjectID, jti string, sessionID string, issuedAt int64) error {
+					return nil
+				},
+				GroupGrantsMock: func(id primitive.ObjectID, orgID primitive.ObjectID) (*userpkg.GroupGrants, error) {
+					assert.Equal(t, userID, id)
+					return tt.Grants, tt.GrantsErr
+				},
+			}
+
+			token, _ := signTestToken(t, keyService, userID, userpkg.JwtClaims{Role: tt.Role})
+
+			var cu *userpkg.UserContext
+			router := gin.New()
+			router.GET("/", Authenticate(userService, tokenpkg.NewJWTService(keyService, testPolicy), nil), func(c *gin.Context) {
+				cu, _ = currentUser(c)
+				c.Status(http.StatusOK)
+			})
+
+			req, err := http.NewRequest("GET", "/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.ExpectedStatusCode, rr.Code)
+			if tt.ExpectedStatusCode != http.StatusOK {
+				return
+			}
+
+			//the highest role wins, the group permissions come on top
+			assert.Equal(t, tt.ExpectedRole, cu.Role)
+			assert.True(t, cu.HasPermission(userpkg.PermAPIKeysManage))
+		})
+	}
+}
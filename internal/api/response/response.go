@@ -12,6 +12,7 @@ type APIResponse struct {
 	Success bool   `json:"success"`
 	Data    any    `json:"data"`
 	Message string `json:"message,omitempty"`
+	Errors  any    `json:"errors,omitempty"`
 }
 
 // SuccessResponse defines a success response
@@ -37,3 +38,12 @@ func LogAndErrorResponse(c *gin.Context, code int, message string, err error) {
 	}
 	ErrorResponse(c, code, message)
 }
+
+// ValidationErrorResponse defines an error response with field level errors
+func ValidationErrorResponse(c *gin.Context, code int, message string, errors any) {
+	resp := new(APIResponse)
+	resp.Success = false
+	resp.Message = message
+	resp.Errors = errors
+	c.JSON(code, resp)
+}
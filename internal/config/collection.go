@@ -2,12 +2,58 @@ package config
 
 // Collection is the collection names
 type Collection struct {
-	UserCollection string
+	UserCollection               string
+	RefreshTokenCollection       string
+	RevokedTokenCollection       string
+	SessionCollection            string
+	ImpersonationLogCollection   string
+	InvitationCollection         string
+	OrganizationCollection       string
+	GroupCollection              string
+	SigningKeyCollection         string
+	MFAChallengeCollection       string
+	PasswordResetCollection      string
+	MagicLinkCollection          string
+	LoginAttemptCollection       string
+	APIKeyCollection             string
+	OAuthClientCollection        string
+	OAuthCodeCollection          string
+	OAuthConsentCollection       string
+	OAuthRefreshTokenCollection  string
+	OIDCStateCollection          string
+	SAMLRequestCollection        string
+	SAMLAssertionCollection      string
+	SAMLLoginCollection          string
+	WebAuthnCredentialCollection string
+	WebAuthnSessionCollection    string
 }
 
 // CreateCollection creates a new collection
 func CreateCollection() *Collection {
 	return &Collection{
-		UserCollection: "users",
+		UserCollection:               "users",
+		RefreshTokenCollection:       "refreshTokens",
+		RevokedTokenCollection:       "revokedTokens",
+		SessionCollection:            "sessions",
+		ImpersonationLogCollection:   "impersonationLogs",
+		InvitationCollection:         "invitations",
+		OrganizationCollection:       "organizations",
+		GroupCollection:              "groups",
+		SigningKeyCollection:         "signingKeys",
+		MFAChallengeCollection:       "mfaChallenges",
+		PasswordResetCollection:      "passwordResets",
+		MagicLinkCollection:          "magicLinks",
+		LoginAttemptCollection:       "loginAttempts",
+		APIKeyCollection:             "apiKeys",
+		OAuthClientCollection:        "oauthClients",
+		OAuthCodeCollection:          "oauthCodes",
+		OAuthConsentCollection:       "oauthConsents",
+		OAuthRefreshTokenCollection:  "oauthRefreshTokens",
+		OIDCStateCollection:          "oidcStates",
+		SAMLRequestCollection:        "samlRequests",
+		SAMLAssertionCollection:      "samlAssertions",
+		SAMLLoginCollection:          "samlLogins",
+		WebAuthnCredentialCollection: "webauthnCredentials",
+		WebAuthnSessionCollection:    "webauthnSessions",
 	}
 }
@@ -3,6 +3,8 @@ package config
 import (
 	"log"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -20,3 +22,51 @@ func GetFromEnv(s string) string {
 
 	return v
 }
+
+// GetDurationFromEnv gets a duration env, falling back to def when unset or invalid
+func GetDurationFromEnv(s string, def time.Duration) time.Duration {
+	v := GetFromEnv(s)
+	if v == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("Invalid duration for %s: %v", s, err)
+		return def
+	}
+
+	return d
+}
+
+// GetIntFromEnv gets an integer env, falling back to def when unset or invalid
+func GetIntFromEnv(s string, def int) int {
+	v := GetFromEnv(s)
+	if v == "" {
+		return def
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("Invalid integer for %s: %v", s, err)
+		return def
+	}
+
+	return i
+}
+
+// GetBoolFromEnv gets a boolean env, falling back to def when unset or invalid
+func GetBoolFromEnv(s string, def bool) bool {
+	v := GetFromEnv(s)
+	if v == "" {
+		return def
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("Invalid boolean for %s: %v", s, err)
+		return def
+	}
+
+	return b
+}
@@ -0,0 +1,24 @@
+package config
+
+import "strings"
+
+// AppURL is the public url of this API server, from APP_URL. Links that are
+// handled by the API itself, like email verification & magic links, use it.
+func AppURL() string {
+	u := GetFromEnv("APP_URL")
+	if u == "" {
+		u = "http://localhost:8080"
+	}
+	return strings.TrimSuffix(u, "/")
+}
+
+// FrontendURL is the public url of the app users see, from FRONTEND_URL.
+// Links that need a page, like password resets, invitations & provider
+// callbacks, use it. It defaults to APP_URL, for an app served by the API.
+func FrontendURL() string {
+	u := GetFromEnv("FRONTEND_URL")
+	if u == "" {
+		return AppURL()
+	}
+	return strings.TrimSuffix(u, "/")
+}
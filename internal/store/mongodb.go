@@ -38,6 +38,228 @@ func ConnectMongoDB() (*mongo.Database, error) {
 			IndexKeys:  bson.D{{Key: "email", Value: 1}},
 			Unique:     true,
 		},
+		{
+			Collection: *client.Database(DbName).Collection("refreshTokens"),
+			IndexKeys:  bson.D{{Key: "tokenHash", Value: 1}},
+			Unique:     true,
+		},
+		{
+			Collection: *client.Database(DbName).Collection("refreshTokens"),
+			IndexKeys:  bson.D{{Key: "familyId", Value: 1}},
+		},
+		{
+			Collection:  *client.Database(DbName).Collection("refreshTokens"),
+			IndexKeys:   bson.D{{Key: "expiresAt", Value: 1}},
+			ExpireAfter: ptr(int32(0)),
+		},
+		{
+			Collection:  *client.Database(DbName).Collection("revokedTokens"),
+			IndexKeys:   bson.D{{Key: "expiresAt", Value: 1}},
+			ExpireAfter: ptr(int32(0)),
+		},
+		{
+			Collection: *client.Database(DbName).Collection("signingKeys"),
+			IndexKeys:  bson.D{{Key: "kid", Value: 1}},
+			Unique:     true,
+		},
+		{
+			Collection:  *client.Database(DbName).Collection("signingKeys"),
+			IndexKeys:   bson.D{{Key: "expiresAt", Value: 1}},
+			ExpireAfter: ptr(int32(0)),
+		},
+		{
+			Collection: *client.Database(DbName).Collection("mfaChallenges"),
+			IndexKeys:  bson.D{{Key: "tokenHash", Value: 1}},
+			Unique:     true,
+		},
+		{
+			Collection:  *client.Database(DbName).Collection("mfaChallenges"),
+			IndexKeys:   bson.D{{Key: "expiresAt", Value: 1}},
+			ExpireAfter: ptr(int32(0)),
+		},
+		{
+			Collection: *client.Database(DbName).Collection("passwordResets"),
+			IndexKeys:  bson.D{{Key: "tokenHash", Value: 1}},
+			Unique:     true,
+		},
+		{
+			Collection: *client.Database(DbName).Collection("passwordResets"),
+			IndexKeys:  bson.D{{Key: "userId", Value: 1}, {Key: "createdAt", Value: 1}},
+		},
+		{
+			Collection:  *client.Database(DbName).Collection("passwordResets"),
+			IndexKeys:   bson.D{{Key: "expiresAt", Value: 1}},
+			ExpireAfter: ptr(int32(0)),
+		},
+		{
+			Collection: *client.Database(DbName).Collection("sessions"),
+			IndexKeys:  bson.D{{Key: "userId", Value: 1}, {Key: "lastSeenAt", Value: -1}},
+		},
+		{
+			Collection:  *client.Database(DbName).Collection("sessions"),
+			IndexKeys:   bson.D{{Key: "expiresAt", Value: 1}},
+			ExpireAfter: ptr(int32(0)),
+		},
+		{
+			Collection: *client.Database(DbName).Collection("impersonationLogs"),
+			IndexKeys:  bson.D{{Key: "userId", Value: 1}, {Key: "createdAt", Value: -1}},
+		},
+		{
+			Collection: *client.Database(DbName).Collection("impersonationLogs"),
+			IndexKeys:  bson.D{{Key: "actorId", Value: 1}, {Key: "createdAt", Value: -1}},
+		},
+		{
+			Collection: *client.Database(DbName).Collection("invitations"),
+			IndexKeys:  bson.D{{Key: "tokenHash", Value: 1}},
+			Unique:     true,
+		},
+		{
+			Collection: *client.Database(DbName).Collection("invitations"),
+			IndexKeys:  bson.D{{Key: "email", Value: 1}},
+		},
+		{
+			Collection: *client.Database(DbName).Collection("users"),
+			IndexKeys:  bson.D{{Key: "memberships.orgId", Value: 1}},
+		},
+		{
+			Collection: *client.Database(DbName).Collection("groups"),
+			IndexKeys:  bson.D{{Key: "orgId", Value: 1}, {Key: "name", Value: 1}},
+			Unique:     true,
+		},
+		{
+			Collection: *client.Database(DbName).Collection("groups"),
+			IndexKeys:  bson.D{{Key: "memberIds", Value: 1}},
+		},
+		{
+			Collection: *client.Database(DbName).Collection("groups"),
+			IndexKeys:  bson.D{{Key: "groupIds", Value: 1}},
+		},
+		{
+			Collection: *client.Database(DbName).Collection("magicLinks"),
+			IndexKeys:  bson.D{{Key: "linkHash", Value: 1}},
+			Unique:     true,
+		},
+		{
+			Collection: *client.Database(DbName).Collection("magicLinks"),
+			IndexKeys:  bson.D{{Key: "email", Value: 1}, {Key: "createdAt", Value: 1}},
+		},
+		{
+			//kept past their expiry, they count towards the rate limit
+			Collection:  *client.Database(DbName).Collection("magicLinks"),
+			IndexKeys:   bson.D{{Key: "createdAt", Value: 1}},
+			ExpireAfter: ptr(int32(24 * 60 * 60)),
+		},
+		{
+			Collection:  *client.Database(DbName).Collection("loginAttempts"),
+			IndexKeys:   bson.D{{Key: "expiresAt", Value: 1}},
+			ExpireAfter: ptr(int32(0)),
+		},
+		{
+			Collection: *client.Database(DbName).Collection("apiKeys"),
+			IndexKeys:  bson.D{{Key: "prefix", Value: 1}},
+			Unique:     true,
+		},
+		{
+			Collection: *client.Database(DbName).Collection("apiKeys"),
+			IndexKeys:  bson.D{{Key: "userId", Value: 1}},
+		},
+		{
+			Collection: *client.Database(DbName).Collection("oauthClients"),
+			IndexKeys:  bson.D{{Key: "clientId", Value: 1}},
+			Unique:     true,
+		},
+		{
+			Collection: *client.Database(DbName).Collection("oauthCodes"),
+			IndexKeys:  bson.D{{Key: "codeHash", Value: 1}},
+			Unique:     true,
+		},
+		{
+			Collection:  *client.Database(DbName).Collection("oauthCodes"),
+			IndexKeys:   bson.D{{Key: "expiresAt", Value: 1}},
+			ExpireAfter: ptr(int32(0)),
+		},
+		{
+			Collection: *client.Database(DbName).Collection("oauthConsents"),
+			IndexKeys:  bson.D{{Key: "userId", Value: 1}, {Key: "clientId", Value: 1}},
+			Unique:     true,
+		},
+		{
+			Collection: *client.Database(DbName).Collection("oauthRefreshTokens"),
+			IndexKeys:  bson.D{{Key: "tokenHash", Value: 1}},
+			Unique:     true,
+		},
+		{
+			Collection: *client.Database(DbName).Collection("oauthRefreshTokens"),
+			IndexKeys:  bson.D{{Key: "familyId", Value: 1}},
+		},
+		{
+			Collection:  *client.Database(DbName).Collection("oauthRefreshTokens"),
+			IndexKeys:   bson.D{{Key: "expiresAt", Value: 1}},
+			ExpireAfter: ptr(int32(0)),
+		},
+		{
+			Collection: *client.Database(DbName).Collection("users"),
+			IndexKeys:  bson.D{{Key: "identities.provider", Value: 1}, {Key: "identities.subject", Value: 1}},
+		},
+		{
+			Collection: *client.Database(DbName).Collection("oidcStates"),
+			IndexKeys:  bson.D{{Key: "stateHash", Value: 1}},
+			Unique:     true,
+		},
+		{
+			Collection:  *client.Database(DbName).Collection("oidcStates"),
+			IndexKeys:   bson.D{{Key: "expiresAt", Value: 1}},
+			ExpireAfter: ptr(int32(0)),
+		},
+		{
+			Collection: *client.Database(DbName).Collection("samlRequests"),
+			IndexKeys:  bson.D{{Key: "requestId", Value: 1}},
+			Unique:     true,
+		},
+		{
+			Collection:  *client.Database(DbName).Collection("samlRequests"),
+			IndexKeys:   bson.D{{Key: "expiresAt", Value: 1}},
+			ExpireAfter: ptr(int32(0)),
+		},
+		{
+			Collection: *client.Database(DbName).Collection("samlAssertions"),
+			IndexKeys:  bson.D{{Key: "provider", Value: 1}, {Key: "assertionId", Value: 1}},
+			Unique:     true,
+		},
+		{
+			Collection:  *client.Database(DbName).Collection("samlAssertions"),
+			IndexKeys:   bson.D{{Key: "expiresAt", Value: 1}},
+			ExpireAfter: ptr(int32(0)),
+		},
+		{
+			Collection: *client.Database(DbName).Collection("samlLogins"),
+			IndexKeys:  bson.D{{Key: "codeHash", Value: 1}},
+			Unique:     true,
+		},
+		{
+			Collection:  *client.Database(DbName).Collection("samlLogins"),
+			IndexKeys:   bson.D{{Key: "expiresAt", Value: 1}},
+			ExpireAfter: ptr(int32(0)),
+		},
+		{
+			Collection: *client.Database(DbName).Collection("webauthnCredentials"),
+			IndexKeys:  bson.D{{Key: "credentialId", Value: 1}},
+			Unique:     true,
+		},
+		{
+			Collection: *client.Database(DbName).Collection("webauthnCredentials"),
+			IndexKeys:  bson.D{{Key: "userId", Value: 1}},
+		},
+		{
+			Collection: *client.Database(DbName).Collection("webauthnSessions"),
+			IndexKeys:  bson.D{{Key: "sessionHash", Value: 1}},
+			Unique:     true,
+		},
+		{
+			Collection:  *client.Database(DbName).Collection("webauthnSessions"),
+			IndexKeys:   bson.D{{Key: "expiresAt", Value: 1}},
+			ExpireAfter: ptr(int32(0)),
+		},
 	}
 
 	for _, index := range indices {
@@ -47,6 +269,17 @@ func ConnectMongoDB() (*mongo.Database, error) {
 		}
 	}
 
+	//users from before email verification have no emailVerified, enforcing
+	//it must not lock them out
+	_, err = client.Database(DbName).Collection("users").UpdateMany(
+		context.TODO(),
+		bson.M{"emailVerified": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"emailVerified": true}},
+	)
+	if err != nil {
+		return nil, err
+	}
+
 	return client.Database(DbName), nil
 }
 
@@ -55,12 +288,23 @@ type CollectionIndex struct {
 	Collection mongo.Collection
 	IndexKeys  bson.D
 	Unique     bool
+	// ExpireAfter makes this a TTL index when set (seconds)
+	ExpireAfter *int32
 }
 
 func createIndex(index CollectionIndex) error {
+	opts := options.Index().SetUnique(index.Unique)
+	if index.ExpireAfter != nil {
+		opts.SetExpireAfterSeconds(*index.ExpireAfter)
+	}
+
 	_, err := index.Collection.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
 		Keys:    index.IndexKeys,
-		Options: options.Index().SetUnique(index.Unique),
+		Options: opts,
 	})
 	return err
 }
+
+func ptr[T any](v T) *T {
+	return &v
+}
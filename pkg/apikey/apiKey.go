@@ -0,0 +1,97 @@
+package apikeypkg
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Key types
+const (
+	// TypePersonal keys are created by users for themselves
+	TypePersonal = "personal"
+	// TypeService keys are created by admins for another (service) account
+	TypeService = "service"
+)
+
+// keyPrefix marks our keys so they are easy to spot in code & logs
+const keyPrefix = "mge"
+
+// APIKey defines api key schema, only the hash of the secret is stored
+type APIKey struct {
+	ID         primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	UserID     primitive.ObjectID `json:"userId" bson:"userId"`
+	CreatedBy  primitive.ObjectID `json:"createdBy" bson:"createdBy"`
+	Name       string             `json:"name" bson:"name"`
+	Type       string             `json:"type" bson:"type"`
+	Prefix     string             `json:"prefix" bson:"prefix"`
+	KeyHash    string             `json:"-" bson:"keyHash"`
+	Scopes     []string           `json:"scopes" bson:"scopes"`
+	CreatedAt  time.Time          `json:"createdAt" bson:"createdAt"`
+	ExpiresAt  *time.Time         `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+	LastUsedAt *time.Time         `json:"lastUsedAt,omitempty" bson:"lastUsedAt,omitempty"`
+	RevokedAt  *time.Time         `json:"revokedAt,omitempty" bson:"revokedAt,omitempty"`
+	// OrgID is the organization the key works in, with the owner's role there
+	OrgID primitive.ObjectID `json:"orgId,omitempty" bson:"orgId,omitempty"`
+}
+
+// CreateRequest defines api key create request. Its scopes are permissions
+// of the owner or self-service scopes such as profile:read, a key can do
+// nothing else.
+type CreateRequest struct {
+	Name      string     `json:"name,omitempty"`
+	Scopes    []string   `json:"scopes,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// OrgID is the organization of the request creating the key, set by the handler
+	OrgID primitive.ObjectID `json:"-"`
+}
+
+// CreateResponse holds the new key, the only time the full key is shown
+type CreateResponse struct {
+	*APIKey
+	Key string `json:"key"`
+}
+
+// IsActive checks the key is neither revoked nor expired
+func (k *APIKey) IsActive() bool {
+	if k.RevokedAt != nil {
+		return false
+	}
+	return k.ExpiresAt == nil || k.ExpiresAt.After(time.Now())
+}
+
+// generateKey returns a key formatted as mge_<prefix>_<secret>
+func generateKey() (prefix string, key string, err error) {
+	p := make([]byte, 5)
+	if _, err := rand.Read(p); err != nil {
+		return "", "", err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+
+	prefix = strings.ToLower(base32.StdEncoding.EncodeToString(p))
+	return prefix, keyPrefix + "_" + prefix + "_" + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// parseKey splits a key into the prefix used for lookup & the full key
+func parseKey(key string) (string, error) {
+	parts := strings.SplitN(key, "_", 3)
+	if len(parts) != 3 || parts[0] != keyPrefix || parts[1] == "" || parts[2] == "" {
+		return "", errors.New("invalid api key")
+	}
+	return parts[1], nil
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,38 @@
+package apikeypkg
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateKey(t *testing.T) {
+	prefix, key, err := generateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Len(t, prefix, 8)
+	assert.True(t, strings.HasPrefix(key, "mge_"+prefix+"_"))
+
+	parsed, err := parseKey(key)
+	assert.NoError(t, err)
+	assert.Equal(t, prefix, parsed)
+
+	for _, invalid := range []string{"", "mge_", "mge_prefix_", "abc_prefix_secret", "prefix_secret"} {
+		_, err := parseKey(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestIsActive(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Minute)
+
+	assert.True(t, (&APIKey{}).IsActive())
+	assert.True(t, (&APIKey{ExpiresAt: &future}).IsActive())
+	assert.False(t, (&APIKey{ExpiresAt: &past}).IsActive())
+	assert.False(t, (&APIKey{RevokedAt: &past}).IsActive())
+}
@@ -0,0 +1,149 @@
+package apikeypkg
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"mahi-go-explorer/internal/config"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Service defines interface for the api key service
+type Service interface {
+	CreateAPIKey(userID primitive.ObjectID, createdBy primitive.ObjectID, req *CreateRequest) (*CreateResponse, error)
+	GetAPIKeys(userID primitive.ObjectID) ([]APIKey, error)
+	RevokeAPIKey(userID primitive.ObjectID, keyID primitive.ObjectID) error
+	// Authenticate resolves an active key & records its use
+	Authenticate(key string) (*APIKey, error)
+}
+
+type service struct {
+	db   *mongo.Database
+	coll *config.Collection
+}
+
+// lastUsedAt is only written when older than this, to avoid a write per request
+const lastUsedResolution = 1 * time.Minute
+
+// NewService returns new instance of api key service
+func NewService(db *mongo.Database, coll *config.Collection) Service {
+	return service{db, coll}
+}
+
+func (s service) CreateAPIKey(userID primitive.ObjectID, createdBy primitive.ObjectID, req *CreateRequest) (*CreateResponse, error) {
+	if req.ExpiresAt != nil && req.ExpiresAt.Before(time.Now()) {
+		return nil, errors.New("expiry in the past")
+	}
+
+	prefix, key, err := generateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	keyType := TypePersonal
+	if userID != createdBy {
+		keyType = TypeService
+	}
+
+	scopes := req.Scopes
+	if scopes == nil {
+		scopes = []string{}
+	}
+
+	apiKey := &APIKey{
+		UserID:    userID,
+		CreatedBy: createdBy,
+		Name:      req.Name,
+		Type:      keyType,
+		Prefix:    prefix,
+		KeyHash:   hashKey(key),
+		Scopes:    scopes,
+		OrgID:     req.OrgID,
+		CreatedAt: time.Now(),
+		ExpiresAt: req.ExpiresAt,
+	}
+
+	resp, err := s.db.Collection(s.coll.APIKeyCollection).InsertOne(context.TODO(), apiKey)
+	if err != nil {
+		return nil, err
+	}
+	apiKey.ID = resp.InsertedID.(primitive.ObjectID)
+
+	return &CreateResponse{APIKey: apiKey, Key: key}, nil
+}
+
+func (s service) GetAPIKeys(userID primitive.ObjectID) ([]APIKey, error) {
+	keys := []APIKey{}
+	cursor, err := s.db.Collection(s.coll.APIKeyCollection).Find(
+		context.TODO(),
+		bson.M{"userId": userID},
+		options.Find().SetSort(bson.M{"createdAt": -1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(context.TODO(), &keys)
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s service) RevokeAPIKey(userID primitive.ObjectID, keyID primitive.ObjectID) error {
+	res, err := s.db.Collection(s.coll.APIKeyCollection).UpdateOne(
+		context.TODO(),
+		bson.M{"_id": keyID, "userId": userID, "revokedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revokedAt": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errors.New("api key not found")
+	}
+	return nil
+}
+
+func (s service) Authenticate(key string) (*APIKey, error) {
+	prefix, err := parseKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var apiKey APIKey
+	err = s.db.Collection(s.coll.APIKeyCollection).FindOne(context.TODO(), bson.M{"prefix": prefix}).Decode(&apiKey)
+	if err == mongo.ErrNoDocuments {
+		return nil, errors.New("invalid api key")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(apiKey.KeyHash), []byte(hashKey(key))) != 1 {
+		return nil, errors.New("invalid api key")
+	}
+	if !apiKey.IsActive() {
+		return nil, errors.New("invalid api key")
+	}
+
+	now := time.Now()
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) > lastUsedResolution {
+		_, err := s.db.Collection(s.coll.APIKeyCollection).UpdateOne(
+			context.TODO(),
+			bson.M{"_id": apiKey.ID},
+			bson.M{"$set": bson.M{"lastUsedAt": now}},
+		)
+		if err != nil {
+			log.Printf("Failed to record use of api key %s: %v", apiKey.ID.Hex(), err)
+		}
+		apiKey.LastUsedAt = &now
+	}
+
+	return &apiKey, nil
+}
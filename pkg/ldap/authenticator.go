@@ -0,0 +1,221 @@
+package ldappkg
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mahi-go-explorer/internal/config"
+	userpkg "mahi-go-explorer/pkg/user"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Authenticator checks login credentials by binding to an LDAP or Active
+// Directory server as the user
+type Authenticator struct {
+	URL string
+	// BindDN & BindPassword are used to search for users, anonymous when empty
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	// Filter finds the user by the email they log in with, %s is replaced by it
+	Filter   string
+	StartTLS bool
+
+	// IDAttribute holds the stable id of the user, the entry DN when empty
+	IDAttribute        string
+	EmailAttribute     string
+	FirstNameAttribute string
+	LastNameAttribute  string
+	GroupAttribute     string
+	// RoleMap maps groups (DN or CN) to roles, roles are left alone without a map
+	RoleMap     map[string]string
+	DefaultRole string
+
+	Timeout time.Duration
+}
+
+// NewAuthenticator returns the authenticator configured by LDAP_URL,
+// LDAP_BIND_DN, LDAP_BIND_PASSWORD, LDAP_BASE_DN, LDAP_FILTER & friends,
+// or nil when LDAP_URL is not set
+func NewAuthenticator() *Authenticator {
+	u := config.GetFromEnv("LDAP_URL")
+	if u == "" {
+		return nil
+	}
+
+	return newAuthenticator(&Authenticator{
+		URL:                u,
+		BindDN:             config.GetFromEnv("LDAP_BIND_DN"),
+		BindPassword:       config.GetFromEnv("LDAP_BIND_PASSWORD"),
+		BaseDN:             config.GetFromEnv("LDAP_BASE_DN"),
+		Filter:             config.GetFromEnv("LDAP_FILTER"),
+		StartTLS:           config.GetBoolFromEnv("LDAP_START_TLS", false),
+		IDAttribute:        config.GetFromEnv("LDAP_ID_ATTRIBUTE"),
+		EmailAttribute:     config.GetFromEnv("LDAP_EMAIL_ATTRIBUTE"),
+		FirstNameAttribute: config.GetFromEnv("LDAP_FIRST_NAME_ATTRIBUTE"),
+		LastNameAttribute:  config.GetFromEnv("LDAP_LAST_NAME_ATTRIBUTE"),
+		GroupAttribute:     config.GetFromEnv("LDAP_GROUP_ATTRIBUTE"),
+		RoleMap:            userpkg.ParseRoleMap(config.GetFromEnv("LDAP_ROLE_MAP")),
+		DefaultRole:        config.GetFromEnv("LDAP_DEFAULT_ROLE"),
+		Timeout:            config.GetDurationFromEnv("LDAP_TIMEOUT", 5*time.Second),
+	})
+}
+
+// newAuthenticator fills in the defaults of an authenticator
+func newAuthenticator(a *Authenticator) *Authenticator {
+	if a.Filter == "" {
+		a.Filter = "(mail=%s)"
+	}
+	if a.EmailAttribute == "" {
+		a.EmailAttribute = "mail"
+	}
+	if a.FirstNameAttribute == "" {
+		a.FirstNameAttribute = "givenName"
+	}
+	if a.LastNameAttribute == "" {
+		a.LastNameAttribute = "sn"
+	}
+	if a.GroupAttribute == "" {
+		a.GroupAttribute = "memberOf"
+	}
+	if a.DefaultRole == "" {
+		a.DefaultRole = userpkg.RoleUser
+	}
+	if a.Timeout == 0 {
+		a.Timeout = 5 * time.Second
+	}
+	return a
+}
+
+// Name returns the name users from the directory are linked by
+func (a *Authenticator) Name() string {
+	return "ldap"
+}
+
+// Authenticate finds the user by email & binds as them with the password
+func (a *Authenticator) Authenticate(email string, password string) (*userpkg.ExternalUser, error) {
+	//an empty password is an unauthenticated bind, which servers accept
+	if email == "" || password == "" {
+		return nil, nil
+	}
+
+	conn, err := a.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if a.BindDN != "" {
+		if err := conn.Bind(a.BindDN, a.BindPassword); err != nil {
+			return nil, fmt.Errorf("service bind: %w", err)
+		}
+	}
+
+	attributes := []string{a.EmailAttribute, a.FirstNameAttribute, a.LastNameAttribute, a.GroupAttribute}
+	if a.IDAttribute != "" {
+		attributes = append(attributes, a.IDAttribute)
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		a.BaseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		2,
+		int(a.Timeout.Seconds()),
+		false,
+		strings.ReplaceAll(a.Filter, "%s", ldap.EscapeFilter(email)),
+		attributes,
+		nil,
+	))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("search: %w", err)
+	}
+	if len(res.Entries) == 0 {
+		return nil, nil
+	}
+	if len(res.Entries) > 1 {
+		return nil, errors.New("search matched more than one entry")
+	}
+	entry := res.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("user bind: %w", err)
+	}
+
+	return a.externalUser(entry, email), nil
+}
+
+func (a *Authenticator) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(a.URL, ldap.DialWithDialer(&net.Dialer{Timeout: a.Timeout}))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(a.Timeout)
+
+	if a.StartTLS {
+		host := a.URL
+		if i := strings.Index(host, "://"); i >= 0 {
+			host = host[i+3:]
+		}
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if err := conn.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("start tls: %w", err)
+		}
+	}
+
+	return conn, nil
+}
+
+// externalUser maps the directory entry to the user it describes
+func (a *Authenticator) externalUser(entry *ldap.Entry, email string) *userpkg.ExternalUser {
+	ext := &userpkg.ExternalUser{
+		Provider:  a.Name(),
+		Subject:   entry.DN,
+		Email:     entry.GetAttributeValue(a.EmailAttribute),
+		FirstName: entry.GetAttributeValue(a.FirstNameAttribute),
+		LastName:  entry.GetAttributeValue(a.LastNameAttribute),
+		//addresses in the directory are managed by its admins
+		EmailVerified: true,
+	}
+	if a.IDAttribute != "" {
+		if id := entry.GetAttributeValue(a.IDAttribute); id != "" {
+			ext.Subject = id
+		}
+	}
+	if ext.Email == "" {
+		ext.Email = email
+	}
+
+	if len(a.RoleMap) > 0 {
+		ext.Role = userpkg.MapRole(groupNames(entry.GetAttributeValues(a.GroupAttribute)), a.RoleMap, a.DefaultRole)
+	}
+
+	return ext
+}
+
+// groupNames returns each group DN along with its CN, so either can be mapped
+func groupNames(dns []string) []string {
+	names := []string{}
+	for _, dn := range dns {
+		names = append(names, dn)
+		parsed, err := ldap.ParseDN(dn)
+		if err != nil || len(parsed.RDNs) == 0 {
+			continue
+		}
+		for _, attr := range parsed.RDNs[0].Attributes {
+			if strings.EqualFold(attr.Type, "cn") {
+				names = append(names, attr.Value)
+			}
+		}
+	}
+	return names
+}
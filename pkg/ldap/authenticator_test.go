@@ -0,0 +1,197 @@
+package ldappkg
+
+import (
+	userpkg "mahi-go-explorer/pkg/user"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDirectory(t *testing.T) *testServer {
+	return newTestServer(t,
+		testEntry{
+			dn:       "cn=search,ou=services,dc=example,dc=com",
+			password: "search-pass",
+		},
+		testEntry{
+			dn:       "uid=jane,ou=people,dc=example,dc=com",
+			password: "jane-pass",
+			attributes: map[string][]string{
+				"objectClass": {"person"},
+				"uid":         {"jane"},
+				"mail":        {"jane@example.com"},
+				"givenName":   {"Jane"},
+				"sn":          {"Doe"},
+				"memberOf":    {"cn=staff,ou=groups,dc=example,dc=com", "cn=Admins,ou=groups,dc=example,dc=com"},
+			},
+		},
+		testEntry{
+			dn:       "uid=john,ou=people,dc=example,dc=com",
+			password: "john-pass",
+			attributes: map[string][]string{
+				"objectClass": {"person"},
+				"uid":         {"john"},
+				"mail":        {"john@example.com"},
+				"memberOf":    {"cn=staff,ou=groups,dc=example,dc=com"},
+			},
+		},
+		testEntry{
+			dn:       "uid=printer,ou=devices,dc=example,dc=com",
+			password: "printer-pass",
+			attributes: map[string][]string{
+				"objectClass": {"device"},
+				"mail":        {"printer@example.com"},
+			},
+		},
+	)
+}
+
+func TestAuthenticate(t *testing.T) {
+	srv := newTestDirectory(t)
+
+	type testCase struct {
+		name          string
+		authenticator Authenticator
+		email         string
+		password      string
+		expected      *userpkg.ExternalUser
+		expectError   bool
+	}
+
+	directory := Authenticator{
+		URL:          srv.URL(),
+		BindDN:       "cn=search,ou=services,dc=example,dc=com",
+		BindPassword: "search-pass",
+		BaseDN:       "ou=people,dc=example,dc=com",
+		RoleMap:      map[string]string{"admins": userpkg.RoleAdmin, "cn=staff,ou=groups,dc=example,dc=com": userpkg.RoleSupport},
+	}
+	anonymous := directory
+	anonymous.BindDN, anonymous.BindPassword = "", ""
+	anonymous.RoleMap = nil
+	wrongBind := directory
+	wrongBind.BindPassword = "wrong"
+	filtered := directory
+	filtered.BaseDN = "dc=example,dc=com"
+	filtered.Filter = "(&(objectClass=person)(mail=%s))"
+	byUID := directory
+	byUID.IDAttribute = "uid"
+
+	tests := []testCase{
+		{
+			name:          "Maps groups to the highest role",
+			authenticator: directory,
+			email:         "jane@example.com",
+			password:      "jane-pass",
+			expected: &userpkg.ExternalUser{
+				Provider:      "ldap",
+				Subject:       "uid=jane,ou=people,dc=example,dc=com",
+				Email:         "jane@example.com",
+				EmailVerified: true,
+				FirstName:     "Jane",
+				LastName:      "Doe",
+				Role:          userpkg.RoleAdmin,
+			},
+		},
+		{
+			name:          "Maps groups by DN",
+			authenticator: directory,
+			email:         "john@example.com",
+			password:      "john-pass",
+			expected: &userpkg.ExternalUser{
+				Provider:      "ldap",
+				Subject:       "uid=john,ou=people,dc=example,dc=com",
+				Email:         "john@example.com",
+				EmailVerified: true,
+				Role:          userpkg.RoleSupport,
+			},
+		},
+		{
+			name:          "Leaves roles alone without a role map",
+			authenticator: anonymous,
+			email:         "jane@example.com",
+			password:      "jane-pass",
+			expected: &userpkg.ExternalUser{
+				Provider:      "ldap",
+				Subject:       "uid=jane,ou=people,dc=example,dc=com",
+				Email:         "jane@example.com",
+				EmailVerified: true,
+				FirstName:     "Jane",
+				LastName:      "Doe",
+			},
+		},
+		{
+			name:          "Uses the id attribute as subject",
+			authenticator: byUID,
+			email:         "john@example.com",
+			password:      "john-pass",
+			expected: &userpkg.ExternalUser{
+				Provider:      "ldap",
+				Subject:       "john",
+				Email:         "john@example.com",
+				EmailVerified: true,
+				Role:          userpkg.RoleSupport,
+			},
+		},
+		{
+			name:          "Rejects wrong password",
+			authenticator: directory,
+			email:         "jane@example.com",
+			password:      "john-pass",
+		},
+		{
+			name:          "Rejects unknown user",
+			authenticator: directory,
+			email:         "nobody@example.com",
+			password:      "jane-pass",
+		},
+		{
+			name:          "Escapes the email in the filter",
+			authenticator: directory,
+			email:         "*",
+			password:      "jane-pass",
+		},
+		{
+			name:          "Applies the configured filter",
+			authenticator: filtered,
+			email:         "printer@example.com",
+			password:      "printer-pass",
+		},
+		{
+			name:          "Fails when the service bind fails",
+			authenticator: wrongBind,
+			email:         "jane@example.com",
+			password:      "jane-pass",
+			expectError:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			a := newAuthenticator(&tc.authenticator)
+			user, err := a.Authenticate(tc.email, tc.password)
+			if tc.expectError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, user)
+		})
+	}
+}
+
+func TestAuthenticateEmptyPassword(t *testing.T) {
+	//nothing listens here, an empty password must not reach the server
+	a := newAuthenticator(&Authenticator{URL: "ldap://127.0.0.1:1", Timeout: time.Second})
+
+	user, err := a.Authenticate("jane@example.com", "")
+	assert.NoError(t, err)
+	assert.Nil(t, user)
+}
+
+func TestAuthenticateUnreachable(t *testing.T) {
+	a := newAuthenticator(&Authenticator{URL: "ldap://127.0.0.1:1", Timeout: time.Second})
+
+	_, err := a.Authenticate("jane@example.com", "jane-pass")
+	assert.Error(t, err)
+}
@@ -0,0 +1,165 @@
+package ldappkg
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+// testEntry is an entry in the test directory
+type testEntry struct {
+	dn         string
+	password   string
+	attributes map[string][]string
+}
+
+// testServer is a minimal in-process ldap server that answers simple binds
+// & searches with equality, and & present filters
+type testServer struct {
+	listener net.Listener
+	entries  []testEntry
+}
+
+// result codes used by the test server
+const (
+	resultSuccess            = 0
+	resultOperationsError    = 1
+	resultInvalidCredentials = 49
+)
+
+// newTestServer starts a test server on a random local port
+func newTestServer(t *testing.T, entries ...testEntry) *testServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &testServer{listener: l, entries: entries}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+
+	return srv
+}
+
+func (srv *testServer) URL() string {
+	return "ldap://" + srv.listener.Addr().String()
+}
+
+func (srv *testServer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		p, err := ber.ReadPacket(conn)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+		id := p.Children[0].Value.(int64)
+		op := p.Children[1]
+
+		switch op.Tag {
+		case 0: //bind
+			code := resultInvalidCredentials
+			dn, password := str(op.Children[1]), str(op.Children[2])
+			for _, e := range srv.entries {
+				if strings.EqualFold(e.dn, dn) && e.password != "" && e.password == password {
+					code = resultSuccess
+				}
+			}
+			conn.Write(message(id, result(1, code)).Bytes())
+		case 2: //unbind
+			return
+		case 3: //search
+			base, filter := str(op.Children[0]), op.Children[6]
+			for _, e := range srv.entries {
+				if strings.HasSuffix(strings.ToLower(e.dn), strings.ToLower(base)) && matches(filter, e) {
+					conn.Write(message(id, searchEntry(e)).Bytes())
+				}
+			}
+			conn.Write(message(id, result(5, resultSuccess)).Bytes())
+		default:
+			conn.Write(message(id, result(1, resultOperationsError)).Bytes())
+		}
+	}
+}
+
+// matches evaluates the search filter against the entry
+func matches(filter *ber.Packet, e testEntry) bool {
+	switch filter.Tag {
+	case 0: //and
+		for _, child := range filter.Children {
+			if !matches(child, e) {
+				return false
+			}
+		}
+		return true
+	case 3: //equality
+		for _, v := range attributeValues(e, str(filter.Children[0])) {
+			if strings.EqualFold(v, str(filter.Children[1])) {
+				return true
+			}
+		}
+		return false
+	case 7: //present
+		return len(attributeValues(e, str(filter))) > 0
+	default:
+		return false
+	}
+}
+
+func attributeValues(e testEntry, name string) []string {
+	for attr, values := range e.attributes {
+		if strings.EqualFold(attr, name) {
+			return values
+		}
+	}
+	return nil
+}
+
+func str(p *ber.Packet) string {
+	if p.Data == nil {
+		return ""
+	}
+	return p.Data.String()
+}
+
+func message(id int64, op *ber.Packet) *ber.Packet {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	p.AppendChild(op)
+	return p
+}
+
+func result(tag ber.Tag, code int) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return p
+}
+
+func searchEntry(e testEntry) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, 4, nil, "")
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, ""))
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	for name, values := range e.attributes {
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		for _, v := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+		}
+		attr.AppendChild(set)
+		attributes.AppendChild(attr)
+	}
+	p.AppendChild(attributes)
+	return p
+}
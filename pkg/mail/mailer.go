@@ -0,0 +1,118 @@
+package mailpkg
+
+import (
+	"fmt"
+	"log"
+	"mahi-go-explorer/internal/config"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Message defines an email message
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer defines interface for sending mail
+type Mailer interface {
+	Send(msg *Message) error
+}
+
+// NewMailer returns the mailer selected by MAIL_DRIVER: log (default), file or smtp
+func NewMailer() Mailer {
+	from := config.GetFromEnv("MAIL_FROM")
+	if from == "" {
+		from = "no-reply@localhost"
+	}
+
+	switch config.GetFromEnv("MAIL_DRIVER") {
+	case "file":
+		dir := config.GetFromEnv("MAIL_DIR")
+		if dir == "" {
+			dir = "./mail"
+		}
+		return fileMailer{dir: dir, from: from}
+	case "smtp":
+		return smtpMailer{
+			addr:     config.GetFromEnv("SMTP_ADDR"),
+			username: config.GetFromEnv("SMTP_USERNAME"),
+			password: config.GetFromEnv("SMTP_PASSWORD"),
+			from:     from,
+		}
+	default:
+		return logMailer{from: from}
+	}
+}
+
+// logMailer prints messages to the log, for local development
+type logMailer struct {
+	from string
+}
+
+func (m logMailer) Send(msg *Message) error {
+	log.Printf("Mail from %s to %s: %s\n%s", m.from, msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+// fileMailer writes each message to an .eml file, for local development
+type fileMailer struct {
+	dir  string
+	from string
+}
+
+func (m fileMailer) Send(msg *Message) error {
+	if err := os.MkdirAll(m.dir, 0o755); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), sanitizeFileName(msg.To))
+	return os.WriteFile(filepath.Join(m.dir, name), format(m.from, msg), 0o644)
+}
+
+// smtpMailer sends messages through an SMTP server
+type smtpMailer struct {
+	addr     string
+	username string
+	password string
+	from     string
+}
+
+func (m smtpMailer) Send(msg *Message) error {
+	var auth smtp.Auth
+	if m.username != "" {
+		host := strings.Split(m.addr, ":")[0]
+		auth = smtp.PlainAuth("", m.username, m.password, host)
+	}
+	return smtp.SendMail(m.addr, auth, m.from, []string{msg.To}, format(m.from, msg))
+}
+
+func format(from string, msg *Message) []byte {
+	var b strings.Builder
+	b.WriteString("From: " + headerValue(from) + "\r\n")
+	b.WriteString("To: " + headerValue(msg.To) + "\r\n")
+	b.WriteString("Subject: " + headerValue(msg.Subject) + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(msg.Body)
+	return []byte(b.String())
+}
+
+// headerValue drops line breaks so values cannot inject extra headers
+func headerValue(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
+
+func sanitizeFileName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' {
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,32 @@
+package mailpkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	m := fileMailer{dir: dir, from: "no-reply@example.com"}
+
+	err := m.Send(&Message{
+		To:      "user@example.com\r\nBcc: attacker@example.com",
+		Subject: "Reset your password",
+		Body:    "hello",
+	})
+	assert.NoError(t, err)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	content, err := os.ReadFile(files[0])
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "To: user@example.comBcc: attacker@example.com\r\n")
+	assert.NotContains(t, string(content), "\r\nBcc:")
+	assert.Contains(t, string(content), "Subject: Reset your password\r\n")
+	assert.Contains(t, string(content), "\r\n\r\nhello")
+}
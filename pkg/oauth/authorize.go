@@ -0,0 +1,121 @@
+package oauthpkg
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// PKCEMethodS256 is the only supported code challenge method, plain would
+// let anyone who sees the authorization request redeem the code
+const PKCEMethodS256 = "S256"
+
+// AuthorizeRequest defines the authorization request, the fields keep their
+// oauth names so the consent screen can pass the query on unchanged
+type AuthorizeRequest struct {
+	ResponseType        string `json:"response_type" form:"response_type"`
+	ClientID            string `json:"client_id" form:"client_id"`
+	RedirectURI         string `json:"redirect_uri" form:"redirect_uri"`
+	Scope               string `json:"scope" form:"scope"`
+	State               string `json:"state" form:"state"`
+	Nonce               string `json:"nonce" form:"nonce"`
+	CodeChallenge       string `json:"code_challenge" form:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method" form:"code_challenge_method"`
+}
+
+// ConsentRequest defines the answer of the user on the consent screen
+type ConsentRequest struct {
+	AuthorizeRequest
+	Approve bool `json:"approve"`
+}
+
+// ConsentInfo is what the consent screen shows the user
+type ConsentInfo struct {
+	ClientID   string   `json:"clientId"`
+	ClientName string   `json:"clientName"`
+	Scopes     []string `json:"scopes"`
+	// ConsentGiven is true when the user already approved these scopes
+	ConsentGiven bool `json:"consentGiven"`
+}
+
+// AuthorizeResponse tells the consent screen where to send the user back to
+type AuthorizeResponse struct {
+	RedirectURI string `json:"redirectUri"`
+}
+
+// AuthorizationCode defines authorization code schema, only the hash of the code is stored
+type AuthorizationCode struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty"`
+	CodeHash      string             `bson:"codeHash"`
+	ClientID      string             `bson:"clientId"`
+	UserID        primitive.ObjectID `bson:"userId"`
+	RedirectURI   string             `bson:"redirectUri"`
+	Scopes        []string           `bson:"scopes"`
+	Nonce         string             `bson:"nonce,omitempty"`
+	CodeChallenge string             `bson:"codeChallenge"`
+	CreatedAt     time.Time          `bson:"createdAt"`
+	ExpiresAt     time.Time          `bson:"expiresAt"`
+	UsedAt        *time.Time         `bson:"usedAt,omitempty"`
+}
+
+// Consent defines the scopes a user granted a client
+type Consent struct {
+	ID        primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	UserID    primitive.ObjectID `json:"userId" bson:"userId"`
+	ClientID  string             `json:"clientId" bson:"clientId"`
+	Scopes    []string           `json:"scopes" bson:"scopes"`
+	GrantedAt time.Time          `json:"grantedAt" bson:"grantedAt"`
+}
+
+// parseScopes splits a space separated scope parameter, dropping duplicates
+func parseScopes(scope string) []string {
+	scopes := []string{}
+	for _, s := range strings.Fields(scope) {
+		if !contains(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+// verifyPKCE checks the verifier hashes to the challenge (RFC 7636, S256)
+func verifyPKCE(challenge string, verifier string) bool {
+	//43 to 128 characters as required by the rfc
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+// RedirectURL adds params to the query of a registered redirect uri
+func RedirectURL(redirectURI string, params url.Values) string {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return redirectURI
+	}
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// ErrorParams returns the params that report err back to the client
+func ErrorParams(err *Error, state string) url.Values {
+	params := url.Values{"error": {err.Code}}
+	if err.Description != "" {
+		params.Set("error_description", err.Description)
+	}
+	if state != "" {
+		params.Set("state", state)
+	}
+	return params
+}
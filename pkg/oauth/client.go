@@ -0,0 +1,100 @@
+package oauthpkg
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Grant types
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantClientCredentials = "client_credentials"
+	GrantRefreshToken      = "refresh_token"
+)
+
+// Standard OpenID Connect scopes
+const (
+	ScopeOpenID        = "openid"
+	ScopeProfile       = "profile"
+	ScopeEmail         = "email"
+	ScopePhone         = "phone"
+	ScopeOfflineAccess = "offline_access"
+)
+
+// Client defines oauth client schema, only the hash of the secret is stored
+type Client struct {
+	ID           primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	ClientID     string             `json:"clientId" bson:"clientId"`
+	SecretHash   string             `json:"-" bson:"secretHash,omitempty"`
+	Name         string             `json:"name" bson:"name"`
+	RedirectURIs []string           `json:"redirectUris" bson:"redirectUris"`
+	GrantTypes   []string           `json:"grantTypes" bson:"grantTypes"`
+	Scopes       []string           `json:"scopes" bson:"scopes"`
+	// Public clients (single page & mobile apps) cannot keep a secret
+	Public    bool               `json:"public" bson:"public"`
+	CreatedBy primitive.ObjectID `json:"createdBy" bson:"createdBy"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+}
+
+// CreateClientRequest defines oauth client create request
+type CreateClientRequest struct {
+	Name         string   `json:"name,omitempty"`
+	RedirectURIs []string `json:"redirectUris,omitempty"`
+	GrantTypes   []string `json:"grantTypes,omitempty"`
+	Scopes       []string `json:"scopes,omitempty"`
+	Public       bool     `json:"public,omitempty"`
+}
+
+// CreateClientResponse holds the new client, the only time the secret is shown
+type CreateClientResponse struct {
+	*Client
+	ClientSecret string `json:"clientSecret,omitempty"`
+}
+
+// AllowsGrant checks the client may use the grant type
+func (c *Client) AllowsGrant(grantType string) bool {
+	return contains(c.GrantTypes, grantType)
+}
+
+// AllowsRedirectURI checks the uri is registered, uris have to match exactly
+func (c *Client) AllowsRedirectURI(uri string) bool {
+	return contains(c.RedirectURIs, uri)
+}
+
+// AllowsScopes checks every scope is registered for the client
+func (c *Client) AllowsScopes(scopes []string) bool {
+	for _, scope := range scopes {
+		if !contains(c.Scopes, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// randomToken returns n random bytes, url safe encoded
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+package oauthpkg
+
+import "net/http"
+
+// Error codes from RFC 6749
+const (
+	ErrInvalidRequest          = "invalid_request"
+	ErrInvalidClient           = "invalid_client"
+	ErrInvalidGrant            = "invalid_grant"
+	ErrUnauthorizedClient      = "unauthorized_client"
+	ErrUnsupportedGrantType    = "unsupported_grant_type"
+	ErrUnsupportedResponseType = "unsupported_response_type"
+	ErrInvalidScope            = "invalid_scope"
+	ErrAccessDenied            = "access_denied"
+	ErrInvalidToken            = "invalid_token"
+	ErrInsufficientScope       = "insufficient_scope"
+)
+
+// Error is returned for requests that oauth clients did wrong, it is
+// written as the standard error response instead of the api envelope
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+// StatusCode returns the http status the error is reported with
+func (e *Error) StatusCode() int {
+	switch e.Code {
+	case ErrInvalidClient, ErrInvalidToken:
+		return http.StatusUnauthorized
+	case ErrAccessDenied, ErrInsufficientScope:
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+func newError(code string, description string) *Error {
+	return &Error{Code: code, Description: description}
+}
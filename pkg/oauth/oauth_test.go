@@ -0,0 +1,118 @@
+package oauthpkg
+
+import (
+	tokenpkg "mahi-go-explorer/pkg/token"
+	userpkg "mahi-go-explorer/pkg/user"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyPKCE(t *testing.T) {
+	//challenge = BASE64URL(SHA256(verifier))
+	verifier := "dBjftJeZ4CVP-mJ92gAp2HBHS6PnQSg-2VzGRPrLsqU"
+	challenge := "4Gfqe2eN_pAqQaoyAt2UsiLVrOwlrxdmdOc0Fmfligs"
+
+	assert.True(t, verifyPKCE(challenge, verifier))
+	assert.False(t, verifyPKCE(challenge, verifier[:42]+"x"))
+	assert.False(t, verifyPKCE(challenge, "too-short"))
+	assert.False(t, verifyPKCE(verifier, verifier))
+}
+
+func TestParseScopes(t *testing.T) {
+	assert.Equal(t, []string{}, parseScopes(""))
+	assert.Equal(t, []string{"openid", "email"}, parseScopes(" openid  email openid "))
+}
+
+func TestClientAllows(t *testing.T) {
+	client := &Client{
+		RedirectURIs: []string{"https://app.example.com/callback"},
+		GrantTypes:   []string{GrantAuthorizationCode},
+		Scopes:       []string{ScopeOpenID, ScopeEmail},
+	}
+
+	assert.True(t, client.AllowsRedirectURI("https://app.example.com/callback"))
+	assert.False(t, client.AllowsRedirectURI("https://app.example.com/callback/"))
+	assert.False(t, client.AllowsRedirectURI("https://evil.example.com/callback"))
+
+	assert.True(t, client.AllowsGrant(GrantAuthorizationCode))
+	assert.False(t, client.AllowsGrant(GrantClientCredentials))
+
+	assert.True(t, client.AllowsScopes([]string{ScopeOpenID}))
+	assert.False(t, client.AllowsScopes([]string{ScopeOpenID, ScopeProfile}))
+}
+
+func TestRedirectURL(t *testing.T) {
+	uri := RedirectURL("https://app.example.com/callback?tenant=1", url.Values{"code": {"abc"}, "state": {"x y"}})
+	assert.Equal(t, "https://app.example.com/callback?code=abc&state=x+y&tenant=1", uri)
+
+	params := ErrorParams(&Error{Code: ErrAccessDenied}, "s")
+	assert.Equal(t, url.Values{"error": {ErrAccessDenied}, "state": {"s"}}, params)
+}
+
+func TestProfileClaims(t *testing.T) {
+	user := &userpkg.User{
+		FirstName:     "Ada",
+		LastName:      "Lovelace",
+		Email:         "ada@example.com",
+		EmailVerified: true,
+		Phone:         "+441234",
+	}
+
+	//openid alone releases nothing but the subject
+	assert.Equal(t, Profile{}, profileClaims(user, []string{ScopeOpenID}))
+
+	p := profileClaims(user, []string{ScopeOpenID, ScopeProfile, ScopeEmail})
+	assert.Equal(t, "Ada Lovelace", p.Name)
+	assert.Equal(t, "Ada", p.GivenName)
+	assert.Equal(t, "Lovelace", p.FamilyName)
+	assert.Equal(t, "ada@example.com", p.Email)
+	assert.True(t, *p.EmailVerified)
+	assert.Empty(t, p.PhoneNumber)
+
+	assert.Equal(t, "+441234", profileClaims(user, []string{ScopePhone}).PhoneNumber)
+}
+
+func TestAccessTokens(t *testing.T) {
+	tokens, err := tokenpkg.NewPasetoLocalService(make([]byte, 32), &tokenpkg.Policy{
+		Issuer:    "mahi-go-explorer",
+		Audiences: []string{"api"},
+		Audience:  "api",
+		TTL:       time.Hour,
+		Leeway:    30 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := service{tokens: tokens, policy: &tokenpkg.Policy{Issuer: "https://auth.example.com", TTL: time.Hour, Leeway: 30 * time.Second}}
+
+	token, err := s.createAccessToken("client-a", "user-1", []string{ScopeOpenID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := s.parseAccessToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "client-a", claims.ClientID)
+	assert.Equal(t, "user-1", claims.Subject)
+	assert.Equal(t, ScopeOpenID, claims.Scope)
+
+	//only accepted for the client it was issued to
+	other := AccessTokenClaims{ClientID: "client-a", RegisteredClaims: s.clientPolicy("client-b").RegisteredClaims("user-1", time.Hour)}
+	token, err = tokens.Issue(&other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.parseAccessToken(token)
+	assert.EqualError(t, err, "invalid_token: invalid access token")
+
+	//login tokens have no client
+	login := userpkg.JwtClaims{RegisteredClaims: tokens.Policy().RegisteredClaims("user-1", time.Hour)}
+	token, err = tokens.Issue(&login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.parseAccessToken(token)
+	assert.EqualError(t, err, "invalid_token: invalid access token")
+}
@@ -0,0 +1,846 @@
+package oauthpkg
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"mahi-go-explorer/internal/config"
+	tokenpkg "mahi-go-explorer/pkg/token"
+	userpkg "mahi-go-explorer/pkg/user"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Service defines interface for the oauth authorization server
+type Service interface {
+	CreateClient(createdBy primitive.ObjectID, req *CreateClientRequest) (*CreateClientResponse, error)
+	GetClients() ([]Client, error)
+	DeleteClient(clientID string) error
+	// AuthenticateClient checks the secret of confidential clients, public clients have none
+	AuthenticateClient(clientID string, secret string) (*Client, error)
+
+	// ValidateAuthorizeRequest checks an authorization request. When the
+	// client is nil the error must be shown instead of redirected, since
+	// the redirect uri cannot be trusted.
+	ValidateAuthorizeRequest(req *AuthorizeRequest) (*Client, error)
+	// ConsentURL returns the consent screen for an authorization request query
+	ConsentURL(query string) string
+	GetConsentInfo(userID primitive.ObjectID, req *AuthorizeRequest) (*ConsentInfo, error)
+	// Authorize records the answer of the user & returns where to send them back to
+	Authorize(userID primitive.ObjectID, req *ConsentRequest) (*AuthorizeResponse, error)
+
+	Token(client *Client, req *TokenRequest) (*TokenResponse, error)
+	Revoke(client *Client, token string, hint string) error
+	Introspect(token string) (*Introspection, error)
+	UserInfo(accessToken string) (*UserInfo, error)
+	Metadata() *ProviderMetadata
+}
+
+type service struct {
+	db     *mongo.Database
+	coll   *config.Collection
+	keys   tokenpkg.KeyService
+	tokens tokenpkg.Service
+	// policy is the one of access tokens, each client is their audience
+	policy     *tokenpkg.Policy
+	users      userpkg.Service
+	issuer     string
+	consentURL string
+}
+
+// scopes that only make sense when a user is involved
+var userScopes = []string{ScopeOpenID, ScopeProfile, ScopeEmail, ScopePhone, ScopeOfflineAccess}
+
+// NewService returns new instance of oauth service.
+// OAUTH_ISSUER is the public url of this server, as clients see it.
+// OAUTH_CONSENT_URL is the page of the frontend that shows the consent
+// screen, this server does not serve one.
+// Access tokens are issued in the format of the token service, id tokens
+// are always JWTs signed by the key service as OpenID Connect requires.
+func NewService(db *mongo.Database, coll *config.Collection, keys tokenpkg.KeyService, tokens tokenpkg.Service, users userpkg.Service) (Service, error) {
+	issuer := config.GetFromEnv("OAUTH_ISSUER")
+	if issuer == "" {
+		issuer = "http://localhost:8080"
+	}
+	issuer = strings.TrimSuffix(issuer, "/")
+	consentURL := config.GetFromEnv("OAUTH_CONSENT_URL")
+	if consentURL == "" {
+		return nil, errors.New("OAUTH_CONSENT_URL is required")
+	}
+
+	policy := *tokens.Policy()
+	policy.Issuer = issuer
+	policy.TTL = config.GetDurationFromEnv("OAUTH_ACCESS_TOKEN_TTL", 1*time.Hour)
+
+	return service{db, coll, keys, tokens, &policy, users, issuer, consentURL}, nil
+}
+
+func (s service) CreateClient(createdBy primitive.ObjectID, req *CreateClientRequest) (*CreateClientResponse, error) {
+	grantTypes := req.GrantTypes
+	if len(grantTypes) == 0 {
+		grantTypes = []string{GrantAuthorizationCode, GrantRefreshToken}
+	}
+	for _, grantType := range grantTypes {
+		switch grantType {
+		case GrantAuthorizationCode, GrantRefreshToken:
+		case GrantClientCredentials:
+			if req.Public {
+				return nil, errors.New("public clients cannot use client credentials")
+			}
+		default:
+			return nil, errors.New("invalid grant type")
+		}
+	}
+
+	if contains(grantTypes, GrantAuthorizationCode) && len(req.RedirectURIs) == 0 {
+		return nil, errors.New("redirect uri required")
+	}
+	for _, uri := range req.RedirectURIs {
+		u, err := url.Parse(uri)
+		if err != nil || !u.IsAbs() || u.Fragment != "" {
+			return nil, errors.New("invalid redirect uri")
+		}
+	}
+
+	scopes := req.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{ScopeOpenID, ScopeProfile, ScopeEmail}
+	}
+
+	clientID, err := randomToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &Client{
+		ClientID:     clientID,
+		Name:         req.Name,
+		RedirectURIs: req.RedirectURIs,
+		GrantTypes:   grantTypes,
+		Scopes:       scopes,
+		Public:       req.Public,
+		CreatedBy:    createdBy,
+		CreatedAt:    time.Now(),
+	}
+	if client.RedirectURIs == nil {
+		client.RedirectURIs = []string{}
+	}
+
+	var secret string
+	if !req.Public {
+		secret, err = randomToken(32)
+		if err != nil {
+			return nil, err
+		}
+		client.SecretHash = hashToken(secret)
+	}
+
+	resp, err := s.db.Collection(s.coll.OAuthClientCollection).InsertOne(context.TODO(), client)
+	if err != nil {
+		return nil, err
+	}
+	client.ID = resp.InsertedID.(primitive.ObjectID)
+
+	return &CreateClientResponse{Client: client, ClientSecret: secret}, nil
+}
+
+func (s service) GetClients() ([]Client, error) {
+	clients := []Client{}
+	cursor, err := s.db.Collection(s.coll.OAuthClientCollection).Find(
+		context.TODO(),
+		bson.M{},
+		options.Find().SetSort(bson.M{"createdAt": -1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(context.TODO(), &clients)
+	if err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+func (s service) getClient(clientID string) (*Client, error) {
+	var client Client
+	err := s.db.Collection(s.coll.OAuthClientCollection).FindOne(context.TODO(), bson.M{"clientId": clientID}).Decode(&client)
+	if err == mongo.ErrNoDocuments {
+		return nil, errors.New("client not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+func (s service) DeleteClient(clientID string) error {
+	res, err := s.db.Collection(s.coll.OAuthClientCollection).DeleteOne(context.TODO(), bson.M{"clientId": clientID})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return errors.New("client not found")
+	}
+
+	//access tokens die with the client, refresh tokens & consents are cleaned up
+	_, err = s.db.Collection(s.coll.OAuthRefreshTokenCollection).UpdateMany(
+		context.TODO(),
+		bson.M{"clientId": clientID},
+		bson.M{"$set": bson.M{"revoked": true}},
+	)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Collection(s.coll.OAuthConsentCollection).DeleteMany(context.TODO(), bson.M{"clientId": clientID})
+	return err
+}
+
+func (s service) AuthenticateClient(clientID string, secret string) (*Client, error) {
+	if clientID == "" {
+		return nil, newError(ErrInvalidClient, "client authentication required")
+	}
+
+	client, err := s.getClient(clientID)
+	if err != nil && err.Error() != "client not found" {
+		return nil, err
+	}
+	if err != nil {
+		return nil, newError(ErrInvalidClient, "client authentication failed")
+	}
+
+	if client.Public {
+		if secret != "" {
+			return nil, newError(ErrInvalidClient, "client authentication failed")
+		}
+		return client, nil
+	}
+
+	if secret == "" || subtle.ConstantTimeCompare([]byte(client.SecretHash), []byte(hashToken(secret))) != 1 {
+		return nil, newError(ErrInvalidClient, "client authentication failed")
+	}
+	return client, nil
+}
+
+func (s service) ValidateAuthorizeRequest(req *AuthorizeRequest) (*Client, error) {
+	client, err := s.getClient(req.ClientID)
+	if err != nil && err.Error() != "client not found" {
+		return nil, err
+	}
+	if err != nil {
+		return nil, newError(ErrInvalidClient, "unknown client")
+	}
+	if req.RedirectURI == "" || !client.AllowsRedirectURI(req.RedirectURI) {
+		return nil, newError(ErrInvalidRequest, "redirect_uri is not registered for the client")
+	}
+
+	//from here on errors can be sent back to the client
+	if req.ResponseType != "code" {
+		return client, newError(ErrUnsupportedResponseType, "only the code response type is supported")
+	}
+	if !client.AllowsGrant(GrantAuthorizationCode) {
+		return client, newError(ErrUnauthorizedClient, "client may not use the authorization code grant")
+	}
+
+	scopes := parseScopes(req.Scope)
+	if len(scopes) == 0 {
+		return client, newError(ErrInvalidScope, "scope is required")
+	}
+	if !client.AllowsScopes(scopes) {
+		return client, newError(ErrInvalidScope, "scope is not allowed for the client")
+	}
+
+	if req.CodeChallenge == "" {
+		return client, newError(ErrInvalidRequest, "code_challenge is required")
+	}
+	if req.CodeChallengeMethod != PKCEMethodS256 {
+		return client, newError(ErrInvalidRequest, "code_challenge_method must be S256")
+	}
+
+	return client, nil
+}
+
+func (s service) ConsentURL(query string) string {
+	return s.consentURL + "?" + query
+}
+
+func (s service) GetConsentInfo(userID primitive.ObjectID, req *AuthorizeRequest) (*ConsentInfo, error) {
+	client, err := s.ValidateAuthorizeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	scopes := parseScopes(req.Scope)
+	given, err := s.hasConsent(userID, client.ClientID, scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ConsentInfo{
+		ClientID:     client.ClientID,
+		ClientName:   client.Name,
+		Scopes:       scopes,
+		ConsentGiven: given,
+	}, nil
+}
+
+func (s service) hasConsent(userID primitive.ObjectID, clientID string, scopes []string) (bool, error) {
+	var consent Consent
+	err := s.db.Collection(s.coll.OAuthConsentCollection).FindOne(
+		context.TODO(),
+		bson.M{"userId": userID, "clientId": clientID},
+	).Decode(&consent)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for _, scope := range scopes {
+		if !contains(consent.Scopes, scope) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (s service) Authorize(userID primitive.ObjectID, req *ConsentRequest) (*AuthorizeResponse, error) {
+	client, err := s.ValidateAuthorizeRequest(&req.AuthorizeRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	if !req.Approve {
+		denied := newError(ErrAccessDenied, "the user denied the request")
+		return &AuthorizeResponse{RedirectURI: RedirectURL(req.RedirectURI, ErrorParams(denied, req.State))}, nil
+	}
+
+	now := time.Now()
+	scopes := parseScopes(req.Scope)
+	_, err = s.db.Collection(s.coll.OAuthConsentCollection).UpdateOne(
+		context.TODO(),
+		bson.M{"userId": userID, "clientId": client.ClientID},
+		bson.M{
+			"$addToSet": bson.M{"scopes": bson.M{"$each": scopes}},
+			"$set":      bson.M{"grantedAt": now},
+		},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	code, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	ac := AuthorizationCode{
+		CodeHash:      hashToken(code),
+		ClientID:      client.ClientID,
+		UserID:        userID,
+		RedirectURI:   req.RedirectURI,
+		Scopes:        scopes,
+		Nonce:         req.Nonce,
+		CodeChallenge: req.CodeChallenge,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(config.GetDurationFromEnv("OAUTH_CODE_TTL", 5*time.Minute)),
+	}
+	_, err = s.db.Collection(s.coll.OAuthCodeCollection).InsertOne(context.TODO(), ac)
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{"code": {code}}
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	return &AuthorizeResponse{RedirectURI: RedirectURL(req.RedirectURI, params)}, nil
+}
+
+func (s service) Token(client *Client, req *TokenRequest) (*TokenResponse, error) {
+	switch req.GrantType {
+	case GrantAuthorizationCode, GrantClientCredentials, GrantRefreshToken:
+	case "":
+		return nil, newError(ErrInvalidRequest, "grant_type is required")
+	default:
+		return nil, newError(ErrUnsupportedGrantType, "grant type is not supported")
+	}
+
+	if !client.AllowsGrant(req.GrantType) {
+		return nil, newError(ErrUnauthorizedClient, "client may not use this grant type")
+	}
+
+	switch req.GrantType {
+	case GrantAuthorizationCode:
+		return s.exchangeCode(client, req)
+	case GrantClientCredentials:
+		return s.clientCredentials(client, req)
+	default:
+		return s.refresh(client, req)
+	}
+}
+
+func (s service) exchangeCode(client *Client, req *TokenRequest) (*TokenResponse, error) {
+	if req.Code == "" {
+		return nil, newError(ErrInvalidRequest, "code is required")
+	}
+
+	coll := s.db.Collection(s.coll.OAuthCodeCollection)
+	codeHash := hashToken(req.Code)
+
+	//codes can only be redeemed once
+	var code AuthorizationCode
+	err := coll.FindOneAndUpdate(
+		context.TODO(),
+		bson.M{"codeHash": codeHash, "usedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"usedAt": time.Now()}},
+	).Decode(&code)
+	if err == mongo.ErrNoDocuments {
+		//a redeemed code is replayed, revoke what was issued for it
+		var used AuthorizationCode
+		if err := coll.FindOne(context.TODO(), bson.M{"codeHash": codeHash}).Decode(&used); err == nil {
+			if err := s.revokeRefreshTokenFamily(used.ID); err != nil {
+				return nil, err
+			}
+			log.Printf("Authorization code reuse detected for client %s, tokens revoked", used.ClientID)
+		}
+		return nil, newError(ErrInvalidGrant, "invalid authorization code")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if code.ExpiresAt.Before(time.Now()) {
+		return nil, newError(ErrInvalidGrant, "authorization code expired")
+	}
+	if code.ClientID != client.ClientID {
+		return nil, newError(ErrInvalidGrant, "authorization code was issued to another client")
+	}
+	if req.RedirectURI != code.RedirectURI {
+		return nil, newError(ErrInvalidGrant, "redirect_uri does not match")
+	}
+	if !verifyPKCE(code.CodeChallenge, req.CodeVerifier) {
+		return nil, newError(ErrInvalidGrant, "invalid code_verifier")
+	}
+
+	user, err := s.activeUser(code.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	//the code starts a new refresh token family
+	return s.issueTokens(client, user, code.Scopes, code.Scopes, code.Nonce, code.ID)
+}
+
+func (s service) clientCredentials(client *Client, req *TokenRequest) (*TokenResponse, error) {
+	if client.Public {
+		return nil, newError(ErrUnauthorizedClient, "public clients cannot use client credentials")
+	}
+
+	scopes := parseScopes(req.Scope)
+	if len(scopes) == 0 {
+		for _, scope := range client.Scopes {
+			if !contains(userScopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	for _, scope := range scopes {
+		if contains(userScopes, scope) {
+			return nil, newError(ErrInvalidScope, "scope "+scope+" needs a user")
+		}
+	}
+	if !client.AllowsScopes(scopes) {
+		return nil, newError(ErrInvalidScope, "scope is not allowed for the client")
+	}
+
+	//the client acts on its own behalf
+	accessToken, err := s.createAccessToken(client.ClientID, client.ClientID, scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(s.policy.TTL.Seconds()),
+		Scope:       strings.Join(scopes, " "),
+	}, nil
+}
+
+func (s service) refresh(client *Client, req *TokenRequest) (*TokenResponse, error) {
+	if req.RefreshToken == "" {
+		return nil, newError(ErrInvalidRequest, "refresh_token is required")
+	}
+
+	coll := s.db.Collection(s.coll.OAuthRefreshTokenCollection)
+	tokenHash := hashToken(req.RefreshToken)
+	now := time.Now()
+
+	//mark the token as used, only succeeds once per token
+	var rt RefreshToken
+	err := coll.FindOneAndUpdate(
+		context.TODO(),
+		bson.M{"tokenHash": tokenHash, "clientId": client.ClientID, "usedAt": bson.M{"$exists": false}, "revoked": false},
+		bson.M{"$set": bson.M{"usedAt": now}},
+	).Decode(&rt)
+	if err == mongo.ErrNoDocuments {
+		//a known token that was already used, revoked or presented by another client leaked
+		var reused RefreshToken
+		if err := coll.FindOne(context.TODO(), bson.M{"tokenHash": tokenHash}).Decode(&reused); err == nil {
+			if err := s.revokeRefreshTokenFamily(reused.FamilyID); err != nil {
+				return nil, err
+			}
+			log.Printf("OAuth refresh token reuse detected for client %s, family %s revoked", reused.ClientID, reused.FamilyID.Hex())
+		}
+		return nil, newError(ErrInvalidGrant, "invalid refresh token")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if rt.ExpiresAt.Before(now) {
+		return nil, newError(ErrInvalidGrant, "refresh token expired")
+	}
+
+	user, err := s.activeUser(rt.UserID)
+	if err != nil {
+		return nil, err
+	}
+	//logging out everywhere, resetting the password or blocking ends oauth grants too
+	if user.TokensValidAfter != nil && !rt.CreatedAt.After(*user.TokensValidAfter) {
+		return nil, newError(ErrInvalidGrant, "refresh token revoked")
+	}
+
+	//the access token may ask for less, the grant itself stays the same
+	scopes := rt.Scopes
+	if req.Scope != "" {
+		scopes = parseScopes(req.Scope)
+		for _, scope := range scopes {
+			if !contains(rt.Scopes, scope) {
+				return nil, newError(ErrInvalidScope, "scope exceeds the original grant")
+			}
+		}
+	}
+
+	return s.issueTokens(client, user, scopes, rt.Scopes, "", rt.FamilyID)
+}
+
+// activeUser returns the user a grant was made by, unless they can no longer log in
+func (s service) activeUser(userID primitive.ObjectID) (*userpkg.User, error) {
+	user, err := s.users.GetUser(bson.M{"_id": userID}, nil)
+	if err == mongo.ErrNoDocuments {
+		return nil, newError(ErrInvalidGrant, "user not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.IsBlocked {
+		return nil, newError(ErrInvalidGrant, "user is blocked")
+	}
+	return user, nil
+}
+
+// issueTokens issues the tokens for scopes, granted is what the user
+// approved & what a new refresh token carries on
+func (s service) issueTokens(client *Client, user *userpkg.User, scopes []string, granted []string, nonce string, familyID primitive.ObjectID) (*TokenResponse, error) {
+	accessToken, err := s.createAccessToken(client.ClientID, user.ID.Hex(), scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(s.policy.TTL.Seconds()),
+		Scope:       strings.Join(scopes, " "),
+	}
+
+	if contains(scopes, ScopeOpenID) {
+		resp.IDToken, err = s.createIDToken(client.ClientID, user, scopes, nonce)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if contains(granted, ScopeOfflineAccess) && client.AllowsGrant(GrantRefreshToken) {
+		resp.RefreshToken, err = s.createRefreshToken(client.ClientID, user.ID, granted, familyID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return resp, nil
+}
+
+// clientPolicy is the policy of the access tokens of a client, they are
+// only accepted for it
+func (s service) clientPolicy(clientID string) *tokenpkg.Policy {
+	policy := s.policy.WithAudience(clientID)
+	policy.Audiences = []string{clientID}
+	return policy
+}
+
+func (s service) createAccessToken(clientID string, subject string, scopes []string) (string, error) {
+	policy := s.clientPolicy(clientID)
+	claims := AccessTokenClaims{
+		ClientID:         clientID,
+		Scope:            strings.Join(scopes, " "),
+		RegisteredClaims: policy.RegisteredClaims(subject, policy.TTL),
+	}
+	return s.tokens.Issue(&claims)
+}
+
+func (s service) createIDToken(clientID string, user *userpkg.User, scopes []string, nonce string) (string, error) {
+	now := time.Now()
+	claims := IDTokenClaims{
+		Nonce:   nonce,
+		Profile: profileClaims(user, scopes),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.issuer,
+			Subject:   user.ID.Hex(),
+			Audience:  jwt.ClaimStrings{clientID},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.policy.TTL)),
+		},
+	}
+	return s.keys.Sign(claims)
+}
+
+func (s service) createRefreshToken(clientID string, userID primitive.ObjectID, scopes []string, familyID primitive.ObjectID) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	rt := RefreshToken{
+		TokenHash: hashToken(token),
+		FamilyID:  familyID,
+		ClientID:  clientID,
+		UserID:    userID,
+		Scopes:    scopes,
+		CreatedAt: now,
+		ExpiresAt: now.Add(config.GetDurationFromEnv("OAUTH_REFRESH_TOKEN_TTL", 30*24*time.Hour)),
+	}
+	_, err = s.db.Collection(s.coll.OAuthRefreshTokenCollection).InsertOne(context.TODO(), rt)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (s service) revokeRefreshTokenFamily(familyID primitive.ObjectID) error {
+	_, err := s.db.Collection(s.coll.OAuthRefreshTokenCollection).UpdateMany(
+		context.TODO(),
+		bson.M{"familyId": familyID},
+		bson.M{"$set": bson.M{"revoked": true}},
+	)
+	return err
+}
+
+func (s service) Revoke(client *Client, token string, hint string) error {
+	//tokens of other clients & unknown tokens are ignored (RFC 7009)
+	if hint != TokenTypeAccess {
+		var rt RefreshToken
+		err := s.db.Collection(s.coll.OAuthRefreshTokenCollection).FindOne(
+			context.TODO(),
+			bson.M{"tokenHash": hashToken(token), "clientId": client.ClientID},
+		).Decode(&rt)
+		if err == nil {
+			return s.revokeRefreshTokenFamily(rt.FamilyID)
+		}
+		if err != mongo.ErrNoDocuments {
+			return err
+		}
+	}
+
+	claims, err := s.parseAccessToken(token)
+	if err != nil || claims.ClientID != client.ClientID {
+		return nil
+	}
+
+	if !claims.isClientToken() {
+		userID, err := primitive.ObjectIDFromHex(claims.Subject)
+		if err != nil {
+			return nil
+		}
+		return s.users.RevokeAccessToken(userID, claims.ID, claims.ExpiresAt.Unix())
+	}
+
+	_, err = s.db.Collection(s.coll.RevokedTokenCollection).UpdateOne(
+		context.TODO(),
+		bson.M{"_id": claims.ID},
+		bson.M{"$setOnInsert": bson.M{"revokedAt": time.Now(), "expiresAt": claims.ExpiresAt.Time}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// parseAccessToken verifies an access token issued by this server to a client
+func (s service) parseAccessToken(token string) (*AccessTokenClaims, error) {
+	claims := &AccessTokenClaims{}
+	if err := s.tokens.Decode(token, claims); err != nil {
+		return nil, newError(ErrInvalidToken, "invalid access token")
+	}
+
+	//our own login tokens have no client, they are not accepted here
+	if claims.ClientID == "" {
+		return nil, newError(ErrInvalidToken, "invalid access token")
+	}
+	if err := s.clientPolicy(claims.ClientID).Validate(claims.Registered()); err != nil {
+		return nil, newError(ErrInvalidToken, "invalid access token")
+	}
+	return claims, nil
+}
+
+// activeAccessToken verifies an access token & checks it was not revoked since
+func (s service) activeAccessToken(token string) (*AccessTokenClaims, error) {
+	claims, err := s.parseAccessToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := s.getClient(claims.ClientID); err != nil {
+		if err.Error() == "client not found" {
+			return nil, newError(ErrInvalidToken, "client no longer exists")
+		}
+		return nil, err
+	}
+
+	if claims.isClientToken() {
+		count, err := s.db.Collection(s.coll.RevokedTokenCollection).CountDocuments(context.TODO(), bson.M{"_id": claims.ID})
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			return nil, newError(ErrInvalidToken, "token revoked")
+		}
+		return claims, nil
+	}
+
+	userID, err := primitive.ObjectIDFromHex(claims.Subject)
+	if err != nil {
+		return nil, newError(ErrInvalidToken, "invalid access token")
+	}
+	if err := s.users.CheckTokenRevocation(userID, claims.ID, "", claims.IssuedAt.Unix()); err != nil {
+		switch err.Error() {
+		case "token revoked", "user not found", "user is blocked":
+			return nil, newError(ErrInvalidToken, err.Error())
+		default:
+			return nil, err
+		}
+	}
+	return claims, nil
+}
+
+func (s service) Introspect(token string) (*Introspection, error) {
+	claims, err := s.activeAccessToken(token)
+	if err == nil {
+		return &Introspection{
+			Active:    true,
+			Scope:     claims.Scope,
+			ClientID:  claims.ClientID,
+			Subject:   claims.Subject,
+			TokenType: "Bearer",
+			ExpiresAt: claims.ExpiresAt.Unix(),
+			IssuedAt:  claims.IssuedAt.Unix(),
+			Issuer:    claims.Issuer,
+			TokenID:   claims.ID,
+		}, nil
+	}
+	var oauthErr *Error
+	if !errors.As(err, &oauthErr) {
+		return nil, err
+	}
+
+	//not an access token, maybe a refresh token
+	var rt RefreshToken
+	err = s.db.Collection(s.coll.OAuthRefreshTokenCollection).FindOne(context.TODO(), bson.M{"tokenHash": hashToken(token)}).Decode(&rt)
+	if err == mongo.ErrNoDocuments {
+		return &Introspection{Active: false}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if rt.Revoked || rt.UsedAt != nil || rt.ExpiresAt.Before(time.Now()) {
+		return &Introspection{Active: false}, nil
+	}
+	if _, err := s.activeUser(rt.UserID); err != nil {
+		if errors.As(err, &oauthErr) {
+			return &Introspection{Active: false}, nil
+		}
+		return nil, err
+	}
+
+	return &Introspection{
+		Active:    true,
+		Scope:     strings.Join(rt.Scopes, " "),
+		ClientID:  rt.ClientID,
+		Subject:   rt.UserID.Hex(),
+		ExpiresAt: rt.ExpiresAt.Unix(),
+		IssuedAt:  rt.CreatedAt.Unix(),
+		Issuer:    s.issuer,
+	}, nil
+}
+
+func (s service) UserInfo(accessToken string) (*UserInfo, error) {
+	claims, err := s.activeAccessToken(accessToken)
+	if err != nil {
+		return nil, err
+	}
+	if claims.isClientToken() {
+		return nil, newError(ErrInvalidToken, "token was not issued for a user")
+	}
+
+	scopes := parseScopes(claims.Scope)
+	if !contains(scopes, ScopeOpenID) {
+		return nil, newError(ErrInsufficientScope, "the openid scope is required")
+	}
+
+	userID, err := primitive.ObjectIDFromHex(claims.Subject)
+	if err != nil {
+		return nil, newError(ErrInvalidToken, "invalid access token")
+	}
+	user, err := s.users.GetUser(bson.M{"_id": userID}, nil)
+	if err == mongo.ErrNoDocuments {
+		return nil, newError(ErrInvalidToken, "user not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &UserInfo{Subject: user.ID.Hex(), Profile: profileClaims(user, scopes)}, nil
+}
+
+func (s service) Metadata() *ProviderMetadata {
+	return &ProviderMetadata{
+		Issuer:                            s.issuer,
+		AuthorizationEndpoint:             s.issuer + "/oauth/authorize",
+		TokenEndpoint:                     s.issuer + "/oauth/token",
+		UserInfoEndpoint:                  s.issuer + "/oauth/userinfo",
+		JWKSURI:                           s.issuer + "/.well-known/jwks.json",
+		RevocationEndpoint:                s.issuer + "/oauth/revoke",
+		IntrospectionEndpoint:             s.issuer + "/oauth/introspect",
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{GrantAuthorizationCode, GrantClientCredentials, GrantRefreshToken},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{s.keys.Alg()},
+		ScopesSupported:                   userScopes,
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{PKCEMethodS256},
+		ClaimsSupported: []string{
+			"sub", "iss", "aud", "exp", "iat", "nonce",
+			"name", "given_name", "family_name", "email", "email_verified", "phone_number",
+		},
+	}
+}
@@ -0,0 +1,143 @@
+package oauthpkg
+
+import (
+	userpkg "mahi-go-explorer/pkg/user"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Token type hints for revocation & introspection (RFC 7009)
+const (
+	TokenTypeAccess  = "access_token"
+	TokenTypeRefresh = "refresh_token"
+)
+
+// TokenRequest defines the token endpoint request, sent form encoded
+type TokenRequest struct {
+	GrantType    string `form:"grant_type"`
+	Code         string `form:"code"`
+	RedirectURI  string `form:"redirect_uri"`
+	CodeVerifier string `form:"code_verifier"`
+	RefreshToken string `form:"refresh_token"`
+	Scope        string `form:"scope"`
+}
+
+// TokenResponse defines the token endpoint response
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Scope        string `json:"scope,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+}
+
+// RefreshToken defines oauth refresh token schema, tokens rotated from the
+// same authorization share a FamilyID so reuse can revoke all of them
+type RefreshToken struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	TokenHash string             `bson:"tokenHash"`
+	FamilyID  primitive.ObjectID `bson:"familyId"`
+	ClientID  string             `bson:"clientId"`
+	UserID    primitive.ObjectID `bson:"userId"`
+	Scopes    []string           `bson:"scopes"`
+	CreatedAt time.Time          `bson:"createdAt"`
+	ExpiresAt time.Time          `bson:"expiresAt"`
+	UsedAt    *time.Time         `bson:"usedAt,omitempty"`
+	Revoked   bool               `bson:"revoked"`
+}
+
+// AccessTokenClaims are the claims of access tokens issued to clients.
+// Tokens from client credentials have the client as subject.
+type AccessTokenClaims struct {
+	ClientID string `json:"client_id"`
+	Scope    string `json:"scope,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// Registered returns the registered claims, for the token service
+func (c *AccessTokenClaims) Registered() *jwt.RegisteredClaims {
+	return &c.RegisteredClaims
+}
+
+// isClientToken checks the token was issued to the client itself, not a user
+func (c *AccessTokenClaims) isClientToken() bool {
+	return c.Subject == c.ClientID
+}
+
+// Profile holds the user claims released by the profile, email & phone scopes
+type Profile struct {
+	Name          string `json:"name,omitempty"`
+	GivenName     string `json:"given_name,omitempty"`
+	FamilyName    string `json:"family_name,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+	PhoneNumber   string `json:"phone_number,omitempty"`
+}
+
+// IDTokenClaims are the claims of OpenID Connect id tokens
+type IDTokenClaims struct {
+	Nonce string `json:"nonce,omitempty"`
+	Profile
+	jwt.RegisteredClaims
+}
+
+// UserInfo defines the userinfo endpoint response
+type UserInfo struct {
+	Subject string `json:"sub"`
+	Profile
+}
+
+// Introspection defines the introspection response (RFC 7662)
+type Introspection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+	TokenID   string `json:"jti,omitempty"`
+}
+
+// profileClaims returns the claims of user that the scopes release
+func profileClaims(user *userpkg.User, scopes []string) Profile {
+	var p Profile
+	if contains(scopes, ScopeProfile) {
+		p.GivenName = user.FirstName
+		p.FamilyName = user.LastName
+		p.Name = strings.TrimSpace(user.FirstName + " " + user.LastName)
+	}
+	if contains(scopes, ScopeEmail) {
+		verified := user.EmailVerified
+		p.Email = user.Email
+		p.EmailVerified = &verified
+	}
+	if contains(scopes, ScopePhone) {
+		p.PhoneNumber = user.Phone
+	}
+	return p
+}
+
+// ProviderMetadata defines the OpenID Connect discovery document
+type ProviderMetadata struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	RevocationEndpoint                string   `json:"revocation_endpoint"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
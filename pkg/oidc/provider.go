@@ -0,0 +1,407 @@
+package oidcpkg
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mahi-go-explorer/internal/config"
+	tokenpkg "mahi-go-explorer/pkg/token"
+	userpkg "mahi-go-explorer/pkg/user"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Provider is an upstream OpenID Connect identity provider
+type Provider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	// RoleClaim names the claim holding the values mapped by RoleMap
+	RoleClaim string
+	// RoleMap maps claim values to roles, the highest ranking match wins.
+	// Users matching none get DefaultRole, roles are left alone without a map.
+	RoleMap     map[string]string
+	DefaultRole string
+
+	client *http.Client
+	cache  *providerCache
+}
+
+// providerMetadata is the part of the discovery document we use
+type providerMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// tokenResponse is the part of the token response we use
+type tokenResponse struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// providerCache holds the discovery document & signing keys of a provider
+type providerCache struct {
+	mu         sync.Mutex
+	metadata   *providerMetadata
+	metadataAt time.Time
+	keys       map[string]crypto.PublicKey
+	keysAt     time.Time
+}
+
+const (
+	// discovery documents & keys are refetched after this
+	providerCacheTTL = 1 * time.Hour
+	// an unknown kid forces a refetch of the keys, but not more often than this
+	keyRefetchInterval = 1 * time.Minute
+)
+
+// signing algorithms accepted for id tokens, never HS256 with a public key
+var idTokenAlgs = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// loadProviders reads the providers named in OIDC_PROVIDERS, each configured
+// by OIDC_<NAME>_ISSUER, _CLIENT_ID, _CLIENT_SECRET, _REDIRECT_URL, _SCOPES,
+// _ROLE_CLAIM, _ROLE_MAP ("value=ROLE,...") & _DEFAULT_ROLE
+func loadProviders() map[string]*Provider {
+	providers := map[string]*Provider{}
+
+	for _, name := range strings.Split(config.GetFromEnv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+
+		p := &Provider{
+			Name:         name,
+			Issuer:       strings.TrimSuffix(config.GetFromEnv(prefix+"ISSUER"), "/"),
+			ClientID:     config.GetFromEnv(prefix + "CLIENT_ID"),
+			ClientSecret: config.GetFromEnv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  config.GetFromEnv(prefix + "REDIRECT_URL"),
+			Scopes:       strings.Fields(config.GetFromEnv(prefix + "SCOPES")),
+			RoleClaim:    config.GetFromEnv(prefix + "ROLE_CLAIM"),
+			RoleMap:      userpkg.ParseRoleMap(config.GetFromEnv(prefix + "ROLE_MAP")),
+			DefaultRole:  config.GetFromEnv(prefix + "DEFAULT_ROLE"),
+		}
+		if p.Issuer == "" || p.ClientID == "" {
+			log.Printf("Skipping OIDC provider %s: issuer & client id are required", name)
+			continue
+		}
+		if p.RedirectURL == "" {
+			p.RedirectURL = config.FrontendURL() + "/auth/oidc/" + name + "/callback"
+		}
+
+		providers[name] = newProvider(p)
+	}
+
+	return providers
+}
+
+// newProvider fills in the defaults of a provider
+func newProvider(p *Provider) *Provider {
+	if len(p.Scopes) == 0 {
+		p.Scopes = []string{"openid", "email", "profile"}
+	}
+	if !contains(p.Scopes, "openid") {
+		p.Scopes = append([]string{"openid"}, p.Scopes...)
+	}
+	if p.RoleClaim == "" {
+		p.RoleClaim = "groups"
+	}
+	if p.DefaultRole == "" {
+		p.DefaultRole = userpkg.RoleUser
+	}
+	if p.client == nil {
+		p.client = &http.Client{Timeout: 10 * time.Second}
+	}
+	p.cache = &providerCache{}
+	return p
+}
+
+// discover returns the discovery document of the provider
+func (p *Provider) discover() (*providerMetadata, error) {
+	p.cache.mu.Lock()
+	defer p.cache.mu.Unlock()
+
+	if p.cache.metadata != nil && time.Since(p.cache.metadataAt) < providerCacheTTL {
+		return p.cache.metadata, nil
+	}
+
+	var metadata providerMetadata
+	if err := p.getJSON(p.Issuer+"/.well-known/openid-configuration", &metadata); err != nil {
+		return nil, err
+	}
+
+	//the document must be about the provider we asked, or anyone could sign tokens for it
+	if strings.TrimSuffix(metadata.Issuer, "/") != p.Issuer {
+		return nil, errors.New("issuer mismatch in discovery document")
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, errors.New("incomplete discovery document")
+	}
+
+	p.cache.metadata = &metadata
+	p.cache.metadataAt = time.Now()
+	return &metadata, nil
+}
+
+// authCodeURL returns the url that starts the login at the provider
+func (p *Provider) authCodeURL(state string, nonce string, codeChallenge string) (string, error) {
+	metadata, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {strings.Join(p.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {codeChallenge},
+		"code_challenge_method": {"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(metadata.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return metadata.AuthorizationEndpoint + sep + params.Encode(), nil
+}
+
+// exchange redeems the authorization code at the token endpoint
+func (p *Provider) exchange(code string, codeVerifier string) (*tokenResponse, error) {
+	metadata, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"code_verifier": {codeVerifier},
+	}
+	if p.ClientSecret == "" {
+		form.Set("client_id", p.ClientID)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var tokens tokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("invalid token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token request failed: %s %s", tokens.Error, tokens.ErrorDescription)
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("token response has no id token")
+	}
+
+	return &tokens, nil
+}
+
+// verifyIDToken checks the signature, issuer, audience, lifetime & nonce of an id token
+func (p *Provider) verifyIDToken(raw string, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	parser := jwt.NewParser(jwt.WithValidMethods(idTokenAlgs))
+	token, err := parser.ParseWithClaims(raw, claims, p.keyfunc)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid id token")
+	}
+
+	if !claims.VerifyIssuer(p.Issuer, true) {
+		return nil, errors.New("invalid issuer")
+	}
+	if !claims.VerifyAudience(p.ClientID, true) {
+		return nil, errors.New("invalid audience")
+	}
+	//with several audiences the token must name us as the party it was issued to
+	if aud, ok := claims["aud"].([]interface{}); ok && len(aud) > 1 {
+		if azp, _ := claims["azp"].(string); azp != p.ClientID {
+			return nil, errors.New("invalid authorized party")
+		}
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, errors.New("id token has no expiry")
+	}
+	if n, _ := claims["nonce"].(string); nonce == "" || n != nonce {
+		return nil, errors.New("invalid nonce")
+	}
+
+	return claims, nil
+}
+
+// keyfunc finds the provider key that signed a token
+func (p *Provider) keyfunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+
+	key, err := p.signingKey(kid, false)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		//the provider may have rotated its keys
+		if key, err = p.signingKey(kid, true); err != nil {
+			return nil, err
+		}
+	}
+	if key == nil {
+		return nil, errors.New("unknown signing key")
+	}
+	return key, nil
+}
+
+// signingKey returns the key with kid, a token without kid works when the provider has one key
+func (p *Provider) signingKey(kid string, refetch bool) (crypto.PublicKey, error) {
+	metadata, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	p.cache.mu.Lock()
+	defer p.cache.mu.Unlock()
+
+	age := time.Since(p.cache.keysAt)
+	if p.cache.keys == nil || age > providerCacheTTL || (refetch && age > keyRefetchInterval) {
+		var jwks tokenpkg.JWKS
+		if err := p.getJSON(metadata.JWKSURI, &jwks); err != nil {
+			return nil, err
+		}
+
+		keys := map[string]crypto.PublicKey{}
+		for _, jwk := range jwks.Keys {
+			if jwk.Use != "" && jwk.Use != "sig" {
+				continue
+			}
+			key, err := jwk.PublicKey()
+			if err != nil {
+				log.Printf("Skipping key %s of OIDC provider %s: %v", jwk.Kid, p.Name, err)
+				continue
+			}
+			keys[jwk.Kid] = key
+		}
+		p.cache.keys = keys
+		p.cache.keysAt = time.Now()
+	}
+
+	if kid == "" && len(p.cache.keys) == 1 {
+		for _, key := range p.cache.keys {
+			return key, nil
+		}
+	}
+	return p.cache.keys[kid], nil
+}
+
+func (p *Provider) getJSON(u string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// externalUser maps the id token claims to the user they describe
+func (p *Provider) externalUser(claims jwt.MapClaims) (*userpkg.ExternalUser, error) {
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, errors.New("id token has no subject")
+	}
+
+	ext := &userpkg.ExternalUser{
+		Provider: p.Name,
+		Subject:  sub,
+		Role:     p.role(claims),
+	}
+	ext.Email, _ = claims["email"].(string)
+	ext.FirstName, _ = claims["given_name"].(string)
+	ext.LastName, _ = claims["family_name"].(string)
+
+	//some providers send the flag as a string
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		ext.EmailVerified = v
+	case string:
+		ext.EmailVerified = v == "true"
+	}
+
+	if ext.FirstName == "" && ext.LastName == "" {
+		name, _ := claims["name"].(string)
+		ext.FirstName, ext.LastName, _ = strings.Cut(name, " ")
+	}
+
+	return ext, nil
+}
+
+// role maps the role claim to the highest ranking configured role
+func (p *Provider) role(claims jwt.MapClaims) string {
+	if len(p.RoleMap) == 0 {
+		return ""
+	}
+
+	var values []string
+	switch v := claims[p.RoleClaim].(type) {
+	case string:
+		values = strings.Fields(v)
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	return userpkg.MapRole(values, p.RoleMap, p.DefaultRole)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
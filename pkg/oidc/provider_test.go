@@ -0,0 +1,261 @@
+package oidcpkg
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	tokenpkg "mahi-go-explorer/pkg/token"
+	userpkg "mahi-go-explorer/pkg/user"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockIdP is a local OpenID Connect provider
+type mockIdP struct {
+	*httptest.Server
+	t            *testing.T
+	key          *rsa.PrivateKey
+	clientID     string
+	clientSecret string
+	// codes maps issued codes to the challenge & nonce of their login
+	codes map[string][2]string
+	// claims are added to the id tokens issued for codes
+	claims jwt.MapClaims
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &mockIdP{
+		t:            t,
+		key:          key,
+		clientID:     "app",
+		clientSecret: "s3cret",
+		codes:        map[string][2]string{},
+		claims:       jwt.MapClaims{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		enc := base64.RawURLEncoding
+		json.NewEncoder(w).Encode(tokenpkg.JWKS{Keys: []tokenpkg.JWK{{
+			Kty: "RSA",
+			Use: "sig",
+			Kid: "idp-key",
+			Alg: "RS256",
+			N:   enc.EncodeToString(key.N.Bytes()),
+			E:   enc.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		login, ok := idp.codes[r.PostFormValue("code")]
+		switch {
+		case id != idp.clientID || secret != idp.clientSecret:
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		case !ok || codeChallenge(r.PostFormValue("code_verifier")) != login[0]:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		claims := idp.idTokenClaims(login[1])
+		for k, v := range idp.claims {
+			claims[k] = v
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "upstream-access",
+			"token_type":   "Bearer",
+			"id_token":     idp.sign(claims, "idp-key", key),
+		})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+
+	return idp
+}
+
+func (idp *mockIdP) idTokenClaims(nonce string) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":            idp.URL,
+		"sub":            "user-123",
+		"aud":            idp.clientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Minute).Unix(),
+		"nonce":          nonce,
+		"email":          "ada@example.com",
+		"email_verified": true,
+		"given_name":     "Ada",
+		"family_name":    "Lovelace",
+	}
+}
+
+func (idp *mockIdP) sign(claims jwt.MapClaims, kid string, key *rsa.PrivateKey) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	return signed
+}
+
+func (idp *mockIdP) provider() *Provider {
+	return newProvider(&Provider{
+		Name:         "corp",
+		Issuer:       idp.URL,
+		ClientID:     idp.clientID,
+		ClientSecret: idp.clientSecret,
+		RedirectURL:  "https://app.example.com/auth/oidc/corp/callback",
+		RoleMap:      userpkg.ParseRoleMap("admins=ADMIN,helpdesk=support"),
+	})
+}
+
+func TestProviderLogin(t *testing.T) {
+	idp := newMockIdP(t)
+	idp.claims["groups"] = []string{"staff", "admins"}
+	p := idp.provider()
+
+	verifier, _ := randomToken()
+	authURL, err := p.authCodeURL("state-1", "nonce-1", codeChallenge(verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	assert.Equal(t, idp.URL+"/authorize", u.Scheme+"://"+u.Host+u.Path)
+	assert.Equal(t, "code", q.Get("response_type"))
+	assert.Equal(t, "app", q.Get("client_id"))
+	assert.Equal(t, p.RedirectURL, q.Get("redirect_uri"))
+	assert.Equal(t, "openid email profile", q.Get("scope"))
+	assert.Equal(t, "state-1", q.Get("state"))
+	assert.Equal(t, "nonce-1", q.Get("nonce"))
+	assert.Equal(t, "S256", q.Get("code_challenge_method"))
+
+	//the user logs in at the provider, which sends them back with a code
+	idp.codes["code-1"] = [2]string{q.Get("code_challenge"), q.Get("nonce")}
+
+	_, err = p.exchange("code-1", "wrong-verifier-wrong-verifier-wrong-verifier")
+	assert.Error(t, err)
+
+	tokens, err := p.exchange("code-1", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := p.verifyIDToken(tokens.IDToken, "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ext, err := p.externalUser(claims)
+	assert.NoError(t, err)
+	assert.Equal(t, &userpkg.ExternalUser{
+		Provider:      "corp",
+		Subject:       "user-123",
+		Email:         "ada@example.com",
+		EmailVerified: true,
+		FirstName:     "Ada",
+		LastName:      "Lovelace",
+		Role:          userpkg.RoleAdmin,
+	}, ext)
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	idp := newMockIdP(t)
+	p := idp.provider()
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type testCase struct {
+		Name          string
+		Claims        jwt.MapClaims
+		Kid           string
+		Key           *rsa.PrivateKey
+		ExpectedValid bool
+	}
+
+	tests := []testCase{
+		{Name: "Valid token", ExpectedValid: true},
+		{Name: "Wrong nonce", Claims: jwt.MapClaims{"nonce": "other"}},
+		{Name: "Wrong audience", Claims: jwt.MapClaims{"aud": "other-app"}},
+		{Name: "Wrong issuer", Claims: jwt.MapClaims{"iss": "https://evil.example.com"}},
+		{Name: "Expired", Claims: jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()}},
+		{Name: "Several audiences without azp", Claims: jwt.MapClaims{"aud": []string{"app", "other-app"}}},
+		{Name: "Several audiences with azp", Claims: jwt.MapClaims{"aud": []string{"app", "other-app"}, "azp": "app"}, ExpectedValid: true},
+		{Name: "Signed by unknown key", Kid: "other-key", Key: otherKey},
+		{Name: "Signed by other key with known kid", Key: otherKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			claims := idp.idTokenClaims("nonce-1")
+			for k, v := range tt.Claims {
+				claims[k] = v
+			}
+			kid, key := "idp-key", idp.key
+			if tt.Key != nil {
+				key = tt.Key
+			}
+			if tt.Kid != "" {
+				kid = tt.Kid
+			}
+
+			_, err := p.verifyIDToken(idp.sign(claims, kid, key), "nonce-1")
+			if tt.ExpectedValid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+
+	//HS256 signed with the public key must not be accepted
+	hs := jwt.NewWithClaims(jwt.SigningMethodHS256, idp.idTokenClaims("nonce-1"))
+	hs.Header["kid"] = "idp-key"
+	signed, _ := hs.SignedString(idp.key.N.Bytes())
+	_, err = p.verifyIDToken(signed, "nonce-1")
+	assert.Error(t, err)
+}
+
+func TestProviderRole(t *testing.T) {
+	p := newProvider(&Provider{RoleMap: userpkg.ParseRoleMap("admins=ADMIN, helpdesk=support, bad=ROOT")})
+
+	assert.Equal(t, map[string]string{"admins": userpkg.RoleAdmin, "helpdesk": userpkg.RoleSupport}, p.RoleMap)
+	assert.Equal(t, userpkg.RoleUser, p.role(jwt.MapClaims{}))
+	assert.Equal(t, userpkg.RoleSupport, p.role(jwt.MapClaims{"groups": []interface{}{"staff", "helpdesk"}}))
+	assert.Equal(t, userpkg.RoleAdmin, p.role(jwt.MapClaims{"groups": []interface{}{"admins", "helpdesk"}}))
+	assert.Equal(t, userpkg.RoleAdmin, p.role(jwt.MapClaims{"groups": "helpdesk admins"}))
+
+	//without a mapping the provider does not manage roles
+	assert.Equal(t, "", newProvider(&Provider{}).role(jwt.MapClaims{"groups": "admins"}))
+}
@@ -0,0 +1,204 @@
+package oidcpkg
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"mahi-go-explorer/internal/config"
+	userpkg "mahi-go-explorer/pkg/user"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Service defines interface for logging in through upstream OpenID Connect providers
+type Service interface {
+	// Providers returns the names of the configured providers
+	Providers() []string
+	// StartLogin returns the url that sends the user to the provider & the
+	// secret of the browser the login has to finish in
+	StartLogin(provider string) (authURL string, binding string, err error)
+	// FinishLogin exchanges the code the provider sent the user back with for our tokens
+	FinishLogin(provider string, req *CallbackRequest) (*userpkg.LoginResponse, error)
+}
+
+type service struct {
+	db        *mongo.Database
+	coll      *config.Collection
+	users     userpkg.Service
+	providers map[string]*Provider
+}
+
+// CallbackRequest defines what the provider sent the user back with
+type CallbackRequest struct {
+	Code  string `json:"code,omitempty"`
+	State string `json:"state,omitempty"`
+	// Error is set when the provider did not log the user in
+	Error string `json:"error,omitempty"`
+	// Binding is the secret of the browser, set by the handler from its cookie
+	Binding string `json:"-"`
+	userpkg.ClientInfo
+}
+
+// loginState is remembered between sending the user to the provider & them
+// coming back, only the hash of the state is stored
+type loginState struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty"`
+	StateHash    string             `bson:"stateHash"`
+	BindingHash  string             `bson:"bindingHash"`
+	Provider     string             `bson:"provider"`
+	Nonce        string             `bson:"nonce"`
+	CodeVerifier string             `bson:"codeVerifier"`
+	ExpiresAt    time.Time          `bson:"expiresAt"`
+}
+
+// LoginStateTTL is how long users have to log in at the provider
+const LoginStateTTL = 10 * time.Minute
+
+// NewService returns new instance of oidc login service
+func NewService(db *mongo.Database, coll *config.Collection, users userpkg.Service) Service {
+	return service{db, coll, users, loadProviders()}
+}
+
+func (s service) Providers() []string {
+	names := []string{}
+	for name := range s.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s service) StartLogin(name string) (string, string, error) {
+	p, ok := s.providers[name]
+	if !ok {
+		return "", "", errors.New("provider not found")
+	}
+
+	state, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	//only the browser that started the login can finish it, so nobody can
+	//slip their own code & state into someone else's browser
+	binding, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	u, err := p.authCodeURL(state, nonce, codeChallenge(verifier))
+	if err != nil {
+		return "", "", err
+	}
+
+	ls := loginState{
+		StateHash:    hashToken(state),
+		BindingHash:  hashToken(binding),
+		Provider:     name,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		ExpiresAt:    time.Now().Add(LoginStateTTL),
+	}
+	_, err = s.db.Collection(s.coll.OIDCStateCollection).InsertOne(context.TODO(), ls)
+	if err != nil {
+		return "", "", err
+	}
+
+	return u, binding, nil
+}
+
+func (s service) FinishLogin(name string, req *CallbackRequest) (*userpkg.LoginResponse, error) {
+	p, ok := s.providers[name]
+	if !ok {
+		return nil, errors.New("provider not found")
+	}
+
+	//a state can only be used once
+	var ls loginState
+	err := s.db.Collection(s.coll.OIDCStateCollection).FindOneAndDelete(
+		context.TODO(),
+		bson.M{"stateHash": hashToken(req.State), "provider": name},
+	).Decode(&ls)
+	if err == mongo.ErrNoDocuments {
+		return nil, errors.New("invalid state")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ls.ExpiresAt.Before(time.Now()) {
+		return nil, errors.New("invalid state")
+	}
+	if !boundTo(ls.BindingHash, req.Binding) {
+		return nil, errors.New("login started in another browser")
+	}
+
+	if req.Error != "" {
+		log.Printf("Login at OIDC provider %s failed: %s", name, req.Error)
+		return nil, errors.New("provider login failed")
+	}
+
+	tokens, err := p.exchange(req.Code, ls.CodeVerifier)
+	if err != nil {
+		log.Printf("Code exchange with OIDC provider %s failed: %v", name, err)
+		return nil, errors.New("provider login failed")
+	}
+
+	claims, err := p.verifyIDToken(tokens.IDToken, ls.Nonce)
+	if err != nil {
+		log.Printf("ID token of OIDC provider %s rejected: %v", name, err)
+		return nil, errors.New("provider login failed")
+	}
+
+	ext, err := p.externalUser(claims)
+	if err != nil {
+		log.Printf("ID token of OIDC provider %s rejected: %v", name, err)
+		return nil, errors.New("provider login failed")
+	}
+
+	user, err := s.users.ProvisionExternalUser(ext)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.users.CompleteLogin(user, userpkg.AMRFederated, req.ClientInfo)
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// boundTo checks the browser secret matches the hash of the login state
+func boundTo(bindingHash string, binding string) bool {
+	return binding != "" && subtle.ConstantTimeCompare([]byte(bindingHash), []byte(hashToken(binding))) == 1
+}
+
+// codeChallenge derives the S256 PKCE challenge from the verifier
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
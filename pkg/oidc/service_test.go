@@ -0,0 +1,31 @@
+package oidcpkg
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBoundTo(t *testing.T) {
+	type testCase struct {
+		Name     string
+		Binding  string
+		Expected bool
+	}
+
+	bindingHash := hashToken("browser-secret")
+	tests := []testCase{
+		{Name: "Browser that started the login", Binding: "browser-secret", Expected: true},
+		{Name: "Another browser", Binding: "other-secret", Expected: false},
+		{Name: "Browser without the cookie", Binding: "", Expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			assert.Equal(t, tt.Expected, boundTo(bindingHash, tt.Binding))
+		})
+	}
+
+	//states stored before browsers were bound can't be finished
+	assert.False(t, boundTo("", ""))
+}
@@ -0,0 +1,62 @@
+package passwordpkg
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BreachedChecker defines interface for checking passwords against known breaches
+type BreachedChecker interface {
+	IsBreached(password string) (bool, error)
+}
+
+// prefixDirChecker looks passwords up in a local copy of the Have I Been Pwned
+// range files: one file per 5 character SHA-1 prefix, holding SUFFIX:COUNT lines
+type prefixDirChecker struct {
+	dir string
+}
+
+// NewPrefixDirChecker returns a checker reading range files from dir
+func NewPrefixDirChecker(dir string) BreachedChecker {
+	return prefixDirChecker{dir: dir}
+}
+
+func (c prefixDirChecker) IsBreached(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	f, err := c.open(prefix)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		candidate, count, _ := strings.Cut(line, ":")
+		if strings.EqualFold(candidate, suffix) {
+			//padding entries from the range api carry a zero count
+			return strings.TrimSpace(count) != "0", nil
+		}
+	}
+
+	return false, scanner.Err()
+}
+
+func (c prefixDirChecker) open(prefix string) (*os.File, error) {
+	f, err := os.Open(filepath.Join(c.dir, prefix))
+	if errors.Is(err, os.ErrNotExist) {
+		return os.Open(filepath.Join(c.dir, prefix+".txt"))
+	}
+	return f, err
+}
@@ -0,0 +1,190 @@
+package passwordpkg
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mahi-go-explorer/internal/config"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Supported hashing algorithms
+const (
+	AlgArgon2id = "argon2id"
+	AlgBcrypt   = "bcrypt"
+)
+
+// Hasher defines interface for hashing passwords into PHC format strings
+type Hasher interface {
+	// Hash hashes the password with the preferred algorithm & parameters
+	Hash(password string) (string, error)
+	// Verify checks the password against a hash made by any supported algorithm
+	Verify(encoded string, password string) (bool, error)
+	// NeedsRehash reports if the hash uses an outdated algorithm or parameters
+	NeedsRehash(encoded string) bool
+}
+
+// Argon2Params defines argon2id parameters, Memory is in KiB
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// HasherConfig defines the preferred algorithm & its parameters
+type HasherConfig struct {
+	Algorithm  string
+	Argon2     Argon2Params
+	BcryptCost int
+}
+
+type hasher struct {
+	config HasherConfig
+}
+
+// NewHasher returns new instance of password hasher
+func NewHasher(config HasherConfig) Hasher {
+	return hasher{config}
+}
+
+var (
+	defaultHasherOnce sync.Once
+	defaultHasher     Hasher
+)
+
+// DefaultHasher returns the hasher configured by the PASSWORD_HASH_* envs
+func DefaultHasher() Hasher {
+	defaultHasherOnce.Do(func() {
+		algorithm := config.GetFromEnv("PASSWORD_HASH_ALGORITHM")
+		if algorithm != AlgBcrypt {
+			algorithm = AlgArgon2id
+		}
+
+		defaultHasher = NewHasher(HasherConfig{
+			Algorithm: algorithm,
+			Argon2: Argon2Params{
+				Memory:      uint32(config.GetIntFromEnv("ARGON2_MEMORY", 64*1024)),
+				Iterations:  uint32(config.GetIntFromEnv("ARGON2_ITERATIONS", 3)),
+				Parallelism: uint8(config.GetIntFromEnv("ARGON2_PARALLELISM", 2)),
+				SaltLength:  16,
+				KeyLength:   32,
+			},
+			BcryptCost: config.GetIntFromEnv("BCRYPT_COST", 12),
+		})
+	})
+	return defaultHasher
+}
+
+func (h hasher) Hash(password string) (string, error) {
+	if h.config.Algorithm == AlgBcrypt {
+		//bcrypt's own $2a$ format is the accepted PHC style encoding for it
+		b, err := bcrypt.GenerateFromPassword([]byte(password), h.config.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+
+	p := h.config.Argon2
+	salt := make([]byte, p.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		enc.EncodeToString(salt), enc.EncodeToString(key),
+	), nil
+}
+
+func (h hasher) Verify(encoded string, password string) (bool, error) {
+	switch algorithmOf(encoded) {
+	case AlgArgon2id:
+		p, salt, key, err := decodeArgon2id(encoded)
+		if err != nil {
+			return false, err
+		}
+		other := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+	case AlgBcrypt:
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	default:
+		return false, errors.New("unknown password hash format")
+	}
+}
+
+func (h hasher) NeedsRehash(encoded string) bool {
+	algorithm := algorithmOf(encoded)
+	if algorithm != h.config.Algorithm {
+		return true
+	}
+
+	if algorithm == AlgBcrypt {
+		cost, err := bcrypt.Cost([]byte(encoded))
+		return err != nil || cost < h.config.BcryptCost
+	}
+
+	p, _, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	want := h.config.Argon2
+	return p.Memory != want.Memory || p.Iterations != want.Iterations ||
+		p.Parallelism != want.Parallelism || uint32(len(key)) != want.KeyLength
+}
+
+func algorithmOf(encoded string) string {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		return AlgArgon2id
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		return AlgBcrypt
+	}
+	return ""
+}
+
+// decodeArgon2id parses $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+func decodeArgon2id(encoded string) (Argon2Params, []byte, []byte, error) {
+	var p Argon2Params
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return p, nil, nil, errors.New("invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, errors.New("unsupported argon2 version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return p, nil, nil, errors.New("invalid argon2id parameters")
+	}
+
+	enc := base64.RawStdEncoding
+	salt, err := enc.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, errors.New("invalid argon2id salt")
+	}
+	key, err := enc.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, errors.New("invalid argon2id hash")
+	}
+	p.SaltLength = uint32(len(salt))
+	p.KeyLength = uint32(len(key))
+
+	return p, salt, key, nil
+}
@@ -0,0 +1,66 @@
+package passwordpkg
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var testArgon2 = Argon2Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func TestHasherArgon2id(t *testing.T) {
+	h := NewHasher(HasherConfig{Algorithm: AlgArgon2id, Argon2: testArgon2, BcryptCost: bcrypt.MinCost})
+
+	encoded, err := h.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, strings.HasPrefix(encoded, "$argon2id$v=19$m=1024,t=1,p=1$"))
+
+	ok, err := h.Verify(encoded, "correct horse")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = h.Verify(encoded, "wrong horse")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	assert.False(t, h.NeedsRehash(encoded))
+
+	//stronger parameters make existing hashes outdated
+	stronger := NewHasher(HasherConfig{Algorithm: AlgArgon2id, Argon2: Argon2Params{Memory: 2048, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}})
+	assert.True(t, stronger.NeedsRehash(encoded))
+}
+
+func TestHasherLegacyBcrypt(t *testing.T) {
+	legacy, err := bcrypt.GenerateFromPassword([]byte("admin123"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHasher(HasherConfig{Algorithm: AlgArgon2id, Argon2: testArgon2})
+
+	//old hashes keep working but get upgraded
+	ok, err := h.Verify(string(legacy), "admin123")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, h.NeedsRehash(string(legacy)))
+
+	//bcrypt stays preferred when configured, as long as the cost is high enough
+	bh := NewHasher(HasherConfig{Algorithm: AlgBcrypt, BcryptCost: bcrypt.MinCost + 1})
+	assert.True(t, bh.NeedsRehash(string(legacy)))
+	upgraded, err := bh.Hash("admin123")
+	assert.NoError(t, err)
+	assert.False(t, bh.NeedsRehash(upgraded))
+}
+
+func TestHasherRejectsUnknownFormat(t *testing.T) {
+	h := NewHasher(HasherConfig{Algorithm: AlgArgon2id, Argon2: testArgon2})
+
+	ok, err := h.Verify("plaintext", "plaintext")
+	assert.Error(t, err)
+	assert.False(t, ok)
+	assert.True(t, h.NeedsRehash("plaintext"))
+}
@@ -0,0 +1,146 @@
+package passwordpkg
+
+import (
+	"mahi-go-explorer/internal/config"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// FieldError defines a single rule a field breaks
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// PolicyError is returned when a password breaks one or more rules
+type PolicyError struct {
+	Errors []FieldError
+}
+
+func (e *PolicyError) Error() string {
+	return "password policy violation"
+}
+
+// Policy defines the rules a password has to follow
+type Policy struct {
+	MinLength     int
+	MaxLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// DisallowPersonal bans passwords containing the user's email or name
+	DisallowPersonal bool
+	// Breached rejects passwords found in known breaches, nil disables the check
+	Breached BreachedChecker
+}
+
+var (
+	defaultPolicyOnce sync.Once
+	defaultPolicy     *Policy
+)
+
+// DefaultPolicy returns the policy configured by the PASSWORD_* envs
+func DefaultPolicy() *Policy {
+	defaultPolicyOnce.Do(func() {
+		defaultPolicy = &Policy{
+			MinLength:        config.GetIntFromEnv("PASSWORD_MIN_LENGTH", 8),
+			MaxLength:        config.GetIntFromEnv("PASSWORD_MAX_LENGTH", 128),
+			RequireUpper:     config.GetBoolFromEnv("PASSWORD_REQUIRE_UPPER", false),
+			RequireLower:     config.GetBoolFromEnv("PASSWORD_REQUIRE_LOWER", false),
+			RequireDigit:     config.GetBoolFromEnv("PASSWORD_REQUIRE_DIGIT", false),
+			RequireSymbol:    config.GetBoolFromEnv("PASSWORD_REQUIRE_SYMBOL", false),
+			DisallowPersonal: config.GetBoolFromEnv("PASSWORD_DISALLOW_PERSONAL", true),
+		}
+		if dir := config.GetFromEnv("PASSWORD_BREACH_DIR"); dir != "" {
+			defaultPolicy.Breached = NewPrefixDirChecker(dir)
+		}
+	})
+	return defaultPolicy
+}
+
+// Validate checks the password against the policy. personal holds values
+// the password may not contain, such as the email and names of the user.
+func (p *Policy) Validate(password string, personal ...string) error {
+	var errs []FieldError
+	add := func(code string, message string) {
+		errs = append(errs, FieldError{Field: "password", Code: code, Message: message})
+	}
+
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		add("too_short", "Password must be at least "+strconv.Itoa(p.MinLength)+" characters")
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		add("too_long", "Password must be at most "+strconv.Itoa(p.MaxLength)+" characters")
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+	if p.RequireUpper && !upper {
+		add("missing_upper", "Password must contain an uppercase letter")
+	}
+	if p.RequireLower && !lower {
+		add("missing_lower", "Password must contain a lowercase letter")
+	}
+	if p.RequireDigit && !digit {
+		add("missing_digit", "Password must contain a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		add("missing_symbol", "Password must contain a symbol")
+	}
+
+	if p.DisallowPersonal && containsPersonal(password, personal) {
+		add("contains_personal", "Password must not contain your email or name")
+	}
+
+	//only worth a lookup when nothing else is wrong
+	if len(errs) == 0 && p.Breached != nil {
+		breached, err := p.Breached.IsBreached(password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			add("breached", "Password has appeared in a data breach, choose another one")
+		}
+	}
+
+	if len(errs) > 0 {
+		return &PolicyError{Errors: errs}
+	}
+	return nil
+}
+
+// containsPersonal checks the password for any personal value, or the local part of an email
+func containsPersonal(password string, personal []string) bool {
+	lower := strings.ToLower(password)
+	for _, v := range personal {
+		v = strings.ToLower(strings.TrimSpace(v))
+		if i := strings.Index(v, "@"); i > 0 {
+			v = v[:i]
+		}
+		//very short values would ban too much
+		if utf8.RuneCountInString(v) < 3 {
+			continue
+		}
+		if strings.Contains(lower, v) {
+			return true
+		}
+	}
+	return false
+}
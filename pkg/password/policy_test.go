@@ -0,0 +1,82 @@
+package passwordpkg
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicyValidate(t *testing.T) {
+	policy := &Policy{
+		MinLength:        10,
+		MaxLength:        64,
+		RequireUpper:     true,
+		RequireDigit:     true,
+		DisallowPersonal: true,
+	}
+
+	type testCase struct {
+		Name          string
+		Password      string
+		ExpectedCodes []string
+	}
+
+	tests := []testCase{
+		{Name: "Valid password", Password: "Correct-Horse-7"},
+		{Name: "Short password", Password: "Ab1", ExpectedCodes: []string{"too_short"}},
+		{Name: "Missing classes", Password: "correcthorsebattery", ExpectedCodes: []string{"missing_upper", "missing_digit"}},
+		{Name: "Contains email", Password: "Johnny1234567", ExpectedCodes: []string{"contains_personal"}},
+		{Name: "Contains name", Password: "XX-Doe-Smith-9", ExpectedCodes: []string{"contains_personal"}},
+		{Name: "Too long", Password: "A1" + strings.Repeat("x", 70), ExpectedCodes: []string{"too_long"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			err := policy.Validate(tt.Password, "johnny@example.com", "Jo", "Smith")
+			if len(tt.ExpectedCodes) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+
+			var policyErr *PolicyError
+			if !errors.As(err, &policyErr) {
+				t.Fatalf("expected a policy error, got %v", err)
+			}
+
+			codes := []string{}
+			for _, e := range policyErr.Errors {
+				assert.Equal(t, "password", e.Field)
+				codes = append(codes, e.Code)
+			}
+			assert.Equal(t, tt.ExpectedCodes, codes)
+		})
+	}
+}
+
+func TestPrefixDirChecker(t *testing.T) {
+	dir := t.TempDir()
+
+	sum := sha1.Sum([]byte("P@ssw0rd-breached"))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	content := "0018A45C4D1DEF81644B54AB7F969B88D65:3\r\n" + hash[5:] + ":42\r\n"
+	if err := os.WriteFile(filepath.Join(dir, hash[:5]), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := &Policy{MinLength: 8, Breached: NewPrefixDirChecker(dir)}
+
+	err := policy.Validate("P@ssw0rd-breached")
+	var policyErr *PolicyError
+	if assert.True(t, errors.As(err, &policyErr)) {
+		assert.Equal(t, "breached", policyErr.Errors[0].Code)
+	}
+
+	//no range file for the prefix means not breached
+	assert.NoError(t, policy.Validate("an unbreached passphrase"))
+}
@@ -0,0 +1,394 @@
+package samlpkg
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"mahi-go-explorer/internal/config"
+	userpkg "mahi-go-explorer/pkg/user"
+	"os"
+	"strings"
+	"time"
+
+	saml2 "github.com/russellhaering/gosaml2"
+	"github.com/russellhaering/gosaml2/types"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// Provider is a SAML 2.0 identity provider we are a service provider for
+type Provider struct {
+	Name string
+	// IdPSSOURL receives the authentication requests of SP-initiated logins
+	IdPSSOURL string
+	// IdPIssuer is the entity id of the identity provider
+	IdPIssuer string
+	// IdPCertificates verify the signatures of responses & assertions
+	IdPCertificates []*x509.Certificate
+	// EntityID & ACSURL identify us to the identity provider
+	EntityID string
+	ACSURL   string
+	// SPCertificate decrypts assertions & signs requests, optional
+	SPCertificate *tls.Certificate
+	SignRequests  bool
+	// RequireEncryption rejects assertions that were not encrypted for us
+	RequireEncryption bool
+	// AllowIdPInitiated accepts responses that do not answer a request of ours
+	AllowIdPInitiated bool
+
+	// Attributes the user is mapped from, the email falls back to the NameID
+	EmailAttribute     string
+	FirstNameAttribute string
+	LastNameAttribute  string
+	RoleAttribute      string
+	// RoleMap maps attribute values to roles, the highest ranking match wins.
+	// Users matching none get DefaultRole, roles are left alone without a map.
+	RoleMap     map[string]string
+	DefaultRole string
+
+	sp *saml2.SAMLServiceProvider
+}
+
+// assertion is what a valid response told us about the user
+type assertion struct {
+	// InResponseTo is the id of our request, empty for IdP-initiated logins
+	InResponseTo string
+	ID           string
+	// ExpiresAt is when the assertion can no longer be replayed
+	ExpiresAt time.Time
+	User      *userpkg.ExternalUser
+}
+
+// rawResponse is used to see how the assertions of a response were sent
+type rawResponse struct {
+	Assertions          []struct{} `xml:"urn:oasis:names:tc:SAML:2.0:assertion Assertion"`
+	EncryptedAssertions []struct{} `xml:"urn:oasis:names:tc:SAML:2.0:assertion EncryptedAssertion"`
+}
+
+// loadProviders reads the providers named in SAML_PROVIDERS, each configured
+// by SAML_<NAME>_IDP_SSO_URL, _IDP_ISSUER, _IDP_CERT (PEM or a file holding
+// it), _SIGN_REQUESTS, _REQUIRE_ENCRYPTION, _ALLOW_IDP_INITIATED, the
+// _*_ATTRIBUTE names, _ROLE_MAP & _DEFAULT_ROLE. SAML_SP_CERT & SAML_SP_KEY
+// hold the key pair assertions are encrypted for.
+func loadProviders() map[string]*Provider {
+	providers := map[string]*Provider{}
+
+	names := strings.Split(config.GetFromEnv("SAML_PROVIDERS"), ",")
+	if len(names) == 1 && strings.TrimSpace(names[0]) == "" {
+		return providers
+	}
+
+	var spCert *tls.Certificate
+	if certPEM, keyPEM := config.GetFromEnv("SAML_SP_CERT"), config.GetFromEnv("SAML_SP_KEY"); certPEM != "" || keyPEM != "" {
+		cert, err := loadKeyPair(certPEM, keyPEM)
+		if err != nil {
+			log.Printf("Invalid SAML service provider key pair: %v", err)
+		} else {
+			spCert = cert
+		}
+	}
+
+	baseURL := config.GetFromEnv("SAML_BASE_URL")
+	if baseURL == "" {
+		baseURL = config.AppURL()
+	}
+	baseURL = strings.TrimSuffix(baseURL, "/")
+
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "SAML_" + strings.ToUpper(name) + "_"
+
+		certs, err := loadCertificates(config.GetFromEnv(prefix + "IDP_CERT"))
+		if err != nil {
+			log.Printf("Skipping SAML provider %s: %v", name, err)
+			continue
+		}
+
+		p := &Provider{
+			Name:               name,
+			IdPSSOURL:          config.GetFromEnv(prefix + "IDP_SSO_URL"),
+			IdPIssuer:          config.GetFromEnv(prefix + "IDP_ISSUER"),
+			IdPCertificates:    certs,
+			EntityID:           baseURL + "/api/auth/saml/" + name + "/metadata",
+			ACSURL:             baseURL + "/api/auth/saml/" + name + "/acs",
+			SPCertificate:      spCert,
+			SignRequests:       config.GetBoolFromEnv(prefix+"SIGN_REQUESTS", false),
+			RequireEncryption:  config.GetBoolFromEnv(prefix+"REQUIRE_ENCRYPTION", false),
+			AllowIdPInitiated:  config.GetBoolFromEnv(prefix+"ALLOW_IDP_INITIATED", false),
+			EmailAttribute:     config.GetFromEnv(prefix + "EMAIL_ATTRIBUTE"),
+			FirstNameAttribute: config.GetFromEnv(prefix + "FIRST_NAME_ATTRIBUTE"),
+			LastNameAttribute:  config.GetFromEnv(prefix + "LAST_NAME_ATTRIBUTE"),
+			RoleAttribute:      config.GetFromEnv(prefix + "ROLE_ATTRIBUTE"),
+			RoleMap:            userpkg.ParseRoleMap(config.GetFromEnv(prefix + "ROLE_MAP")),
+			DefaultRole:        config.GetFromEnv(prefix + "DEFAULT_ROLE"),
+		}
+		if p.IdPSSOURL == "" || p.IdPIssuer == "" || len(p.IdPCertificates) == 0 {
+			log.Printf("Skipping SAML provider %s: sso url, issuer & certificate are required", name)
+			continue
+		}
+		if (p.SignRequests || p.RequireEncryption) && p.SPCertificate == nil {
+			log.Printf("Skipping SAML provider %s: signing requests & encryption need SAML_SP_CERT & SAML_SP_KEY", name)
+			continue
+		}
+
+		providers[name] = newProvider(p)
+	}
+
+	return providers
+}
+
+// newProvider fills in the defaults of a provider
+func newProvider(p *Provider) *Provider {
+	if p.EmailAttribute == "" {
+		p.EmailAttribute = "email"
+	}
+	if p.FirstNameAttribute == "" {
+		p.FirstNameAttribute = "firstName"
+	}
+	if p.LastNameAttribute == "" {
+		p.LastNameAttribute = "lastName"
+	}
+	if p.RoleAttribute == "" {
+		p.RoleAttribute = "groups"
+	}
+	if p.DefaultRole == "" {
+		p.DefaultRole = userpkg.RoleUser
+	}
+
+	p.sp = &saml2.SAMLServiceProvider{
+		IdentityProviderSSOURL:      p.IdPSSOURL,
+		IdentityProviderIssuer:      p.IdPIssuer,
+		IDPCertificateStore:         &dsig.MemoryX509CertificateStore{Roots: p.IdPCertificates},
+		ServiceProviderIssuer:       p.EntityID,
+		AudienceURI:                 p.EntityID,
+		AssertionConsumerServiceURL: p.ACSURL,
+		SignAuthnRequests:           p.SignRequests,
+		AllowMissingAttributes:      true,
+	}
+	if p.SPCertificate != nil {
+		p.sp.SPKeyStore = dsig.TLSCertKeyStore(*p.SPCertificate)
+	}
+
+	return p
+}
+
+// metadata returns the service provider metadata to register with the identity provider
+func (p *Provider) metadata() ([]byte, error) {
+	md, err := p.sp.Metadata()
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := xml.MarshalIndent(md, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+// authnRequest returns the url that sends the user to the identity provider
+// with a new authentication request, and the id of that request
+func (p *Provider) authnRequest() (string, string, error) {
+	//the redirect binding signs the query instead of the document
+	doc, err := p.sp.BuildAuthRequestDocumentNoSig()
+	if err != nil {
+		return "", "", err
+	}
+	id := doc.Root().SelectAttrValue("ID", "")
+	if id == "" {
+		return "", "", errors.New("authentication request without id")
+	}
+
+	u, err := p.sp.BuildAuthURLRedirect("", doc)
+	if err != nil {
+		return "", "", err
+	}
+	return u, id, nil
+}
+
+// parseResponse validates the base64 encoded response the identity provider
+// posted to us, checking its signatures, decrypting its assertion & checking
+// that it is meant for us right now
+func (p *Provider) parseResponse(encoded string) (*assertion, error) {
+	if p.RequireEncryption {
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		var rr rawResponse
+		if err := xml.Unmarshal(raw, &rr); err != nil {
+			return nil, err
+		}
+		if len(rr.Assertions) > 0 || len(rr.EncryptedAssertions) == 0 {
+			return nil, errors.New("assertion not encrypted")
+		}
+	}
+
+	response, err := p.sp.ValidateEncodedResponse(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Assertions) != 1 {
+		return nil, fmt.Errorf("expected one assertion, got %d", len(response.Assertions))
+	}
+	a := response.Assertions[0]
+
+	//the library reports these as warnings only
+	warnings, err := p.sp.VerifyAssertionConditions(&a)
+	if err != nil {
+		return nil, err
+	}
+	if warnings.InvalidTime {
+		return nil, errors.New("assertion expired or not yet valid")
+	}
+	if warnings.NotInAudience {
+		return nil, errors.New("assertion not meant for us")
+	}
+	if len(a.Conditions.AudienceRestrictions) == 0 {
+		return nil, errors.New("assertion has no audience")
+	}
+
+	inResponseTo := a.Subject.SubjectConfirmation.SubjectConfirmationData.InResponseTo
+	if response.InResponseTo != inResponseTo {
+		return nil, errors.New("response & assertion answer different requests")
+	}
+	if inResponseTo == "" && !p.AllowIdPInitiated {
+		return nil, errors.New("identity provider initiated login not allowed")
+	}
+
+	if a.Subject.NameID == nil || a.Subject.NameID.Value == "" {
+		return nil, errors.New("assertion has no subject")
+	}
+	if a.ID == "" {
+		return nil, errors.New("assertion has no id")
+	}
+
+	expiresAt, err := time.Parse(time.RFC3339, a.Conditions.NotOnOrAfter)
+	if err != nil {
+		return nil, err
+	}
+
+	return &assertion{
+		InResponseTo: inResponseTo,
+		ID:           a.ID,
+		ExpiresAt:    expiresAt,
+		User:         p.externalUser(&a),
+	}, nil
+}
+
+// externalUser maps the assertion to the user it describes
+func (p *Provider) externalUser(a *types.Assertion) *userpkg.ExternalUser {
+	nameID := a.Subject.NameID.Value
+
+	ext := &userpkg.ExternalUser{
+		//names are shared with oidc providers, keep the identities apart
+		Provider:  "saml:" + p.Name,
+		Subject:   nameID,
+		Email:     first(attributeValues(a, p.EmailAttribute)),
+		FirstName: first(attributeValues(a, p.FirstNameAttribute)),
+		LastName:  first(attributeValues(a, p.LastNameAttribute)),
+		//the identity provider is set up by our admins, like a directory
+		EmailVerified: true,
+	}
+	if ext.Email == "" && strings.Contains(nameID, "@") {
+		ext.Email = nameID
+	}
+	ext.Email = strings.ToLower(ext.Email)
+
+	if len(p.RoleMap) > 0 {
+		ext.Role = userpkg.MapRole(attributeValues(a, p.RoleAttribute), p.RoleMap, p.DefaultRole)
+	}
+
+	return ext
+}
+
+// attributeValues returns the values of the attribute with the name or friendly name
+func attributeValues(a *types.Assertion, name string) []string {
+	values := []string{}
+	if a.AttributeStatement == nil {
+		return values
+	}
+	for _, attr := range a.AttributeStatement.Attributes {
+		if attr.Name != name && attr.FriendlyName != name {
+			continue
+		}
+		for _, v := range attr.Values {
+			if s := strings.TrimSpace(v.Value); s != "" {
+				values = append(values, s)
+			}
+		}
+	}
+	return values
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// readPEM returns v when it is PEM, or the contents of the file it names
+func readPEM(v string) ([]byte, error) {
+	v = strings.TrimSpace(v)
+	if strings.HasPrefix(v, "-----BEGIN") {
+		//multi line values are often squashed into one in env files
+		return []byte(strings.ReplaceAll(v, `\n`, "\n")), nil
+	}
+	return os.ReadFile(v)
+}
+
+func loadKeyPair(certPEM string, keyPEM string) (*tls.Certificate, error) {
+	certBytes, err := readPEM(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	keyBytes, err := readPEM(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.X509KeyPair(certBytes, keyBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func loadCertificates(certPEM string) ([]*x509.Certificate, error) {
+	if certPEM == "" {
+		return nil, nil
+	}
+	b, err := readPEM(certPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	certs := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate found")
+	}
+	return certs, nil
+}
@@ -0,0 +1,437 @@
+package samlpkg
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io"
+	userpkg "mahi-go-explorer/pkg/user"
+	"math/big"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testIssuer   = "https://idp.example.com"
+	testEntityID = "http://localhost:8080/api/auth/saml/corp/metadata"
+	testACSURL   = "http://localhost:8080/api/auth/saml/corp/acs"
+)
+
+// testCertificate returns a self signed key pair valid for the test
+func testCertificate(t *testing.T, cn string) *tls.Certificate {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// testResponse describes the response the test identity provider issues
+type testResponse struct {
+	InResponseTo  string
+	Issuer        string
+	Audience      string
+	Recipient     string
+	NameID        string
+	NotBefore     time.Time
+	NotOnOrAfter  time.Time
+	Attributes    map[string][]string
+	SignAssertion bool
+	SignResponse  bool
+	Encrypt       bool
+	// Signer signs the response, the identity provider key when nil
+	Signer *tls.Certificate
+	// Tamper changes the xml after it was signed
+	Tamper func(string) string
+}
+
+// testIdP issues responses signed with its test key, encrypting them for the sp
+type testIdP struct {
+	t    *testing.T
+	cert *tls.Certificate
+	sp   *tls.Certificate
+}
+
+func (idp *testIdP) defaults() testResponse {
+	return testResponse{
+		Issuer:       testIssuer,
+		Audience:     testEntityID,
+		Recipient:    testACSURL,
+		NameID:       "jane@example.com",
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotOnOrAfter: time.Now().Add(5 * time.Minute),
+		Attributes: map[string][]string{
+			"email":     {"Jane@Example.com"},
+			"firstName": {"Jane"},
+			"lastName":  {"Doe"},
+			"groups":    {"staff", "admins"},
+		},
+		SignAssertion: true,
+	}
+}
+
+func (idp *testIdP) issue(r testResponse) string {
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	assertion := etree.NewElement("saml:Assertion")
+	assertion.CreateAttr("xmlns:saml", "urn:oasis:names:tc:SAML:2.0:assertion")
+	assertion.CreateAttr("ID", "_a"+randomID(idp.t))
+	assertion.CreateAttr("Version", "2.0")
+	assertion.CreateAttr("IssueInstant", now)
+	assertion.CreateElement("saml:Issuer").SetText(r.Issuer)
+
+	subject := assertion.CreateElement("saml:Subject")
+	subject.CreateElement("saml:NameID").SetText(r.NameID)
+	confirmation := subject.CreateElement("saml:SubjectConfirmation")
+	confirmation.CreateAttr("Method", "urn:oasis:names:tc:SAML:2.0:cm:bearer")
+	data := confirmation.CreateElement("saml:SubjectConfirmationData")
+	data.CreateAttr("Recipient", r.Recipient)
+	data.CreateAttr("NotOnOrAfter", r.NotOnOrAfter.UTC().Format(time.RFC3339))
+	if r.InResponseTo != "" {
+		data.CreateAttr("InResponseTo", r.InResponseTo)
+	}
+
+	conditions := assertion.CreateElement("saml:Conditions")
+	conditions.CreateAttr("NotBefore", r.NotBefore.UTC().Format(time.RFC3339))
+	conditions.CreateAttr("NotOnOrAfter", r.NotOnOrAfter.UTC().Format(time.RFC3339))
+	conditions.CreateElement("saml:AudienceRestriction").CreateElement("saml:Audience").SetText(r.Audience)
+
+	authn := assertion.CreateElement("saml:AuthnStatement")
+	authn.CreateAttr("AuthnInstant", now)
+	authn.CreateAttr("SessionIndex", "_s1")
+
+	statement := assertion.CreateElement("saml:AttributeStatement")
+	for name, values := range r.Attributes {
+		attr := statement.CreateElement("saml:Attribute")
+		attr.CreateAttr("Name", name)
+		for _, v := range values {
+			attr.CreateElement("saml:AttributeValue").SetText(v)
+		}
+	}
+
+	signer := r.Signer
+	if signer == nil {
+		signer = idp.cert
+	}
+	if r.SignAssertion {
+		assertion = idp.sign(assertion, signer)
+	}
+
+	response := etree.NewElement("samlp:Response")
+	response.CreateAttr("xmlns:samlp", "urn:oasis:names:tc:SAML:2.0:protocol")
+	response.CreateAttr("xmlns:saml", "urn:oasis:names:tc:SAML:2.0:assertion")
+	response.CreateAttr("ID", "_r"+randomID(idp.t))
+	response.CreateAttr("Version", "2.0")
+	response.CreateAttr("IssueInstant", now)
+	response.CreateAttr("Destination", r.Recipient)
+	if r.InResponseTo != "" {
+		response.CreateAttr("InResponseTo", r.InResponseTo)
+	}
+	response.CreateElement("saml:Issuer").SetText(r.Issuer)
+	response.CreateElement("samlp:Status").CreateElement("samlp:StatusCode").CreateAttr("Value", "urn:oasis:names:tc:SAML:2.0:status:Success")
+	if r.Encrypt {
+		response.AddChild(idp.encrypt(assertion))
+	} else {
+		response.AddChild(assertion)
+	}
+
+	if r.SignResponse {
+		response = idp.sign(response, signer)
+	}
+
+	doc := etree.NewDocument()
+	doc.SetRoot(response)
+	s, err := doc.WriteToString()
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	if r.Tamper != nil {
+		s = r.Tamper(s)
+	}
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func (idp *testIdP) sign(el *etree.Element, cert *tls.Certificate) *etree.Element {
+	ctx := dsig.NewDefaultSigningContext(dsig.TLSCertKeyStore(*cert))
+	//like real identity providers, so the assertion can be moved into the response
+	ctx.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	signed, err := ctx.SignEnveloped(el)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	return signed
+}
+
+// encrypt encrypts the assertion with AES-GCM, transporting the key with RSA-OAEP
+func (idp *testIdP) encrypt(assertion *etree.Element) *etree.Element {
+	doc := etree.NewDocument()
+	doc.SetRoot(assertion.Copy())
+	plain, err := doc.WriteToBytes()
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+
+	key := make([]byte, 32)
+	nonce := make([]byte, 12)
+	io.ReadFull(rand.Reader, key)
+	io.ReadFull(rand.Reader, nonce)
+	block, _ := aes.NewCipher(key)
+	gcm, _ := cipher.NewGCM(block)
+	sealed := gcm.Seal(nonce, nonce, plain, nil)
+
+	encryptedKey, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, idp.sp.Leaf.PublicKey.(*rsa.PublicKey), key, nil)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+
+	ea := etree.NewElement("saml:EncryptedAssertion")
+	ed := ea.CreateElement("xenc:EncryptedData")
+	ed.CreateAttr("xmlns:xenc", "http://www.w3.org/2001/04/xmlenc#")
+	ed.CreateAttr("Type", "http://www.w3.org/2001/04/xmlenc#Element")
+	ed.CreateElement("xenc:EncryptionMethod").CreateAttr("Algorithm", "http://www.w3.org/2009/xmlenc11#aes256-gcm")
+	keyInfo := ed.CreateElement("ds:KeyInfo")
+	keyInfo.CreateAttr("xmlns:ds", "http://www.w3.org/2000/09/xmldsig#")
+	ek := keyInfo.CreateElement("xenc:EncryptedKey")
+	ek.CreateElement("xenc:EncryptionMethod").CreateAttr("Algorithm", "http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p")
+	ek.CreateElement("xenc:CipherData").CreateElement("xenc:CipherValue").SetText(base64.StdEncoding.EncodeToString(encryptedKey))
+	ed.CreateElement("xenc:CipherData").CreateElement("xenc:CipherValue").SetText(base64.StdEncoding.EncodeToString(sealed))
+	return ea
+}
+
+func randomID(t *testing.T) string {
+	id, err := randomToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.NewReplacer("-", "", "_", "").Replace(id)
+}
+
+func newTestProvider(idp *testIdP) *Provider {
+	return newProvider(&Provider{
+		Name:            "corp",
+		IdPSSOURL:       "https://idp.example.com/sso",
+		IdPIssuer:       testIssuer,
+		IdPCertificates: []*x509.Certificate{idp.cert.Leaf},
+		EntityID:        testEntityID,
+		ACSURL:          testACSURL,
+		SPCertificate:   idp.sp,
+		RoleMap:         map[string]string{"admins": userpkg.RoleAdmin, "support": userpkg.RoleSupport},
+	})
+}
+
+func TestParseResponse(t *testing.T) {
+	idp := &testIdP{t: t, cert: testCertificate(t, "idp"), sp: testCertificate(t, "sp")}
+	other := testCertificate(t, "attacker")
+
+	p := newTestProvider(idp)
+	idpInitiated := newTestProvider(idp)
+	idpInitiated.AllowIdPInitiated = true
+	encrypted := newTestProvider(idp)
+	encrypted.RequireEncryption = true
+
+	jane := &userpkg.ExternalUser{
+		Provider:      "saml:corp",
+		Subject:       "jane@example.com",
+		Email:         "jane@example.com",
+		EmailVerified: true,
+		FirstName:     "Jane",
+		LastName:      "Doe",
+		Role:          userpkg.RoleAdmin,
+	}
+
+	type testCase struct {
+		name     string
+		provider *Provider
+		modify   func(r *testResponse)
+		expected *userpkg.ExternalUser
+	}
+
+	tests := []testCase{
+		{
+			name:     "Accepts signed assertion",
+			provider: p,
+			modify:   func(r *testResponse) {},
+			expected: jane,
+		},
+		{
+			name:     "Accepts signed response",
+			provider: p,
+			modify:   func(r *testResponse) { r.SignAssertion, r.SignResponse = false, true },
+			expected: jane,
+		},
+		{
+			name:     "Accepts encrypted assertion",
+			provider: encrypted,
+			modify:   func(r *testResponse) { r.Encrypt = true },
+			expected: jane,
+		},
+		{
+			name:     "Falls back to the NameID for the email",
+			provider: p,
+			modify: func(r *testResponse) {
+				r.Attributes = map[string][]string{"groups": {"support"}}
+			},
+			expected: &userpkg.ExternalUser{
+				Provider:      "saml:corp",
+				Subject:       "jane@example.com",
+				Email:         "jane@example.com",
+				EmailVerified: true,
+				Role:          userpkg.RoleSupport,
+			},
+		},
+		{
+			name:     "Accepts IdP-initiated login when allowed",
+			provider: idpInitiated,
+			modify:   func(r *testResponse) { r.InResponseTo = "" },
+			expected: jane,
+		},
+		{
+			name:     "Rejects IdP-initiated login",
+			provider: p,
+			modify:   func(r *testResponse) { r.InResponseTo = "" },
+		},
+		{
+			name:     "Rejects unsigned response",
+			provider: p,
+			modify:   func(r *testResponse) { r.SignAssertion = false },
+		},
+		{
+			name:     "Rejects response signed by another key",
+			provider: p,
+			modify:   func(r *testResponse) { r.Signer = other },
+		},
+		{
+			name:     "Rejects tampered assertion",
+			provider: p,
+			modify: func(r *testResponse) {
+				r.Attributes["groups"] = []string{"staff"}
+				r.Tamper = func(s string) string { return strings.Replace(s, ">staff<", ">admins<", 1) }
+			},
+		},
+		{
+			name:     "Rejects plain assertion when encryption is required",
+			provider: encrypted,
+			modify:   func(r *testResponse) {},
+		},
+		{
+			name:     "Rejects assertion for another audience",
+			provider: p,
+			modify:   func(r *testResponse) { r.Audience = "https://other.example.com" },
+		},
+		{
+			name:     "Rejects assertion for another recipient",
+			provider: p,
+			modify:   func(r *testResponse) { r.Recipient = "https://other.example.com/acs" },
+		},
+		{
+			name:     "Rejects assertion of another issuer",
+			provider: p,
+			modify:   func(r *testResponse) { r.Issuer = "https://other.example.com" },
+		},
+		{
+			name:     "Rejects expired assertion",
+			provider: p,
+			modify: func(r *testResponse) {
+				r.NotBefore = time.Now().Add(-10 * time.Minute)
+				r.NotOnOrAfter = time.Now().Add(-5 * time.Minute)
+			},
+		},
+		{
+			name:     "Rejects assertion that is not valid yet",
+			provider: p,
+			modify:   func(r *testResponse) { r.NotBefore = time.Now().Add(5 * time.Minute) },
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := idp.defaults()
+			r.InResponseTo = "_req1"
+			tc.modify(&r)
+
+			a, err := tc.provider.parseResponse(idp.issue(r))
+			if tc.expected == nil {
+				assert.Error(t, err)
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, tc.expected, a.User)
+			assert.Equal(t, r.InResponseTo, a.InResponseTo)
+			assert.NotEmpty(t, a.ID)
+		})
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	idp := &testIdP{t: t, cert: testCertificate(t, "idp"), sp: testCertificate(t, "sp")}
+	p := newTestProvider(idp)
+
+	md, err := p.metadata()
+	assert.NoError(t, err)
+
+	doc := etree.NewDocument()
+	assert.NoError(t, doc.ReadFromBytes(md))
+	assert.Equal(t, testEntityID, doc.Root().SelectAttrValue("entityID", ""))
+
+	acs := doc.FindElement("//AssertionConsumerService")
+	if assert.NotNil(t, acs) {
+		assert.Equal(t, testACSURL, acs.SelectAttrValue("Location", ""))
+	}
+	assert.Contains(t, string(md), base64.StdEncoding.EncodeToString(idp.sp.Certificate[0]))
+}
+
+func TestAuthnRequest(t *testing.T) {
+	idp := &testIdP{t: t, cert: testCertificate(t, "idp"), sp: testCertificate(t, "sp")}
+	p := newTestProvider(idp)
+	p.sp.SignAuthnRequests = true
+
+	u, id, err := p.authnRequest()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, id)
+
+	parsed, err := url.Parse(u)
+	assert.NoError(t, err)
+	assert.Equal(t, "idp.example.com", parsed.Host)
+	assert.NotEmpty(t, parsed.Query().Get("Signature"))
+
+	//the request is deflated & base64 encoded
+	raw, err := base64.StdEncoding.DecodeString(parsed.Query().Get("SAMLRequest"))
+	assert.NoError(t, err)
+	xml, err := io.ReadAll(flate.NewReader(bytes.NewReader(raw)))
+	assert.NoError(t, err)
+
+	doc := etree.NewDocument()
+	assert.NoError(t, doc.ReadFromBytes(xml))
+	assert.Equal(t, id, doc.Root().SelectAttrValue("ID", ""))
+	assert.Equal(t, testACSURL, doc.Root().SelectAttrValue("AssertionConsumerServiceURL", ""))
+}
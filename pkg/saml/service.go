@@ -0,0 +1,245 @@
+package samlpkg
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"mahi-go-explorer/internal/config"
+	userpkg "mahi-go-explorer/pkg/user"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Service defines interface for logging in through SAML 2.0 identity providers
+type Service interface {
+	// Providers returns the names of the configured providers
+	Providers() []string
+	// Metadata returns our service provider metadata for the provider
+	Metadata(provider string) ([]byte, error)
+	// StartLogin returns the url that sends the user to the provider
+	StartLogin(provider string) (string, error)
+	// ConsumeResponse logs the user in with the response the provider posted,
+	// returning a code the app exchanges for our tokens
+	ConsumeResponse(provider string, samlResponse string) (string, error)
+	// FinishLogin exchanges the code for our tokens
+	FinishLogin(req *FinishLoginRequest) (*userpkg.LoginResponse, error)
+	// CallbackURL returns the url of the app the user is sent back to
+	CallbackURL(params url.Values) string
+}
+
+type service struct {
+	db        *mongo.Database
+	coll      *config.Collection
+	users     userpkg.Service
+	providers map[string]*Provider
+}
+
+// FinishLoginRequest defines the request body for finishing a login
+type FinishLoginRequest struct {
+	Code string `json:"code,omitempty"`
+	userpkg.ClientInfo
+}
+
+// authnRequest is a request we sent to a provider that was not answered yet
+type authnRequest struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	RequestID string             `bson:"requestId"`
+	Provider  string             `bson:"provider"`
+	ExpiresAt time.Time          `bson:"expiresAt"`
+}
+
+// usedAssertion is remembered until it expires so it cannot be replayed
+type usedAssertion struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty"`
+	AssertionID string             `bson:"assertionId"`
+	Provider    string             `bson:"provider"`
+	ExpiresAt   time.Time          `bson:"expiresAt"`
+}
+
+// pendingLogin is a login waiting for the app to pick up its tokens, only
+// the hash of the code is stored
+type pendingLogin struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	CodeHash  string             `bson:"codeHash"`
+	UserID    primitive.ObjectID `bson:"userId"`
+	ExpiresAt time.Time          `bson:"expiresAt"`
+}
+
+const (
+	// users have this long to log in at the provider
+	authnRequestTTL = 10 * time.Minute
+	// the app has this long to pick up the tokens
+	pendingLoginTTL = 1 * time.Minute
+)
+
+// NewService returns new instance of saml login service
+func NewService(db *mongo.Database, coll *config.Collection, users userpkg.Service) Service {
+	return service{db, coll, users, loadProviders()}
+}
+
+func (s service) Providers() []string {
+	names := []string{}
+	for name := range s.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s service) Metadata(name string) ([]byte, error) {
+	p, ok := s.providers[name]
+	if !ok {
+		return nil, errors.New("provider not found")
+	}
+	return p.metadata()
+}
+
+func (s service) StartLogin(name string) (string, error) {
+	p, ok := s.providers[name]
+	if !ok {
+		return "", errors.New("provider not found")
+	}
+
+	u, requestID, err := p.authnRequest()
+	if err != nil {
+		return "", err
+	}
+
+	req := authnRequest{
+		RequestID: requestID,
+		Provider:  name,
+		ExpiresAt: time.Now().Add(authnRequestTTL),
+	}
+	_, err = s.db.Collection(s.coll.SAMLRequestCollection).InsertOne(context.TODO(), req)
+	if err != nil {
+		return "", err
+	}
+
+	return u, nil
+}
+
+func (s service) ConsumeResponse(name string, samlResponse string) (string, error) {
+	p, ok := s.providers[name]
+	if !ok {
+		return "", errors.New("provider not found")
+	}
+
+	a, err := p.parseResponse(samlResponse)
+	if err != nil {
+		log.Printf("SAML response of provider %s rejected: %v", name, err)
+		return "", errors.New("invalid response")
+	}
+
+	//a request can only be answered once
+	if a.InResponseTo != "" {
+		var req authnRequest
+		err := s.db.Collection(s.coll.SAMLRequestCollection).FindOneAndDelete(
+			context.TODO(),
+			bson.M{"requestId": a.InResponseTo, "provider": name},
+		).Decode(&req)
+		if err == mongo.ErrNoDocuments {
+			return "", errors.New("invalid request")
+		}
+		if err != nil {
+			return "", err
+		}
+		if req.ExpiresAt.Before(time.Now()) {
+			return "", errors.New("invalid request")
+		}
+	}
+
+	//an assertion can only be used once, which is all that protects idp-initiated logins
+	_, err = s.db.Collection(s.coll.SAMLAssertionCollection).InsertOne(context.TODO(), usedAssertion{
+		AssertionID: a.ID,
+		Provider:    name,
+		ExpiresAt:   a.ExpiresAt,
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		log.Printf("SAML assertion %s of provider %s replayed", a.ID, name)
+		return "", errors.New("assertion replayed")
+	}
+	if err != nil {
+		return "", err
+	}
+
+	user, err := s.users.ProvisionExternalUser(a.User)
+	if err != nil {
+		return "", err
+	}
+
+	code, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	login := pendingLogin{
+		CodeHash:  hashToken(code),
+		UserID:    user.ID,
+		ExpiresAt: time.Now().Add(pendingLoginTTL),
+	}
+	_, err = s.db.Collection(s.coll.SAMLLoginCollection).InsertOne(context.TODO(), login)
+	if err != nil {
+		return "", err
+	}
+
+	return code, nil
+}
+
+func (s service) FinishLogin(req *FinishLoginRequest) (*userpkg.LoginResponse, error) {
+	//a code can only be used once
+	var login pendingLogin
+	err := s.db.Collection(s.coll.SAMLLoginCollection).FindOneAndDelete(
+		context.TODO(),
+		bson.M{"codeHash": hashToken(req.Code)},
+	).Decode(&login)
+	if err == mongo.ErrNoDocuments {
+		return nil, errors.New("invalid code")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if login.ExpiresAt.Before(time.Now()) {
+		return nil, errors.New("invalid code")
+	}
+
+	user, err := s.users.GetUser(bson.M{"_id": login.UserID}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.users.CompleteLogin(user, userpkg.AMRFederated, req.ClientInfo)
+}
+
+func (s service) CallbackURL(params url.Values) string {
+	u := config.GetFromEnv("SAML_CALLBACK_URL")
+	if u == "" {
+		u = config.FrontendURL() + "/auth/saml/callback"
+	}
+
+	if strings.Contains(u, "?") {
+		return u + "&" + params.Encode()
+	}
+	return u + "?" + params.Encode()
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
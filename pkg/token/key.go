@@ -0,0 +1,274 @@
+package tokenpkg
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Supported signing algorithms
+const (
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+	AlgEdDSA = "EdDSA"
+	AlgHS256 = "HS256"
+)
+
+// SigningKey defines signing key schema.
+// A key signs new tokens from ActivateAt until RotateAt and verifies them
+// until ExpiresAt. It is in the JWKS from its creation, ahead of ActivateAt.
+// The private key is a PEM, sealed when JWT_KEY_ENCRYPTION_KEY is set.
+type SigningKey struct {
+	ID         primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	Kid        string             `json:"kid" bson:"kid"`
+	Alg        string             `json:"alg" bson:"alg"`
+	PrivateKey string             `json:"-" bson:"privateKey"`
+	CreatedAt  time.Time          `json:"createdAt" bson:"createdAt"`
+	ActivateAt time.Time          `json:"activateAt" bson:"activateAt"`
+	RotateAt   time.Time          `json:"rotateAt" bson:"rotateAt"`
+	ExpiresAt  time.Time          `json:"expiresAt" bson:"expiresAt"`
+
+	signer crypto.Signer
+}
+
+// Signer returns the private key used to sign tokens
+func (k *SigningKey) Signer() crypto.Signer {
+	return k.signer
+}
+
+// PublicKey returns the public key used to verify tokens
+func (k *SigningKey) PublicKey() crypto.PublicKey {
+	return k.signer.Public()
+}
+
+// JWK defines a public JSON web key
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS defines a JSON web key set
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK returns the public part of the key as a JWK
+func (k *SigningKey) JWK() JWK {
+	jwk := JWK{Use: "sig", Kid: k.Kid, Alg: k.Alg}
+	enc := base64.RawURLEncoding
+
+	switch pub := k.PublicKey().(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = enc.EncodeToString(pub.N.Bytes())
+		jwk.E = enc.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = pub.Curve.Params().Name
+		jwk.X = enc.EncodeToString(pub.X.FillBytes(make([]byte, size)))
+		jwk.Y = enc.EncodeToString(pub.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = enc.EncodeToString(pub)
+	}
+
+	return jwk
+}
+
+// PublicKey parses the key, for verifying tokens signed by other issuers
+func (j JWK) PublicKey() (crypto.PublicKey, error) {
+	enc := base64.RawURLEncoding
+
+	switch j.Kty {
+	case "RSA":
+		n, err := enc.DecodeString(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := enc.DecodeString(j.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("unsupported curve")
+		}
+		x, err := enc.DecodeString(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := enc.DecodeString(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("invalid ec key")
+		}
+		return pub, nil
+	case "OKP":
+		if j.Crv != "Ed25519" {
+			return nil, errors.New("unsupported curve")
+		}
+		x, err := enc.DecodeString(j.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, errors.New("unsupported key type")
+}
+
+func generateSigningKey(alg string, activateAt, rotateAt, expiresAt time.Time) (*SigningKey, error) {
+	var signer crypto.Signer
+	var err error
+	switch alg {
+	case AlgRS256:
+		signer, err = rsa.GenerateKey(rand.Reader, 2048)
+	case AlgES256:
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, errors.New("unsupported signing algorithm")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SigningKey{
+		Kid:        primitive.NewObjectID().Hex(),
+		Alg:        alg,
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		CreatedAt:  time.Now(),
+		ActivateAt: activateAt,
+		RotateAt:   rotateAt,
+		ExpiresAt:  expiresAt,
+		signer:     signer,
+	}, nil
+}
+
+// sealedKeyPrefix marks private keys encrypted with JWT_KEY_ENCRYPTION_KEY
+const sealedKeyPrefix = "aes256gcm:"
+
+func keyCipher(encryptionKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts the private key for storage, bound to the kid
+func (k *SigningKey) seal(encryptionKey []byte) error {
+	if encryptionKey == nil {
+		return nil
+	}
+
+	aead, err := keyCipher(encryptionKey)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(k.PrivateKey), []byte(k.Kid))
+	k.PrivateKey = sealedKeyPrefix + base64.StdEncoding.EncodeToString(sealed)
+
+	return nil
+}
+
+// open decrypts a sealed private key, keys stored before encryption was
+// turned on are plain PEMs
+func (k *SigningKey) open(encryptionKey []byte) ([]byte, error) {
+	if !strings.HasPrefix(k.PrivateKey, sealedKeyPrefix) {
+		return []byte(k.PrivateKey), nil
+	}
+	if encryptionKey == nil {
+		return nil, errors.New("private key is sealed, JWT_KEY_ENCRYPTION_KEY is not set")
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(k.PrivateKey, sealedKeyPrefix))
+	if err != nil {
+		return nil, errors.New("invalid private key")
+	}
+	aead, err := keyCipher(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("invalid private key")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(k.Kid))
+	if err != nil {
+		return nil, errors.New("invalid private key")
+	}
+	return plain, nil
+}
+
+func (k *SigningKey) parse(encryptionKey []byte) error {
+	plain, err := k.open(encryptionKey)
+	if err != nil {
+		return err
+	}
+
+	block, _ := pem.Decode(plain)
+	if block == nil {
+		return errors.New("invalid private key")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return errors.New("invalid private key")
+	}
+	k.signer = signer
+
+	return nil
+}
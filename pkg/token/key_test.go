@@ -0,0 +1,129 @@
+package tokenpkg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSigningKey(t *testing.T) {
+	type testCase struct {
+		Name        string
+		Alg         string
+		ExpectedKty string
+	}
+
+	tests := []testCase{
+		{Name: "RS256 key", Alg: AlgRS256, ExpectedKty: "RSA"},
+		{Name: "ES256 key", Alg: AlgES256, ExpectedKty: "EC"},
+		{Name: "EdDSA key", Alg: AlgEdDSA, ExpectedKty: "OKP"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			now := time.Now()
+			key, err := generateSigningKey(tt.Alg, now, now.Add(time.Hour), now.Add(2*time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			//the stored PEM must load back into the same key
+			stored := &SigningKey{Kid: key.Kid, Alg: key.Alg, PrivateKey: key.PrivateKey}
+			if err := stored.parse(nil); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, key.PublicKey(), stored.PublicKey())
+
+			jwk := stored.JWK()
+			assert.Equal(t, tt.ExpectedKty, jwk.Kty)
+			assert.Equal(t, tt.Alg, jwk.Alg)
+			assert.Equal(t, key.Kid, jwk.Kid)
+
+			//and the JWK parses back into the public key
+			pub, err := jwk.PublicKey()
+			assert.NoError(t, err)
+			assert.Equal(t, key.PublicKey(), pub)
+
+			//a token signed with the key verifies with its public key
+			signed, err := jwt.NewWithClaims(jwt.GetSigningMethod(tt.Alg), jwt.MapClaims{"sub": "user"}).SignedString(key.Signer())
+			if err != nil {
+				t.Fatal(err)
+			}
+			token, err := jwt.Parse(signed, func(t *jwt.Token) (interface{}, error) {
+				return stored.PublicKey(), nil
+			})
+			assert.NoError(t, err)
+			assert.True(t, token.Valid)
+		})
+	}
+}
+
+func TestGenerateSigningKeyRejectsUnknownAlg(t *testing.T) {
+	_, err := generateSigningKey("none", time.Now(), time.Now(), time.Now())
+	assert.Error(t, err)
+}
+
+func TestSealedSigningKey(t *testing.T) {
+	now := time.Now()
+	key, err := generateSigningKey(AlgES256, now, now.Add(time.Hour), now.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptionKey := make([]byte, 32)
+	otherKey := append([]byte{1}, encryptionKey[1:]...)
+
+	stored := *key
+	if err := stored.seal(encryptionKey); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, stored.PrivateKey, "PRIVATE KEY")
+
+	loaded := SigningKey{Kid: stored.Kid, Alg: stored.Alg, PrivateKey: stored.PrivateKey}
+	assert.NoError(t, loaded.parse(encryptionKey))
+	assert.Equal(t, key.PublicKey(), loaded.PublicKey())
+
+	//a sealed key does not load without its encryption key, or under another kid
+	assert.Error(t, (&SigningKey{Kid: stored.Kid, Alg: stored.Alg, PrivateKey: stored.PrivateKey}).parse(nil))
+	assert.Error(t, (&SigningKey{Kid: stored.Kid, Alg: stored.Alg, PrivateKey: stored.PrivateKey}).parse(otherKey))
+	assert.Error(t, (&SigningKey{Kid: "other", Alg: stored.Alg, PrivateKey: stored.PrivateKey}).parse(encryptionKey))
+
+	//keys stored before encryption was turned on still load
+	plain := SigningKey{Kid: key.Kid, Alg: key.Alg, PrivateKey: key.PrivateKey}
+	assert.NoError(t, plain.parse(encryptionKey))
+}
+
+func TestActiveKey(t *testing.T) {
+	now := time.Now()
+	legacy := &SigningKey{Kid: "legacy", Alg: AlgRS256, RotateAt: now.Add(time.Hour)}
+	current := &SigningKey{Kid: "current", Alg: AlgRS256, ActivateAt: now.Add(-time.Hour), RotateAt: now.Add(time.Hour)}
+	next := &SigningKey{Kid: "next", Alg: AlgRS256, ActivateAt: now.Add(time.Hour), RotateAt: now.Add(2 * time.Hour)}
+	other := &SigningKey{Kid: "other", Alg: AlgES256, ActivateAt: now.Add(-time.Hour), RotateAt: now.Add(time.Hour)}
+
+	s := keyService{alg: AlgRS256, cache: &keyCache{keys: []*SigningKey{next, other, current}}}
+	//the pre-published key does not sign before its time
+	assert.Equal(t, current, s.activeKey(now))
+	assert.Equal(t, next, s.activeKey(now.Add(90*time.Minute)))
+	assert.Nil(t, s.activeKey(now.Add(3*time.Hour)))
+	assert.Equal(t, next, s.keyFrom(current.RotateAt))
+	assert.Nil(t, s.keyFrom(next.RotateAt))
+
+	s = keyService{alg: AlgRS256, cache: &keyCache{keys: []*SigningKey{legacy}}}
+	assert.Equal(t, legacy, s.activeKey(now))
+}
+
+func TestJWKSDoesNotCreateKeys(t *testing.T) {
+	//there is no database, creating a key would panic
+	s := keyService{alg: AlgRS256, cache: &keyCache{loadedAt: time.Now()}}
+	jwks, err := s.JWKS()
+	assert.NoError(t, err)
+	assert.Empty(t, jwks.Keys)
+}
+
+func TestNewKeyServiceRequiresSecret(t *testing.T) {
+	t.Setenv("JWT_ALG", AlgHS256)
+	t.Setenv("JWT_SECRET", "")
+	_, err := NewKeyService(nil, nil)
+	assert.EqualError(t, err, "JWT_SECRET is required for HS256")
+}
@@ -0,0 +1,179 @@
+package tokenpkg
+
+import (
+	"crypto/ed25519"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20"
+)
+
+// PASETO v4 (https://github.com/paseto-standard/paseto-spec), local tokens
+// are encrypted with XChaCha20 & authenticated with BLAKE2b, public tokens
+// are signed with Ed25519
+const (
+	pasetoLocalHeader  = "v4.local."
+	pasetoPublicHeader = "v4.public."
+
+	pasetoNonceSize = 32
+	pasetoMACSize   = 32
+)
+
+var errInvalidPaseto = errors.New("invalid token")
+
+// pae is the pre-authentication encoding of the pieces
+func pae(pieces ...[]byte) []byte {
+	out := le64(uint64(len(pieces)))
+	for _, p := range pieces {
+		out = append(out, le64(uint64(len(p)))...)
+		out = append(out, p...)
+	}
+	return out
+}
+
+func le64(n uint64) []byte {
+	//the most significant bit is cleared for interoperability
+	return binary.LittleEndian.AppendUint64(nil, n&(1<<63-1))
+}
+
+// pasetoKeys derives the encryption key & nonce, and the authentication key
+func pasetoKeys(key []byte, nonce []byte) (ek []byte, n2 []byte, ak []byte, err error) {
+	h, err := blake2b.New(56, key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	h.Write([]byte("paseto-encryption-key"))
+	h.Write(nonce)
+	tmp := h.Sum(nil)
+
+	h, err = blake2b.New(32, key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	h.Write([]byte("paseto-auth-key-for-aead"))
+	h.Write(nonce)
+
+	return tmp[:32], tmp[32:], h.Sum(nil), nil
+}
+
+func pasetoMAC(ak []byte, preAuth []byte) ([]byte, error) {
+	h, err := blake2b.New(pasetoMACSize, ak)
+	if err != nil {
+		return nil, err
+	}
+	h.Write(preAuth)
+	return h.Sum(nil), nil
+}
+
+// encryptLocal makes a v4.local token of the message with a random nonce
+// of pasetoNonceSize bytes
+func encryptLocal(key []byte, nonce []byte, message []byte, footer []byte, implicit []byte) (string, error) {
+	ek, n2, ak, err := pasetoKeys(key, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	cipher, err := chacha20.NewUnauthenticatedCipher(ek, n2)
+	if err != nil {
+		return "", err
+	}
+	c := make([]byte, len(message))
+	cipher.XORKeyStream(c, message)
+
+	t, err := pasetoMAC(ak, pae([]byte(pasetoLocalHeader), nonce, c, footer, implicit))
+	if err != nil {
+		return "", err
+	}
+
+	body := append(append(append([]byte{}, nonce...), c...), t...)
+	return pasetoToken(pasetoLocalHeader, body, footer), nil
+}
+
+// decryptLocal returns the message of a v4.local token, after checking
+// the token was made with the key
+func decryptLocal(key []byte, token string, implicit []byte) ([]byte, error) {
+	body, footer, err := splitPaseto(pasetoLocalHeader, token)
+	if err != nil || len(body) < pasetoNonceSize+pasetoMACSize {
+		return nil, errInvalidPaseto
+	}
+	nonce := body[:pasetoNonceSize]
+	c := body[pasetoNonceSize : len(body)-pasetoMACSize]
+	t := body[len(body)-pasetoMACSize:]
+
+	ek, n2, ak, err := pasetoKeys(key, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	t2, err := pasetoMAC(ak, pae([]byte(pasetoLocalHeader), nonce, c, footer, implicit))
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(t, t2) != 1 {
+		return nil, errInvalidPaseto
+	}
+
+	cipher, err := chacha20.NewUnauthenticatedCipher(ek, n2)
+	if err != nil {
+		return nil, err
+	}
+	message := make([]byte, len(c))
+	cipher.XORKeyStream(message, c)
+	return message, nil
+}
+
+// signPublic makes a v4.public token of the message
+func signPublic(key ed25519.PrivateKey, message []byte, footer []byte, implicit []byte) string {
+	sig := ed25519.Sign(key, pae([]byte(pasetoPublicHeader), message, footer, implicit))
+	body := append(append([]byte{}, message...), sig...)
+	return pasetoToken(pasetoPublicHeader, body, footer)
+}
+
+// verifyPublic returns the message of a v4.public token, after checking
+// its signature
+func verifyPublic(key ed25519.PublicKey, token string, implicit []byte) ([]byte, error) {
+	body, footer, err := splitPaseto(pasetoPublicHeader, token)
+	if err != nil || len(body) < ed25519.SignatureSize {
+		return nil, errInvalidPaseto
+	}
+	message := body[:len(body)-ed25519.SignatureSize]
+	sig := body[len(body)-ed25519.SignatureSize:]
+
+	if !ed25519.Verify(key, pae([]byte(pasetoPublicHeader), message, footer, implicit), sig) {
+		return nil, errInvalidPaseto
+	}
+	return message, nil
+}
+
+func pasetoToken(header string, body []byte, footer []byte) string {
+	token := header + base64.RawURLEncoding.EncodeToString(body)
+	if len(footer) > 0 {
+		token += "." + base64.RawURLEncoding.EncodeToString(footer)
+	}
+	return token
+}
+
+func splitPaseto(header string, token string) (body []byte, footer []byte, err error) {
+	if !strings.HasPrefix(token, header) {
+		return nil, nil, errInvalidPaseto
+	}
+	parts := strings.Split(strings.TrimPrefix(token, header), ".")
+	if len(parts) > 2 {
+		return nil, nil, errInvalidPaseto
+	}
+
+	body, err = base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, nil, errInvalidPaseto
+	}
+	if len(parts) == 2 {
+		if footer, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+			return nil, nil, errInvalidPaseto
+		}
+	}
+	return body, footer, nil
+}
@@ -0,0 +1,87 @@
+package tokenpkg
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// vectors 4-E-1 & 4-S-1 of the PASETO test vectors
+const (
+	vectorLocalKey   = "707172737475767778797a7b7c7d7e7f808182838485868788898a8b8c8d8e8f"
+	vectorLocalToken = "v4.local.AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAQAr68PS4AXe7If_ZgesdkUMvSwscFlAl1pk5HC0e8kApeaqMfGo_7OpBnwJOAbY9V7WU6abu74MmcUE8YWAiaArVI8XJ5hOb_4v9RmDkneN0S92dx0OW4pgy7omxgf3S8c3LlQg"
+	vectorLocalData  = `{"data":"this is a secret message","exp":"2022-01-01T00:00:00+00:00"}`
+
+	vectorSecretKey   = "b4cbfb43df4ce210727d953e4a713307fa19bb7d9f85041438d9e11b942a37741eb9dbbbbc047c03fd70604e0071f0987e16b28b757225c11f00415d0e20b1a2"
+	vectorPublicToken = "v4.public.eyJkYXRhIjoidGhpcyBpcyBhIHNpZ25lZCBtZXNzYWdlIiwiZXhwIjoiMjAyMi0wMS0wMVQwMDowMDowMCswMDowMCJ9bg_XBBzds8lTZShVlwwKSgeKpLT3yukTw6JUz3W4h_ExsQV-P0V54zemZDcAxFaSeef1QlXEFtkqxT1ciiQEDA"
+	vectorPublicData  = `{"data":"this is a signed message","exp":"2022-01-01T00:00:00+00:00"}`
+)
+
+func TestPasetoVectors(t *testing.T) {
+	key, _ := hex.DecodeString(vectorLocalKey)
+	token, err := encryptLocal(key, make([]byte, pasetoNonceSize), []byte(vectorLocalData), nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, vectorLocalToken, token)
+
+	message, err := decryptLocal(key, vectorLocalToken, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, vectorLocalData, string(message))
+
+	sk, _ := hex.DecodeString(vectorSecretKey)
+	secret := ed25519.PrivateKey(sk)
+	assert.Equal(t, vectorPublicToken, signPublic(secret, []byte(vectorPublicData), nil, nil))
+
+	message, err = verifyPublic(secret.Public().(ed25519.PublicKey), vectorPublicToken, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, vectorPublicData, string(message))
+}
+
+func TestPasetoTampering(t *testing.T) {
+	key, _ := hex.DecodeString(vectorLocalKey)
+	sk, _ := hex.DecodeString(vectorSecretKey)
+	public := ed25519.PrivateKey(sk).Public().(ed25519.PublicKey)
+
+	//flips a bit in the middle of the token body
+	flip := func(token string) string {
+		b := []byte(token)
+		i := len(b) / 2
+		if b[i] == 'A' {
+			b[i] = 'B'
+		} else {
+			b[i] = 'A'
+		}
+		return string(b)
+	}
+
+	type testCase struct {
+		Name  string
+		Token string
+		// Local decrypts the token instead of verifying it
+		Local bool
+	}
+
+	tests := []testCase{
+		{Name: "Local token with a changed body", Token: flip(vectorLocalToken), Local: true},
+		{Name: "Local token with a footer added", Token: vectorLocalToken + ".Zm9vdGVy", Local: true},
+		{Name: "Local token read as public", Token: "v4.public." + vectorLocalToken[len(pasetoLocalHeader):]},
+		{Name: "Local token of another version", Token: "v3.local." + vectorLocalToken[len(pasetoLocalHeader):], Local: true},
+		{Name: "Public token with a changed body", Token: flip(vectorPublicToken)},
+		{Name: "Public token with a footer added", Token: vectorPublicToken + ".Zm9vdGVy"},
+		{Name: "Public token read as local", Token: "v4.local." + vectorPublicToken[len(pasetoPublicHeader):], Local: true},
+		{Name: "Truncated token", Token: vectorPublicToken[:len(pasetoPublicHeader)+10]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			var err error
+			if tt.Local {
+				_, err = decryptLocal(key, tt.Token, nil)
+			} else {
+				_, err = verifyPublic(public, tt.Token, nil)
+			}
+			assert.Error(t, err)
+		})
+	}
+}
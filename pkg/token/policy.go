@@ -0,0 +1,106 @@
+package tokenpkg
+
+import (
+	"errors"
+	"mahi-go-explorer/internal/config"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Policy decides the registered claims access tokens are issued with and
+// what a service accepts
+type Policy struct {
+	Issuer string
+	// Audiences are the services tokens are issued for
+	Audiences []string
+	// Audience is the audience a token must name to be accepted here
+	Audience string
+	TTL      time.Duration
+	// Leeway allows for clock skew between the issuer & the services
+	Leeway time.Duration
+}
+
+// LoadPolicy returns the policy set by TOKEN_ISSUER, the comma separated
+// TOKEN_AUDIENCES, TOKEN_AUDIENCE (the first of TOKEN_AUDIENCES by default),
+// ACCESS_TOKEN_TTL & TOKEN_LEEWAY
+func LoadPolicy() *Policy {
+	issuer := config.GetFromEnv("TOKEN_ISSUER")
+	if issuer == "" {
+		issuer = "mahi-go-explorer"
+	}
+
+	var audiences []string
+	for _, a := range strings.Split(config.GetFromEnv("TOKEN_AUDIENCES"), ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			audiences = append(audiences, a)
+		}
+	}
+	if len(audiences) == 0 {
+		audiences = []string{"mahi-go-explorer"}
+	}
+
+	audience := config.GetFromEnv("TOKEN_AUDIENCE")
+	if audience == "" {
+		audience = audiences[0]
+	}
+
+	return &Policy{
+		Issuer:    issuer,
+		Audiences: audiences,
+		Audience:  audience,
+		TTL:       config.GetDurationFromEnv("ACCESS_TOKEN_TTL", 1*time.Hour),
+		Leeway:    config.GetDurationFromEnv("TOKEN_LEEWAY", 30*time.Second),
+	}
+}
+
+// WithAudience returns a copy of the policy for a service that requires
+// its own audience
+func (p *Policy) WithAudience(audience string) *Policy {
+	cp := *p
+	cp.Audience = audience
+	return &cp
+}
+
+// RegisteredClaims returns the claims of a new token for subject, valid for ttl
+func (p *Policy) RegisteredClaims(subject string, ttl time.Duration) jwt.RegisteredClaims {
+	now := time.Now()
+	return jwt.RegisteredClaims{
+		ID:        primitive.NewObjectID().Hex(),
+		Subject:   subject,
+		Issuer:    p.Issuer,
+		Audience:  jwt.ClaimStrings(p.Audiences),
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+	}
+}
+
+// Validate checks the registered claims of a token whose signature was
+// verified, every one of them is required
+func (p *Policy) Validate(claims *jwt.RegisteredClaims) error {
+	if claims.ID == "" || claims.Subject == "" || claims.ExpiresAt == nil || claims.IssuedAt == nil || claims.NotBefore == nil {
+		return errors.New("missing claims")
+	}
+	if claims.Issuer != p.Issuer {
+		return errors.New("invalid issuer")
+	}
+	if !claims.VerifyAudience(p.Audience, true) {
+		return errors.New("invalid audience")
+	}
+
+	now := jwt.TimeFunc()
+	if !now.Before(claims.ExpiresAt.Add(p.Leeway)) {
+		return errors.New("token expired")
+	}
+	if now.Add(p.Leeway).Before(claims.NotBefore.Time) {
+		return errors.New("token not valid yet")
+	}
+	if now.Add(p.Leeway).Before(claims.IssuedAt.Time) {
+		return errors.New("token issued in the future")
+	}
+
+	return nil
+}
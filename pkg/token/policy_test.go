@@ -0,0 +1,102 @@
+package tokenpkg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicy(t *testing.T) {
+	policy := &Policy{
+		Issuer:    "https://auth.example.com",
+		Audiences: []string{"api", "billing"},
+		Audience:  "api",
+		TTL:       time.Hour,
+		Leeway:    30 * time.Second,
+	}
+
+	type testCase struct {
+		Name string
+		// Policy validates instead of the issuing policy when set
+		Policy *Policy
+		// Prepare changes the claims before they are validated
+		Prepare       func(c *jwt.RegisteredClaims)
+		ExpectedError string
+	}
+
+	tests := []testCase{
+		{
+			Name: "Accepts a token it issued",
+		},
+		{
+			Name:   "Accepts a token for the audience of another service",
+			Policy: policy.WithAudience("billing"),
+		},
+		{
+			Name:          "Rejects a token for another audience",
+			Policy:        policy.WithAudience("reports"),
+			ExpectedError: "invalid audience",
+		},
+		{
+			Name:          "Rejects a token of another issuer",
+			Prepare:       func(c *jwt.RegisteredClaims) { c.Issuer = "https://evil.example.com" },
+			ExpectedError: "invalid issuer",
+		},
+		{
+			Name:          "Rejects an expired token",
+			Prepare:       func(c *jwt.RegisteredClaims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute)) },
+			ExpectedError: "token expired",
+		},
+		{
+			Name:    "Accepts a token expired within the leeway",
+			Prepare: func(c *jwt.RegisteredClaims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-10 * time.Second)) },
+		},
+		{
+			Name:          "Rejects a token not valid yet",
+			Prepare:       func(c *jwt.RegisteredClaims) { c.NotBefore = jwt.NewNumericDate(time.Now().Add(time.Minute)) },
+			ExpectedError: "token not valid yet",
+		},
+		{
+			Name:    "Accepts a token from a clock ahead within the leeway",
+			Prepare: func(c *jwt.RegisteredClaims) { c.NotBefore = jwt.NewNumericDate(time.Now().Add(10 * time.Second)) },
+		},
+		{
+			Name:          "Rejects a token issued in the future",
+			Prepare:       func(c *jwt.RegisteredClaims) { c.IssuedAt = jwt.NewNumericDate(time.Now().Add(time.Minute)) },
+			ExpectedError: "token issued in the future",
+		},
+		{
+			Name:          "Rejects a token without expiry",
+			Prepare:       func(c *jwt.RegisteredClaims) { c.ExpiresAt = nil },
+			ExpectedError: "missing claims",
+		},
+		{
+			Name:          "Rejects a token without id",
+			Prepare:       func(c *jwt.RegisteredClaims) { c.ID = "" },
+			ExpectedError: "missing claims",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			claims := policy.RegisteredClaims("user", policy.TTL)
+			if tt.Prepare != nil {
+				tt.Prepare(&claims)
+			}
+
+			p := policy
+			if tt.Policy != nil {
+				p = tt.Policy
+			}
+
+			err := p.Validate(&claims)
+			if tt.ExpectedError != "" {
+				assert.EqualError(t, err, tt.ExpectedError)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,313 @@
+package tokenpkg
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"log"
+	"mahi-go-explorer/internal/config"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// KeyService defines interface for the signing key service
+type KeyService interface {
+	// Sign signs the claims with the current key, rotating it when due
+	Sign(claims jwt.Claims) (string, error)
+	// Keyfunc returns the key to verify a parsed token with
+	Keyfunc(t *jwt.Token) (interface{}, error)
+	// JWKS returns the public keys that can currently verify tokens, it
+	// never creates any
+	JWKS() (*JWKS, error)
+	// Alg returns the algorithm new tokens are signed with
+	Alg() string
+}
+
+type keyService struct {
+	db        *mongo.Database
+	coll      *config.Collection
+	alg       string
+	secret    []byte
+	rotation  time.Duration
+	retention time.Duration
+	// prepublish is how long the next key is in the JWKS before it signs
+	prepublish time.Duration
+	// encryptionKey seals the private keys in the database when set
+	encryptionKey []byte
+
+	cache *keyCache
+}
+
+// keyCache holds the unexpired keys, newest first
+type keyCache struct {
+	mu       sync.RWMutex
+	keys     []*SigningKey
+	loadedAt time.Time
+}
+
+const (
+	// keys are reloaded from the database so rotations by other instances are picked up
+	keyCacheTTL = 1 * time.Minute
+	// an unknown kid forces a reload, but not more often than this
+	keyReloadInterval = 5 * time.Second
+)
+
+// NewKeyService returns new instance of signing key service.
+// JWT_ALG selects RS256, ES256, EdDSA or the legacy shared secret HS256.
+// The next key is published JWT_KEY_PREPUBLISH before it starts signing.
+// Private keys are stored as plain PEMs unless JWT_KEY_ENCRYPTION_KEY, a
+// 32 byte hex key, is set to seal them with AES-GCM. The signing keys are
+// created here when there are none, HS256 refuses to start without JWT_SECRET.
+func NewKeyService(db *mongo.Database, coll *config.Collection) (KeyService, error) {
+	alg := config.GetFromEnv("JWT_ALG")
+	if alg == "" {
+		alg = AlgRS256
+	}
+
+	var encryptionKey []byte
+	if k := config.GetFromEnv("JWT_KEY_ENCRYPTION_KEY"); k != "" {
+		b, err := hex.DecodeString(k)
+		if err != nil || len(b) != 32 {
+			return nil, errors.New("JWT_KEY_ENCRYPTION_KEY must be 32 bytes of hex")
+		}
+		encryptionKey = b
+	}
+
+	secret := config.GetFromEnv("JWT_SECRET")
+	if alg == AlgHS256 && secret == "" {
+		return nil, errors.New("JWT_SECRET is required for HS256")
+	}
+
+	s := keyService{
+		db:            db,
+		coll:          coll,
+		alg:           alg,
+		secret:        []byte(secret),
+		rotation:      config.GetDurationFromEnv("JWT_KEY_ROTATION", 30*24*time.Hour),
+		retention:     config.GetDurationFromEnv("JWT_KEY_RETENTION", 24*time.Hour),
+		prepublish:    config.GetDurationFromEnv("JWT_KEY_PREPUBLISH", 24*time.Hour),
+		encryptionKey: encryptionKey,
+		cache:         &keyCache{},
+	}
+	if alg == AlgHS256 {
+		return s, nil
+	}
+
+	//the JWKS only publishes keys, it never creates them
+	if _, err := s.signingKey(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s keyService) Sign(claims jwt.Claims) (string, error) {
+	if s.alg == AlgHS256 {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.secret)
+	}
+
+	key, err := s.signingKey()
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Alg), claims)
+	token.Header["kid"] = key.Kid
+	return token.SignedString(key.Signer())
+}
+
+func (s keyService) Keyfunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	return s.verificationKey(kid, t.Method.Alg())
+}
+
+// signingKey returns the active key, making sure the one after it is
+// published ahead of time
+func (s keyService) signingKey() (*SigningKey, error) {
+	if err := s.loadKeys(keyCacheTTL); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	key := s.activeKey(now)
+	if key == nil {
+		//no key is active, create one right away
+		var err error
+		if key, err = s.createKey(now); err != nil {
+			return nil, err
+		}
+	}
+
+	//verifiers caching the JWKS know the next key before it signs anything
+	if key.RotateAt.Sub(now) <= s.prepublish && s.keyFrom(key.RotateAt) == nil {
+		if _, err := s.createKey(key.RotateAt); err != nil {
+			return nil, err
+		}
+	}
+
+	return key, nil
+}
+
+// createKey creates a key that signs from activateAt
+func (s keyService) createKey(activateAt time.Time) (*SigningKey, error) {
+	key, err := generateSigningKey(s.alg, activateAt, activateAt.Add(s.rotation), activateAt.Add(s.rotation+s.retention))
+	if err != nil {
+		return nil, err
+	}
+
+	stored := *key
+	if err := stored.seal(s.encryptionKey); err != nil {
+		return nil, err
+	}
+	if _, err := s.db.Collection(s.coll.SigningKeyCollection).InsertOne(context.TODO(), &stored); err != nil {
+		return nil, err
+	}
+	log.Printf("Signing key %s (%s) created, signing from %s", key.Kid, key.Alg, activateAt.Format(time.RFC3339))
+
+	s.cache.mu.Lock()
+	s.cache.keys = append([]*SigningKey{key}, s.cache.keys...)
+	s.cache.mu.Unlock()
+
+	return key, nil
+}
+
+func (s keyService) verificationKey(kid string, alg string) (interface{}, error) {
+	if s.alg == AlgHS256 {
+		if alg != AlgHS256 {
+			return nil, errors.New("invalid signing method")
+		}
+		return s.secret, nil
+	}
+
+	if err := s.loadKeys(keyCacheTTL); err != nil {
+		return nil, err
+	}
+
+	key := s.findKey(kid)
+	if key == nil {
+		//the key may have been created by another instance
+		if err := s.loadKeys(keyReloadInterval); err != nil {
+			return nil, err
+		}
+		key = s.findKey(kid)
+	}
+	if key == nil {
+		return nil, errors.New("unknown signing key")
+	}
+
+	//never let the token pick a different algorithm than the key was made for
+	if key.Alg != alg {
+		return nil, errors.New("invalid signing method")
+	}
+
+	return key.PublicKey(), nil
+}
+
+func (s keyService) Alg() string {
+	return s.alg
+}
+
+func (s keyService) JWKS() (*JWKS, error) {
+	jwks := &JWKS{Keys: []JWK{}}
+	if s.alg == AlgHS256 {
+		return jwks, nil
+	}
+
+	//keys are created at startup & by signing, a public request only reads them
+	if err := s.loadKeys(keyCacheTTL); err != nil {
+		return nil, err
+	}
+
+	s.cache.mu.RLock()
+	defer s.cache.mu.RUnlock()
+	for _, key := range s.cache.keys {
+		jwks.Keys = append(jwks.Keys, key.JWK())
+	}
+
+	return jwks, nil
+}
+
+// activeKey returns the key that signs at now, keys from before pre-publishing
+// have no activation time & sign from their creation
+func (s keyService) activeKey(now time.Time) *SigningKey {
+	s.cache.mu.RLock()
+	defer s.cache.mu.RUnlock()
+
+	for _, key := range s.cache.keys {
+		if key.Alg == s.alg && !key.ActivateAt.After(now) && key.RotateAt.After(now) {
+			return key
+		}
+	}
+	return nil
+}
+
+// keyFrom returns a key that starts signing at t or later
+func (s keyService) keyFrom(t time.Time) *SigningKey {
+	s.cache.mu.RLock()
+	defer s.cache.mu.RUnlock()
+
+	for _, key := range s.cache.keys {
+		if key.Alg == s.alg && !key.ActivateAt.Before(t) {
+			return key
+		}
+	}
+	return nil
+}
+
+func (s keyService) findKey(kid string) *SigningKey {
+	s.cache.mu.RLock()
+	defer s.cache.mu.RUnlock()
+
+	now := time.Now()
+	for _, key := range s.cache.keys {
+		if key.Kid == kid && key.ExpiresAt.After(now) {
+			return key
+		}
+	}
+	return nil
+}
+
+// loadKeys reloads the unexpired keys when the cache is older than maxAge
+func (s keyService) loadKeys(maxAge time.Duration) error {
+	s.cache.mu.RLock()
+	fresh := time.Since(s.cache.loadedAt) < maxAge
+	s.cache.mu.RUnlock()
+	if fresh {
+		return nil
+	}
+
+	cursor, err := s.db.Collection(s.coll.SigningKeyCollection).Find(
+		context.TODO(),
+		bson.M{"expiresAt": bson.M{"$gt": time.Now()}},
+		options.Find().SetSort(bson.M{"createdAt": -1}),
+	)
+	if err != nil {
+		return err
+	}
+
+	var keys []*SigningKey
+	if err := cursor.All(context.TODO(), &keys); err != nil {
+		return err
+	}
+
+	loaded := []*SigningKey{}
+	for _, key := range keys {
+		if err := key.parse(s.encryptionKey); err != nil {
+			log.Printf("Skipping signing key %s: %v", key.Kid, err)
+			continue
+		}
+		loaded = append(loaded, key)
+	}
+
+	s.cache.mu.Lock()
+	s.cache.keys = loaded
+	s.cache.loadedAt = time.Now()
+	s.cache.mu.Unlock()
+
+	return nil
+}
@@ -0,0 +1,279 @@
+package tokenpkg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"mahi-go-explorer/internal/config"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Token formats, selected by TOKEN_FORMAT
+const (
+	FormatJWT = "jwt"
+	// FormatPasetoLocal tokens are encrypted with a key shared by the services
+	FormatPasetoLocal = "v4.local"
+	// FormatPasetoPublic tokens are signed, services only need the public key
+	FormatPasetoPublic = "v4.public"
+)
+
+// Claims are token claims carrying the registered claims the policy checks
+type Claims interface {
+	jwt.Claims
+	Registered() *jwt.RegisteredClaims
+}
+
+// Service issues & verifies access tokens, the one place both sides of a
+// token go through
+type Service interface {
+	// Issue turns the claims into a token
+	Issue(claims Claims) (string, error)
+	// Verify decodes the token into claims, checking it was issued by us &
+	// passes the policy
+	Verify(token string, claims Claims) error
+	// Decode decodes the token into claims, only checking it was issued by
+	// us. The caller validates the claims with a policy of its own, for
+	// tokens whose audience depends on what they carry.
+	Decode(token string, claims Claims) error
+	// Policy returns the policy tokens are issued & verified with
+	Policy() *Policy
+}
+
+// NewService returns the token service of TOKEN_FORMAT, JWTs signed by
+// the key service by default. PASETO local tokens use the 32 byte hex key
+// PASETO_LOCAL_KEY. PASETO public tokens are signed with the hex Ed25519
+// PASETO_SECRET_KEY, services that only verify set PASETO_PUBLIC_KEY instead.
+func NewService(keys KeyService, policy *Policy) (Service, error) {
+	switch format := config.GetFromEnv("TOKEN_FORMAT"); format {
+	case "", FormatJWT:
+		return NewJWTService(keys, policy), nil
+	case FormatPasetoLocal:
+		key, err := hex.DecodeString(config.GetFromEnv("PASETO_LOCAL_KEY"))
+		if err != nil {
+			return nil, errors.New("invalid PASETO_LOCAL_KEY")
+		}
+		return NewPasetoLocalService(key, policy)
+	case FormatPasetoPublic:
+		var secret ed25519.PrivateKey
+		if s := config.GetFromEnv("PASETO_SECRET_KEY"); s != "" {
+			b, err := hex.DecodeString(s)
+			if err != nil {
+				return nil, errors.New("invalid PASETO_SECRET_KEY")
+			}
+			secret = b
+		}
+		var public ed25519.PublicKey
+		if s := config.GetFromEnv("PASETO_PUBLIC_KEY"); s != "" {
+			b, err := hex.DecodeString(s)
+			if err != nil {
+				return nil, errors.New("invalid PASETO_PUBLIC_KEY")
+			}
+			public = b
+		}
+		return NewPasetoPublicService(secret, public, policy)
+	default:
+		return nil, errors.New("unknown token format " + format)
+	}
+}
+
+type jwtService struct {
+	keys   KeyService
+	policy *Policy
+	parser *jwt.Parser
+}
+
+// NewJWTService returns a token service for JWTs signed by the key service
+func NewJWTService(keys KeyService, policy *Policy) Service {
+	//the registered claims are checked by the policy, with its leeway
+	return jwtService{keys, policy, jwt.NewParser(jwt.WithoutClaimsValidation())}
+}
+
+func (s jwtService) Issue(claims Claims) (string, error) {
+	return s.keys.Sign(claims)
+}
+
+func (s jwtService) Verify(token string, claims Claims) error {
+	if err := s.Decode(token, claims); err != nil {
+		return err
+	}
+	return s.policy.Validate(claims.Registered())
+}
+
+func (s jwtService) Decode(token string, claims Claims) error {
+	t, err := s.parser.ParseWithClaims(token, claims, s.keys.Keyfunc)
+	if err != nil || !t.Valid {
+		return errors.New("invalid token")
+	}
+	return nil
+}
+
+func (s jwtService) Policy() *Policy {
+	return s.policy
+}
+
+type pasetoLocalService struct {
+	key    []byte
+	policy *Policy
+}
+
+// NewPasetoLocalService returns a token service for v4.local tokens
+func NewPasetoLocalService(key []byte, policy *Policy) (Service, error) {
+	if len(key) != 32 {
+		return nil, errors.New("paseto local key must be 32 bytes")
+	}
+	return pasetoLocalService{key, policy}, nil
+}
+
+func (s pasetoLocalService) Issue(claims Claims) (string, error) {
+	payload, err := pasetoPayload(claims)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, pasetoNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return encryptLocal(s.key, nonce, payload, nil, nil)
+}
+
+func (s pasetoLocalService) Verify(token string, claims Claims) error {
+	if err := s.Decode(token, claims); err != nil {
+		return err
+	}
+	return s.policy.Validate(claims.Registered())
+}
+
+func (s pasetoLocalService) Decode(token string, claims Claims) error {
+	payload, err := decryptLocal(s.key, token, nil)
+	if err != nil {
+		return errors.New("invalid token")
+	}
+	return decodePasetoClaims(payload, claims)
+}
+
+func (s pasetoLocalService) Policy() *Policy {
+	return s.policy
+}
+
+type pasetoPublicService struct {
+	secret ed25519.PrivateKey
+	public ed25519.PublicKey
+	policy *Policy
+}
+
+// NewPasetoPublicService returns a token service for v4.public tokens, the
+// public key is taken from the secret key when there is one
+func NewPasetoPublicService(secret ed25519.PrivateKey, public ed25519.PublicKey, policy *Policy) (Service, error) {
+	switch len(secret) {
+	case 0:
+	case ed25519.SeedSize:
+		secret = ed25519.NewKeyFromSeed(secret)
+	case ed25519.PrivateKeySize:
+	default:
+		return nil, errors.New("paseto secret key must be 32 or 64 bytes")
+	}
+
+	if secret != nil {
+		derived := secret.Public().(ed25519.PublicKey)
+		if public != nil && !derived.Equal(public) {
+			return nil, errors.New("paseto public key does not match the secret key")
+		}
+		public = derived
+	}
+	if len(public) != ed25519.PublicKeySize {
+		return nil, errors.New("paseto public key must be 32 bytes")
+	}
+
+	return pasetoPublicService{secret, public, policy}, nil
+}
+
+func (s pasetoPublicService) Issue(claims Claims) (string, error) {
+	if s.secret == nil {
+		return "", errors.New("no paseto secret key to issue tokens with")
+	}
+
+	payload, err := pasetoPayload(claims)
+	if err != nil {
+		return "", err
+	}
+	return signPublic(s.secret, payload, nil, nil), nil
+}
+
+func (s pasetoPublicService) Verify(token string, claims Claims) error {
+	if err := s.Decode(token, claims); err != nil {
+		return err
+	}
+	return s.policy.Validate(claims.Registered())
+}
+
+func (s pasetoPublicService) Decode(token string, claims Claims) error {
+	payload, err := verifyPublic(s.public, token, nil)
+	if err != nil {
+		return errors.New("invalid token")
+	}
+	return decodePasetoClaims(payload, claims)
+}
+
+func (s pasetoPublicService) Policy() *Policy {
+	return s.policy
+}
+
+// pasetoTimeClaims are the registered claims PASETO has as RFC 3339 times,
+// where JWT has seconds
+var pasetoTimeClaims = []string{"exp", "nbf", "iat"}
+
+// pasetoPayload encodes the claims as PASETO does
+func pasetoPayload(claims Claims) ([]byte, error) {
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(b, &payload); err != nil {
+		return nil, err
+	}
+	for _, name := range pasetoTimeClaims {
+		if secs, ok := payload[name].(float64); ok {
+			payload[name] = time.Unix(int64(secs), 0).UTC().Format(time.RFC3339)
+		}
+	}
+	return json.Marshal(payload)
+}
+
+// decodePasetoClaims decodes an authenticated payload into claims
+func decodePasetoClaims(payload []byte, claims Claims) error {
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(payload, &decoded); err != nil {
+		return errors.New("invalid token")
+	}
+	for _, name := range pasetoTimeClaims {
+		v, ok := decoded[name]
+		if !ok {
+			continue
+		}
+		s, ok := v.(string)
+		if !ok {
+			return errors.New("invalid token")
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return errors.New("invalid token")
+		}
+		decoded[name] = t.Unix()
+	}
+
+	b, err := json.Marshal(decoded)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, claims); err != nil {
+		return errors.New("invalid token")
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package tokenpkg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+type testClaims struct {
+	Role string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+func (c *testClaims) Registered() *jwt.RegisteredClaims {
+	return &c.RegisteredClaims
+}
+
+// hmacKeyService signs with a fixed secret, the key rotation is tested
+// against the database elsewhere
+type hmacKeyService struct {
+	secret []byte
+}
+
+func (k hmacKeyService) Sign(claims jwt.Claims) (string, error) {
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(k.secret)
+}
+
+func (k hmacKeyService) Keyfunc(t *jwt.Token) (interface{}, error) {
+	return k.secret, nil
+}
+
+func (k hmacKeyService) JWKS() (*JWKS, error) {
+	return &JWKS{}, nil
+}
+
+func (k hmacKeyService) Alg() string {
+	return "HS256"
+}
+
+func TestTokenService(t *testing.T) {
+	policy := &Policy{
+		Issuer:    "https://auth.example.com",
+		Audiences: []string{"api"},
+		Audience:  "api",
+		TTL:       time.Hour,
+		Leeway:    30 * time.Second,
+	}
+
+	newService := func(t *testing.T, format string, key []byte) Service {
+		var s Service
+		var err error
+		switch format {
+		case FormatJWT:
+			s = NewJWTService(hmacKeyService{key}, policy)
+		case FormatPasetoLocal:
+			s, err = NewPasetoLocalService(key, policy)
+		case FormatPasetoPublic:
+			s, err = NewPasetoPublicService(ed25519.NewKeyFromSeed(key), nil, policy)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	randomKey := func(t *testing.T) []byte {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	type testCase struct {
+		Name string
+		// Prepare changes the claims before they are issued
+		Prepare func(c *testClaims)
+		// Tamper changes the issued token before it is verified
+		Tamper func(token string) string
+		// OtherKey verifies with a service holding another key
+		OtherKey      bool
+		ExpectedError string
+	}
+
+	tests := []testCase{
+		{Name: "Valid token"},
+		{
+			Name:          "Expired token",
+			Prepare:       func(c *testClaims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute)) },
+			ExpectedError: "token expired",
+		},
+		{
+			Name:          "Token of another issuer",
+			Prepare:       func(c *testClaims) { c.Issuer = "https://evil.example.com" },
+			ExpectedError: "invalid issuer",
+		},
+		{
+			Name:          "Token for another audience",
+			Prepare:       func(c *testClaims) { c.Audience = jwt.ClaimStrings{"billing"} },
+			ExpectedError: "invalid audience",
+		},
+		{
+			Name:          "Token of another key",
+			OtherKey:      true,
+			ExpectedError: "invalid token",
+		},
+		{
+			Name:          "Tampered token",
+			Tamper:        func(token string) string { return token[:len(token)-4] + "AAAA" },
+			ExpectedError: "invalid token",
+		},
+		{
+			Name:          "Garbage",
+			Tamper:        func(token string) string { return "not-a-token" },
+			ExpectedError: "invalid token",
+		},
+	}
+
+	for _, format := range []string{FormatJWT, FormatPasetoLocal, FormatPasetoPublic} {
+		for _, tt := range tests {
+			t.Run(format+"/"+tt.Name, func(t *testing.T) {
+				s := newService(t, format, randomKey(t))
+
+				claims := testClaims{Role: "admin", RegisteredClaims: policy.RegisteredClaims("user-1", policy.TTL)}
+				if tt.Prepare != nil {
+					tt.Prepare(&claims)
+				}
+				token, err := s.Issue(&claims)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if format != FormatJWT {
+					assert.True(t, strings.HasPrefix(token, format+"."))
+				}
+				if tt.Tamper != nil {
+					token = tt.Tamper(token)
+				}
+				if tt.OtherKey {
+					s = newService(t, format, randomKey(t))
+				}
+
+				var verified testClaims
+				err = s.Verify(token, &verified)
+				if tt.ExpectedError != "" {
+					assert.EqualError(t, err, tt.ExpectedError)
+					return
+				}
+				assert.NoError(t, err)
+				assert.Equal(t, claims.Role, verified.Role)
+				assert.Equal(t, claims.ID, verified.ID)
+				assert.Equal(t, claims.Subject, verified.Subject)
+				assert.Equal(t, claims.ExpiresAt.Unix(), verified.ExpiresAt.Unix())
+			})
+		}
+	}
+
+	t.Run("Formats do not accept each other", func(t *testing.T) {
+		key := randomKey(t)
+		local := newService(t, FormatPasetoLocal, key)
+		public := newService(t, FormatPasetoPublic, key)
+		jwtService := newService(t, FormatJWT, key)
+
+		claims := testClaims{RegisteredClaims: policy.RegisteredClaims("user-1", policy.TTL)}
+		services := []Service{local, public, jwtService}
+		for i, issuer := range services {
+			token, err := issuer.Issue(&claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for j, verifier := range services {
+				if i == j {
+					continue
+				}
+				assert.EqualError(t, verifier.Verify(token, &testClaims{}), "invalid token")
+			}
+		}
+	})
+
+	for _, format := range []string{FormatJWT, FormatPasetoLocal, FormatPasetoPublic} {
+		t.Run(format+"/Decode leaves the audience to the caller", func(t *testing.T) {
+			s := newService(t, format, randomKey(t))
+
+			claims := testClaims{RegisteredClaims: policy.RegisteredClaims("user-1", policy.TTL)}
+			claims.Audience = jwt.ClaimStrings{"billing"}
+			token, err := s.Issue(&claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var decoded testClaims
+			assert.NoError(t, s.Decode(token, &decoded))
+			assert.NoError(t, policy.WithAudience("billing").Validate(decoded.Registered()))
+			assert.EqualError(t, policy.Validate(decoded.Registered()), "invalid audience")
+			assert.EqualError(t, s.Decode(token[:len(token)-4]+"AAAA", &testClaims{}), "invalid token")
+		})
+	}
+
+	t.Run("Public key only verifies", func(t *testing.T) {
+		secret := ed25519.NewKeyFromSeed(randomKey(t))
+		signer, err := NewPasetoPublicService(secret, nil, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		verifier, err := NewPasetoPublicService(nil, secret.Public().(ed25519.PublicKey), policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		claims := testClaims{RegisteredClaims: policy.RegisteredClaims("user-1", policy.TTL)}
+		token, err := signer.Issue(&claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, verifier.Verify(token, &testClaims{}))
+
+		_, err = verifier.Issue(&claims)
+		assert.EqualError(t, err, "no paseto secret key to issue tokens with")
+	})
+
+	t.Run("Mismatched key pair", func(t *testing.T) {
+		other := ed25519.NewKeyFromSeed(randomKey(t))
+		_, err := NewPasetoPublicService(ed25519.NewKeyFromSeed(randomKey(t)), other.Public().(ed25519.PublicKey), policy)
+		assert.EqualError(t, err, "paseto public key does not match the secret key")
+	})
+}
@@ -0,0 +1,62 @@
+package userpkg
+
+import (
+	"context"
+	"errors"
+	"log"
+	passwordpkg "mahi-go-explorer/pkg/password"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Authenticator is an external backend that can check login credentials,
+// such as a directory server
+type Authenticator interface {
+	Name() string
+	// Authenticate returns the user the credentials belong to. A nil user
+	// without error means the backend does not accept them.
+	Authenticate(email string, password string) (*ExternalUser, error)
+}
+
+// authenticate checks the credentials against the local password first,
+// then against each authenticator in turn
+func (s service) authenticate(req *LoginRequest) (*User, error) {
+	var user User
+	err := s.db.Collection(s.coll.UserCollection).FindOne(context.TODO(), bson.M{"email": req.Email}).Decode(&user)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	if err == nil && user.HashedPassword != "" {
+		if camparePassword(user.HashedPassword, req.Password) {
+			//the plain password is only around now, upgrade an outdated hash while we have it
+			if passwordpkg.DefaultHasher().NeedsRehash(user.HashedPassword) {
+				s.rehashPassword(&user, req.Password)
+			}
+			return &user, nil
+		}
+	} else {
+		//users without a local password take as long as wrong passwords
+		camparePassword(dummyPasswordHash(), req.Password)
+	}
+
+	var backendErr error
+	for _, a := range s.authenticators {
+		ext, err := a.Authenticate(req.Email, req.Password)
+		if err != nil {
+			log.Printf("Authenticator %s failed: %v", a.Name(), err)
+			backendErr = err
+			continue
+		}
+		if ext != nil {
+			return s.ProvisionExternalUser(ext)
+		}
+	}
+
+	//a backend being down is not the same as wrong credentials
+	if backendErr != nil {
+		return nil, backendErr
+	}
+	return nil, errors.New("invalid credentials")
+}
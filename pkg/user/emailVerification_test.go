@@ -0,0 +1,21 @@
+package userpkg
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmailVerificationMode(t *testing.T) {
+	t.Setenv("EMAIL_VERIFICATION_MODE", "enforce")
+	s := service{verificationMode: emailVerificationMode()}
+
+	//the mode is the one the service was created with
+	t.Setenv("EMAIL_VERIFICATION_MODE", "flag")
+	_, err := s.CompleteLogin(&User{Email: "user@example.com"}, AMRPassword, ClientInfo{})
+	assert.EqualError(t, err, "email not verified")
+
+	assert.Equal(t, EmailVerificationFlag, emailVerificationMode())
+	t.Setenv("EMAIL_VERIFICATION_MODE", "")
+	assert.Equal(t, EmailVerificationFlag, emailVerificationMode())
+}
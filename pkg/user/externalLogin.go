@@ -0,0 +1,185 @@
+package userpkg
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Identity links a user to their account at an external identity provider
+type Identity struct {
+	Provider string    `json:"provider" bson:"provider"`
+	Subject  string    `json:"subject" bson:"subject"`
+	LinkedAt time.Time `json:"linkedAt" bson:"linkedAt"`
+}
+
+// ExternalUser is a user as an external identity provider reports them
+type ExternalUser struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	FirstName     string
+	LastName      string
+	// Role is applied on every login when set
+	Role string
+}
+
+// ProvisionExternalUser returns the user linked to the external account.
+// An unlinked account is linked to the user with the same verified email,
+// or a new user is created for it just in time. With signup disabled only
+// an invitation for the email gets a new user.
+func (s service) ProvisionExternalUser(ext *ExternalUser) (*User, error) {
+	coll := s.db.Collection(s.coll.UserCollection)
+
+	var user User
+	err := coll.FindOne(
+		context.TODO(),
+		bson.M{"identities": bson.M{"$elemMatch": bson.M{"provider": ext.Provider, "subject": ext.Subject}}},
+	).Decode(&user)
+	if err == nil {
+		return s.applyExternalRole(&user, ext)
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	if ext.Email == "" {
+		return nil, errors.New("email missing")
+	}
+
+	identity := Identity{Provider: ext.Provider, Subject: ext.Subject, LinkedAt: time.Now()}
+
+	err = coll.FindOne(context.TODO(), bson.M{"email": ext.Email}).Decode(&user)
+	if err == nil {
+		//an unverified email on either side could belong to someone else
+		if !ext.EmailVerified {
+			return nil, errors.New("email not verified by provider")
+		}
+		if !user.EmailVerified {
+			return nil, errors.New("email not verified")
+		}
+
+		_, err := coll.UpdateOne(
+			context.TODO(),
+			bson.M{"_id": user.ID},
+			bson.M{"$push": bson.M{"identities": identity}},
+		)
+		if err != nil {
+			return nil, err
+		}
+		user.Identities = append(user.Identities, identity)
+		log.Printf("Linked %s account %s to user %s", ext.Provider, ext.Subject, user.ID.Hex())
+
+		return s.applyExternalRole(&user, ext)
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	//first login, create the user just in time, with signup closed only for invited people
+	invitation, err := s.useExternalInvitation(ext)
+	if err != nil {
+		return nil, err
+	}
+	created, err := justInTimeUser(ext, identity, invitation, SignupEnabled())
+	if err != nil {
+		return nil, err
+	}
+	user = *created
+	id, err := s.CreateUser(&user)
+	if err != nil {
+		if invitation != nil {
+			s.reopenInvitation(invitation.ID)
+		}
+		return nil, err
+	}
+	user.ID = id.(primitive.ObjectID)
+	log.Printf("Created user %s for %s account %s", user.ID.Hex(), ext.Provider, ext.Subject)
+
+	return &user, nil
+}
+
+// justInTimeUser is the user created on the first login of an external
+// account, an invitation for the email decides its role & organization
+func justInTimeUser(ext *ExternalUser, identity Identity, invitation *Invitation, signupEnabled bool) (*User, error) {
+	if invitation == nil && !signupEnabled {
+		return nil, errors.New("signup disabled")
+	}
+
+	user := User{
+		FirstName:     ext.FirstName,
+		LastName:      ext.LastName,
+		Email:         ext.Email,
+		Role:          NormalizeRole(ext.Role),
+		EmailVerified: ext.EmailVerified,
+		Identities:    []Identity{identity},
+	}
+	if invitation == nil {
+		return &user, nil
+	}
+
+	//a role from the provider still wins, it is applied on every login anyway
+	if ext.Role == "" {
+		user.Role = invitation.Role
+	}
+	if !invitation.OrgID.IsZero() {
+		user.Memberships = []Membership{{OrgID: invitation.OrgID, Role: invitation.Role, JoinedAt: identity.LinkedAt}}
+		if ext.Role == "" {
+			user.Role = RoleUser
+		}
+	}
+	return &user, nil
+}
+
+// useExternalInvitation accepts the pending invitation for the email of the
+// external account, if any
+func (s service) useExternalInvitation(ext *ExternalUser) (*Invitation, error) {
+	//an unverified email could belong to someone else than the one invited
+	if !ext.EmailVerified {
+		return nil, nil
+	}
+
+	now := time.Now()
+	var invitation Invitation
+	err := s.db.Collection(s.coll.InvitationCollection).FindOneAndUpdate(
+		context.TODO(),
+		pendingInvitation(bson.M{"email": ext.Email, "expiresAt": bson.M{"$gt": now}}),
+		bson.M{"$set": bson.M{"acceptedAt": now}},
+	).Decode(&invitation)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Accepted invitation %s with %s account %s", invitation.ID.Hex(), ext.Provider, ext.Subject)
+
+	return &invitation, nil
+}
+
+// applyExternalRole keeps the role of the user in line with the provider
+func (s service) applyExternalRole(user *User, ext *ExternalUser) (*User, error) {
+	if ext.Role == "" || NormalizeRole(ext.Role) == user.Role {
+		return user, nil
+	}
+
+	role := NormalizeRole(ext.Role)
+	_, err := s.db.Collection(s.coll.UserCollection).UpdateOne(
+		context.TODO(),
+		bson.M{"_id": user.ID},
+		bson.M{"$set": bson.M{"role": role}},
+	)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Role of user %s changed from %s to %s by %s", user.ID.Hex(), user.Role, role, ext.Provider)
+	user.Role = role
+
+	return user, nil
+}
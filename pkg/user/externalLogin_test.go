@@ -0,0 +1,91 @@
+package userpkg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestJustInTimeUser(t *testing.T) {
+	type testCase struct {
+		name                string
+		ext                 ExternalUser
+		invitation          *Invitation
+		signupEnabled       bool
+		expectedRole        string
+		expectedMemberships int
+		expectedError       string
+	}
+
+	orgID := primitive.NewObjectID()
+	ext := ExternalUser{Provider: "corp", Subject: "sub", Email: "user@example.com", EmailVerified: true}
+	withRole := ext
+	withRole.Role = RoleAdmin
+
+	tests := []testCase{
+		{
+			name:          "Creates a user when signup is open",
+			ext:           ext,
+			signupEnabled: true,
+			expectedRole:  RoleUser,
+		},
+		{
+			name:          "Refuses a new user when signup is closed",
+			ext:           ext,
+			signupEnabled: false,
+			expectedError: "signup disabled",
+		},
+		{
+			name:          "Refuses a new user with a provider role when signup is closed",
+			ext:           withRole,
+			signupEnabled: false,
+			expectedError: "signup disabled",
+		},
+		{
+			name:          "Creates an invited user when signup is closed",
+			ext:           ext,
+			invitation:    &Invitation{Email: ext.Email, Role: RoleAdmin},
+			signupEnabled: false,
+			expectedRole:  RoleAdmin,
+		},
+		{
+			name:                "Puts an invited user in the organization",
+			ext:                 ext,
+			invitation:          &Invitation{Email: ext.Email, Role: RoleAdmin, OrgID: orgID},
+			signupEnabled:       false,
+			expectedRole:        RoleUser,
+			expectedMemberships: 1,
+		},
+		{
+			name:          "Keeps the provider role over the invited one",
+			ext:           withRole,
+			invitation:    &Invitation{Email: ext.Email, Role: RoleUser},
+			signupEnabled: false,
+			expectedRole:  RoleAdmin,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			identity := Identity{Provider: test.ext.Provider, Subject: test.ext.Subject, LinkedAt: time.Now()}
+			user, err := justInTimeUser(&test.ext, identity, test.invitation, test.signupEnabled)
+			if test.expectedError != "" {
+				assert.EqualError(t, err, test.expectedError)
+				assert.Nil(t, user)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, test.ext.Email, user.Email)
+			assert.Equal(t, test.expectedRole, user.Role)
+			assert.Len(t, user.Memberships, test.expectedMemberships)
+			if test.expectedMemberships > 0 {
+				assert.Equal(t, orgID, user.Memberships[0].OrgID)
+				assert.Equal(t, test.invitation.Role, user.Memberships[0].Role)
+			}
+			assert.Equal(t, []Identity{identity}, user.Identities)
+		})
+	}
+}
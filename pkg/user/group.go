@@ -0,0 +1,480 @@
+package userpkg
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Group gives its members a role & permissions, groups nest so a team can be
+// part of a department
+type Group struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	OrgID       primitive.ObjectID `json:"orgId,omitempty" bson:"orgId,omitempty"`
+	Name        string             `json:"name" bson:"name"`
+	Description string             `json:"description,omitempty" bson:"description,omitempty"`
+	// Role & Permissions are granted to the members, including the ones of nested groups
+	Role        string               `json:"role,omitempty" bson:"role,omitempty"`
+	Permissions []string             `json:"permissions" bson:"permissions"`
+	MemberIDs   []primitive.ObjectID `json:"memberIds" bson:"memberIds"`
+	// GroupIDs are the nested groups, their members are members of this group too
+	GroupIDs  []primitive.ObjectID `json:"groupIds" bson:"groupIds"`
+	CreatedAt time.Time            `json:"createdAt" bson:"createdAt"`
+}
+
+// GroupRequest defines group request schema, an update replaces every field
+type GroupRequest struct {
+	Name        string   `json:"name,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Role        string   `json:"role,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+// GroupMemberRequest defines group member request schema
+type GroupMemberRequest struct {
+	UserID string `json:"userId"`
+}
+
+// SubgroupRequest defines nested group request schema
+type SubgroupRequest struct {
+	GroupID string `json:"groupId"`
+}
+
+// GroupGrants are what a user gets from their groups, Role is empty when
+// none of them grants one
+type GroupGrants struct {
+	Role        string
+	Permissions []string
+}
+
+// maxGroupDepth bounds how far nested groups are followed
+const maxGroupDepth = 16
+
+// grantCache keeps the grants of users in memory so groups are not resolved
+// on every request. Group changes clear it, other instances catch up within
+// the ttl.
+type grantCache struct {
+	mu     sync.RWMutex
+	ttl    time.Duration
+	grants map[string]cacheEntry[*GroupGrants]
+}
+
+func newGrantCache(ttl time.Duration) *grantCache {
+	return &grantCache{ttl: ttl, grants: map[string]cacheEntry[*GroupGrants]{}}
+}
+
+func grantKey(userID primitive.ObjectID, orgID primitive.ObjectID) string {
+	return userID.Hex() + "/" + orgID.Hex()
+}
+
+func (gc *grantCache) get(key string) (*GroupGrants, bool) {
+	gc.mu.RLock()
+	defer gc.mu.RUnlock()
+	e, ok := gc.grants[key]
+	if !ok || e.expiresAt.Before(time.Now()) {
+		return nil, false
+	}
+	return e.value, true
+}
+
+func (gc *grantCache) set(key string, grants *GroupGrants) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	if len(gc.grants) >= revocationCacheMaxEntries {
+		gc.grants = purgeExpired(gc.grants)
+	}
+	gc.grants[key] = cacheEntry[*GroupGrants]{value: grants, expiresAt: time.Now().Add(gc.ttl)}
+}
+
+func (gc *grantCache) clear() {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	gc.grants = map[string]cacheEntry[*GroupGrants]{}
+}
+
+// orgGroups matches the groups of the organization, or the ones outside of
+// any for a zero orgID
+func orgGroups(conds bson.M, orgID primitive.ObjectID) bson.M {
+	if orgID.IsZero() {
+		conds["orgId"] = bson.M{"$exists": false}
+	} else {
+		conds["orgId"] = orgID
+	}
+	return conds
+}
+
+func (s service) GroupGrants(userID primitive.ObjectID, orgID primitive.ObjectID) (*GroupGrants, error) {
+	key := grantKey(userID, orgID)
+	if grants, ok := s.grants.get(key); ok {
+		return grants, nil
+	}
+
+	coll := s.db.Collection(s.coll.GroupCollection)
+	grants := &GroupGrants{}
+	seen := map[primitive.ObjectID]bool{}
+
+	//the groups of the user, then the groups those are nested in
+	conds := bson.M{"memberIds": userID}
+	for depth := 0; depth < maxGroupDepth; depth++ {
+		cursor, err := coll.Find(context.TODO(), orgGroups(conds, orgID))
+		if err != nil {
+			return nil, err
+		}
+		var groups []Group
+		if err := cursor.All(context.TODO(), &groups); err != nil {
+			return nil, err
+		}
+
+		var ids []primitive.ObjectID
+		for _, g := range groups {
+			if seen[g.ID] {
+				continue
+			}
+			seen[g.ID] = true
+			ids = append(ids, g.ID)
+
+			if RoleRank(g.Role) > RoleRank(grants.Role) {
+				grants.Role = NormalizeRole(g.Role)
+			}
+			for _, p := range g.Permissions {
+				if !contains(grants.Permissions, p) {
+					grants.Permissions = append(grants.Permissions, p)
+				}
+			}
+		}
+		if len(ids) == 0 {
+			break
+		}
+		conds = bson.M{"groupIds": bson.M{"$in": ids}}
+	}
+
+	s.grants.set(key, grants)
+	return grants, nil
+}
+
+func (s service) CreateGroup(req *GroupRequest) (*Group, error) {
+	return s.createGroup(primitive.NilObjectID, req)
+}
+
+func (s service) createGroup(orgID primitive.ObjectID, req *GroupRequest) (*Group, error) {
+	group := Group{
+		OrgID:       orgID,
+		Name:        strings.TrimSpace(req.Name),
+		Description: req.Description,
+		Role:        groupRole(req.Role),
+		Permissions: groupPermissions(req.Permissions),
+		MemberIDs:   []primitive.ObjectID{},
+		GroupIDs:    []primitive.ObjectID{},
+		CreatedAt:   time.Now(),
+	}
+	res, err := s.db.Collection(s.coll.GroupCollection).InsertOne(context.TODO(), group)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, errors.New("group already exists")
+	}
+	if err != nil {
+		return nil, err
+	}
+	group.ID = res.InsertedID.(primitive.ObjectID)
+	return &group, nil
+}
+
+// groupRole keeps groups without a role from granting RoleUser explicitly
+func groupRole(role string) string {
+	if role == "" {
+		return ""
+	}
+	return NormalizeRole(role)
+}
+
+func groupPermissions(permissions []string) []string {
+	if permissions == nil {
+		return []string{}
+	}
+	return permissions
+}
+
+func (s service) GetGroups() ([]Group, error) {
+	return s.getGroups(bson.M{})
+}
+
+func (s service) getGroups(conds bson.M) ([]Group, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}})
+	cursor, err := s.db.Collection(s.coll.GroupCollection).Find(context.TODO(), conds, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []Group{}
+	if err := cursor.All(context.TODO(), &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+func (s service) GetGroup(id primitive.ObjectID) (*Group, error) {
+	return s.getGroup(bson.M{"_id": id})
+}
+
+func (s service) getGroup(conds bson.M) (*Group, error) {
+	var group Group
+	err := s.db.Collection(s.coll.GroupCollection).FindOne(context.TODO(), conds).Decode(&group)
+	if err == mongo.ErrNoDocuments {
+		return nil, errors.New("group not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+func (s service) UpdateGroup(id primitive.ObjectID, req *GroupRequest) (*Group, error) {
+	return s.updateGroup(bson.M{"_id": id}, req)
+}
+
+func (s service) updateGroup(conds bson.M, req *GroupRequest) (*Group, error) {
+	var group Group
+	err := s.db.Collection(s.coll.GroupCollection).FindOneAndUpdate(
+		context.TODO(),
+		conds,
+		bson.M{"$set": bson.M{
+			"name":        strings.TrimSpace(req.Name),
+			"description": req.Description,
+			"role":        groupRole(req.Role),
+			"permissions": groupPermissions(req.Permissions),
+		}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&group)
+	if err == mongo.ErrNoDocuments {
+		return nil, errors.New("group not found")
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, errors.New("group already exists")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.grants.clear()
+	return &group, nil
+}
+
+func (s service) DeleteGroup(id primitive.ObjectID) error {
+	return s.deleteGroup(bson.M{"_id": id})
+}
+
+func (s service) deleteGroup(conds bson.M) error {
+	coll := s.db.Collection(s.coll.GroupCollection)
+	var group Group
+	err := coll.FindOneAndDelete(context.TODO(), conds).Decode(&group)
+	if err == mongo.ErrNoDocuments {
+		return errors.New("group not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	//groups it was nested in no longer contain it
+	_, err = coll.UpdateMany(context.TODO(), bson.M{"groupIds": group.ID}, bson.M{"$pull": bson.M{"groupIds": group.ID}})
+	if err != nil {
+		return err
+	}
+
+	s.grants.clear()
+	return nil
+}
+
+func (s service) AddGroupMember(id primitive.ObjectID, userID primitive.ObjectID) error {
+	return s.addGroupMember(bson.M{"_id": id}, bson.M{"_id": userID})
+}
+
+func (s service) addGroupMember(groupConds bson.M, userConds bson.M) error {
+	user, err := s.GetUser(userConds, options.FindOne().SetProjection(bson.M{"_id": 1}))
+	if err == mongo.ErrNoDocuments {
+		return errors.New("user not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	res, err := s.db.Collection(s.coll.GroupCollection).UpdateOne(
+		context.TODO(),
+		groupConds,
+		bson.M{"$addToSet": bson.M{"memberIds": user.ID}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errors.New("group not found")
+	}
+
+	s.grants.clear()
+	return nil
+}
+
+func (s service) RemoveGroupMember(id primitive.ObjectID, userID primitive.ObjectID) error {
+	return s.removeGroupMember(bson.M{"_id": id}, userID)
+}
+
+func (s service) removeGroupMember(groupConds bson.M, userID primitive.ObjectID) error {
+	groupConds["memberIds"] = userID
+	res, err := s.db.Collection(s.coll.GroupCollection).UpdateOne(
+		context.TODO(),
+		groupConds,
+		bson.M{"$pull": bson.M{"memberIds": userID}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errors.New("member not found")
+	}
+
+	s.grants.clear()
+	return nil
+}
+
+func (s service) AddSubgroup(id primitive.ObjectID, subgroupID primitive.ObjectID) error {
+	return s.addSubgroup(bson.M{"_id": id}, bson.M{"_id": subgroupID})
+}
+
+// addSubgroup nests a group, both are looked up with their own conds so they
+// belong to the same organization
+func (s service) addSubgroup(groupConds bson.M, subgroupConds bson.M) error {
+	group, err := s.getGroup(groupConds)
+	if err != nil {
+		return err
+	}
+	subgroup, err := s.getGroup(subgroupConds)
+	if err != nil {
+		return err
+	}
+	if group.OrgID != subgroup.OrgID {
+		return errors.New("group not found")
+	}
+
+	//a group nested in itself, even through others, would never stop
+	contained, err := s.containsGroup(subgroup, group.ID)
+	if err != nil {
+		return err
+	}
+	if contained {
+		return errors.New("group cycle")
+	}
+
+	_, err = s.db.Collection(s.coll.GroupCollection).UpdateOne(
+		context.TODO(),
+		bson.M{"_id": group.ID},
+		bson.M{"$addToSet": bson.M{"groupIds": subgroup.ID}},
+	)
+	if err != nil {
+		return err
+	}
+
+	s.grants.clear()
+	return nil
+}
+
+// containsGroup checks if the group is id or has it nested at any depth
+func (s service) containsGroup(group *Group, id primitive.ObjectID) (bool, error) {
+	if group.ID == id {
+		return true, nil
+	}
+
+	seen := map[primitive.ObjectID]bool{group.ID: true}
+	ids := group.GroupIDs
+	for depth := 0; len(ids) > 0 && depth < maxGroupDepth; depth++ {
+		cursor, err := s.db.Collection(s.coll.GroupCollection).Find(
+			context.TODO(),
+			bson.M{"_id": bson.M{"$in": ids}},
+			options.Find().SetProjection(bson.M{"groupIds": 1}),
+		)
+		if err != nil {
+			return false, err
+		}
+		var groups []Group
+		if err := cursor.All(context.TODO(), &groups); err != nil {
+			return false, err
+		}
+
+		ids = nil
+		for _, g := range groups {
+			if g.ID == id {
+				return true, nil
+			}
+			if seen[g.ID] {
+				continue
+			}
+			seen[g.ID] = true
+			ids = append(ids, g.GroupIDs...)
+		}
+	}
+	return false, nil
+}
+
+func (s service) RemoveSubgroup(id primitive.ObjectID, subgroupID primitive.ObjectID) error {
+	return s.removeSubgroup(bson.M{"_id": id}, subgroupID)
+}
+
+func (s service) removeSubgroup(groupConds bson.M, subgroupID primitive.ObjectID) error {
+	groupConds["groupIds"] = subgroupID
+	res, err := s.db.Collection(s.coll.GroupCollection).UpdateOne(
+		context.TODO(),
+		groupConds,
+		bson.M{"$pull": bson.M{"groupIds": subgroupID}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errors.New("group not found")
+	}
+
+	s.grants.clear()
+	return nil
+}
+
+// CreateGroup creates a group of the organization
+func (s orgService) CreateGroup(req *GroupRequest) (*Group, error) {
+	return s.createGroup(s.orgID, req)
+}
+
+func (s orgService) GetGroups() ([]Group, error) {
+	return s.getGroups(bson.M{"orgId": s.orgID})
+}
+
+func (s orgService) GetGroup(id primitive.ObjectID) (*Group, error) {
+	return s.getGroup(bson.M{"_id": id, "orgId": s.orgID})
+}
+
+func (s orgService) UpdateGroup(id primitive.ObjectID, req *GroupRequest) (*Group, error) {
+	return s.updateGroup(bson.M{"_id": id, "orgId": s.orgID}, req)
+}
+
+func (s orgService) DeleteGroup(id primitive.ObjectID) error {
+	return s.deleteGroup(bson.M{"_id": id, "orgId": s.orgID})
+}
+
+// AddGroupMember adds a member of the organization to one of its groups
+func (s orgService) AddGroupMember(id primitive.ObjectID, userID primitive.ObjectID) error {
+	return s.addGroupMember(bson.M{"_id": id, "orgId": s.orgID}, s.scope(bson.M{"_id": userID}))
+}
+
+func (s orgService) RemoveGroupMember(id primitive.ObjectID, userID primitive.ObjectID) error {
+	return s.removeGroupMember(bson.M{"_id": id, "orgId": s.orgID}, userID)
+}
+
+func (s orgService) AddSubgroup(id primitive.ObjectID, subgroupID primitive.ObjectID) error {
+	return s.addSubgroup(bson.M{"_id": id, "orgId": s.orgID}, bson.M{"_id": subgroupID, "orgId": s.orgID})
+}
+
+func (s orgService) RemoveSubgroup(id primitive.ObjectID, subgroupID primitive.ObjectID) error {
+	return s.removeSubgroup(bson.M{"_id": id, "orgId": s.orgID}, subgroupID)
+}
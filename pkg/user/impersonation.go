@@ -0,0 +1,121 @@
+package userpkg
+
+import (
+	"context"
+	"errors"
+	"log"
+	"mahi-go-explorer/internal/config"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Actor is the admin behind an impersonated token, the "act" claim of RFC 8693
+type Actor struct {
+	ID    primitive.ObjectID `json:"sub" bson:"id"`
+	Email string             `json:"email,omitempty" bson:"email"`
+}
+
+// ImpersonationResponse holds the token for acting as the user, there is
+// no refresh token, the admin asks for a new one when it expires
+type ImpersonationResponse struct {
+	AccessToken string `json:"accessToken"`
+	ExpiresIn   int64  `json:"expiresIn"`
+}
+
+// ImpersonationStarted is the audit action of handing out a token, the
+// requests made with it are recorded by method & path
+const ImpersonationStarted = "impersonation started"
+
+// ImpersonationRecord is an entry of the impersonation audit trail
+type ImpersonationRecord struct {
+	ID      primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	ActorID primitive.ObjectID `json:"actorId" bson:"actorId"`
+	UserID  primitive.ObjectID `json:"userId" bson:"userId"`
+	// TokenID is the impersonated token the action was taken with
+	TokenID   string    `json:"tokenId" bson:"tokenId"`
+	Action    string    `json:"action" bson:"action"`
+	Status    int       `json:"status,omitempty" bson:"status,omitempty"`
+	IP        string    `json:"ip,omitempty" bson:"ip,omitempty"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+func impersonationTTL() time.Duration {
+	return config.GetDurationFromEnv("IMPERSONATION_TTL", 15*time.Minute)
+}
+
+func (s service) Impersonate(actor *UserContext, userID primitive.ObjectID) (*ImpersonationResponse, error) {
+	//no impersonating from an impersonated token
+	if actor.IsImpersonated() {
+		return nil, errors.New("already impersonating")
+	}
+	if actor.ID == userID {
+		return nil, errors.New("cannot impersonate this user")
+	}
+
+	var user User
+	err := s.db.Collection(s.coll.UserCollection).FindOne(context.TODO(), bson.M{"_id": userID}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil, errors.New("user not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	//an organization admin only acts as members, with the role they have there
+	role := user.Role
+	if actor.InOrg() {
+		m := user.Membership(actor.OrgID)
+		if m == nil {
+			return nil, errors.New("user not found")
+		}
+		role = m.Role
+	}
+	grants, err := s.GroupGrants(user.ID, actor.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	if RoleRank(grants.Role) > RoleRank(role) {
+		role = grants.Role
+	}
+
+	//acting as an equal would hand out their privileges
+	if RoleRank(role) >= RoleRank(actor.Role) {
+		return nil, errors.New("cannot impersonate this user")
+	}
+	if user.IsBlocked {
+		return nil, errors.New("user is blocked")
+	}
+
+	//the token lives in the session of the admin, logging out ends it too
+	ttl := impersonationTTL()
+	claims := s.accessTokenClaims(&user, actor.SessionID, actor.OrgID, ttl)
+	claims.Act = &Actor{ID: actor.ID, Email: actor.Email}
+
+	token, err := s.tokens.Issue(&claims)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.RecordImpersonation(&ImpersonationRecord{
+		ActorID: actor.ID,
+		UserID:  user.ID,
+		TokenID: claims.ID,
+		Action:  ImpersonationStarted,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ImpersonationResponse{AccessToken: token, ExpiresIn: int64(ttl.Seconds())}, nil
+}
+
+func (s service) RecordImpersonation(record *ImpersonationRecord) error {
+	record.CreatedAt = time.Now()
+	log.Printf("Impersonation: admin %s as user %s: %s", record.ActorID.Hex(), record.UserID.Hex(), record.Action)
+
+	_, err := s.db.Collection(s.coll.ImpersonationLogCollection).InsertOne(context.TODO(), record)
+	return err
+}
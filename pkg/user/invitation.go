@@ -0,0 +1,400 @@
+package userpkg
+
+import (
+	"context"
+	"errors"
+	"log"
+	"mahi-go-explorer/internal/config"
+	mailpkg "mahi-go-explorer/pkg/mail"
+	passwordpkg "mahi-go-explorer/pkg/password"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Invitation lets someone create their account with a role chosen by an admin
+type Invitation struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Email     string             `json:"email" bson:"email"`
+	FirstName string             `json:"firstName,omitempty" bson:"firstName,omitempty"`
+	LastName  string             `json:"lastName,omitempty" bson:"lastName,omitempty"`
+	Role      string             `json:"role" bson:"role"`
+	InvitedBy primitive.ObjectID `json:"invitedBy" bson:"invitedBy"`
+	// OrgID is the organization the account joins, the role is the one it has there
+	OrgID     primitive.ObjectID `json:"orgId,omitempty" bson:"orgId,omitempty"`
+	TokenHash string             `json:"-" bson:"tokenHash"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+	// SentAt is when the last email went out, resending replaces the token
+	SentAt     time.Time  `json:"sentAt" bson:"sentAt"`
+	ExpiresAt  time.Time  `json:"expiresAt" bson:"expiresAt"`
+	AcceptedAt *time.Time `json:"acceptedAt,omitempty" bson:"acceptedAt,omitempty"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty" bson:"revokedAt,omitempty"`
+	// Expired marks pending invitations that have to be resent to be accepted
+	Expired bool `json:"expired,omitempty" bson:"-"`
+}
+
+// InvitationRequest defines invitation request schema
+type InvitationRequest struct {
+	Email     string `json:"email,omitempty"`
+	FirstName string `json:"firstName,omitempty"`
+	LastName  string `json:"lastName,omitempty"`
+	Role      string `json:"role,omitempty"`
+}
+
+// AcceptInvitationRequest defines accept invitation request schema, the
+// names default to the ones the admin gave. Someone who already has an
+// account joins the organization with the password of that account.
+type AcceptInvitationRequest struct {
+	Token     string `json:"token,omitempty"`
+	Password  string `json:"password,omitempty"`
+	FirstName string `json:"firstName,omitempty"`
+	LastName  string `json:"lastName,omitempty"`
+	ClientInfo
+}
+
+// SignupEnabled checks if anyone can sign up, when off accounts are only
+// created by admins & invitations
+func SignupEnabled() bool {
+	return config.GetBoolFromEnv("SIGNUP_ENABLED", true)
+}
+
+func invitationTTL() time.Duration {
+	return config.GetDurationFromEnv("INVITATION_TTL", 7*24*time.Hour)
+}
+
+// pendingInvitation matches invitations that were neither accepted nor revoked
+func pendingInvitation(conds bson.M) bson.M {
+	conds["acceptedAt"] = bson.M{"$exists": false}
+	conds["revokedAt"] = bson.M{"$exists": false}
+	return conds
+}
+
+func (s service) InviteUser(invitedBy primitive.ObjectID, req *InvitationRequest) (*Invitation, error) {
+	return s.inviteUser(invitedBy, primitive.NilObjectID, req)
+}
+
+func (s service) inviteUser(invitedBy primitive.ObjectID, orgID primitive.ObjectID, req *InvitationRequest) (*Invitation, error) {
+	email := strings.TrimSpace(req.Email)
+
+	//an organization only learns about its own members, anyone else is
+	//invited the same way & joins with their account when they have one
+	count, err := s.db.Collection(s.coll.UserCollection).CountDocuments(context.TODO(), invitedUser(email, orgID))
+	if err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		if orgID.IsZero() {
+			return nil, errors.New("user already exists")
+		}
+		return nil, errors.New("already a member")
+	}
+
+	coll := s.db.Collection(s.coll.InvitationCollection)
+	count, err = coll.CountDocuments(context.TODO(), pendingInvitation(invitationScope(email, orgID)))
+	if err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, errors.New("invitation already pending")
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	invitation := Invitation{
+		Email:     email,
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+		Role:      NormalizeRole(req.Role),
+		InvitedBy: invitedBy,
+		OrgID:     orgID,
+		TokenHash: hashToken(token),
+		CreatedAt: now,
+		SentAt:    now,
+		ExpiresAt: now.Add(invitationTTL()),
+	}
+	res, err := coll.InsertOne(context.TODO(), invitation)
+	if err != nil {
+		return nil, err
+	}
+	invitation.ID = res.InsertedID.(primitive.ObjectID)
+
+	//a failed email can be resent, the invitation stays
+	if err := s.sendInvitation(&invitation, token); err != nil {
+		return nil, err
+	}
+
+	return &invitation, nil
+}
+
+// invitedUser matches the account that makes an invitation pointless, any
+// account for the platform & a member for an organization
+func invitedUser(email string, orgID primitive.ObjectID) bson.M {
+	if orgID.IsZero() {
+		return bson.M{"email": email}
+	}
+	return bson.M{"email": email, "memberships.orgId": orgID}
+}
+
+// invitationScope matches the invitations for the email from the same
+// organization, or from the platform
+func invitationScope(email string, orgID primitive.ObjectID) bson.M {
+	if orgID.IsZero() {
+		return bson.M{"email": email, "orgId": bson.M{"$exists": false}}
+	}
+	return bson.M{"email": email, "orgId": orgID}
+}
+
+func (s service) GetInvitations() ([]Invitation, error) {
+	return s.getInvitations(bson.M{})
+}
+
+func (s service) getInvitations(conds bson.M) ([]Invitation, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}})
+	cursor, err := s.db.Collection(s.coll.InvitationCollection).Find(context.TODO(), pendingInvitation(conds), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	invitations := []Invitation{}
+	if err := cursor.All(context.TODO(), &invitations); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for i := range invitations {
+		invitations[i].Expired = !invitations[i].ExpiresAt.After(now)
+	}
+
+	return invitations, nil
+}
+
+func (s service) ResendInvitation(id primitive.ObjectID) (*Invitation, error) {
+	return s.resendInvitation(bson.M{"_id": id})
+}
+
+func (s service) resendInvitation(conds bson.M) (*Invitation, error) {
+	token, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	//the old link stops working, the new one gets a full lifetime
+	now := time.Now()
+	var invitation Invitation
+	err = s.db.Collection(s.coll.InvitationCollection).FindOneAndUpdate(
+		context.TODO(),
+		pendingInvitation(conds),
+		bson.M{"$set": bson.M{"tokenHash": hashToken(token), "sentAt": now, "expiresAt": now.Add(invitationTTL())}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&invitation)
+	if err == mongo.ErrNoDocuments {
+		return nil, errors.New("invitation not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.sendInvitation(&invitation, token); err != nil {
+		return nil, err
+	}
+
+	return &invitation, nil
+}
+
+func (s service) RevokeInvitation(id primitive.ObjectID) error {
+	return s.revokeInvitation(bson.M{"_id": id})
+}
+
+func (s service) revokeInvitation(conds bson.M) error {
+	res, err := s.db.Collection(s.coll.InvitationCollection).UpdateOne(
+		context.TODO(),
+		pendingInvitation(conds),
+		bson.M{"$set": bson.M{"revokedAt": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errors.New("invitation not found")
+	}
+	return nil
+}
+
+func (s service) AcceptInvitation(req *AcceptInvitationRequest) (*LoginResponse, error) {
+	coll := s.db.Collection(s.coll.InvitationCollection)
+	now := time.Now()
+	valid := pendingInvitation(bson.M{"tokenHash": hashToken(req.Token), "expiresAt": bson.M{"$gt": now}})
+
+	var invitation Invitation
+	err := coll.FindOne(context.TODO(), valid).Decode(&invitation)
+	if err == mongo.ErrNoDocuments {
+		return nil, errors.New("invalid invitation")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !invitation.OrgID.IsZero() {
+		count, err := s.db.Collection(s.coll.UserCollection).CountDocuments(context.TODO(), bson.M{"email": invitation.Email})
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			return s.joinByInvitation(&invitation, valid, req)
+		}
+	}
+
+	user := User{
+		FirstName: invitation.FirstName,
+		LastName:  invitation.LastName,
+		Email:     invitation.Email,
+		Role:      invitation.Role,
+		//the invitation reached the address
+		EmailVerified: true,
+	}
+	if req.FirstName != "" {
+		user.FirstName = req.FirstName
+	}
+	if req.LastName != "" {
+		user.LastName = req.LastName
+	}
+	if !invitation.OrgID.IsZero() {
+		user.Memberships = []Membership{{OrgID: invitation.OrgID, Role: invitation.Role, JoinedAt: now}}
+		user.Role = RoleUser
+	}
+
+	//a rejected password does not use up the invitation
+	if err := passwordpkg.DefaultPolicy().Validate(req.Password, user.Email, user.FirstName, user.LastName); err != nil {
+		return nil, err
+	}
+	hp, err := hashPassword(req.Password)
+	if err != nil {
+		return nil, err
+	}
+	user.HashedPassword = hp
+
+	//mark the invitation as accepted, only succeeds once per invitation
+	res, err := coll.UpdateOne(context.TODO(), valid, bson.M{"$set": bson.M{"acceptedAt": now}})
+	if err != nil {
+		return nil, err
+	}
+	if res.ModifiedCount == 0 {
+		return nil, errors.New("invalid invitation")
+	}
+
+	id, err := s.CreateUser(&user)
+	if err != nil {
+		//the invitation is only used up by an account it created
+		s.reopenInvitation(invitation.ID)
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, errors.New("user already exists")
+		}
+		return nil, err
+	}
+	user.ID = id.(primitive.ObjectID)
+	log.Printf("Created user %s from invitation %s", user.ID.Hex(), invitation.ID.Hex())
+
+	return s.CompleteLogin(&user, AMREmail, req.ClientInfo)
+}
+
+// joinByInvitation adds the membership of an organization invitation to the
+// account that already has the email, once its password is confirmed
+func (s service) joinByInvitation(invitation *Invitation, valid bson.M, req *AcceptInvitationRequest) (*LoginResponse, error) {
+	login := &LoginRequest{Email: invitation.Email, Password: req.Password, ClientInfo: req.ClientInfo}
+	keys := []string{emailAttemptKey(login.Email)}
+	if login.ClientIP != "" {
+		keys = append(keys, ipAttemptKey(login.ClientIP))
+	}
+	if err := s.checkLockout(keys...); err != nil {
+		return nil, err
+	}
+
+	user, err := s.authenticate(login)
+	if err != nil && err.Error() == "invalid credentials" {
+		if err := s.recordFailedLogin(login); err != nil {
+			return nil, err
+		}
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.clearLoginFailures(login.Email); err != nil {
+		return nil, err
+	}
+
+	//mark the invitation as accepted, only succeeds once per invitation
+	now := time.Now()
+	res, err := s.db.Collection(s.coll.InvitationCollection).UpdateOne(context.TODO(), valid, bson.M{"$set": bson.M{"acceptedAt": now}})
+	if err != nil {
+		return nil, err
+	}
+	if res.ModifiedCount == 0 {
+		return nil, errors.New("invalid invitation")
+	}
+
+	//joined in the meantime, the membership they have stays
+	membership := Membership{OrgID: invitation.OrgID, Role: invitation.Role, JoinedAt: now}
+	res, err = s.db.Collection(s.coll.UserCollection).UpdateOne(
+		context.TODO(),
+		bson.M{"_id": user.ID, "memberships.orgId": bson.M{"$ne": invitation.OrgID}},
+		bson.M{"$push": bson.M{"memberships": membership}},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if res.ModifiedCount > 0 {
+		user.Memberships = append(user.Memberships, membership)
+	}
+	log.Printf("Added user %s to organization %s from invitation %s", user.ID.Hex(), invitation.OrgID.Hex(), invitation.ID.Hex())
+
+	return s.CompleteLogin(user, AMRPassword, req.ClientInfo)
+}
+
+// reopenInvitation makes an accepted invitation pending again, when no
+// account came out of it
+func (s service) reopenInvitation(id primitive.ObjectID) {
+	_, err := s.db.Collection(s.coll.InvitationCollection).UpdateOne(context.TODO(), bson.M{"_id": id}, bson.M{"$unset": bson.M{"acceptedAt": ""}})
+	if err != nil {
+		log.Printf("Failed to reopen invitation %s: %v", id.Hex(), err)
+	}
+}
+
+func (s service) sendInvitation(invitation *Invitation, token string) error {
+	ttl := invitationTTL()
+	link := config.FrontendURL() + "/accept-invitation?token=" + url.QueryEscape(token)
+	return s.mailer.Send(&mailpkg.Message{
+		To:      invitation.Email,
+		Subject: "You have been invited",
+		Body: "You have been invited to create an account.\n\n" +
+			"Use this link within " + ttl.String() + " to choose your password:\n" + link + "\n\n" +
+			"If you weren't expecting this, you can ignore this email.\n",
+	})
+}
+
+// InviteUser invites someone to join the organization
+func (s orgService) InviteUser(invitedBy primitive.ObjectID, req *InvitationRequest) (*Invitation, error) {
+	return s.inviteUser(invitedBy, s.orgID, req)
+}
+
+func (s orgService) GetInvitations() ([]Invitation, error) {
+	return s.getInvitations(bson.M{"orgId": s.orgID})
+}
+
+func (s orgService) ResendInvitation(id primitive.ObjectID) (*Invitation, error) {
+	return s.resendInvitation(bson.M{"_id": id, "orgId": s.orgID})
+}
+
+func (s orgService) RevokeInvitation(id primitive.ObjectID) error {
+	return s.revokeInvitation(bson.M{"_id": id, "orgId": s.orgID})
+}
@@ -0,0 +1,41 @@
+package userpkg
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestInvitationScope(t *testing.T) {
+	type testCase struct {
+		name                string
+		orgID               primitive.ObjectID
+		expectedUser        bson.M
+		expectedInvitations bson.M
+	}
+
+	email := "new@example.com"
+	orgID := primitive.NewObjectID()
+	tests := []testCase{
+		{
+			name:                "Platform invitations see every account",
+			expectedUser:        bson.M{"email": email},
+			expectedInvitations: bson.M{"email": email, "orgId": bson.M{"$exists": false}},
+		},
+		{
+			name:                "Organization invitations only see their own",
+			orgID:               orgID,
+			expectedUser:        bson.M{"email": email, "memberships.orgId": orgID},
+			expectedInvitations: bson.M{"email": email, "orgId": orgID},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expectedUser, invitedUser(email, test.orgID))
+			assert.Equal(t, test.expectedInvitations, invitationScope(email, test.orgID))
+		})
+	}
+}
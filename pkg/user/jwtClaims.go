@@ -1,19 +1,51 @@
 package userpkg
 
 import (
-	"github.com/golang-jwt/jwt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-// JwtClaims jwt claims
+// JwtClaims jwt claims, the user is the subject of the registered claims
 type JwtClaims struct {
-	ID        primitive.ObjectID `json:"id"`
-	FirstName string             `json:"firstName"`
-	LastName  string             `json:"lastName"`
-	Role      string             `json:"role"`
-	Email     string             `json:"email"`
-	Exp       interface{}        `json:"exp,omitempty"`
-	jwt.StandardClaims
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+	Role      string `json:"role"`
+	Email     string `json:"email"`
+	// EmailVerified is false until the user confirms their email
+	EmailVerified bool `json:"emailVerified"`
+	// SessionID is the session the token was issued to
+	SessionID string `json:"sid,omitempty"`
+	// Act names the admin impersonating the user (RFC 8693)
+	Act *Actor `json:"act,omitempty"`
+	// AuthTime is when the user last proved who they are, carried over on refresh
+	AuthTime *jwt.NumericDate `json:"auth_time,omitempty"`
+	// AMR are the methods the user proved who they are with (RFC 8176)
+	AMR []string `json:"amr,omitempty"`
+	// OrgID is the active organization, OrgRole the role of the user in it
+	OrgID   string `json:"org_id,omitempty"`
+	OrgRole string `json:"org_role,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// Registered returns the registered claims, checked by the token policy
+func (c *JwtClaims) Registered() *jwt.RegisteredClaims {
+	return &c.RegisteredClaims
+}
+
+// UserSession returns the session of the user the token lives & dies with,
+// none when an admin impersonates them from their own session
+func (c *JwtClaims) UserSession() string {
+	if c.Act != nil {
+		return ""
+	}
+	return c.SessionID
+}
+
+// UserID returns the user the token was issued to
+func (c *JwtClaims) UserID() (primitive.ObjectID, error) {
+	return primitive.ObjectIDFromHex(c.Subject)
 }
 
 // UserContext user context
@@ -24,4 +56,58 @@ type UserContext struct {
 	Role      string             `json:"role"`
 	Email     string             `json:"email"`
 	Exp       interface{}        `json:"exp,omitempty"`
+	TokenID   string             `json:"jti,omitempty"`
+	SessionID string             `json:"sid,omitempty"`
+
+	EmailVerified bool `json:"emailVerified"`
+
+	// AuthMethod is how the request authenticated, AuthMethodToken or AuthMethodAPIKey
+	AuthMethod string `json:"authMethod,omitempty"`
+	// APIKeyID is the key used when authenticated by api key
+	APIKeyID string `json:"apiKeyId,omitempty"`
+	// Scopes limits the permissions of the request when not nil
+	Scopes []string `json:"scopes,omitempty"`
+	// Actor is the admin making the request when the user is impersonated
+	Actor *Actor `json:"act,omitempty"`
+	// AuthTime is when the user last proved who they are, zero for api keys
+	AuthTime int64    `json:"auth_time,omitempty"`
+	AMR      []string `json:"amr,omitempty"`
+	// OrgID is the active organization, the request only sees its users &
+	// Role is the role in it
+	OrgID primitive.ObjectID `json:"orgId,omitempty"`
+	// Permissions are granted by the groups of the user on top of Role
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+// IsImpersonated checks if the request is made by an admin acting as the user
+func (u *UserContext) IsImpersonated() bool {
+	return u.Actor != nil
+}
+
+// InOrg checks if the request works in an organization
+func (u *UserContext) InOrg() bool {
+	return !u.OrgID.IsZero()
 }
+
+// AuthenticatedWithin checks if the user proved who they are in the last maxAge
+func (u *UserContext) AuthenticatedWithin(maxAge time.Duration) bool {
+	return u.AuthTime != 0 && time.Since(time.Unix(u.AuthTime, 0)) <= maxAge
+}
+
+// Authentication methods
+const (
+	AuthMethodToken  = "token"
+	AuthMethodAPIKey = "apikey"
+)
+
+// Authentication method references of the amr claim, fed & email are not
+// registered by RFC 8176 but are in common use
+const (
+	AMRPassword  = "pwd"
+	AMROTP       = "otp"
+	AMRPasskey   = "hwk"
+	AMRFederated = "fed"
+	AMREmail     = "email"
+	// AMRMFA is added when more than one factor was used
+	AMRMFA = "mfa"
+)
@@ -0,0 +1,166 @@
+package userpkg
+
+import (
+	"context"
+	"errors"
+	"mahi-go-explorer/internal/config"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LoginAttempt defines the failed login counter for an email or an IP
+type LoginAttempt struct {
+	Key           string    `json:"key" bson:"_id"`
+	Failures      int       `json:"failures" bson:"failures"`
+	LastFailureAt time.Time `json:"lastFailureAt" bson:"lastFailureAt"`
+	LockedUntil   time.Time `json:"lockedUntil" bson:"lockedUntil"`
+	ExpiresAt     time.Time `json:"expiresAt" bson:"expiresAt"`
+}
+
+// LockedError is returned while logins are locked out after too many failures
+type LockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockedError) Error() string {
+	return "too many attempts"
+}
+
+// lockoutPolicy defines how quickly failures lock out an email or an IP
+type lockoutPolicy struct {
+	freeAttempts int
+	backoffBase  time.Duration
+	maxLockout   time.Duration
+}
+
+// delay is the lockout after the nth failure, doubling past the free attempts
+func (p lockoutPolicy) delay(failures int) time.Duration {
+	if failures <= p.freeAttempts {
+		return 0
+	}
+
+	d := p.backoffBase
+	for i := p.freeAttempts + 1; i < failures && d < p.maxLockout; i++ {
+		d *= 2
+	}
+	if d > p.maxLockout {
+		d = p.maxLockout
+	}
+	return d
+}
+
+func accountLockoutPolicy() lockoutPolicy {
+	return lockoutPolicy{
+		freeAttempts: config.GetIntFromEnv("LOGIN_FREE_ATTEMPTS", 3),
+		backoffBase:  config.GetDurationFromEnv("LOGIN_BACKOFF_BASE", 1*time.Second),
+		maxLockout:   config.GetDurationFromEnv("LOGIN_LOCKOUT_DURATION", 15*time.Minute),
+	}
+}
+
+func ipLockoutPolicy() lockoutPolicy {
+	//one address may be shared by many honest users
+	return lockoutPolicy{
+		freeAttempts: config.GetIntFromEnv("LOGIN_IP_FREE_ATTEMPTS", 20),
+		backoffBase:  config.GetDurationFromEnv("LOGIN_BACKOFF_BASE", 1*time.Second),
+		maxLockout:   config.GetDurationFromEnv("LOGIN_LOCKOUT_DURATION", 15*time.Minute),
+	}
+}
+
+func emailAttemptKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipAttemptKey(ip string) string {
+	return "ip:" + ip
+}
+
+// checkLockout returns a LockedError when any of the keys is locked
+func (s service) checkLockout(keys ...string) error {
+	cursor, err := s.db.Collection(s.coll.LoginAttemptCollection).Find(
+		context.TODO(),
+		bson.M{"_id": bson.M{"$in": keys}, "lockedUntil": bson.M{"$gt": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+
+	var attempts []LoginAttempt
+	if err := cursor.All(context.TODO(), &attempts); err != nil {
+		return err
+	}
+
+	var retryAfter time.Duration
+	for _, a := range attempts {
+		if d := time.Until(a.LockedUntil); d > retryAfter {
+			retryAfter = d
+		}
+	}
+	if retryAfter > 0 {
+		return &LockedError{RetryAfter: retryAfter}
+	}
+
+	return nil
+}
+
+// recordLoginFailure counts a failure against the key and locks it when due
+func (s service) recordLoginFailure(key string, policy lockoutPolicy) error {
+	now := time.Now()
+	coll := s.db.Collection(s.coll.LoginAttemptCollection)
+
+	var attempt LoginAttempt
+	err := coll.FindOneAndUpdate(
+		context.TODO(),
+		bson.M{"_id": key},
+		bson.M{
+			"$inc": bson.M{"failures": 1},
+			"$set": bson.M{"lastFailureAt": now, "expiresAt": now.Add(24 * time.Hour)},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&attempt)
+	if err != nil {
+		return err
+	}
+
+	if d := policy.delay(attempt.Failures); d > 0 {
+		_, err = coll.UpdateOne(
+			context.TODO(),
+			bson.M{"_id": key},
+			bson.M{"$set": bson.M{"lockedUntil": now.Add(d)}},
+		)
+	}
+	return err
+}
+
+// recordFailedLogin counts a failure against both the email and the ip
+func (s service) recordFailedLogin(req *LoginRequest) error {
+	if err := s.recordLoginFailure(emailAttemptKey(req.Email), accountLockoutPolicy()); err != nil {
+		return err
+	}
+	if req.ClientIP != "" {
+		return s.recordLoginFailure(ipAttemptKey(req.ClientIP), ipLockoutPolicy())
+	}
+	return nil
+}
+
+func (s service) clearLoginFailures(email string) error {
+	_, err := s.db.Collection(s.coll.LoginAttemptCollection).DeleteOne(context.TODO(), bson.M{"_id": emailAttemptKey(email)})
+	return err
+}
+
+func (s service) UnlockUser(userID primitive.ObjectID) error {
+	var user User
+	err := s.db.Collection(s.coll.UserCollection).FindOne(context.TODO(), bson.M{"_id": userID}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return errors.New("user not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.clearLoginFailures(user.Email)
+}
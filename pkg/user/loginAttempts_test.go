@@ -0,0 +1,36 @@
+package userpkg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockoutPolicyDelay(t *testing.T) {
+	policy := lockoutPolicy{
+		freeAttempts: 3,
+		backoffBase:  time.Second,
+		maxLockout:   10 * time.Second,
+	}
+
+	type testCase struct {
+		Failures int
+		Expected time.Duration
+	}
+
+	tests := []testCase{
+		{Failures: 1, Expected: 0},
+		{Failures: 3, Expected: 0},
+		{Failures: 4, Expected: 1 * time.Second},
+		{Failures: 5, Expected: 2 * time.Second},
+		{Failures: 6, Expected: 4 * time.Second},
+		{Failures: 7, Expected: 8 * time.Second},
+		{Failures: 8, Expected: 10 * time.Second},
+		{Failures: 100, Expected: 10 * time.Second},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.Expected, policy.delay(tt.Failures), "failures: %d", tt.Failures)
+	}
+}
@@ -0,0 +1,188 @@
+package userpkg
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"mahi-go-explorer/internal/config"
+	mailpkg "mahi-go-explorer/pkg/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const magicLinkPurpose = "magic-link"
+
+// MagicLink defines a login link sent by email, only usable once
+type MagicLink struct {
+	ID     primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	UserID primitive.ObjectID `json:"userId" bson:"userId"`
+	// Email is lowercased, links are rate limited per address
+	Email     string     `json:"email" bson:"email"`
+	LinkHash  string     `json:"-" bson:"linkHash"`
+	CreatedAt time.Time  `json:"createdAt" bson:"createdAt"`
+	ExpiresAt time.Time  `json:"expiresAt" bson:"expiresAt"`
+	UsedAt    *time.Time `json:"usedAt,omitempty" bson:"usedAt,omitempty"`
+}
+
+// MagicLinkRequest defines the request to email a login link, BindBrowser
+// makes the link only work in the browser that asked for it
+type MagicLinkRequest struct {
+	Email       string `json:"email,omitempty"`
+	BindBrowser bool   `json:"bindBrowser,omitempty"`
+}
+
+// MagicLinkLoginRequest defines the request to log in with a link
+type MagicLinkLoginRequest struct {
+	Token string `json:"token,omitempty" form:"token"`
+	// Binding is the secret of the browser, set by the handler from its cookie
+	Binding string `json:"-" form:"-"`
+	ClientInfo
+}
+
+func (s service) RequestMagicLink(req *MagicLinkRequest) (string, error) {
+	//the binding is handed out for unknown emails too, so the caller learns nothing
+	var binding string
+	if req.BindBrowser {
+		b, err := generateToken()
+		if err != nil {
+			return "", err
+		}
+		binding = b
+	}
+
+	var user User
+	err := s.db.Collection(s.coll.UserCollection).FindOne(context.TODO(), bson.M{"email": req.Email}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		log.Printf("Magic link requested for unknown email")
+		return binding, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	coll := s.db.Collection(s.coll.MagicLinkCollection)
+	email := strings.ToLower(user.Email)
+
+	window := config.GetDurationFromEnv("MAGIC_LINK_RATE_WINDOW", 15*time.Minute)
+	sent, err := coll.CountDocuments(context.TODO(), bson.M{"email": email, "createdAt": bson.M{"$gt": now.Add(-window)}})
+	if err != nil {
+		return "", err
+	}
+	if sent >= int64(config.GetIntFromEnv("MAGIC_LINK_RATE_LIMIT", 3)) {
+		//throttled requests look like any other
+		log.Printf("Magic link throttled for user %s", user.ID.Hex())
+		return binding, nil
+	}
+
+	linkID, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	ttl := config.GetDurationFromEnv("MAGIC_LINK_TTL", 15*time.Minute)
+	payload := signedPayload{
+		UserID:    user.ID.Hex(),
+		Email:     user.Email,
+		ExpiresAt: now.Add(ttl).Unix(),
+		ID:        linkID,
+	}
+	if binding != "" {
+		payload.Binding = hashToken(binding)
+	}
+	token, err := signToken(magicLinkPurpose, payload)
+	if err != nil {
+		return "", err
+	}
+
+	link := MagicLink{
+		UserID:    user.ID,
+		Email:     email,
+		LinkHash:  hashToken(linkID),
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	if _, err := coll.InsertOne(context.TODO(), link); err != nil {
+		return "", err
+	}
+
+	//the page asks for a click & posts the token, mail scanners following the link don't use it up
+	u := config.FrontendURL() + "/magic-link?token=" + url.QueryEscape(token)
+	err = s.mailer.Send(&mailpkg.Message{
+		To:      user.Email,
+		Subject: "Your login link",
+		Body: "Use this link within " + ttl.String() + " to log in:\n" + u + "\n\n" +
+			"The link works once. If you didn't ask for it, you can ignore this email.\n",
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return binding, nil
+}
+
+func (s service) LoginWithMagicLink(req *MagicLinkLoginRequest) (*LoginResponse, error) {
+	payload, err := verifyMagicLink(req.Token, req.Binding)
+	if err != nil {
+		return nil, err
+	}
+
+	userID, err := primitive.ObjectIDFromHex(payload.UserID)
+	if err != nil {
+		return nil, errors.New("invalid magic link")
+	}
+
+	//mark the link as used, only succeeds once per link
+	now := time.Now()
+	res, err := s.db.Collection(s.coll.MagicLinkCollection).UpdateOne(
+		context.TODO(),
+		bson.M{"linkHash": hashToken(payload.ID), "userId": userID, "usedAt": bson.M{"$exists": false}, "expiresAt": bson.M{"$gt": now}},
+		bson.M{"$set": bson.M{"usedAt": now}},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if res.ModifiedCount == 0 {
+		return nil, errors.New("invalid magic link")
+	}
+
+	//the link is bound to the address it was sent to, which it just proved
+	var user User
+	err = s.db.Collection(s.coll.UserCollection).FindOneAndUpdate(
+		context.TODO(),
+		bson.M{"_id": userID, "email": payload.Email},
+		bson.M{"$set": bson.M{"emailVerified": true}},
+	).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil, errors.New("invalid magic link")
+	}
+	if err != nil {
+		return nil, err
+	}
+	user.EmailVerified = true
+
+	return s.CompleteLogin(&user, AMREmail, req.ClientInfo)
+}
+
+// verifyMagicLink checks the signature & expiry of a link, and that it is
+// used in the browser it is bound to
+func verifyMagicLink(token string, binding string) (*signedPayload, error) {
+	payload, err := verifySignedToken(magicLinkPurpose, token)
+	if err != nil || payload.ID == "" {
+		return nil, errors.New("invalid magic link")
+	}
+
+	if payload.Binding != "" {
+		if binding == "" || subtle.ConstantTimeCompare([]byte(payload.Binding), []byte(hashToken(binding))) != 1 {
+			return nil, errors.New("magic link bound to another browser")
+		}
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,93 @@
+package userpkg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyMagicLink(t *testing.T) {
+	type testCase struct {
+		name          string
+		purpose       string
+		payload       signedPayload
+		binding       string
+		expectedError string
+	}
+
+	valid := signedPayload{
+		UserID:    "1234567890abcdef12345678",
+		Email:     "user@example.com",
+		ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		ID:        "link-id",
+	}
+	bound := valid
+	bound.Binding = hashToken("browser-secret")
+	expired := valid
+	expired.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	withoutID := valid
+	withoutID.ID = ""
+
+	tests := []testCase{
+		{
+			name:    "Accepts a link",
+			purpose: magicLinkPurpose,
+			payload: valid,
+		},
+		{
+			name:    "Accepts a bound link in its browser",
+			purpose: magicLinkPurpose,
+			payload: bound,
+			binding: "browser-secret",
+		},
+		{
+			name:          "Rejects a bound link without the browser secret",
+			purpose:       magicLinkPurpose,
+			payload:       bound,
+			expectedError: "magic link bound to another browser",
+		},
+		{
+			name:          "Rejects a bound link in another browser",
+			purpose:       magicLinkPurpose,
+			payload:       bound,
+			binding:       "other-secret",
+			expectedError: "magic link bound to another browser",
+		},
+		{
+			name:          "Rejects an expired link",
+			purpose:       magicLinkPurpose,
+			payload:       expired,
+			expectedError: "invalid magic link",
+		},
+		{
+			name:          "Rejects a link that cannot be used up",
+			purpose:       magicLinkPurpose,
+			payload:       withoutID,
+			expectedError: "invalid magic link",
+		},
+		{
+			name:          "Rejects a token signed for another purpose",
+			purpose:       emailVerificationPurpose,
+			payload:       valid,
+			expectedError: "invalid magic link",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			token, err := signToken(tc.purpose, tc.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			payload, err := verifyMagicLink(token, tc.binding)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.payload, *payload)
+		})
+	}
+}
@@ -0,0 +1,344 @@
+package userpkg
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"mahi-go-explorer/internal/config"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	mfaChallengeTTL         = 5 * time.Minute
+	mfaChallengeMaxAttempts = 5
+	recoveryCodeCount       = 10
+)
+
+// MFAChallenge defines a pending second factor check after a password login
+type MFAChallenge struct {
+	ID        primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	UserID    primitive.ObjectID `json:"userId" bson:"userId"`
+	TokenHash string             `json:"-" bson:"tokenHash"`
+	Attempts  int                `json:"attempts" bson:"attempts"`
+	ExpiresAt time.Time          `json:"expiresAt" bson:"expiresAt"`
+	// AMR are the methods of the first factor, the login adds the second
+	AMR []string `json:"amr,omitempty" bson:"amr,omitempty"`
+}
+
+// MFAEnrollment is returned when TOTP enrollment starts
+type MFAEnrollment struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauthUri"`
+	QRCode     string `json:"qrCode"`
+}
+
+// MFACodeRequest defines the request to confirm enrollment
+type MFACodeRequest struct {
+	Code string `json:"code,omitempty"`
+}
+
+// MFAVerifyRequest defines the request to complete an MFA login,
+// either Code or RecoveryCode is required
+type MFAVerifyRequest struct {
+	MFAToken     string `json:"mfaToken,omitempty"`
+	Code         string `json:"code,omitempty"`
+	RecoveryCode string `json:"recoveryCode,omitempty"`
+	ClientInfo
+}
+
+// LoginResponse holds the tokens, or the MFA challenge when a second factor is required
+type LoginResponse struct {
+	*TokenPair
+	MFARequired bool   `json:"mfaRequired,omitempty"`
+	MFAToken    string `json:"mfaToken,omitempty"`
+}
+
+func (s service) EnrollMFA(userID primitive.ObjectID) (*MFAEnrollment, error) {
+	user, err := s.GetUser(bson.M{"_id": userID}, nil)
+	if err != nil {
+		return nil, errors.New("user not found")
+	}
+	if user.MFAEnabled {
+		return nil, errors.New("mfa already enabled")
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	//the secret stays pending until a code from it is confirmed
+	_, err = s.db.Collection(s.coll.UserCollection).UpdateOne(
+		context.TODO(),
+		bson.M{"_id": userID},
+		bson.M{"$set": bson.M{"totpPendingSecret": secret}},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	issuer := config.GetFromEnv("MFA_ISSUER")
+	if issuer == "" {
+		issuer = "Mahi Go Explorer"
+	}
+	uri := totpURI(issuer, user.Email, secret)
+
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MFAEnrollment{
+		Secret:     secret,
+		OTPAuthURI: uri,
+		QRCode:     "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	}, nil
+}
+
+func (s service) ConfirmMFA(userID primitive.ObjectID, code string) ([]string, error) {
+	user, err := s.GetUser(bson.M{"_id": userID}, nil)
+	if err != nil {
+		return nil, errors.New("user not found")
+	}
+	if user.MFAEnabled {
+		return nil, errors.New("mfa already enabled")
+	}
+	if user.TOTPPendingSecret == "" {
+		return nil, errors.New("mfa enrollment not started")
+	}
+
+	counter, ok := validateTOTP(user.TOTPPendingSecret, code, time.Now(), 0)
+	if !ok {
+		return nil, errors.New("invalid mfa code")
+	}
+
+	codes, err := generateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+	hashed := make([]string, len(codes))
+	for i, c := range codes {
+		hashed[i] = hashToken(c)
+	}
+
+	_, err = s.db.Collection(s.coll.UserCollection).UpdateOne(
+		context.TODO(),
+		bson.M{"_id": userID},
+		bson.M{
+			"$set": bson.M{
+				"mfaEnabled":      true,
+				"totpSecret":      user.TOTPPendingSecret,
+				"totpLastCounter": counter,
+				"recoveryCodes":   hashed,
+			},
+			"$unset": bson.M{"totpPendingSecret": ""},
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	//recovery codes are only ever shown here
+	return codes, nil
+}
+
+func (s service) VerifyMFA(req *MFAVerifyRequest) (*TokenPair, error) {
+	coll := s.db.Collection(s.coll.MFAChallengeCollection)
+
+	var challenge MFAChallenge
+	err := coll.FindOneAndUpdate(
+		context.TODO(),
+		bson.M{
+			"tokenHash": hashToken(req.MFAToken),
+			"expiresAt": bson.M{"$gt": time.Now()},
+			"attempts":  bson.M{"$lt": mfaChallengeMaxAttempts},
+		},
+		bson.M{"$inc": bson.M{"attempts": 1}},
+	).Decode(&challenge)
+	if err == mongo.ErrNoDocuments {
+		return nil, errors.New("invalid mfa token")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.GetUser(bson.M{"_id": challenge.UserID}, nil)
+	if err != nil {
+		return nil, errors.New("user not found")
+	}
+	if user.IsBlocked {
+		return nil, errors.New("user is blocked")
+	}
+
+	if err := s.checkSecondFactor(user, req.Code, req.RecoveryCode); err != nil {
+		return nil, err
+	}
+
+	if _, err := coll.DeleteOne(context.TODO(), bson.M{"_id": challenge.ID}); err != nil {
+		return nil, err
+	}
+
+	return s.startSession(user, req.ClientInfo, append(challenge.AMR, AMROTP, AMRMFA))
+}
+
+func (s service) MFAChallengeUser(mfaToken string) (*User, error) {
+	var challenge MFAChallenge
+	err := s.db.Collection(s.coll.MFAChallengeCollection).FindOne(
+		context.TODO(),
+		bson.M{
+			"tokenHash": hashToken(mfaToken),
+			"expiresAt": bson.M{"$gt": time.Now()},
+			"attempts":  bson.M{"$lt": mfaChallengeMaxAttempts},
+		},
+	).Decode(&challenge)
+	if err == mongo.ErrNoDocuments {
+		return nil, errors.New("invalid mfa token")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.GetUser(bson.M{"_id": challenge.UserID}, nil)
+	if err != nil {
+		return nil, errors.New("user not found")
+	}
+	return user, nil
+}
+
+func (s service) CompleteMFAChallenge(mfaToken string, method string, client ClientInfo) (*TokenPair, error) {
+	//a challenge can only be completed once
+	var challenge MFAChallenge
+	err := s.db.Collection(s.coll.MFAChallengeCollection).FindOneAndDelete(
+		context.TODO(),
+		bson.M{
+			"tokenHash": hashToken(mfaToken),
+			"expiresAt": bson.M{"$gt": time.Now()},
+			"attempts":  bson.M{"$lt": mfaChallengeMaxAttempts},
+		},
+	).Decode(&challenge)
+	if err == mongo.ErrNoDocuments {
+		return nil, errors.New("invalid mfa token")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.GetUser(bson.M{"_id": challenge.UserID}, nil)
+	if err != nil {
+		return nil, errors.New("user not found")
+	}
+	if user.IsBlocked {
+		return nil, errors.New("user is blocked")
+	}
+
+	return s.startSession(user, client, append(challenge.AMR, method, AMRMFA))
+}
+
+func (s service) ResetMFA(userID primitive.ObjectID) error {
+	res, err := s.db.Collection(s.coll.UserCollection).UpdateOne(
+		context.TODO(),
+		bson.M{"_id": userID},
+		bson.M{
+			"$set":   bson.M{"mfaEnabled": false},
+			"$unset": bson.M{"totpSecret": "", "totpPendingSecret": "", "totpLastCounter": "", "recoveryCodes": ""},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errors.New("user not found")
+	}
+
+	//passkeys are a second factor too
+	_, err = s.db.Collection(s.coll.WebAuthnCredentialCollection).DeleteMany(context.TODO(), bson.M{"userId": userID})
+	return err
+}
+
+// mfaEnrolled checks if the user has a second factor, a confirmed TOTP
+// authenticator or a registered passkey
+func (s service) mfaEnrolled(user *User) (bool, error) {
+	if user.MFAEnabled {
+		return true, nil
+	}
+
+	n, err := s.db.Collection(s.coll.WebAuthnCredentialCollection).CountDocuments(
+		context.TODO(),
+		bson.M{"userId": user.ID},
+		options.Count().SetLimit(1),
+	)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// checkSecondFactor verifies a TOTP code or consumes a recovery code
+func (s service) checkSecondFactor(user *User, code string, recoveryCode string) error {
+	users := s.db.Collection(s.coll.UserCollection)
+
+	if code != "" {
+		counter, ok := validateTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastCounter)
+		if !ok {
+			return errors.New("invalid mfa code")
+		}
+		//only move forward, so a code can never be replayed
+		res, err := users.UpdateOne(
+			context.TODO(),
+			bson.M{"_id": user.ID, "totpLastCounter": bson.M{"$lt": counter}},
+			bson.M{"$set": bson.M{"totpLastCounter": counter}},
+		)
+		if err != nil {
+			return err
+		}
+		if res.ModifiedCount == 0 {
+			return errors.New("invalid mfa code")
+		}
+		return nil
+	}
+
+	if recoveryCode != "" {
+		res, err := users.UpdateOne(
+			context.TODO(),
+			bson.M{"_id": user.ID, "recoveryCodes": hashToken(normalizeRecoveryCode(recoveryCode))},
+			bson.M{"$pull": bson.M{"recoveryCodes": hashToken(normalizeRecoveryCode(recoveryCode))}},
+		)
+		if err != nil {
+			return err
+		}
+		if res.ModifiedCount == 0 {
+			return errors.New("invalid mfa code")
+		}
+		return nil
+	}
+
+	return errors.New("invalid mfa code")
+}
+
+// createMFAChallenge stores a challenge for the user who passed the first
+// factor with amr and returns its token
+func (s service) createMFAChallenge(userID primitive.ObjectID, amr []string) (string, error) {
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	challenge := MFAChallenge{
+		UserID:    userID,
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().Add(mfaChallengeTTL),
+		AMR:       amr,
+	}
+	_, err = s.db.Collection(s.coll.MFAChallengeCollection).InsertOne(context.TODO(), challenge)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
@@ -0,0 +1,391 @@
+package userpkg
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Organization is a customer company, its users only see each other
+type Organization struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Name      string             `json:"name" bson:"name"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+}
+
+// Membership puts a user in an organization with their role there
+type Membership struct {
+	OrgID    primitive.ObjectID `json:"orgId" bson:"orgId"`
+	Role     string             `json:"role" bson:"role"`
+	JoinedAt time.Time          `json:"joinedAt" bson:"joinedAt"`
+}
+
+// UserOrganization is an organization the user belongs to, with their role
+type UserOrganization struct {
+	Organization
+	Role string `json:"role"`
+}
+
+// OrganizationRequest defines organization request schema
+type OrganizationRequest struct {
+	Name string `json:"name,omitempty"`
+}
+
+// MembershipRequest defines membership request schema
+type MembershipRequest struct {
+	Email string `json:"email,omitempty"`
+	Role  string `json:"role,omitempty"`
+}
+
+// SwitchOrganizationRequest defines switch organization request schema, an
+// empty org leaves the organization
+type SwitchOrganizationRequest struct {
+	OrgID string `json:"orgId"`
+}
+
+// AccessTokenResponse holds a new access token for the session
+type AccessTokenResponse struct {
+	AccessToken string `json:"accessToken"`
+	ExpiresIn   int64  `json:"expiresIn"`
+}
+
+// Membership returns the membership of the user in the organization, if any
+func (u *User) Membership(orgID primitive.ObjectID) *Membership {
+	if orgID.IsZero() {
+		return nil
+	}
+	for i := range u.Memberships {
+		if u.Memberships[i].OrgID == orgID {
+			return &u.Memberships[i]
+		}
+	}
+	return nil
+}
+
+// defaultOrg is the organization a new session starts in, the one the user
+// joined first
+func (u *User) defaultOrg() primitive.ObjectID {
+	if len(u.Memberships) == 0 {
+		return primitive.NilObjectID
+	}
+	return u.Memberships[0].OrgID
+}
+
+func (s service) CreateOrganization(req *OrganizationRequest) (*Organization, error) {
+	org := Organization{
+		Name:      strings.TrimSpace(req.Name),
+		CreatedAt: time.Now(),
+	}
+	res, err := s.db.Collection(s.coll.OrganizationCollection).InsertOne(context.TODO(), org)
+	if err != nil {
+		return nil, err
+	}
+	org.ID = res.InsertedID.(primitive.ObjectID)
+	return &org, nil
+}
+
+func (s service) GetOrganizations() ([]Organization, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}})
+	cursor, err := s.db.Collection(s.coll.OrganizationCollection).Find(context.TODO(), bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	orgs := []Organization{}
+	if err := cursor.All(context.TODO(), &orgs); err != nil {
+		return nil, err
+	}
+	return orgs, nil
+}
+
+func (s service) GetUserOrganizations(userID primitive.ObjectID) ([]UserOrganization, error) {
+	user, err := s.GetUser(bson.M{"_id": userID}, nil)
+	if err == mongo.ErrNoDocuments {
+		return nil, errors.New("user not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]primitive.ObjectID, len(user.Memberships))
+	for i, m := range user.Memberships {
+		ids[i] = m.OrgID
+	}
+	cursor, err := s.db.Collection(s.coll.OrganizationCollection).Find(context.TODO(), bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	var orgs []Organization
+	if err := cursor.All(context.TODO(), &orgs); err != nil {
+		return nil, err
+	}
+
+	//in the order they were joined, the first one is where logins start
+	byID := map[primitive.ObjectID]Organization{}
+	for _, org := range orgs {
+		byID[org.ID] = org
+	}
+	userOrgs := []UserOrganization{}
+	for _, m := range user.Memberships {
+		if org, ok := byID[m.OrgID]; ok {
+			userOrgs = append(userOrgs, UserOrganization{Organization: org, Role: m.Role})
+		}
+	}
+	return userOrgs, nil
+}
+
+func (s service) AddMember(orgID primitive.ObjectID, req *MembershipRequest) error {
+	count, err := s.db.Collection(s.coll.OrganizationCollection).CountDocuments(context.TODO(), bson.M{"_id": orgID})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errors.New("organization not found")
+	}
+
+	membership := Membership{OrgID: orgID, Role: NormalizeRole(req.Role), JoinedAt: time.Now()}
+	res, err := s.db.Collection(s.coll.UserCollection).UpdateOne(
+		context.TODO(),
+		bson.M{"email": req.Email, "memberships.orgId": bson.M{"$ne": orgID}},
+		bson.M{"$push": bson.M{"memberships": membership}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount > 0 {
+		return nil
+	}
+
+	count, err = s.db.Collection(s.coll.UserCollection).CountDocuments(context.TODO(), bson.M{"email": req.Email})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errors.New("user not found")
+	}
+	return errors.New("already a member")
+}
+
+func (s service) RemoveMember(orgID primitive.ObjectID, userID primitive.ObjectID) error {
+	res, err := s.db.Collection(s.coll.UserCollection).UpdateOne(
+		context.TODO(),
+		bson.M{"_id": userID, "memberships.orgId": orgID},
+		bson.M{"$pull": bson.M{"memberships": bson.M{"orgId": orgID}}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errors.New("membership not found")
+	}
+
+	//coming back later does not bring the old groups back
+	_, err = s.db.Collection(s.coll.GroupCollection).UpdateMany(
+		context.TODO(),
+		bson.M{"orgId": orgID, "memberIds": userID},
+		bson.M{"$pull": bson.M{"memberIds": userID}},
+	)
+	if err != nil {
+		return err
+	}
+	s.grants.clear()
+
+	return s.endOrgSessions(userID, orgID)
+}
+
+func (s service) SwitchOrganization(userID primitive.ObjectID, sessionID string, orgID primitive.ObjectID) (*AccessTokenResponse, error) {
+	sid, err := primitive.ObjectIDFromHex(sessionID)
+	if err != nil {
+		return nil, errors.New("session revoked")
+	}
+
+	user, err := s.GetUser(bson.M{"_id": userID}, nil)
+	if err == mongo.ErrNoDocuments {
+		return nil, errors.New("user not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !orgID.IsZero() && user.Membership(orgID) == nil {
+		return nil, errors.New("not a member")
+	}
+
+	update := bson.M{"$set": bson.M{"orgId": orgID}}
+	if orgID.IsZero() {
+		update = bson.M{"$unset": bson.M{"orgId": ""}}
+	}
+	var session Session
+	err = s.db.Collection(s.coll.SessionCollection).FindOneAndUpdate(
+		context.TODO(),
+		bson.M{"_id": sid, "userId": userID, "revokedAt": bson.M{"$exists": false}, "expiresAt": bson.M{"$gt": time.Now()}},
+		update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		return nil, errors.New("session revoked")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := s.createAccessToken(user, &session)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AccessTokenResponse{AccessToken: token, ExpiresIn: int64(s.tokens.Policy().TTL.Seconds())}, nil
+}
+
+// endOrgSessions logs the user out of the sessions working in the
+// organization, so a changed membership applies right away
+func (s service) endOrgSessions(userID primitive.ObjectID, orgID primitive.ObjectID) error {
+	cursor, err := s.db.Collection(s.coll.SessionCollection).Find(
+		context.TODO(),
+		bson.M{"userId": userID, "orgId": orgID, "revokedAt": bson.M{"$exists": false}},
+		options.Find().SetProjection(bson.M{"_id": 1}),
+	)
+	if err != nil {
+		return err
+	}
+	var sessions []Session
+	if err := cursor.All(context.TODO(), &sessions); err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		if err := s.revokeRefreshTokenFamily(session.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s service) InOrg(orgID primitive.ObjectID) Service {
+	if orgID.IsZero() {
+		return s
+	}
+	return orgService{s, orgID}
+}
+
+// orgService is the user service as an organization sees it, users outside
+// it are not found & roles are the ones users have in it
+type orgService struct {
+	service
+	orgID primitive.ObjectID
+}
+
+func (s orgService) scope(conds bson.M) bson.M {
+	return bson.M{"$and": bson.A{conds, bson.M{"memberships.orgId": s.orgID}}}
+}
+
+// inOrg shows the user with their role in the organization, their other
+// organizations are none of its business
+func (s orgService) inOrg(user *User) {
+	if m := user.Membership(s.orgID); m != nil {
+		user.Role = m.Role
+		user.Memberships = []Membership{*m}
+	}
+}
+
+// CreateUser creates the user as a member of the organization, their role
+// is the role they have in it
+func (s orgService) CreateUser(user *User) (any, error) {
+	user.Memberships = []Membership{{OrgID: s.orgID, Role: NormalizeRole(user.Role), JoinedAt: time.Now()}}
+	user.Role = RoleUser
+	return s.service.CreateUser(user)
+}
+
+func (s orgService) GetUsers(conds bson.M, opts *options.FindOptions) ([]User, error) {
+	users, err := s.service.GetUsers(s.scope(conds), opts)
+	if err != nil {
+		return nil, err
+	}
+	for i := range users {
+		s.inOrg(&users[i])
+	}
+	return users, nil
+}
+
+func (s orgService) GetUser(conds bson.M, opts *options.FindOneOptions) (*User, error) {
+	user, err := s.service.GetUser(s.scope(conds), opts)
+	if err != nil {
+		return nil, err
+	}
+	s.inOrg(user)
+	return user, nil
+}
+
+// UpdateUser updates members of the organization, a role is set on their
+// membership & logs them out of it
+func (s orgService) UpdateUser(conds bson.M, update bson.M, opts *options.UpdateOptions) (any, error) {
+	conds = s.scope(conds)
+
+	set, _ := update["$set"].(bson.M)
+	role, ok := set["role"]
+	if !ok {
+		return s.service.UpdateUser(conds, update, opts)
+	}
+
+	scoped := bson.M{}
+	for k, v := range update {
+		scoped[k] = v
+	}
+	scopedSet := bson.M{}
+	for k, v := range set {
+		scopedSet[k] = v
+	}
+	delete(scopedSet, "role")
+	scopedSet["memberships.$[m].role"] = role
+	scoped["$set"] = scopedSet
+
+	if opts == nil {
+		opts = options.Update()
+	}
+	opts.SetArrayFilters(options.ArrayFilters{Filters: bson.A{bson.M{"m.orgId": s.orgID}}})
+
+	//the members whose sessions carry the old role
+	users, err := s.service.GetUsers(conds, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.service.UpdateUser(conds, scoped, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, user := range users {
+		if err := s.endOrgSessions(user.ID, s.orgID); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// DeleteUser deletes a member of the organization, someone who belongs to
+// other organizations too is only removed from this one
+func (s orgService) DeleteUser(conds bson.M) (any, error) {
+	user, err := s.service.GetUser(s.scope(conds), options.FindOne().SetProjection(bson.M{"memberships": 1}))
+	if err == mongo.ErrNoDocuments {
+		return &mongo.DeleteResult{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(user.Memberships) > 1 {
+		if err := s.RemoveMember(s.orgID, user.ID); err != nil {
+			return nil, err
+		}
+		//gone as far as the organization can tell
+		return &mongo.DeleteResult{DeletedCount: 1}, nil
+	}
+
+	return s.service.DeleteUser(bson.M{"_id": user.ID})
+}
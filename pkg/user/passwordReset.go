@@ -0,0 +1,223 @@
+package userpkg
+
+import (
+	"context"
+	"errors"
+	"log"
+	"mahi-go-explorer/internal/config"
+	mailpkg "mahi-go-explorer/pkg/mail"
+	passwordpkg "mahi-go-explorer/pkg/password"
+	"net/url"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// PasswordReset defines a single-use password reset token
+type PasswordReset struct {
+	ID        primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	UserID    primitive.ObjectID `json:"userId" bson:"userId"`
+	TokenHash string             `json:"-" bson:"tokenHash"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+	ExpiresAt time.Time          `json:"expiresAt" bson:"expiresAt"`
+	UsedAt    *time.Time         `json:"usedAt,omitempty" bson:"usedAt,omitempty"`
+}
+
+// ForgotPasswordRequest defines forgot password request schema
+type ForgotPasswordRequest struct {
+	Email string `json:"email,omitempty"`
+}
+
+// ResetPasswordRequest defines reset password request schema
+type ResetPasswordRequest struct {
+	Token    string `json:"token,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+func (s service) RequestPasswordReset(email string) {
+	go func() {
+		if err := s.sendPasswordReset(email); err != nil {
+			log.Printf("Failed to send password reset: %v", err)
+		}
+	}()
+}
+
+func (s service) sendPasswordReset(email string) error {
+	var user User
+	err := s.db.Collection(s.coll.UserCollection).FindOne(context.TODO(), bson.M{"email": email}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		//never tell the caller whether the email exists
+		log.Printf("Password reset requested for unknown email")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	coll := s.db.Collection(s.coll.PasswordResetCollection)
+
+	window := config.GetDurationFromEnv("PASSWORD_RESET_RATE_WINDOW", 15*time.Minute)
+	sent, err := coll.CountDocuments(context.TODO(), bson.M{"userId": user.ID, "createdAt": bson.M{"$gt": now.Add(-window)}})
+	if err != nil {
+		return err
+	}
+	if sent >= int64(config.GetIntFromEnv("PASSWORD_RESET_RATE_LIMIT", 3)) {
+		//throttled requests look like any other
+		log.Printf("Password reset throttled for user %s", user.ID.Hex())
+		return nil
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return err
+	}
+
+	ttl := config.GetDurationFromEnv("PASSWORD_RESET_TTL", 1*time.Hour)
+	reset := PasswordReset{
+		UserID:    user.ID,
+		TokenHash: hashToken(token),
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	_, err = coll.InsertOne(context.TODO(), reset)
+	if err != nil {
+		return err
+	}
+
+	link := config.FrontendURL() + "/reset-password?token=" + url.QueryEscape(token)
+	return s.mailer.Send(&mailpkg.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: "Someone asked to reset the password for your account.\n\n" +
+			"Use this link within " + ttl.String() + " to choose a new password:\n" + link + "\n\n" +
+			"If it wasn't you, you can ignore this email.\n",
+	})
+}
+
+func (s service) ResetPassword(token string, password string) error {
+	coll := s.db.Collection(s.coll.PasswordResetCollection)
+	now := time.Now()
+	valid := bson.M{"tokenHash": hashToken(token), "usedAt": bson.M{"$exists": false}, "expiresAt": bson.M{"$gt": now}}
+
+	var reset PasswordReset
+	err := coll.FindOne(context.TODO(), valid).Decode(&reset)
+	if err == mongo.ErrNoDocuments {
+		return errors.New("invalid reset token")
+	}
+	if err != nil {
+		return err
+	}
+
+	user, err := s.GetUser(bson.M{"_id": reset.UserID}, nil)
+	if err == mongo.ErrNoDocuments {
+		return errors.New("invalid reset token")
+	}
+	if err != nil {
+		return err
+	}
+
+	//a rejected password does not use up the token
+	if err := passwordpkg.DefaultPolicy().Validate(password, user.Email, user.FirstName, user.LastName); err != nil {
+		return err
+	}
+
+	//mark the token as used, only succeeds once per token
+	res, err := coll.UpdateOne(context.TODO(), valid, bson.M{"$set": bson.M{"usedAt": now}})
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount == 0 {
+		return errors.New("invalid reset token")
+	}
+
+	hp, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Collection(s.coll.UserCollection).UpdateOne(
+		context.TODO(),
+		bson.M{"_id": reset.UserID},
+		bson.M{"$set": bson.M{"hashedPassword": hp}},
+	)
+	if err != nil {
+		return err
+	}
+
+	//other outstanding reset links are void now
+	_, err = coll.UpdateMany(
+		context.TODO(),
+		bson.M{"userId": reset.UserID, "usedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"usedAt": now}},
+	)
+	if err != nil {
+		return err
+	}
+
+	//the owner proved themselves, drop any lockout
+	if err := s.UnlockUser(reset.UserID); err != nil {
+		return err
+	}
+
+	//whoever knew the old password is logged out
+	return s.RevokeUserTokens(reset.UserID)
+}
+
+func (s service) ChangePassword(userID primitive.ObjectID, req *ChangePasswordRequest) (*TokenPair, error) {
+	user, err := s.GetUser(bson.M{"_id": userID}, nil)
+	if err == mongo.ErrNoDocuments {
+		return nil, errors.New("user not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	//a stolen token must not make guessing any easier than the login does
+	attempt := &LoginRequest{Email: user.Email, ClientInfo: req.ClientInfo}
+	keys := []string{emailAttemptKey(user.Email)}
+	if req.ClientIP != "" {
+		keys = append(keys, ipAttemptKey(req.ClientIP))
+	}
+	if err := s.checkLockout(keys...); err != nil {
+		return nil, err
+	}
+
+	if !camparePassword(user.HashedPassword, req.CurrentPassword) {
+		if err := s.recordFailedLogin(attempt); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("invalid password")
+	}
+
+	if err := s.clearLoginFailures(user.Email); err != nil {
+		return nil, err
+	}
+
+	if err := passwordpkg.DefaultPolicy().Validate(req.NewPassword, user.Email, user.FirstName, user.LastName); err != nil {
+		return nil, err
+	}
+
+	hp, err := hashPassword(req.NewPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.db.Collection(s.coll.UserCollection).UpdateOne(
+		context.TODO(),
+		bson.M{"_id": userID},
+		bson.M{"$set": bson.M{"hashedPassword": hp}},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	//every other session is logged out, the caller continues in a new one
+	if err := s.RevokeUserTokens(userID); err != nil {
+		return nil, err
+	}
+
+	return s.startSession(user, req.ClientInfo, []string{AMRPassword})
+}
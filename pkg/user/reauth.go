@@ -0,0 +1,122 @@
+package userpkg
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ReauthRequest proves who the user is again, with their password or a
+// second factor code
+type ReauthRequest struct {
+	Password     string `json:"password,omitempty"`
+	Code         string `json:"code,omitempty"`
+	RecoveryCode string `json:"recoveryCode,omitempty"`
+	ClientInfo
+}
+
+// ReauthResponse holds an access token with the new auth time, the refresh
+// token of the session keeps working & hands it out too
+type ReauthResponse struct {
+	AccessToken string `json:"accessToken"`
+	ExpiresIn   int64  `json:"expiresIn"`
+}
+
+func (s service) Reauthenticate(userID primitive.ObjectID, sessionID string, req *ReauthRequest) (*ReauthResponse, error) {
+	sid, err := primitive.ObjectIDFromHex(sessionID)
+	if err != nil {
+		return nil, errors.New("session revoked")
+	}
+
+	user, err := s.GetUser(bson.M{"_id": userID}, nil)
+	if err == mongo.ErrNoDocuments {
+		return nil, errors.New("user not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.IsBlocked {
+		return nil, errors.New("user is blocked")
+	}
+
+	//a stolen token must not make guessing any easier than the login does
+	attempt := &LoginRequest{Email: user.Email, ClientInfo: req.ClientInfo}
+	keys := []string{emailAttemptKey(user.Email)}
+	if req.ClientIP != "" {
+		keys = append(keys, ipAttemptKey(req.ClientIP))
+	}
+	if err := s.checkLockout(keys...); err != nil {
+		return nil, err
+	}
+
+	method, err := s.checkReauth(user, req)
+	if err != nil && err.Error() == "invalid credentials" {
+		if err := s.recordFailedLogin(attempt); err != nil {
+			return nil, err
+		}
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.clearLoginFailures(user.Email); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var session Session
+	err = s.db.Collection(s.coll.SessionCollection).FindOneAndUpdate(
+		context.TODO(),
+		bson.M{"_id": sid, "userId": userID, "revokedAt": bson.M{"$exists": false}, "expiresAt": bson.M{"$gt": now}},
+		bson.M{"$set": bson.M{"authTime": now, "amr": []string{method}, "lastSeenAt": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		return nil, errors.New("session revoked")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := s.createAccessToken(user, &session)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReauthResponse{AccessToken: token, ExpiresIn: int64(s.tokens.Policy().TTL.Seconds())}, nil
+}
+
+// checkReauth checks the proof of a reauthentication, returning the method used
+func (s service) checkReauth(user *User, req *ReauthRequest) (string, error) {
+	switch {
+	case req.Password != "":
+		authenticated, err := s.authenticate(&LoginRequest{Email: user.Email, Password: req.Password})
+		if err != nil {
+			return "", err
+		}
+		//an authenticator may know the email as another user
+		if authenticated.ID != user.ID {
+			return "", errors.New("invalid credentials")
+		}
+		return AMRPassword, nil
+	case req.Code != "" || req.RecoveryCode != "":
+		if !user.MFAEnabled {
+			return "", errors.New("mfa not enabled")
+		}
+		err := s.checkSecondFactor(user, req.Code, req.RecoveryCode)
+		if err != nil && err.Error() == "invalid mfa code" {
+			return "", errors.New("invalid credentials")
+		}
+		if err != nil {
+			return "", err
+		}
+		return AMROTP, nil
+	}
+	return "", errors.New("invalid credentials")
+}
@@ -0,0 +1,133 @@
+package userpkg
+
+import (
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RevokedToken defines a revoked access token, kept until the token expires
+type RevokedToken struct {
+	ID        string             `json:"jti" bson:"_id"`
+	UserID    primitive.ObjectID `json:"userId" bson:"userId"`
+	RevokedAt time.Time          `json:"revokedAt" bson:"revokedAt"`
+	ExpiresAt time.Time          `json:"expiresAt" bson:"expiresAt"`
+}
+
+// userState is the part of a user that decides whether their tokens are still valid
+type userState struct {
+	found            bool
+	isBlocked        bool
+	tokensValidAfter *time.Time
+}
+
+type cacheEntry[T any] struct {
+	value     T
+	expiresAt time.Time
+}
+
+// revocationCache keeps revocation lookups in memory so they are not
+// hitting the database on every request
+type revocationCache struct {
+	mu       sync.RWMutex
+	ttl      time.Duration
+	tokens   map[string]cacheEntry[bool]
+	users    map[primitive.ObjectID]cacheEntry[userState]
+	sessions map[string]cacheEntry[bool]
+}
+
+const revocationCacheMaxEntries = 10000
+
+func newRevocationCache(ttl time.Duration) *revocationCache {
+	return &revocationCache{
+		ttl:      ttl,
+		tokens:   map[string]cacheEntry[bool]{},
+		users:    map[primitive.ObjectID]cacheEntry[userState]{},
+		sessions: map[string]cacheEntry[bool]{},
+	}
+}
+
+func (rc *revocationCache) getToken(jti string) (revoked bool, ok bool) {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	e, ok := rc.tokens[jti]
+	if !ok || e.expiresAt.Before(time.Now()) {
+		return false, false
+	}
+	return e.value, true
+}
+
+func (rc *revocationCache) setToken(jti string, revoked bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if len(rc.tokens) >= revocationCacheMaxEntries {
+		rc.tokens = purgeExpired(rc.tokens)
+	}
+	rc.tokens[jti] = cacheEntry[bool]{value: revoked, expiresAt: time.Now().Add(rc.ttl)}
+}
+
+func (rc *revocationCache) getUser(id primitive.ObjectID) (userState, bool) {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	e, ok := rc.users[id]
+	if !ok || e.expiresAt.Before(time.Now()) {
+		return userState{}, false
+	}
+	return e.value, true
+}
+
+func (rc *revocationCache) setUser(id primitive.ObjectID, state userState) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if len(rc.users) >= revocationCacheMaxEntries {
+		rc.users = purgeExpired(rc.users)
+	}
+	rc.users[id] = cacheEntry[userState]{value: state, expiresAt: time.Now().Add(rc.ttl)}
+}
+
+func (rc *revocationCache) getSession(id string) (revoked bool, ok bool) {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	e, ok := rc.sessions[id]
+	if !ok || e.expiresAt.Before(time.Now()) {
+		return false, false
+	}
+	return e.value, true
+}
+
+func (rc *revocationCache) setSession(id string, revoked bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if len(rc.sessions) >= revocationCacheMaxEntries {
+		rc.sessions = purgeExpired(rc.sessions)
+	}
+	rc.sessions[id] = cacheEntry[bool]{value: revoked, expiresAt: time.Now().Add(rc.ttl)}
+}
+
+func (rc *revocationCache) invalidateUser(id primitive.ObjectID) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	delete(rc.users, id)
+}
+
+func purgeExpired[K comparable, T any](m map[K]cacheEntry[T]) map[K]cacheEntry[T] {
+	now := time.Now()
+	for k, e := range m {
+		if e.expiresAt.Before(now) {
+			delete(m, k)
+		}
+	}
+	return m
+}
+
+// expiryTime converts a token exp claim to a time, defaulting to the access token lifetime ttl
+func expiryTime(exp interface{}, ttl time.Duration) time.Time {
+	switch v := exp.(type) {
+	case float64:
+		return time.Unix(int64(v), 0)
+	case int64:
+		return time.Unix(v, 0)
+	}
+	return time.Now().Add(ttl)
+}
@@ -0,0 +1,66 @@
+package userpkg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCheckTokenRevocationCutoff(t *testing.T) {
+	type testCase struct {
+		name          string
+		sessionID     string
+		issuedAt      int64
+		expectedError string
+	}
+
+	cutoff := time.Now()
+	tests := []testCase{
+		{
+			name:          "Rejects a token issued before the cutoff",
+			issuedAt:      cutoff.Unix() - 1,
+			expectedError: "token revoked",
+		},
+		{
+			name:          "Rejects a token issued in the cutoff second",
+			issuedAt:      cutoff.Unix(),
+			expectedError: "token revoked",
+		},
+		{
+			name:     "Accepts a token issued after the cutoff second",
+			issuedAt: cutoff.Unix() + 1,
+		},
+		{
+			name:      "Leaves a session token to its session",
+			sessionID: primitive.NewObjectID().Hex(),
+			issuedAt:  cutoff.Unix(),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			//the cached state of the user spares the database
+			s := service{cache: newRevocationCache(time.Minute)}
+			userID := primitive.NewObjectID()
+			s.cache.setUser(userID, userState{found: true, tokensValidAfter: &cutoff})
+
+			err := s.CheckTokenRevocation(userID, "", test.sessionID, test.issuedAt)
+			if test.expectedError != "" {
+				assert.EqualError(t, err, test.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestUserSession(t *testing.T) {
+	claims := JwtClaims{SessionID: "session"}
+	assert.Equal(t, "session", claims.UserSession())
+
+	//the session of an impersonating admin is not the user's
+	claims.Act = &Actor{}
+	assert.Empty(t, claims.UserSession())
+}
@@ -0,0 +1,157 @@
+package userpkg
+
+import (
+	"log"
+	"strings"
+)
+
+// User roles, from least to most privileged
+const (
+	RoleUser    = "USER"
+	RoleSupport = "SUPPORT"
+	RoleAdmin   = "ADMIN"
+)
+
+// Permissions granted through roles
+const (
+	PermUsersRead   = "users:read"
+	PermUsersCreate = "users:create"
+	PermUsersWrite  = "users:write"
+	PermUsersDelete = "users:delete"
+	// PermUsersImpersonate allows acting as users of a lower role
+	PermUsersImpersonate = "users:impersonate"
+	// PermAPIKeysManage allows managing the api keys of other users
+	PermAPIKeysManage = "apikeys:manage"
+	// PermOAuthClientsManage allows registering oauth clients
+	PermOAuthClientsManage = "oauth:clients"
+	// PermOrgsManage allows creating organizations & managing their members
+	PermOrgsManage = "orgs:manage"
+	// PermGroupsManage allows managing groups & their members
+	PermGroupsManage = "groups:manage"
+)
+
+// Self-service scopes, an api key needs them to act on its owner's own
+// account, whatever the owner's role
+const (
+	ScopeProfileRead  = "profile:read"
+	ScopeProfileWrite = "profile:write"
+)
+
+// SelfServiceScopes are the scopes any api key may be given
+var SelfServiceScopes = []string{ScopeProfileRead, ScopeProfileWrite}
+
+// platformPermissions reach beyond a single organization, an organization
+// admin never has them
+var platformPermissions = []string{PermOrgsManage, PermOAuthClientsManage}
+
+var roleRanks = map[string]int{
+	RoleUser:    1,
+	RoleSupport: 2,
+	RoleAdmin:   3,
+}
+
+var rolePermissions = map[string][]string{
+	RoleUser:    {},
+	RoleSupport: {PermUsersRead},
+	RoleAdmin:   {PermUsersRead, PermUsersCreate, PermUsersWrite, PermUsersDelete, PermUsersImpersonate, PermAPIKeysManage, PermOAuthClientsManage, PermOrgsManage, PermGroupsManage},
+}
+
+// NormalizeRole returns the canonical form of a role, empty roles become RoleUser
+func NormalizeRole(role string) string {
+	if role == "" {
+		return RoleUser
+	}
+	return strings.ToUpper(role)
+}
+
+// IsValidRole checks if the role is known
+func IsValidRole(role string) bool {
+	_, ok := roleRanks[NormalizeRole(role)]
+	return ok
+}
+
+// RoleRank returns the privilege level of a role, unknown roles rank lowest
+func RoleRank(role string) int {
+	return roleRanks[NormalizeRole(role)]
+}
+
+// RolePermissions returns the permissions granted by a role
+func RolePermissions(role string) []string {
+	return rolePermissions[NormalizeRole(role)]
+}
+
+// CanAssignRole checks that actorRole may give role to someone, a role
+// can never be assigned by someone ranking below it
+func CanAssignRole(actorRole string, role string) bool {
+	return IsValidRole(role) && RoleRank(role) <= RoleRank(actorRole)
+}
+
+// ParseRoleMap parses a mapping of external groups to roles such as
+// "admins=ADMIN,support=SUPPORT". Group names may contain "=" themselves,
+// pairs are separated by ";" instead when group names are DNs.
+func ParseRoleMap(s string) map[string]string {
+	sep := ","
+	if strings.Contains(s, ";") {
+		sep = ";"
+	}
+
+	roles := map[string]string{}
+	for _, pair := range strings.Split(s, sep) {
+		i := strings.LastIndex(pair, "=")
+		if i < 1 {
+			continue
+		}
+		group, role := strings.TrimSpace(pair[:i]), strings.TrimSpace(pair[i+1:])
+		if !IsValidRole(role) {
+			log.Printf("Ignoring role mapping for %s: unknown role %s", group, role)
+			continue
+		}
+		roles[strings.ToLower(group)] = NormalizeRole(role)
+	}
+	return roles
+}
+
+// MapRole returns the highest ranking role the groups map to, or
+// defaultRole when none of them is mapped
+func MapRole(groups []string, roleMap map[string]string, defaultRole string) string {
+	role := NormalizeRole(defaultRole)
+	for _, group := range groups {
+		if mapped, ok := roleMap[strings.ToLower(group)]; ok && RoleRank(mapped) > RoleRank(role) {
+			role = mapped
+		}
+	}
+	return role
+}
+
+// HasPermission checks if the user's role or groups grant the permission,
+// and that the scopes of the request (if any) allow it. Inside an
+// organization the platform permissions are never granted.
+func (u *UserContext) HasPermission(permission string) bool {
+	if !u.HasScope(permission) {
+		return false
+	}
+	if u.InOrg() && contains(platformPermissions, permission) {
+		return false
+	}
+	return contains(RolePermissions(u.Role), permission) || contains(u.Permissions, permission)
+}
+
+// HasScope checks the scopes of the request (if any) allow the scope,
+// requests without scopes are not limited
+func (u *UserContext) HasScope(scope string) bool {
+	return u.Scopes == nil || contains(u.Scopes, scope)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// HasRole checks if the user's role ranks at least as high as role
+func (u *UserContext) HasRole(role string) bool {
+	return RoleRank(u.Role) >= RoleRank(role)
+}
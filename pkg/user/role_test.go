@@ -0,0 +1,71 @@
+package userpkg
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseRoleMap(t *testing.T) {
+	assert.Equal(t, map[string]string{
+		"admins":  RoleAdmin,
+		"support": RoleSupport,
+	}, ParseRoleMap("admins=admin, Support=SUPPORT,nobody=ROOT,broken"))
+
+	assert.Equal(t, map[string]string{
+		"cn=admins,ou=groups,dc=example,dc=com":  RoleAdmin,
+		"cn=support,ou=groups,dc=example,dc=com": RoleSupport,
+	}, ParseRoleMap("cn=admins,ou=groups,dc=example,dc=com=ADMIN; cn=Support,ou=groups,dc=example,dc=com=SUPPORT"))
+}
+
+func TestMapRole(t *testing.T) {
+	roleMap := map[string]string{"admins": RoleAdmin, "support": RoleSupport}
+
+	type testCase struct {
+		Groups   []string
+		Default  string
+		Expected string
+	}
+
+	tests := []testCase{
+		{Groups: nil, Default: "", Expected: RoleUser},
+		{Groups: []string{"staff"}, Default: RoleSupport, Expected: RoleSupport},
+		{Groups: []string{"Support"}, Default: RoleUser, Expected: RoleSupport},
+		{Groups: []string{"support", "ADMINS"}, Default: RoleUser, Expected: RoleAdmin},
+		{Groups: []string{"support"}, Default: RoleAdmin, Expected: RoleAdmin},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.Expected, MapRole(tt.Groups, roleMap, tt.Default), "groups: %v", tt.Groups)
+	}
+}
+
+func TestHasPermissionInOrg(t *testing.T) {
+	platformAdmin := &UserContext{Role: RoleAdmin}
+	orgAdmin := &UserContext{Role: RoleAdmin, OrgID: primitive.NewObjectID()}
+
+	assert.True(t, platformAdmin.HasPermission(PermOrgsManage))
+	assert.True(t, platformAdmin.HasPermission(PermOAuthClientsManage))
+
+	//an organization admin runs their organization, not the platform
+	assert.True(t, orgAdmin.HasPermission(PermUsersDelete))
+	assert.False(t, orgAdmin.HasPermission(PermOrgsManage))
+	assert.False(t, orgAdmin.HasPermission(PermOAuthClientsManage))
+}
+
+func TestHasPermissionFromGroups(t *testing.T) {
+	u := &UserContext{Role: RoleUser, Permissions: []string{PermUsersRead, PermOrgsManage}}
+	assert.True(t, u.HasPermission(PermUsersRead))
+	assert.True(t, u.HasPermission(PermOrgsManage))
+	assert.False(t, u.HasPermission(PermUsersDelete))
+
+	//groups of an organization never grant platform permissions
+	u.OrgID = primitive.NewObjectID()
+	assert.True(t, u.HasPermission(PermUsersRead))
+	assert.False(t, u.HasPermission(PermOrgsManage))
+
+	//scopes still limit what groups grant
+	u.Scopes = []string{}
+	assert.False(t, u.HasPermission(PermUsersRead))
+}
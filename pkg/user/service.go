@@ -5,10 +5,13 @@ import (
 	"errors"
 	"log"
 	"mahi-go-explorer/internal/config"
+	mailpkg "mahi-go-explorer/pkg/mail"
+	tokenpkg "mahi-go-explorer/pkg/token"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
+	"github.com/golang-jwt/jwt/v4"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -16,7 +19,108 @@ import (
 // Service defines interface for the user service
 type Service interface {
 	EnsureAdminUserExists() error
-	LoginUser(req *LoginRequest) (string, error)
+	LoginUser(req *LoginRequest) (*LoginResponse, error)
+	// CompleteLogin finishes the login of a user who already proved who they
+	// are with method (an AMR value), asking for the second factor first when enabled
+	CompleteLogin(user *User, method string, client ClientInfo) (*LoginResponse, error)
+	// CompleteMultiFactorLogin finishes the login of a user who proved who
+	// they are with more than one factor at once, like a verified passkey
+	CompleteMultiFactorLogin(user *User, method string, client ClientInfo) (*LoginResponse, error)
+	// ProvisionExternalUser returns the user for an external identity provider account
+	ProvisionExternalUser(ext *ExternalUser) (*User, error)
+	RefreshTokens(refreshToken string) (*TokenPair, error)
+	RevokeAccessToken(userID primitive.ObjectID, jti string, exp interface{}) error
+	RevokeRefreshToken(userID primitive.ObjectID, refreshToken string) error
+	RevokeUserTokens(userID primitive.ObjectID) error
+	// CheckTokenRevocation checks the token was not revoked. A token of a
+	// session of the user, sessionID, is ended with the session, CheckSession
+	// tells. Others only carry their issue second, all of the second the
+	// user's tokens were revoked in are rejected.
+	CheckTokenRevocation(userID primitive.ObjectID, jti string, sessionID string, issuedAt int64) error
+
+	GetSessions(userID primitive.ObjectID) ([]Session, error)
+	RevokeSession(userID primitive.ObjectID, sessionID primitive.ObjectID) error
+	// CheckSession fails with "session revoked" once the session is logged out
+	CheckSession(sessionID string) error
+
+	// Impersonate issues a short lived access token for the user, acted on by actor
+	Impersonate(actor *UserContext, userID primitive.ObjectID) (*ImpersonationResponse, error)
+	// RecordImpersonation adds a request made while impersonating to the audit trail
+	RecordImpersonation(record *ImpersonationRecord) error
+
+	EnrollMFA(userID primitive.ObjectID) (*MFAEnrollment, error)
+	ConfirmMFA(userID primitive.ObjectID, code string) ([]string, error)
+	VerifyMFA(req *MFAVerifyRequest) (*TokenPair, error)
+	// MFAChallengeUser returns the user a pending MFA challenge is for
+	MFAChallengeUser(mfaToken string) (*User, error)
+	// CompleteMFAChallenge finishes a login whose second factor was checked
+	// elsewhere with method
+	CompleteMFAChallenge(mfaToken string, method string, client ClientInfo) (*TokenPair, error)
+	// ResetMFA removes the TOTP authenticator & the passkeys of the user
+	ResetMFA(userID primitive.ObjectID) error
+
+	// RequestPasswordReset sends a reset link if the email is registered. It
+	// works in the background, neither the answer nor its timing tell
+	// whether the email exists.
+	RequestPasswordReset(email string)
+	ResetPassword(token string, password string) error
+	ChangePassword(userID primitive.ObjectID, req *ChangePasswordRequest) (*TokenPair, error)
+	// Reauthenticate checks the password or an MFA code of the user again,
+	// moving the auth time of their session forward
+	Reauthenticate(userID primitive.ObjectID, sessionID string, req *ReauthRequest) (*ReauthResponse, error)
+
+	// RequestMagicLink emails a login link, returning the secret of the browser
+	// the link is bound to when asked for
+	RequestMagicLink(req *MagicLinkRequest) (string, error)
+	LoginWithMagicLink(req *MagicLinkLoginRequest) (*LoginResponse, error)
+
+	SendVerificationEmail(userID primitive.ObjectID) error
+	ResendVerificationEmail(email string) error
+	VerifyEmail(token string) error
+
+	UnlockUser(userID primitive.ObjectID) error
+
+	// InviteUser emails an invitation to create an account with the role
+	InviteUser(invitedBy primitive.ObjectID, req *InvitationRequest) (*Invitation, error)
+	// GetInvitations returns the invitations that were neither accepted nor revoked
+	GetInvitations() ([]Invitation, error)
+	ResendInvitation(id primitive.ObjectID) (*Invitation, error)
+	RevokeInvitation(id primitive.ObjectID) error
+	// AcceptInvitation creates the invited user with their password & logs them in
+	AcceptInvitation(req *AcceptInvitationRequest) (*LoginResponse, error)
+
+	CreateOrganization(req *OrganizationRequest) (*Organization, error)
+	GetOrganizations() ([]Organization, error)
+	// AddMember adds the user with the email to the organization with the role
+	AddMember(orgID primitive.ObjectID, req *MembershipRequest) error
+	// RemoveMember takes the user out of the organization & ends their sessions in it
+	RemoveMember(orgID primitive.ObjectID, userID primitive.ObjectID) error
+	// GetUserOrganizations returns the organizations of the user with their role in each
+	GetUserOrganizations(userID primitive.ObjectID) ([]UserOrganization, error)
+	// SwitchOrganization moves the session to the organization, or out of
+	// any with a zero orgID, returning an access token for it
+	SwitchOrganization(userID primitive.ObjectID, sessionID string, orgID primitive.ObjectID) (*AccessTokenResponse, error)
+	// InOrg returns the service as the organization sees it: users, their
+	// roles & invitations are the ones of the organization, a zero orgID
+	// sees everything
+	InOrg(orgID primitive.ObjectID) Service
+
+	CreateGroup(req *GroupRequest) (*Group, error)
+	GetGroups() ([]Group, error)
+	GetGroup(id primitive.ObjectID) (*Group, error)
+	UpdateGroup(id primitive.ObjectID, req *GroupRequest) (*Group, error)
+	// DeleteGroup deletes the group, taking it out of the groups it was nested in
+	DeleteGroup(id primitive.ObjectID) error
+	AddGroupMember(id primitive.ObjectID, userID primitive.ObjectID) error
+	RemoveGroupMember(id primitive.ObjectID, userID primitive.ObjectID) error
+	// AddSubgroup nests a group, its members become members of the group too.
+	// Fails with "group cycle" when the group is already nested in it.
+	AddSubgroup(id primitive.ObjectID, subgroupID primitive.ObjectID) error
+	RemoveSubgroup(id primitive.ObjectID, subgroupID primitive.ObjectID) error
+	// GroupGrants resolves the role & permissions the user gets from their
+	// groups in the organization, following nested groups. Cached for
+	// GROUP_CACHE_TTL.
+	GroupGrants(userID primitive.ObjectID, orgID primitive.ObjectID) (*GroupGrants, error)
 
 	CreateUser(user *User) (any, error)
 	GetUsers(conds bson.M, opts *options.FindOptions) ([]User, error)
@@ -26,13 +130,24 @@ type Service interface {
 }
 
 type service struct {
-	db   *mongo.Database
-	coll *config.Collection
+	db     *mongo.Database
+	coll   *config.Collection
+	tokens tokenpkg.Service
+	mailer mailpkg.Mailer
+	cache  *revocationCache
+	grants *grantCache
+	// verificationMode is the EMAIL_VERIFICATION_MODE logins are checked with
+	verificationMode string
+	// authenticators are asked in order when the local password does not match
+	authenticators []Authenticator
 }
 
-// NewService returns new instance of user service
-func NewService(db *mongo.Database, coll *config.Collection) Service {
-	return service{db, coll}
+// NewService returns new instance of user service, logins are checked
+// against the local password & then the authenticators
+func NewService(db *mongo.Database, coll *config.Collection, tokens tokenpkg.Service, mailer mailpkg.Mailer, authenticators ...Authenticator) Service {
+	cacheTTL := config.GetDurationFromEnv("REVOCATION_CACHE_TTL", 30*time.Second)
+	grantTTL := config.GetDurationFromEnv("GROUP_CACHE_TTL", 30*time.Second)
+	return service{db, coll, tokens, mailer, newRevocationCache(cacheTTL), newGrantCache(grantTTL), emailVerificationMode(), authenticators}
 }
 
 func (s service) EnsureAdminUserExists() error {
@@ -49,7 +164,9 @@ func (s service) EnsureAdminUserExists() error {
 		FirstName: "Admin",
 		LastName:  "User",
 		Email:     "admin@example.com",
-		Role:      "ADMIN",
+		Role:      RoleAdmin,
+		//the seeded address is not a real mailbox
+		EmailVerified: true,
 	}
 
 	hp, _ := hashPassword("admin123")
@@ -65,40 +182,373 @@ func (s service) EnsureAdminUserExists() error {
 	return nil
 }
 
-func (s service) LoginUser(req *LoginRequest) (string, error) {
+func (s service) LoginUser(req *LoginRequest) (*LoginResponse, error) {
+	keys := []string{emailAttemptKey(req.Email)}
+	if req.ClientIP != "" {
+		keys = append(keys, ipAttemptKey(req.ClientIP))
+	}
+	if err := s.checkLockout(keys...); err != nil {
+		return nil, err
+	}
+
+	//unknown emails & wrong passwords fail the same way
+	user, err := s.authenticate(req)
+	if err != nil && err.Error() == "invalid credentials" {
+		if err := s.recordFailedLogin(req); err != nil {
+			return nil, err
+		}
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.clearLoginFailures(req.Email); err != nil {
+		return nil, err
+	}
+
+	return s.CompleteLogin(user, AMRPassword, req.ClientInfo)
+}
+
+func (s service) CompleteLogin(user *User, method string, client ClientInfo) (*LoginResponse, error) {
+	return s.completeLogin(user, client, []string{method}, false)
+}
+
+func (s service) CompleteMultiFactorLogin(user *User, method string, client ClientInfo) (*LoginResponse, error) {
+	return s.completeLogin(user, client, []string{method, AMRMFA}, true)
+}
+
+func (s service) completeLogin(user *User, client ClientInfo, amr []string, multiFactor bool) (*LoginResponse, error) {
+	//only reported to someone who proved who they are
+	if user.IsBlocked {
+		return nil, errors.New("user is blocked")
+	}
+
+	if !user.EmailVerified && s.verificationMode == EmailVerificationEnforce {
+		return nil, errors.New("email not verified")
+	}
+
+	//the first factor alone is not enough, hand out a challenge for the second
+	if !multiFactor {
+		enrolled, err := s.mfaEnrolled(user)
+		if err != nil {
+			return nil, err
+		}
+		if enrolled {
+			mfaToken, err := s.createMFAChallenge(user.ID, amr)
+			if err != nil {
+				return nil, err
+			}
+			return &LoginResponse{MFARequired: true, MFAToken: mfaToken}, nil
+		}
+	}
+
+	tokens, err := s.startSession(user, client, amr)
+	if err != nil {
+		return nil, err
+	}
+	return &LoginResponse{TokenPair: tokens}, nil
+}
+
+func (s service) RefreshTokens(refreshToken string) (*TokenPair, error) {
+	coll := s.db.Collection(s.coll.RefreshTokenCollection)
+	tokenHash := hashToken(refreshToken)
+	now := time.Now()
+
+	//mark the token as used, only succeeds once per token
+	var rt RefreshToken
+	err := coll.FindOneAndUpdate(
+		context.TODO(),
+		bson.M{"tokenHash": tokenHash, "usedAt": bson.M{"$exists": false}, "revoked": false},
+		bson.M{"$set": bson.M{"usedAt": now}},
+	).Decode(&rt)
+	if err == mongo.ErrNoDocuments {
+		//a known token that was already used or revoked means it leaked, revoke the whole family
+		var reused RefreshToken
+		if err := coll.FindOne(context.TODO(), bson.M{"tokenHash": tokenHash}).Decode(&reused); err == nil {
+			if err := s.revokeRefreshTokenFamily(reused.FamilyID); err != nil {
+				return nil, err
+			}
+			log.Printf("Refresh token reuse detected for user %s, family %s revoked", reused.UserID.Hex(), reused.FamilyID.Hex())
+			return nil, errors.New("refresh token reuse detected")
+		}
+		return nil, errors.New("invalid refresh token")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if rt.ExpiresAt.Before(now) {
+		return nil, errors.New("refresh token expired")
+	}
+
 	var user User
-	err := s.db.Collection(s.coll.UserCollection).FindOne(context.TODO(), bson.M{"email": req.Email}).Decode(&user)
+	err = s.db.Collection(s.coll.UserCollection).FindOne(context.TODO(), bson.M{"_id": rt.UserID}).Decode(&user)
 	if err != nil {
-		return "", errors.New("user not found")
+		return nil, errors.New("user not found")
 	}
 
 	if user.IsBlocked {
-		return "", errors.New("user is blocked")
+		return nil, errors.New("user is blocked")
+	}
+
+	session, err := s.touchSession(rt.FamilyID)
+	if err != nil {
+		return nil, err
 	}
 
-	if !camparePassword(user.HashedPassword, req.Password) {
-		return "", errors.New("invalid password")
+	return s.issueTokens(&user, session)
+}
+
+// issueTokens hands out the next tokens of the session, its id is the
+// refresh token family
+func (s service) issueTokens(user *User, session *Session) (*TokenPair, error) {
+	accessToken, err := s.createAccessToken(user, session)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := generateToken()
+	if err != nil {
+		return nil, err
 	}
 
-	//create a jwt
+	now := time.Now()
+	rt := RefreshToken{
+		UserID:    user.ID,
+		FamilyID:  session.ID,
+		TokenHash: hashToken(refreshToken),
+		CreatedAt: now,
+		ExpiresAt: now.Add(refreshTokenTTL()),
+	}
+	_, err = s.db.Collection(s.coll.RefreshTokenCollection).InsertOne(context.TODO(), rt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+func (s service) createAccessToken(user *User, session *Session) (string, error) {
+	claims := s.accessTokenClaims(user, session.ID.Hex(), session.OrgID, s.tokens.Policy().TTL)
+	//a refreshed token still tells when the user last proved who they are
+	claims.AuthTime = jwt.NewNumericDate(session.authTime())
+	claims.AMR = session.AMR
+	return s.tokens.Issue(&claims)
+}
+
+// accessTokenClaims describes the user for a token, in the organization
+// when they are a member of it
+func (s service) accessTokenClaims(user *User, sessionID string, orgID primitive.ObjectID, ttl time.Duration) JwtClaims {
 	claims := JwtClaims{
-		ID:        user.ID,
 		FirstName: user.FirstName,
 		LastName:  user.LastName,
 		Email:     user.Email,
 		Role:      user.Role,
-		Exp:       time.Now().Add(1 * time.Hour).Unix(),
+
+		EmailVerified:    user.EmailVerified,
+		SessionID:        sessionID,
+		RegisteredClaims: s.tokens.Policy().RegisteredClaims(user.ID.Hex(), ttl),
+	}
+	if m := user.Membership(orgID); m != nil {
+		claims.OrgID = orgID.Hex()
+		claims.OrgRole = m.Role
+	}
+	return claims
+}
+
+// rehashPassword stores the password with the current hasher settings,
+// failures are only logged since the old hash still works
+func (s service) rehashPassword(user *User, password string) {
+	hp, err := hashPassword(password)
+	if err != nil {
+		log.Printf("Failed to rehash password for user %s: %v", user.ID.Hex(), err)
+		return
+	}
+
+	//only replace the hash that was verified, a concurrent change wins
+	_, err = s.db.Collection(s.coll.UserCollection).UpdateOne(
+		context.TODO(),
+		bson.M{"_id": user.ID, "hashedPassword": user.HashedPassword},
+		bson.M{"$set": bson.M{"hashedPassword": hp}},
+	)
+	if err != nil {
+		log.Printf("Failed to rehash password for user %s: %v", user.ID.Hex(), err)
+		return
+	}
+
+	user.HashedPassword = hp
+}
+
+// revokeRefreshTokenFamily ends the session of the family, its access
+// tokens are rejected by CheckSession
+func (s service) revokeRefreshTokenFamily(familyID primitive.ObjectID) error {
+	_, err := s.db.Collection(s.coll.RefreshTokenCollection).UpdateMany(
+		context.TODO(),
+		bson.M{"familyId": familyID},
+		bson.M{"$set": bson.M{"revoked": true}},
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Collection(s.coll.SessionCollection).UpdateOne(
+		context.TODO(),
+		bson.M{"_id": familyID, "revokedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revokedAt": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+
+	s.cache.setSession(familyID.Hex(), true)
+	return nil
+}
+
+func (s service) RevokeAccessToken(userID primitive.ObjectID, jti string, exp interface{}) error {
+	if jti == "" {
+		return errors.New("token has no id")
+	}
+
+	rt := RevokedToken{
+		ID:        jti,
+		UserID:    userID,
+		RevokedAt: time.Now(),
+		ExpiresAt: expiryTime(exp, s.tokens.Policy().TTL),
+	}
+	_, err := s.db.Collection(s.coll.RevokedTokenCollection).UpdateOne(
+		context.TODO(),
+		bson.M{"_id": jti},
+		bson.M{"$setOnInsert": rt},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return err
+	}
+
+	s.cache.setToken(jti, true)
+	return nil
+}
+
+func (s service) RevokeRefreshToken(userID primitive.ObjectID, refreshToken string) error {
+	var rt RefreshToken
+	err := s.db.Collection(s.coll.RefreshTokenCollection).FindOne(
+		context.TODO(),
+		bson.M{"tokenHash": hashToken(refreshToken), "userId": userID},
+	).Decode(&rt)
+	if err == mongo.ErrNoDocuments {
+		return errors.New("invalid refresh token")
+	}
+	if err != nil {
+		return err
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return s.revokeRefreshTokenFamily(rt.FamilyID)
+}
+
+// RevokeUserTokens ends every session of the user, tokens issued outside
+// of a session of theirs are cut off by tokensValidAfter
+func (s service) RevokeUserTokens(userID primitive.ObjectID) error {
+	now := time.Now()
+	_, err := s.db.Collection(s.coll.UserCollection).UpdateOne(
+		context.TODO(),
+		bson.M{"_id": userID},
+		bson.M{"$set": bson.M{"tokensValidAfter": now}},
+	)
+	if err != nil {
+		return err
+	}
+
+	//the sessions to note as revoked, their tokens are checked against the cache
+	cursor, err := s.db.Collection(s.coll.SessionCollection).Find(
+		context.TODO(),
+		bson.M{"userId": userID, "revokedAt": bson.M{"$exists": false}},
+		options.Find().SetProjection(bson.M{"_id": 1}),
+	)
+	if err != nil {
+		return err
+	}
+	var sessions []Session
+	if err := cursor.All(context.TODO(), &sessions); err != nil {
+		return err
+	}
+
+	_, err = s.db.Collection(s.coll.RefreshTokenCollection).UpdateMany(
+		context.TODO(),
+		bson.M{"userId": userID},
+		bson.M{"$set": bson.M{"revoked": true}},
+	)
+	if err != nil {
+		return err
+	}
 
-	//sign & return the token
-	t, err := token.SignedString([]byte(config.GetFromEnv("JWT_SECRET")))
+	_, err = s.db.Collection(s.coll.SessionCollection).UpdateMany(
+		context.TODO(),
+		bson.M{"userId": userID, "revokedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revokedAt": now}},
+	)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	return t, nil
+	for _, session := range sessions {
+		s.cache.setSession(session.ID.Hex(), true)
+	}
+	s.cache.invalidateUser(userID)
+	return nil
+}
+
+func (s service) CheckTokenRevocation(userID primitive.ObjectID, jti string, sessionID string, issuedAt int64) error {
+	//check the token itself
+	revoked, ok := s.cache.getToken(jti)
+	if !ok && jti != "" {
+		count, err := s.db.Collection(s.coll.RevokedTokenCollection).CountDocuments(context.TODO(), bson.M{"_id": jti})
+		if err != nil {
+			return err
+		}
+		revoked = count > 0
+		s.cache.setToken(jti, revoked)
+	}
+	if revoked {
+		return errors.New("token revoked")
+	}
+
+	//check the user the token belongs to
+	state, ok := s.cache.getUser(userID)
+	if !ok {
+		var user User
+		err := s.db.Collection(s.coll.UserCollection).FindOne(
+			context.TODO(),
+			bson.M{"_id": userID},
+			options.FindOne().SetProjection(bson.M{"isBlocked": 1, "tokensValidAfter": 1}),
+		).Decode(&user)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+		state = userState{
+			found:            err == nil,
+			isBlocked:        user.IsBlocked,
+			tokensValidAfter: user.TokensValidAfter,
+		}
+		s.cache.setUser(userID, state)
+	}
+
+	if !state.found {
+		return errors.New("user not found")
+	}
+	if state.isBlocked {
+		return errors.New("user is blocked")
+	}
+	//a session of the user is revoked along with their tokens, a new one is
+	//fine however soon after
+	if sessionID == "" && state.tokensValidAfter != nil && issuedAt <= state.tokensValidAfter.Unix() {
+		return errors.New("token revoked")
+	}
+
+	return nil
 }
 
 func (s service) CreateUser(user *User) (any, error) {
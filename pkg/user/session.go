@@ -0,0 +1,167 @@
+package userpkg
+
+import (
+	"context"
+	"errors"
+	"mahi-go-explorer/internal/config"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Session is a login on one device. It shares its id with the refresh
+// token family of the login, revoking one revokes the other.
+type Session struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id"`
+	UserID     primitive.ObjectID `json:"userId" bson:"userId"`
+	UserAgent  string             `json:"userAgent" bson:"userAgent"`
+	IP         string             `json:"ip" bson:"ip"`
+	CreatedAt  time.Time          `json:"createdAt" bson:"createdAt"`
+	LastSeenAt time.Time          `json:"lastSeenAt" bson:"lastSeenAt"`
+	ExpiresAt  time.Time          `json:"expiresAt" bson:"expiresAt"`
+	RevokedAt  *time.Time         `json:"-" bson:"revokedAt,omitempty"`
+	// AuthTime is when the user last proved who they are, at login or reauth
+	AuthTime time.Time `json:"authTime" bson:"authTime"`
+	AMR      []string  `json:"amr,omitempty" bson:"amr,omitempty"`
+	// OrgID is the organization the session works in, switched by the user
+	OrgID primitive.ObjectID `json:"orgId,omitempty" bson:"orgId,omitempty"`
+	// Current marks the session making the request
+	Current bool `json:"current,omitempty" bson:"-"`
+}
+
+// ClientInfo describes the device a request comes from, set by the handler
+type ClientInfo struct {
+	ClientIP  string `json:"-" form:"-"`
+	UserAgent string `json:"-" form:"-"`
+}
+
+// maxUserAgentLength keeps clients from storing novels in their sessions
+const maxUserAgentLength = 512
+
+func refreshTokenTTL() time.Duration {
+	return config.GetDurationFromEnv("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+}
+
+// startSession records a new login with the methods in amr & issues its
+// first tokens
+func (s service) startSession(user *User, client ClientInfo, amr []string) (*TokenPair, error) {
+	userAgent := client.UserAgent
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+
+	now := time.Now()
+	session := Session{
+		ID:         primitive.NewObjectID(),
+		UserID:     user.ID,
+		UserAgent:  userAgent,
+		IP:         client.ClientIP,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(refreshTokenTTL()),
+		AuthTime:   now,
+		AMR:        amr,
+		OrgID:      user.defaultOrg(),
+	}
+	_, err := s.db.Collection(s.coll.SessionCollection).InsertOne(context.TODO(), session)
+	if err != nil {
+		return nil, err
+	}
+
+	//every session starts a new refresh token family
+	return s.issueTokens(user, &session)
+}
+
+// touchSession moves the last seen time of a session forward, the session
+// lives as long as the refresh token it was just given
+func (s service) touchSession(sessionID primitive.ObjectID) (*Session, error) {
+	now := time.Now()
+	var session Session
+	err := s.db.Collection(s.coll.SessionCollection).FindOneAndUpdate(
+		context.TODO(),
+		bson.M{"_id": sessionID},
+		bson.M{"$set": bson.M{"lastSeenAt": now, "expiresAt": now.Add(refreshTokenTTL())}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		return nil, errors.New("invalid refresh token")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// authTime returns when the user last proved who they are, sessions from
+// before auth times were kept started with a login
+func (s *Session) authTime() time.Time {
+	if s.AuthTime.IsZero() {
+		return s.CreatedAt
+	}
+	return s.AuthTime
+}
+
+func (s service) GetSessions(userID primitive.ObjectID) ([]Session, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "lastSeenAt", Value: -1}})
+	cursor, err := s.db.Collection(s.coll.SessionCollection).Find(
+		context.TODO(),
+		bson.M{"userId": userID, "revokedAt": bson.M{"$exists": false}, "expiresAt": bson.M{"$gt": time.Now()}},
+		opts,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []Session{}
+	if err := cursor.All(context.TODO(), &sessions); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+func (s service) RevokeSession(userID primitive.ObjectID, sessionID primitive.ObjectID) error {
+	count, err := s.db.Collection(s.coll.SessionCollection).CountDocuments(
+		context.TODO(),
+		bson.M{"_id": sessionID, "userId": userID, "revokedAt": bson.M{"$exists": false}},
+	)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errors.New("session not found")
+	}
+
+	return s.revokeRefreshTokenFamily(sessionID)
+}
+
+func (s service) CheckSession(sessionID string) error {
+	revoked, ok := s.cache.getSession(sessionID)
+	if !ok {
+		id, err := primitive.ObjectIDFromHex(sessionID)
+		if err != nil {
+			return errors.New("session revoked")
+		}
+
+		//seeing the session is as good as any time to note it was seen
+		var session Session
+		err = s.db.Collection(s.coll.SessionCollection).FindOneAndUpdate(
+			context.TODO(),
+			bson.M{"_id": id},
+			bson.M{"$set": bson.M{"lastSeenAt": time.Now()}},
+		).Decode(&session)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+		revoked = err == mongo.ErrNoDocuments || session.RevokedAt != nil
+		s.cache.setSession(sessionID, revoked)
+	}
+
+	if revoked {
+		return errors.New("session revoked")
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package userpkg
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignedToken(t *testing.T) {
+	payload := signedPayload{
+		UserID:    "1234567890abcdef12345678",
+		Email:     "user@example.com",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	}
+
+	token, err := signToken(emailVerificationPurpose, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := verifySignedToken(emailVerificationPurpose, token)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, *got)
+
+	//a token for one purpose is useless for another
+	_, err = verifySignedToken("other-purpose", token)
+	assert.Error(t, err)
+
+	//tampering with the payload breaks the signature
+	parts := strings.Split(token, ".")
+	_, err = verifySignedToken(emailVerificationPurpose, parts[0]+"x."+parts[1])
+	assert.Error(t, err)
+
+	//expired tokens are rejected
+	payload.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	expired, _ := signToken(emailVerificationPurpose, payload)
+	_, err = verifySignedToken(emailVerificationPurpose, expired)
+	assert.EqualError(t, err, "signed token expired")
+}
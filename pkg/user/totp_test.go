@@ -0,0 +1,72 @@
+package userpkg
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTOTPCode(t *testing.T) {
+	//RFC 6238 appendix B SHA1 vectors, truncated to 6 digits
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+	type testCase struct {
+		Time     int64
+		Expected string
+	}
+
+	tests := []testCase{
+		{Time: 59, Expected: "287082"},
+		{Time: 1111111109, Expected: "081804"},
+		{Time: 1234567890, Expected: "005924"},
+		{Time: 2000000000, Expected: "279037"},
+	}
+
+	for _, tt := range tests {
+		code, err := totpCode(secret, tt.Time/totpPeriod)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.Expected, code)
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	counter := now.Unix() / totpPeriod
+	code, _ := totpCode(secret, counter)
+	previous, _ := totpCode(secret, counter-1)
+	stale, _ := totpCode(secret, counter-3)
+
+	got, ok := validateTOTP(secret, code, now, 0)
+	assert.True(t, ok)
+	assert.Equal(t, counter, got)
+
+	//drift of one step is tolerated
+	_, ok = validateTOTP(secret, previous, now, 0)
+	assert.True(t, ok)
+
+	//older codes and replays are not
+	_, ok = validateTOTP(secret, stale, now, 0)
+	assert.False(t, ok)
+	_, ok = validateTOTP(secret, code, now, counter)
+	assert.False(t, ok)
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := generateRecoveryCodes(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Len(t, codes, 10)
+	for _, code := range codes {
+		assert.Len(t, code, 11)
+		assert.Equal(t, code, normalizeRecoveryCode(" "+code[:5]+code[6:]+" "))
+	}
+}
@@ -1,8 +1,11 @@
 package userpkg
 
 import (
+	passwordpkg "mahi-go-explorer/pkg/password"
+	"sync"
+	"time"
+
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // User defines user schema
@@ -15,6 +18,24 @@ type User struct {
 	Role           string             `json:"role,omitempty" bson:"role,omitempty"`
 	HashedPassword string             `json:"-" bson:"hashedPassword,omitempty"`
 	IsBlocked      bool               `json:"isBlocked" bson:"isBlocked"`
+	EmailVerified  bool               `json:"emailVerified" bson:"emailVerified"`
+	// VerificationSentAt is when the last verification email went out
+	VerificationSentAt *time.Time `json:"-" bson:"verificationSentAt,omitempty"`
+	// TokensValidAfter invalidates the access tokens issued before it outside
+	// of a session of the user, sessions are revoked with it
+	TokensValidAfter *time.Time `json:"-" bson:"tokensValidAfter,omitempty"`
+
+	MFAEnabled        bool     `json:"mfaEnabled" bson:"mfaEnabled"`
+	TOTPSecret        string   `json:"-" bson:"totpSecret,omitempty"`
+	TOTPPendingSecret string   `json:"-" bson:"totpPendingSecret,omitempty"`
+	TOTPLastCounter   int64    `json:"-" bson:"totpLastCounter,omitempty"`
+	RecoveryCodes     []string `json:"-" bson:"recoveryCodes,omitempty"`
+
+	// Identities links the user to accounts at external identity providers
+	Identities []Identity `json:"identities,omitempty" bson:"identities,omitempty"`
+	// Memberships are the organizations of the user, Role is then only used
+	// outside of them
+	Memberships []Membership `json:"memberships,omitempty" bson:"memberships,omitempty"`
 }
 
 // CreateRequest defines user create request
@@ -28,23 +49,35 @@ type CreateRequest struct {
 }
 
 func hashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
-	if err != nil {
-		return "", err
-	}
-	return string(bytes), nil
+	return passwordpkg.DefaultHasher().Hash(password)
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// dummyPasswordHash is compared against when the user does not exist,
+// so unknown emails take as long as wrong passwords
+func dummyPasswordHash() string {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = hashPassword("dummy-password")
+	})
+	return dummyHash
 }
 
 func camparePassword(hashedPassword, password string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
-	if err != nil {
-		return false
-	}
-	return true
+	ok, err := passwordpkg.DefaultHasher().Verify(hashedPassword, password)
+	return err == nil && ok
 }
 
-// CreateUser creates user
+// CreateUser creates user, the password has to follow the password policy
 func (cu *CreateRequest) CreateUser() (*User, error) {
+	err := passwordpkg.DefaultPolicy().Validate(cu.Password, cu.Email, cu.FirstName, cu.LastName)
+	if err != nil {
+		return nil, err
+	}
+
 	u := &User{
 		FirstName: cu.FirstName,
 		LastName:  cu.LastName,
@@ -68,6 +101,20 @@ func (cu *CreateRequest) CreateUser() (*User, error) {
 type LoginRequest struct {
 	Email    string `json:"email,omitempty"`
 	Password string `json:"password,omitempty"`
+	// ClientInfo is set by the handler, the ip is also used for per address throttling
+	ClientInfo
+}
+
+// LogoutRequest defines logout request schema
+type LogoutRequest struct {
+	RefreshToken string `json:"refreshToken,omitempty"`
+}
+
+// ChangePasswordRequest defines change password request schema
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword,omitempty"`
+	NewPassword     string `json:"newPassword,omitempty"`
+	ClientInfo
 }
 
 // UpdateRequest defines user update request
@@ -77,4 +124,5 @@ type UpdateRequest struct {
 	Email     string `json:"email,omitempty"`
 	Phone     string `json:"phone,omitempty"`
 	Role      string `json:"role,omitempty"`
+	IsBlocked *bool  `json:"isBlocked,omitempty"`
 }
@@ -0,0 +1,233 @@
+package webauthnpkg
+
+import (
+	"bytes"
+	"errors"
+	"mahi-go-explorer/internal/config"
+	userpkg "mahi-go-explorer/pkg/user"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Credential is a passkey registered by a user
+type Credential struct {
+	ID     primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	UserID primitive.ObjectID `json:"userId" bson:"userId"`
+	Name   string             `json:"name" bson:"name"`
+	// CredentialID is the id the authenticator knows the passkey by
+	CredentialID    []byte   `json:"-" bson:"credentialId"`
+	PublicKey       []byte   `json:"-" bson:"publicKey"`
+	AttestationType string   `json:"-" bson:"attestationType"`
+	Transports      []string `json:"transports,omitempty" bson:"transports,omitempty"`
+	AAGUID          []byte   `json:"-" bson:"aaguid,omitempty"`
+	// SignCount only moves forward, a lower count means the passkey was cloned.
+	// Synced passkeys always report 0.
+	SignCount      uint32     `json:"-" bson:"signCount"`
+	BackupEligible bool       `json:"backupEligible" bson:"backupEligible"`
+	BackupState    bool       `json:"backupState" bson:"backupState"`
+	CreatedAt      time.Time  `json:"createdAt" bson:"createdAt"`
+	LastUsedAt     *time.Time `json:"lastUsedAt,omitempty" bson:"lastUsedAt,omitempty"`
+}
+
+// relyingParty runs the WebAuthn ceremonies, storing the sessions &
+// credentials is up to the caller
+type relyingParty struct {
+	wa *webauthn.WebAuthn
+}
+
+// passkeyUser is a user together with their passkeys
+type passkeyUser struct {
+	user        *userpkg.User
+	credentials []Credential
+}
+
+// loadRelyingParty reads WEBAUTHN_RP_ID, WEBAUTHN_RP_NAME & the comma
+// separated WEBAUTHN_RP_ORIGINS, the origins default to FRONTEND_URL
+func loadRelyingParty() (*relyingParty, error) {
+	rpID := config.GetFromEnv("WEBAUTHN_RP_ID")
+	if rpID == "" {
+		rpID = "localhost"
+	}
+	rpName := config.GetFromEnv("WEBAUTHN_RP_NAME")
+	if rpName == "" {
+		rpName = "Mahi Go Explorer"
+	}
+
+	origins := []string{}
+	for _, o := range strings.Split(config.GetFromEnv("WEBAUTHN_RP_ORIGINS"), ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			origins = append(origins, strings.TrimSuffix(o, "/"))
+		}
+	}
+	if len(origins) == 0 {
+		origins = append(origins, config.FrontendURL())
+	}
+
+	return newRelyingParty(rpID, rpName, origins)
+}
+
+func newRelyingParty(rpID string, rpName string, origins []string) (*relyingParty, error) {
+	wa, err := webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: rpName,
+		RPOrigins:     origins,
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        webauthn.TimeoutConfig{Enforce: true, Timeout: ceremonyTTL, TimeoutUVD: ceremonyTTL},
+			Registration: webauthn.TimeoutConfig{Enforce: true, Timeout: ceremonyTTL, TimeoutUVD: ceremonyTTL},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &relyingParty{wa}, nil
+}
+
+// beginRegistration returns the options for creating a new passkey, the
+// passkeys the user already has are excluded
+func (rp *relyingParty) beginRegistration(u *passkeyUser) (*protocol.CredentialCreation, *webauthn.SessionData, error) {
+	exclude := []protocol.CredentialDescriptor{}
+	for _, c := range u.WebAuthnCredentials() {
+		exclude = append(exclude, c.Descriptor())
+	}
+
+	return rp.wa.BeginRegistration(u,
+		webauthn.WithExclusions(exclude),
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementPreferred,
+			UserVerification: protocol.VerificationPreferred,
+		}),
+	)
+}
+
+// finishRegistration verifies the new passkey against the session
+func (rp *relyingParty) finishRegistration(u *passkeyUser, session webauthn.SessionData, body []byte) (*Credential, error) {
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := rp.wa.CreateCredential(u, session, parsed)
+	if err != nil {
+		return nil, err
+	}
+
+	transports := []string{}
+	for _, t := range c.Transport {
+		transports = append(transports, string(t))
+	}
+
+	return &Credential{
+		UserID:          u.user.ID,
+		CredentialID:    c.ID,
+		PublicKey:       c.PublicKey,
+		AttestationType: c.AttestationType,
+		Transports:      transports,
+		AAGUID:          c.Authenticator.AAGUID,
+		SignCount:       c.Authenticator.SignCount,
+		BackupEligible:  c.Flags.BackupEligible,
+		BackupState:     c.Flags.BackupState,
+	}, nil
+}
+
+// beginLogin returns the options for logging in with one of the passkeys
+// of the user, or with any discoverable passkey when there is no user
+func (rp *relyingParty) beginLogin(u *passkeyUser, uv protocol.UserVerificationRequirement) (*protocol.CredentialAssertion, *webauthn.SessionData, error) {
+	if u == nil {
+		return rp.wa.BeginDiscoverableLogin(webauthn.WithUserVerification(uv))
+	}
+	return rp.wa.BeginLogin(u, webauthn.WithUserVerification(uv))
+}
+
+// finishLogin verifies the assertion against the session, looking the user
+// up by the user handle for discoverable logins. It returns the user & the
+// passkey used, with its sign count updated.
+func (rp *relyingParty) finishLogin(u *passkeyUser, session webauthn.SessionData, body []byte, lookup func(userHandle []byte) (*passkeyUser, error)) (*passkeyUser, *Credential, error) {
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var c *webauthn.Credential
+	if session.UserID == nil {
+		c, err = rp.wa.ValidateDiscoverableLogin(func(_, userHandle []byte) (webauthn.User, error) {
+			found, err := lookup(userHandle)
+			if err != nil {
+				return nil, err
+			}
+			u = found
+			return u, nil
+		}, session, parsed)
+	} else {
+		c, err = rp.wa.ValidateLogin(u, session, parsed)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	//two copies of the private key exist, neither can be trusted
+	if c.Authenticator.CloneWarning {
+		return nil, nil, errors.New("credential cloned")
+	}
+
+	for _, stored := range u.credentials {
+		if bytes.Equal(stored.CredentialID, c.ID) {
+			stored.SignCount = c.Authenticator.SignCount
+			stored.BackupState = c.Flags.BackupState
+			return u, &stored, nil
+		}
+	}
+	return nil, nil, errors.New("credential not found")
+}
+
+// userHandle is what authenticators store to identify the user, never the email
+func userHandle(userID primitive.ObjectID) []byte {
+	return userID[:]
+}
+
+func (u *passkeyUser) WebAuthnID() []byte {
+	return userHandle(u.user.ID)
+}
+
+func (u *passkeyUser) WebAuthnName() string {
+	return u.user.Email
+}
+
+func (u *passkeyUser) WebAuthnDisplayName() string {
+	if name := strings.TrimSpace(u.user.FirstName + " " + u.user.LastName); name != "" {
+		return name
+	}
+	return u.user.Email
+}
+
+func (u *passkeyUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u *passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := []webauthn.Credential{}
+	for _, c := range u.credentials {
+		transports := []protocol.AuthenticatorTransport{}
+		for _, t := range c.Transports {
+			transports = append(transports, protocol.AuthenticatorTransport(t))
+		}
+		credentials = append(credentials, webauthn.Credential{
+			ID:              c.CredentialID,
+			PublicKey:       c.PublicKey,
+			AttestationType: c.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				BackupEligible: c.BackupEligible,
+				BackupState:    c.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    c.AAGUID,
+				SignCount: c.SignCount,
+			},
+		})
+	}
+	return credentials
+}
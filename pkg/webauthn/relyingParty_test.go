@@ -0,0 +1,317 @@
+package webauthnpkg
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	userpkg "mahi-go-explorer/pkg/user"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	testRPID   = "app.example.com"
+	testOrigin = "https://app.example.com"
+)
+
+func newTestRelyingParty(t *testing.T) *relyingParty {
+	rp, err := newRelyingParty(testRPID, "Test", []string{testOrigin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rp
+}
+
+func newTestUser(email string) *passkeyUser {
+	return &passkeyUser{user: &userpkg.User{
+		ID:        primitive.NewObjectID(),
+		FirstName: "Jane",
+		LastName:  "Doe",
+		Email:     email,
+	}}
+}
+
+// register runs a registration ceremony, adding the passkey to the user
+func register(t *testing.T, rp *relyingParty, u *passkeyUser, a *softAuthenticator) *Credential {
+	options, session, err := rp.beginRegistration(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := rp.finishRegistration(u, *session, a.create(options))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ID = primitive.NewObjectID()
+	u.credentials = append(u.credentials, *c)
+	return c
+}
+
+func TestRegistration(t *testing.T) {
+	rp := newTestRelyingParty(t)
+
+	type testCase struct {
+		name   string
+		origin string
+		// otherChallenge answers the options of another ceremony
+		otherChallenge bool
+		// body is sent instead of the answer of the authenticator
+		body        string
+		expectError bool
+	}
+
+	tests := []testCase{
+		{
+			name:   "Registers a passkey",
+			origin: testOrigin,
+		},
+		{
+			name:        "Rejects a wrong origin",
+			origin:      "https://evil.example.com",
+			expectError: true,
+		},
+		{
+			name:           "Rejects an answer to another challenge",
+			origin:         testOrigin,
+			otherChallenge: true,
+			expectError:    true,
+		},
+		{
+			name:        "Rejects a malformed credential",
+			origin:      testOrigin,
+			body:        `{"id":"abc","type":"public-key"}`,
+			expectError: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			u := newTestUser("jane@example.com")
+			options, session, err := rp.beginRegistration(u)
+			assert.NoError(t, err)
+			if tc.otherChallenge {
+				options, _, err = rp.beginRegistration(u)
+				assert.NoError(t, err)
+			}
+
+			body := newSoftAuthenticator(t, tc.origin).create(options)
+			if tc.body != "" {
+				body = []byte(tc.body)
+			}
+
+			c, err := rp.finishRegistration(u, *session, body)
+			if tc.expectError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, u.user.ID, c.UserID)
+			assert.Equal(t, "none", c.AttestationType)
+			assert.Len(t, c.CredentialID, 16)
+			assert.NotEmpty(t, c.PublicKey)
+		})
+	}
+}
+
+func TestRegistrationExcludesPasskeys(t *testing.T) {
+	rp := newTestRelyingParty(t)
+	u := newTestUser("jane@example.com")
+	a := newSoftAuthenticator(t, testOrigin)
+	c := register(t, rp, u, a)
+
+	options, _, err := rp.beginRegistration(u)
+	assert.NoError(t, err)
+	assert.Len(t, options.Response.CredentialExcludeList, 1)
+	assert.Equal(t, protocol.URLEncodedBase64(c.CredentialID), options.Response.CredentialExcludeList[0].CredentialID)
+	assert.Equal(t, protocol.URLEncodedBase64(userHandle(u.user.ID)), options.Response.User.ID)
+}
+
+func TestLogin(t *testing.T) {
+	rp := newTestRelyingParty(t)
+
+	type testCase struct {
+		name string
+		// discoverable leaves the user to the passkey
+		discoverable bool
+		uv           protocol.UserVerificationRequirement
+		// storedCount is the sign count we remember for the passkey
+		storedCount uint32
+		// prepare changes the authenticator before it answers
+		prepare func(a *softAuthenticator)
+		rpID    string
+		// otherChallenge answers the options of another ceremony
+		otherChallenge bool
+		// otherUser answers with the passkey of another user
+		otherUser     bool
+		unknownUser   bool
+		expectedCount uint32
+		expectError   bool
+		// expectedError is checked when set
+		expectedError string
+	}
+
+	tests := []testCase{
+		{
+			name:          "Logs in with a passkey of the user",
+			uv:            protocol.VerificationRequired,
+			expectedCount: 1,
+		},
+		{
+			name:          "Logs in with a discoverable passkey",
+			discoverable:  true,
+			uv:            protocol.VerificationRequired,
+			expectedCount: 1,
+		},
+		{
+			name:          "Moves the sign count forward",
+			uv:            protocol.VerificationRequired,
+			storedCount:   7,
+			prepare:       func(a *softAuthenticator) { a.signCount = 41 },
+			expectedCount: 42,
+		},
+		{
+			name:    "Accepts zero counts of synced passkeys",
+			uv:      protocol.VerificationRequired,
+			prepare: func(a *softAuthenticator) { a.synced = true },
+		},
+		{
+			name:          "Rejects a sign count that went backwards",
+			uv:            protocol.VerificationRequired,
+			storedCount:   10,
+			prepare:       func(a *softAuthenticator) { a.signCount = 4 },
+			expectError:   true,
+			expectedError: "credential cloned",
+		},
+		{
+			name:          "Rejects a sign count that did not move",
+			uv:            protocol.VerificationRequired,
+			storedCount:   5,
+			prepare:       func(a *softAuthenticator) { a.signCount = 4 },
+			expectError:   true,
+			expectedError: "credential cloned",
+		},
+		{
+			name:        "Requires user verification",
+			uv:          protocol.VerificationRequired,
+			prepare:     func(a *softAuthenticator) { a.skipUV = true },
+			expectError: true,
+		},
+		{
+			name:          "Accepts user presence when verification is preferred",
+			uv:            protocol.VerificationPreferred,
+			prepare:       func(a *softAuthenticator) { a.skipUV = true },
+			expectedCount: 1,
+		},
+		{
+			name:        "Rejects a wrong origin",
+			uv:          protocol.VerificationRequired,
+			prepare:     func(a *softAuthenticator) { a.origin = "https://evil.example.com" },
+			expectError: true,
+		},
+		{
+			name:        "Rejects another relying party",
+			uv:          protocol.VerificationRequired,
+			rpID:        "evil.example.com",
+			expectError: true,
+		},
+		{
+			name:           "Rejects an answer to another challenge",
+			uv:             protocol.VerificationRequired,
+			otherChallenge: true,
+			expectError:    true,
+		},
+		{
+			name: "Rejects a signature of another key",
+			uv:   protocol.VerificationRequired,
+			prepare: func(a *softAuthenticator) {
+				a.key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			},
+			expectError: true,
+		},
+		{
+			name:        "Rejects a passkey of another user",
+			uv:          protocol.VerificationRequired,
+			otherUser:   true,
+			expectError: true,
+		},
+		{
+			name:         "Rejects a discoverable passkey of another user",
+			discoverable: true,
+			uv:           protocol.VerificationRequired,
+			otherUser:    true,
+			expectError:  true,
+		},
+		{
+			name:         "Rejects a discoverable passkey of an unknown user",
+			discoverable: true,
+			uv:           protocol.VerificationRequired,
+			unknownUser:  true,
+			expectError:  true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			u := newTestUser("jane@example.com")
+			a := newSoftAuthenticator(t, testOrigin)
+			register(t, rp, u, a)
+			u.credentials[0].SignCount = tc.storedCount
+
+			other := newTestUser("john@example.com")
+			otherAuthenticator := newSoftAuthenticator(t, testOrigin)
+			register(t, rp, other, otherAuthenticator)
+
+			users := map[primitive.ObjectID]*passkeyUser{u.user.ID: u, other.user.ID: other}
+			lookup := func(handle []byte) (*passkeyUser, error) {
+				var id primitive.ObjectID
+				copy(id[:], handle)
+				if found, ok := users[id]; ok && !tc.unknownUser {
+					return found, nil
+				}
+				return nil, errors.New("user not found")
+			}
+
+			var loginUser *passkeyUser
+			if !tc.discoverable {
+				loginUser = u
+			}
+			options, session, err := rp.beginLogin(loginUser, tc.uv)
+			assert.NoError(t, err)
+			if tc.otherChallenge {
+				options, _, err = rp.beginLogin(loginUser, tc.uv)
+				assert.NoError(t, err)
+			}
+
+			answering := a
+			if tc.otherUser {
+				//the other passkey claims to be for the user logging in
+				answering = otherAuthenticator
+				answering.userHandle = a.userHandle
+			}
+			if tc.prepare != nil {
+				tc.prepare(answering)
+			}
+			rpID := testRPID
+			if tc.rpID != "" {
+				rpID = tc.rpID
+			}
+
+			found, c, err := rp.finishLogin(loginUser, *session, answering.get(rpID, options), lookup)
+			if tc.expectError {
+				assert.Error(t, err)
+				if tc.expectedError != "" {
+					assert.EqualError(t, err, tc.expectedError)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, u.user.ID, found.user.ID)
+			assert.Equal(t, u.credentials[0].ID, c.ID)
+			assert.Equal(t, tc.expectedCount, c.SignCount)
+		})
+	}
+}
@@ -0,0 +1,406 @@
+package webauthnpkg
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"mahi-go-explorer/internal/config"
+	userpkg "mahi-go-explorer/pkg/user"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Service defines interface for registering passkeys & logging in with them
+type Service interface {
+	// BeginRegistration returns the options for creating a new passkey
+	BeginRegistration(userID primitive.ObjectID) (*Ceremony, error)
+	// FinishRegistration stores the passkey the authenticator created
+	FinishRegistration(userID primitive.ObjectID, req *FinishRequest) (*Credential, error)
+	// BeginLogin returns the options for logging in with a passkey alone
+	BeginLogin(req *BeginLoginRequest) (*Ceremony, error)
+	// FinishLogin logs the user of the passkey in
+	FinishLogin(req *FinishRequest) (*userpkg.LoginResponse, error)
+	// BeginMFA returns the options for using a passkey as the second factor
+	// of a pending MFA challenge
+	BeginMFA(req *BeginMFARequest) (*Ceremony, error)
+	// FinishMFA completes the MFA challenge with the passkey
+	FinishMFA(req *FinishRequest) (*userpkg.TokenPair, error)
+
+	GetCredentials(userID primitive.ObjectID) ([]Credential, error)
+	DeleteCredential(userID primitive.ObjectID, id primitive.ObjectID) error
+}
+
+type service struct {
+	db    *mongo.Database
+	coll  *config.Collection
+	users userpkg.Service
+	rp    *relyingParty
+}
+
+// Ceremony is handed to the browser to start a ceremony, the session id
+// comes back with its result
+type Ceremony struct {
+	SessionID string `json:"sessionId"`
+	Options   any    `json:"options"`
+}
+
+// BeginLoginRequest defines the request body for starting a login, without
+// an email any discoverable passkey can be used
+type BeginLoginRequest struct {
+	Email string `json:"email,omitempty"`
+}
+
+// BeginMFARequest defines the request body for starting a second factor check
+type BeginMFARequest struct {
+	MFAToken string `json:"mfaToken,omitempty"`
+	userpkg.ClientInfo
+}
+
+// FinishRequest defines the request body for finishing a ceremony,
+// Credential is the PublicKeyCredential the browser returned
+type FinishRequest struct {
+	SessionID  string          `json:"sessionId,omitempty"`
+	Credential json.RawMessage `json:"credential,omitempty"`
+	// Name labels a new passkey
+	Name string `json:"name,omitempty"`
+	// MFAToken is the challenge a second factor check completes
+	MFAToken string `json:"mfaToken,omitempty"`
+	userpkg.ClientInfo
+}
+
+// session is a ceremony waiting for the browser, only the hash of its id is stored
+type session struct {
+	ID           primitive.ObjectID   `bson:"_id,omitempty"`
+	SessionHash  string               `bson:"sessionHash"`
+	Type         string               `bson:"type"`
+	UserID       primitive.ObjectID   `bson:"userId,omitempty"`
+	MFATokenHash string               `bson:"mfaTokenHash,omitempty"`
+	Data         webauthn.SessionData `bson:"data"`
+	ExpiresAt    time.Time            `bson:"expiresAt"`
+}
+
+const (
+	ceremonyRegistration = "registration"
+	ceremonyLogin        = "login"
+	ceremonyMFA          = "mfa"
+
+	// browsers have this long to finish a ceremony
+	ceremonyTTL = 5 * time.Minute
+)
+
+// NewService returns new instance of passkey service
+func NewService(db *mongo.Database, coll *config.Collection, users userpkg.Service) (Service, error) {
+	rp, err := loadRelyingParty()
+	if err != nil {
+		return nil, err
+	}
+	return service{db, coll, users, rp}, nil
+}
+
+func (s service) BeginRegistration(userID primitive.ObjectID) (*Ceremony, error) {
+	u, err := s.passkeyUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	options, data, err := s.rp.beginRegistration(u)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.startCeremony(ceremonyRegistration, userID, "", data, options)
+}
+
+func (s service) FinishRegistration(userID primitive.ObjectID, req *FinishRequest) (*Credential, error) {
+	sess, err := s.takeCeremony(ceremonyRegistration, req.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	if sess.UserID != userID {
+		return nil, errors.New("invalid session")
+	}
+
+	u, err := s.passkeyUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := s.rp.finishRegistration(u, sess.Data, req.Credential)
+	if err != nil {
+		log.Printf("Passkey registration of user %s rejected: %v", userID.Hex(), describe(err))
+		return nil, errors.New("invalid credential")
+	}
+
+	c.Name = strings.TrimSpace(req.Name)
+	if c.Name == "" {
+		c.Name = "Passkey"
+	}
+	c.CreatedAt = time.Now()
+
+	res, err := s.db.Collection(s.coll.WebAuthnCredentialCollection).InsertOne(context.TODO(), c)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, errors.New("credential already registered")
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.ID = res.InsertedID.(primitive.ObjectID)
+
+	return c, nil
+}
+
+func (s service) BeginLogin(req *BeginLoginRequest) (*Ceremony, error) {
+	//unknown emails & users without passkeys get a discoverable login, the
+	//same as no email at all
+	var u *passkeyUser
+	if req.Email != "" {
+		user, err := s.users.GetUser(bson.M{"email": req.Email}, nil)
+		if err == nil {
+			found, err := s.passkeyUser(user.ID)
+			if err != nil {
+				return nil, err
+			}
+			if len(found.credentials) > 0 {
+				u = found
+			}
+		}
+	}
+
+	//the passkey is the only factor, so the user has to be verified by it
+	options, data, err := s.rp.beginLogin(u, protocol.VerificationRequired)
+	if err != nil {
+		return nil, err
+	}
+
+	var userID primitive.ObjectID
+	if u != nil {
+		userID = u.user.ID
+	}
+	return s.startCeremony(ceremonyLogin, userID, "", data, options)
+}
+
+func (s service) FinishLogin(req *FinishRequest) (*userpkg.LoginResponse, error) {
+	sess, err := s.takeCeremony(ceremonyLogin, req.SessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	var u *passkeyUser
+	if !sess.UserID.IsZero() {
+		if u, err = s.passkeyUser(sess.UserID); err != nil {
+			return nil, err
+		}
+	}
+
+	u, err = s.finishAssertion(u, sess, req.Credential)
+	if err != nil {
+		return nil, err
+	}
+
+	//possession of the passkey & the user verification are both factors
+	return s.users.CompleteMultiFactorLogin(u.user, userpkg.AMRPasskey, req.ClientInfo)
+}
+
+func (s service) BeginMFA(req *BeginMFARequest) (*Ceremony, error) {
+	user, err := s.users.MFAChallengeUser(req.MFAToken)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := s.passkeyUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(u.credentials) == 0 {
+		return nil, errors.New("no passkeys registered")
+	}
+
+	//the password was the first factor, presence is enough for the second
+	options, data, err := s.rp.beginLogin(u, protocol.VerificationPreferred)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.startCeremony(ceremonyMFA, user.ID, hashToken(req.MFAToken), data, options)
+}
+
+func (s service) FinishMFA(req *FinishRequest) (*userpkg.TokenPair, error) {
+	sess, err := s.takeCeremony(ceremonyMFA, req.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	//the passkey only answers the challenge the ceremony was started for
+	if sess.MFATokenHash != hashToken(req.MFAToken) {
+		return nil, errors.New("invalid session")
+	}
+
+	u, err := s.passkeyUser(sess.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := s.finishAssertion(u, sess, req.Credential); err != nil {
+		return nil, err
+	}
+
+	return s.users.CompleteMFAChallenge(req.MFAToken, userpkg.AMRPasskey, req.ClientInfo)
+}
+
+func (s service) GetCredentials(userID primitive.ObjectID) ([]Credential, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}})
+	cursor, err := s.db.Collection(s.coll.WebAuthnCredentialCollection).Find(context.TODO(), bson.M{"userId": userID}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials := []Credential{}
+	if err := cursor.All(context.TODO(), &credentials); err != nil {
+		return nil, err
+	}
+
+	return credentials, nil
+}
+
+func (s service) DeleteCredential(userID primitive.ObjectID, id primitive.ObjectID) error {
+	res, err := s.db.Collection(s.coll.WebAuthnCredentialCollection).DeleteOne(
+		context.TODO(),
+		bson.M{"_id": id, "userId": userID},
+	)
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return errors.New("credential not found")
+	}
+	return nil
+}
+
+// finishAssertion verifies the passkey used & moves its sign count forward
+func (s service) finishAssertion(u *passkeyUser, sess *session, credential []byte) (*passkeyUser, error) {
+	u, c, err := s.rp.finishLogin(u, sess.Data, credential, func(handle []byte) (*passkeyUser, error) {
+		if len(handle) != len(primitive.ObjectID{}) {
+			return nil, errors.New("unknown user handle")
+		}
+		var userID primitive.ObjectID
+		copy(userID[:], handle)
+		return s.passkeyUser(userID)
+	})
+	if err != nil && err.Error() == "credential cloned" {
+		log.Printf("Passkey of session %s reported a sign count that went backwards", sess.ID.Hex())
+		return nil, err
+	}
+	if err != nil {
+		log.Printf("Passkey assertion rejected: %v", describe(err))
+		return nil, errors.New("invalid credential")
+	}
+
+	//a concurrent login with the same count lost the race, only one can win
+	filter := bson.M{"_id": c.ID, "signCount": bson.M{"$lt": c.SignCount}}
+	if c.SignCount == 0 {
+		filter = bson.M{"_id": c.ID, "signCount": 0}
+	}
+	res, err := s.db.Collection(s.coll.WebAuthnCredentialCollection).UpdateOne(
+		context.TODO(),
+		filter,
+		bson.M{"$set": bson.M{"signCount": c.SignCount, "backupState": c.BackupState, "lastUsedAt": time.Now()}},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if res.MatchedCount == 0 {
+		return nil, errors.New("credential cloned")
+	}
+
+	return u, nil
+}
+
+// passkeyUser loads the user & their passkeys
+func (s service) passkeyUser(userID primitive.ObjectID) (*passkeyUser, error) {
+	user, err := s.users.GetUser(bson.M{"_id": userID}, nil)
+	if err != nil {
+		return nil, errors.New("user not found")
+	}
+
+	credentials, err := s.GetCredentials(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &passkeyUser{user, credentials}, nil
+}
+
+// startCeremony stores the session data the result is checked against
+func (s service) startCeremony(ceremonyType string, userID primitive.ObjectID, mfaTokenHash string, data *webauthn.SessionData, options any) (*Ceremony, error) {
+	sessionID, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	sess := session{
+		SessionHash:  hashToken(sessionID),
+		Type:         ceremonyType,
+		UserID:       userID,
+		MFATokenHash: mfaTokenHash,
+		Data:         *data,
+		ExpiresAt:    time.Now().Add(ceremonyTTL),
+	}
+	_, err = s.db.Collection(s.coll.WebAuthnSessionCollection).InsertOne(context.TODO(), sess)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Ceremony{SessionID: sessionID, Options: options}, nil
+}
+
+// takeCeremony consumes the session, a challenge can only be answered once
+func (s service) takeCeremony(ceremonyType string, sessionID string) (*session, error) {
+	var sess session
+	err := s.db.Collection(s.coll.WebAuthnSessionCollection).FindOneAndDelete(
+		context.TODO(),
+		bson.M{"sessionHash": hashToken(sessionID), "type": ceremonyType},
+	).Decode(&sess)
+	if err == mongo.ErrNoDocuments {
+		return nil, errors.New("invalid session")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sess.ExpiresAt.Before(time.Now()) {
+		return nil, errors.New("invalid session")
+	}
+	return &sess, nil
+}
+
+// describe includes the details the protocol errors keep apart from the message
+func describe(err error) string {
+	var perr *protocol.Error
+	if errors.As(err, &perr) {
+		return perr.Details + " (" + perr.DevInfo + ")"
+	}
+	return err.Error()
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}